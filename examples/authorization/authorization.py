@@ -21,6 +21,10 @@ from typing import TextIO
 
 
 def main():
+    if len(sys.argv) > 1 and sys.argv[1] == "--plugin":
+        plugin_main(sys.stdin, sys.stdout)
+        sys.exit(0)
+
     try:
         ai = get_authorize_input(sys.stdin)
     except json.JSONDecodeError as exp:
@@ -74,10 +78,48 @@ def user_authorization(ai: AuthorizationInput) -> AuthorizationOutput:
     return out
 
 
+def plugin_main(stdin: TextIO, stdout: TextIO):
+    """
+    Plugin mode, the server starts the script once and sends each request as a line of JSON
+    ({"id": 1, "method": "authorize", "params": {...}}) to stdin. Each request is answered with a line of JSON
+    ({"id": 1, "result": {"duration": 180}} or {"id": 1, "error": "..."}) to stdout. Returns once stdin is closed.
+    """
+    for line in stdin:
+        if not line.strip():
+            continue
+
+        resp = plugin_handle_request(json.loads(line))
+        stdout.write(json.dumps(resp) + "\n")
+        stdout.flush()
+
+
+def plugin_handle_request(req: dict) -> dict:
+    resp = {"id": req.get("id")}
+    method = req.get("method")
+
+    if method == "ping":
+        return resp
+
+    if method != "authorize":
+        resp["error"] = "unsupported method: " + str(method)
+        return resp
+
+    ai = authorize_input_from_dict(req.get("params") or {})
+    valid, err = ai.valid()
+    if not valid:
+        resp["error"] = "authorization input invalid: " + err
+        return resp
+
+    resp["result"] = {"duration": user_authorization(ai).duration}
+    return resp
+
+
 def get_authorize_input(f: TextIO) -> AuthorizationInput:
     f_input = "".join(f.readlines())
+    return authorize_input_from_dict(json.loads(f_input))
+
 
-    ai_raw = json.loads(f_input)
+def authorize_input_from_dict(ai_raw: dict) -> AuthorizationInput:
     ai = AuthorizationInput()
 
     ai.clientUUID = ai_raw.get("clientUUID")
@@ -1,4 +1,5 @@
 import io
+import json
 import unittest
 import authorization
 
@@ -58,6 +59,35 @@ class TestAuthorization(unittest.TestCase):
         expect = """{"duration": 45}"""
         self.assertEqual(f.getvalue(), expect)
 
+    def test_plugin_main(self):
+        params = {
+            "clientUUID": "62fcb148-76cf-45d2-9781-a09b95b309d9",
+            "ipIsIPv6": False,
+            "clientIP": "88.200.23.23",
+            "targetIP": "88.200.23.30",
+            "targetProtocol": "TCP",
+            "targetPortStart": 80,
+            "targetPortEnd": 1000,
+        }
+        stdin = io.StringIO(
+            json.dumps({"id": 1, "method": "ping"}) + "\n" +
+            json.dumps({"id": 2, "method": "authorize", "params": params}) + "\n" +
+            json.dumps({"id": 3, "method": "authorize", "params": {}}) + "\n" +
+            json.dumps({"id": 4, "method": "foo"}) + "\n"
+        )
+        stdout = io.StringIO()
+
+        authorization.plugin_main(stdin, stdout)
+
+        resp = [json.loads(line) for line in stdout.getvalue().splitlines()]
+        self.assertEqual(len(resp), 4)
+        self.assertEqual(resp[0], {"id": 1})
+        self.assertEqual(resp[1], {"id": 2, "result": {"duration": 180}})
+        self.assertEqual(resp[2]["id"], 3)
+        self.assertIn("error", resp[2])
+        self.assertEqual(resp[3]["id"], 4)
+        self.assertIn("error", resp[3])
+
 
 if __name__ == '__main__':
     unittest.main()
@@ -11,18 +11,32 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-var _ xdp.ADKProofGenerator = ADKProofGen{}
+var _ xdp.ADKProofGenerator = &ADKProofGen{}
 
 type ADKProofGen struct {
 	secret string
+	lock   sync.RWMutex
 }
 
-func NewADKProofGen(secret string) ADKProofGen {
-	return ADKProofGen{secret: secret}
+func NewADKProofGen(secret string) *ADKProofGen {
+	return &ADKProofGen{secret: secret}
 }
 
-func (a ADKProofGen) ADKProofNow() uint32 {
-	proof, err := openspalib.ADKGenerateProof(a.secret)
+// SetSecret replaces the ADK secret, proofs generated afterwards are based on the new secret.
+func (a *ADKProofGen) SetSecret(secret string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.secret = secret
+}
+
+func (a *ADKProofGen) getSecret() string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.secret
+}
+
+func (a *ADKProofGen) ADKProofNow() uint32 {
+	proof, err := openspalib.ADKGenerateProof(a.getSecret())
 	if err != nil {
 		return 0
 	}
@@ -30,8 +44,8 @@ func (a ADKProofGen) ADKProofNow() uint32 {
 	return proof
 }
 
-func (a ADKProofGen) ADKProofNext() uint32 {
-	proof, err := openspalib.ADKGenerateNextProof(a.secret)
+func (a *ADKProofGen) ADKProofNext() uint32 {
+	proof, err := openspalib.ADKGenerateNextProof(a.getSecret())
 	if err != nil {
 		return 0
 	}
@@ -0,0 +1,323 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	AuditLogMaxSizeDefault    = 100 * 1024 * 1024 // bytes
+	AuditLogMaxBackupsDefault = 5
+)
+
+type AuditEventType string
+
+const (
+	// AuditEventGrant is emitted when a request is authorized and the firewall rule is in effect
+	AuditEventGrant AuditEventType = "grant"
+	// AuditEventDeny is emitted when a request is rejected, see AuditEvent.Reason
+	AuditEventDeny AuditEventType = "deny"
+	// AuditEventExpire is emitted when a grant's firewall rule is removed due to expiration
+	AuditEventExpire AuditEventType = "expire"
+	// AuditEventRevoke is emitted when a grant's firewall rule is removed by an administrator
+	AuditEventRevoke AuditEventType = "revoke"
+	// AuditEventRelease is emitted when a grant's firewall rule is removed due to the server shutting down
+	AuditEventRelease AuditEventType = "release"
+	// AuditEventRemoveFailed is emitted when a grant's firewall rule could not be removed after it expired (after
+	// repeated attempts), the client still has access
+	AuditEventRemoveFailed AuditEventType = "remove_failed"
+)
+
+// Deny reasons
+const (
+	AuditReasonADKMissing             = "adk_missing"
+	AuditReasonADKInvalid             = "adk_invalid"
+	AuditReasonBadRequest             = "bad_request"
+	AuditReasonRateLimitedSourceIP    = "rate_limited_source_ip"
+	AuditReasonRateLimitedClientUUID  = "rate_limited_client_uuid"
+	AuditReasonUnauthorized           = "unauthorized"
+	AuditReasonInvalidFirewallRequest = "invalid_firewall_request"
+	AuditReasonTargetNotAllowed       = "target_not_allowed"
+	AuditReasonFirewallRuleAddFailure = "firewall_rule_add_failure"
+)
+
+// AuditEvent is a single authorization decision or grant lifecycle event. Fields that are unknown at the time of the
+// event (e.g. the client UUID of a request that failed to decrypt) are omitted.
+type AuditEvent struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Event     AuditEventType `json:"event"`
+	Reason    string         `json:"reason,omitempty"`
+
+	Source     string `json:"source,omitempty"`
+	ClientUUID string `json:"clientUUID,omitempty"`
+	GrantID    string `json:"grantID,omitempty"`
+
+	Requested *AuditTarget `json:"requested,omitempty"`
+	Granted   *AuditTarget `json:"granted,omitempty"`
+	// DurationSeconds is the duration of the grant
+	DurationSeconds int64 `json:"durationSeconds,omitempty"`
+
+	CipherSuite          string  `json:"cipherSuite,omitempty"`
+	LatencyMilliseconds  float64 `json:"latencyMilliseconds,omitempty"`
+	AuthorizationBackend string  `json:"authorizationBackend,omitempty"`
+	FirewallBackend      string  `json:"firewallBackend,omitempty"`
+
+	// Count is the number of denied requests summarized by the event, see auditDenySummary
+	Count int `json:"count,omitempty"`
+}
+
+type AuditTarget struct {
+	Proto        string `json:"proto"`
+	SrcIP        string `json:"srcIP"`
+	DstIP        string `json:"dstIP"`
+	DstPortStart int    `json:"dstPortStart,omitempty"`
+	DstPortEnd   int    `json:"dstPortEnd,omitempty"`
+}
+
+func auditTargetFromFirewallRule(r FirewallRule) *AuditTarget {
+	return &AuditTarget{
+		Proto:        r.Proto,
+		SrcIP:        r.SrcIP.String(),
+		DstIP:        r.DstIP.String(),
+		DstPortStart: r.DstPortStart,
+		DstPortEnd:   r.DstPortEnd,
+	}
+}
+
+// auditGrantEvent returns the event of a grant's firewall rule removal.
+func auditGrantEvent(t AuditEventType, re FirewallRuleWithExpiration) AuditEvent {
+	return AuditEvent{
+		Event:           t,
+		ClientUUID:      re.Meta.ClientUUID,
+		GrantID:         re.ID,
+		Granted:         auditTargetFromFirewallRule(re.Rule),
+		DurationSeconds: int64(re.Duration.Seconds()),
+	}
+}
+
+// AuditLogger records audit events. Implementations should not block for long, since events are recorded while
+// handling requests.
+type AuditLogger interface {
+	Audit(e AuditEvent)
+}
+
+// AuditLoggers passes the events to all of its AuditLogger.
+type AuditLoggers []AuditLogger
+
+func (a AuditLoggers) Audit(e AuditEvent) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+
+	for _, l := range a {
+		l.Audit(e)
+	}
+}
+
+// auditLoggerWithFirewallBackend sets the firewall backend of all the events passed to the next AuditLogger.
+type auditLoggerWithFirewallBackend struct {
+	next    AuditLogger
+	backend string
+}
+
+func (a auditLoggerWithFirewallBackend) Audit(e AuditEvent) {
+	e.FirewallBackend = a.backend
+	a.next.Audit(e)
+}
+
+// auditDenySummaryInterval is the interval over which the unauthenticated denied requests are summarized
+const auditDenySummaryInterval = time.Minute
+
+// auditDenySummary summarizes the denied requests that were not authenticated (e.g. a missing ADK proof or a request
+// that fails to decrypt) into a single event per reason and interval. Anyone can send such requests, recording each of
+// them would let a flood rotate the other events out of the audit log and slow down the request handling.
+type auditDenySummary struct {
+	next     AuditLogger
+	interval time.Duration
+
+	counts map[string]int // key is the reason
+	lock   sync.Mutex
+}
+
+func newAuditDenySummary(next AuditLogger) *auditDenySummary {
+	s := &auditDenySummary{
+		next:     next,
+		interval: auditDenySummaryInterval,
+		counts:   make(map[string]int),
+	}
+	return s
+}
+
+// deny counts the denied request, the summary is recorded at the end of the interval.
+func (s *auditDenySummary) deny(reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.counts) == 0 {
+		time.AfterFunc(s.interval, s.flush)
+	}
+	s.counts[reason]++
+}
+
+func (s *auditDenySummary) flush() {
+	s.lock.Lock()
+	counts := s.counts
+	s.counts = make(map[string]int)
+	s.lock.Unlock()
+
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	now := time.Now()
+	for _, reason := range reasons {
+		s.next.Audit(AuditEvent{Timestamp: now, Event: AuditEventDeny, Reason: reason, Count: counts[reason]})
+	}
+}
+
+var _ AuditLogger = &AuditLog{}
+
+type AuditLogOpt struct {
+	// MaxSize is the size in bytes after which the file is rotated, AuditLogMaxSizeDefault if 0
+	MaxSize int64
+	// MaxBackups is the number of rotated files to keep (<path>.1 being the newest), AuditLogMaxBackupsDefault if 0
+	MaxBackups int
+}
+
+// AuditLog writes audit events as JSON lines to an append-only file, which is rotated once it exceeds the maximum size.
+type AuditLog struct {
+	path string
+	opt  AuditLogOpt
+
+	f    *os.File
+	size int64
+	lock sync.Mutex
+}
+
+func NewAuditLog(path string, opt AuditLogOpt) *AuditLog {
+	if opt.MaxSize <= 0 {
+		opt.MaxSize = AuditLogMaxSizeDefault
+	}
+	if opt.MaxBackups <= 0 {
+		opt.MaxBackups = AuditLogMaxBackupsDefault
+	}
+
+	a := &AuditLog{
+		path: path,
+		opt:  opt,
+	}
+	return a
+}
+
+func (a *AuditLog) Open() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.open()
+}
+
+// open needs to be called with lock held.
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "stat")
+	}
+
+	a.f = f
+	a.size = fi.Size()
+	return nil
+}
+
+// Audit writes the event to the file. Failures are logged, since the decision has already been made.
+func (a *AuditLog) Audit(e AuditEvent) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+
+	if err := a.write(e); err != nil {
+		log.Error().Err(err).Msgf("Failed to write audit event: %s (client: %s)", e.Event, e.ClientUUID)
+	}
+}
+
+func (a *AuditLog) write(e AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "json marshal")
+	}
+	b = append(b, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.f == nil {
+		return errors.New("audit log not open")
+	}
+
+	if a.size > 0 && a.size+int64(len(b)) > a.opt.MaxSize {
+		if err := a.rotate(); err != nil {
+			return errors.Wrap(err, "rotate")
+		}
+	}
+
+	n, err := a.f.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "write")
+	}
+
+	return nil
+}
+
+// rotate shifts the backups (<path>.1 -> <path>.2, ...), moves the current file to <path>.1 and opens a new file. The
+// oldest backup is removed. Needs to be called with lock held.
+func (a *AuditLog) rotate() error {
+	if err := a.f.Close(); err != nil {
+		return errors.Wrap(err, "close")
+	}
+	a.f = nil
+
+	for i := a.opt.MaxBackups - 1; i >= 1; i-- {
+		err := os.Rename(a.backupPath(i), a.backupPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "rename backup")
+		}
+	}
+
+	if err := os.Rename(a.path, a.backupPath(1)); err != nil {
+		return errors.Wrap(err, "rename")
+	}
+
+	return a.open()
+}
+
+func (a *AuditLog) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.f == nil {
+		return nil
+	}
+
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func auditTestReadEvents(t *testing.T, path string) []AuditEvent {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	events := make([]AuditEvent, 0)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		e := AuditEvent{}
+		require.NoError(t, json.Unmarshal(s.Bytes(), &e))
+		events = append(events, e)
+	}
+	require.NoError(t, s.Err())
+
+	return events
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	a := NewAuditLog(path, AuditLogOpt{})
+	require.NoError(t, a.Open())
+
+	a.Audit(AuditEvent{
+		Event:      AuditEventGrant,
+		Source:     "88.200.23.12:40975",
+		ClientUUID: "09896692-c299-4f90-9906-2e23cfcc417c",
+		Granted: auditTargetFromFirewallRule(FirewallRule{
+			Proto:        FirewallProtoTCP,
+			SrcIP:        net.IPv4(88, 200, 23, 12),
+			DstIP:        net.IPv4(88, 200, 23, 19),
+			DstPortStart: 22,
+			DstPortEnd:   22,
+		}),
+		DurationSeconds: 3600,
+	})
+	a.Audit(AuditEvent{Event: AuditEventDeny, Reason: AuditReasonUnauthorized})
+	require.NoError(t, a.Close())
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	events := auditTestReadEvents(t, path)
+	require.Len(t, events, 2)
+	assert.Equal(t, AuditEventGrant, events[0].Event)
+	assert.Equal(t, "09896692-c299-4f90-9906-2e23cfcc417c", events[0].ClientUUID)
+	assert.Equal(t, "88.200.23.19", events[0].Granted.DstIP)
+	assert.Equal(t, 22, events[0].Granted.DstPortStart)
+	assert.WithinDuration(t, time.Now(), events[0].Timestamp, 5*time.Second)
+	assert.Equal(t, AuditEventDeny, events[1].Event)
+	assert.Equal(t, AuditReasonUnauthorized, events[1].Reason)
+
+	// Reopening appends
+	require.NoError(t, a.Open())
+	a.Audit(AuditEvent{Event: AuditEventExpire})
+	require.NoError(t, a.Close())
+	assert.Len(t, auditTestReadEvents(t, path), 3)
+}
+
+func TestAuditLog_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	e := AuditEvent{Event: AuditEventDeny, Reason: AuditReasonBadRequest, Timestamp: time.Now()}
+	b, err := json.Marshal(e)
+	require.NoError(t, err)
+	lineSize := int64(len(b) + 1)
+
+	// Two events per file
+	a := NewAuditLog(path, AuditLogOpt{MaxSize: 2 * lineSize, MaxBackups: 2})
+	require.NoError(t, a.Open())
+
+	for i := 0; i < 7; i++ {
+		a.Audit(e)
+	}
+	require.NoError(t, a.Close())
+
+	assert.Len(t, auditTestReadEvents(t, path), 1)
+	assert.Len(t, auditTestReadEvents(t, path+".1"), 2)
+	assert.Len(t, auditTestReadEvents(t, path+".2"), 2)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAuditDenySummary(t *testing.T) {
+	audit := &AuditLoggerStub{}
+	s := newAuditDenySummary(audit)
+	s.interval = 50 * time.Millisecond
+
+	for i := 0; i < 100; i++ {
+		s.deny(AuditReasonADKInvalid)
+	}
+	s.deny(AuditReasonBadRequest)
+	assert.Len(t, audit.Events(), 0)
+
+	assert.Eventually(t, func() bool { return len(audit.Events()) == 2 }, time.Second, 10*time.Millisecond)
+	events := audit.Events()
+	assert.Equal(t, AuditEventDeny, events[0].Event)
+	assert.Equal(t, AuditReasonADKInvalid, events[0].Reason)
+	assert.Equal(t, 100, events[0].Count)
+	assert.False(t, events[0].Timestamp.IsZero())
+	assert.Equal(t, AuditReasonBadRequest, events[1].Reason)
+	assert.Equal(t, 1, events[1].Count)
+
+	// The next interval starts with the next denied request
+	s.deny(AuditReasonADKMissing)
+	assert.Eventually(t, func() bool { return len(audit.Events()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, AuditReasonADKMissing, audit.Events()[2].Reason)
+}
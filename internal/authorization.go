@@ -1,10 +1,12 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"net"
 	"time"
 
+	"github.com/greenstatic/openspa/internal/observability"
 	lib "github.com/greenstatic/openspa/pkg/openspalib"
 	"github.com/greenstatic/openspa/pkg/openspalib/tlv"
 	"github.com/pkg/errors"
@@ -12,7 +14,7 @@ import (
 )
 
 type AuthorizationStrategy interface {
-	RequestAuthorization(request tlv.Container) (time.Duration, error)
+	RequestAuthorization(ctx context.Context, request tlv.Container) (time.Duration, error)
 }
 
 var _ AuthorizationStrategy = AuthorizationStrategySimple{}
@@ -30,16 +32,25 @@ func NewAuthorizationStrategyAllow(duration time.Duration) *AuthorizationStrateg
 	return a
 }
 
-func (a AuthorizationStrategySimple) RequestAuthorization(_ tlv.Container) (time.Duration, error) {
+func (a AuthorizationStrategySimple) RequestAuthorization(_ context.Context, _ tlv.Container) (time.Duration, error) {
 	return a.dur, nil
 }
 
 var _ AuthorizationStrategy = AuthorizationStrategyCommand{}
 
+// AuthorizationStrategyCommand executes the authorization command per request, with the request
+// (AuthorizationStrategyCommandAuthorizeInput) as JSON on stdin. Alternatively (see
+// NewAuthorizationStrategyCommandPlugin) the requests are sent to a plugin.
 type AuthorizationStrategyCommand struct {
 	AuthorizeCmd string
 
-	exec CommandExecuter
+	exec    CommandExecuter
+	plugin  *Plugin // nil if the command is executed
+	metrics authorizationStrategyCommandMetrics
+}
+
+type authorizationStrategyCommandMetrics struct {
+	duration observability.Histogram
 }
 
 type AuthorizationStrategyCommandAuthorizeInput struct {
@@ -60,38 +71,98 @@ func NewAuthorizationStrategyCommand(cmd string) *AuthorizationStrategyCommand {
 	a := &AuthorizationStrategyCommand{
 		AuthorizeCmd: cmd,
 
-		exec: &CommandExecute{},
+		exec:    &CommandExecute{},
+		metrics: newAuthorizationStrategyCommandMetrics(),
 	}
 	return a
 }
 
-func (a AuthorizationStrategyCommand) RequestAuthorization(c tlv.Container) (time.Duration, error) {
+// NewAuthorizationStrategyCommandPlugin returns an AuthorizationStrategyCommand that sends the requests to the plugin
+// (PluginMethodAuthorize), the response's result is the output of the authorization command.
+func NewAuthorizationStrategyCommandPlugin(p *Plugin) *AuthorizationStrategyCommand {
+	a := &AuthorizationStrategyCommand{
+		plugin:  p,
+		metrics: newAuthorizationStrategyCommandMetrics(),
+	}
+	return a
+}
+
+func (a AuthorizationStrategyCommand) RequestAuthorization(ctx context.Context, c tlv.Container) (time.Duration,
+	error) {
+	_, span := startSpan(ctx, "authorization.command")
+	defer span.End()
+
 	i, err := a.authorizeInputGenerate(c)
 	if err != nil {
 		return 0, err
 	}
 
-	stdin, err := json.Marshal(i)
-	if err != nil {
-		return 0, errors.Wrap(err, "json marshal AuthorizationStrategyCommand stdin input")
+	start := time.Now()
+	stdout, err := a.execute(ctx, i)
+	observability.ObserveDuration(a.metrics.duration, start)
+	if err != nil && a.plugin != nil {
+		err = errors.Wrap(err, "authorization plugin")
+		spanError(span, err)
+		return 0, err
 	}
 
-	stdout, err := a.exec.Execute(a.AuthorizeCmd, stdin)
 	out := AuthorizationStrategyCommandAuthorizeOutput{}
 	if err := json.Unmarshal(stdout, &out); err != nil {
 		log.Info().Msgf("Authorize command output: %s", string(stdout))
-		return 0, errors.Wrap(err, "json unmarshal AuthorizationStrategyCommand stdout output")
+		err = errors.Wrap(err, "json unmarshal AuthorizationStrategyCommand stdout output")
+		spanError(span, err)
+		return 0, err
 	}
 
 	log.Debug().Msgf("Authorize command output: %s", string(stdout))
 	if err != nil {
-		return 0, errors.Wrap(err, "executing authorization command "+a.AuthorizeCmd)
+		err = errors.Wrap(err, "executing authorization command "+a.AuthorizeCmd)
+		spanError(span, err)
+		return 0, err
 	}
 
 	d := time.Duration(out.Duration) * time.Second
 	return d, nil
 }
 
+func (a AuthorizationStrategyCommand) execute(ctx context.Context, i AuthorizationStrategyCommandAuthorizeInput) (
+	[]byte, error) {
+	if a.plugin != nil {
+		return a.plugin.Call(ctx, PluginMethodAuthorize, i)
+	}
+
+	stdin, err := json.Marshal(i)
+	if err != nil {
+		return nil, errors.Wrap(err, "json marshal AuthorizationStrategyCommand stdin input")
+	}
+
+	return a.exec.Execute(a.AuthorizeCmd, stdin)
+}
+
+// Health returns the health of the plugin, the command has no health.
+func (a AuthorizationStrategyCommand) Health() HealthComponent {
+	if a.plugin == nil {
+		return HealthComponent{Status: HealthStatusOK}
+	}
+	return a.plugin.Health()
+}
+
+// Stop stops the plugin, if any.
+func (a AuthorizationStrategyCommand) Stop() error {
+	if a.plugin == nil {
+		return nil
+	}
+	return a.plugin.Stop()
+}
+
+func newAuthorizationStrategyCommandMetrics() authorizationStrategyCommandMetrics {
+	m := authorizationStrategyCommandMetrics{}
+	mr := getMetricsRepository()
+
+	m.duration = mr.Histogram("authorization_command_duration_seconds", observability.NewLabels(), nil)
+	return m
+}
+
 //nolint:lll
 func (a AuthorizationStrategyCommand) authorizeInputGenerate(c tlv.Container) (AuthorizationStrategyCommandAuthorizeInput, error) {
 	fwd, err := lib.RequestFirewallDataFromContainer(c)
@@ -118,6 +189,13 @@ func NewAuthorizationStrategyFromServerConfigAuthorization(s ServerConfigAuthori
 		return NewAuthorizationStrategyAllow(s.Simple.GetDuration()), nil
 
 	case ServerConfigAuthorizationBackendCommand:
+		if p := s.Command.Plugin; p != nil {
+			plugin := NewPlugin("authorization", p.Command, p.Settings())
+			if err := plugin.Start(); err != nil {
+				return nil, errors.Wrap(err, "plugin start")
+			}
+			return NewAuthorizationStrategyCommandPlugin(plugin), nil
+		}
 		return NewAuthorizationStrategyCommand(s.Command.AuthorizationCmd), nil
 
 	case ServerConfigAuthorizationBackendNone:
@@ -127,10 +205,24 @@ func NewAuthorizationStrategyFromServerConfigAuthorization(s ServerConfigAuthori
 	return nil, errors.New("unsupported authorization backend")
 }
 
+// authorizationStrategyName returns the name of the backend (as used in ServerConfigAuthorization) of a.
+func authorizationStrategyName(a AuthorizationStrategy) string {
+	switch a.(type) {
+	case AuthorizationStrategySimple, *AuthorizationStrategySimple:
+		return ServerConfigAuthorizationBackendSimple
+	case AuthorizationStrategyCommand, *AuthorizationStrategyCommand:
+		return ServerConfigAuthorizationBackendCommand
+	case authorizationStrategyDummy:
+		return ServerConfigAuthorizationBackendNone
+	}
+
+	return ""
+}
+
 // authorizationStrategyDummy does nothing, it is just used to satisfy the interface definition. It is mostly used
 // for testing/performance measurement purposes. Do not use for production work.
 type authorizationStrategyDummy struct{}
 
-func (a authorizationStrategyDummy) RequestAuthorization(request tlv.Container) (time.Duration, error) {
+func (a authorizationStrategyDummy) RequestAuthorization(_ context.Context, _ tlv.Container) (time.Duration, error) {
 	return 3 * time.Second, nil
 }
@@ -1,11 +1,13 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"net"
 	"testing"
 	"time"
 
+	"github.com/greenstatic/openspa/internal/observability"
 	lib "github.com/greenstatic/openspa/pkg/openspalib"
 	"github.com/greenstatic/openspa/pkg/openspalib/tlv"
 	"github.com/pkg/errors"
@@ -19,7 +21,7 @@ func TestAuthorizationStrategySimple(t *testing.T) {
 	dur := time.Hour
 	as := NewAuthorizationStrategyAllow(dur)
 
-	d, err := as.RequestAuthorization(c)
+	d, err := as.RequestAuthorization(context.Background(), c)
 	assert.NoError(t, err)
 	assert.Equal(t, dur, d)
 
@@ -66,7 +68,7 @@ func TestAuthorizationStrategyCommand(t *testing.T) {
 	as := NewAuthorizationStrategyCommand("foo")
 	as.exec = exec
 
-	d, err := as.RequestAuthorization(c)
+	d, err := as.RequestAuthorization(context.Background(), c)
 	assert.NoError(t, err)
 	assert.Equal(t, time.Minute, d)
 
@@ -74,12 +76,46 @@ func TestAuthorizationStrategyCommand(t *testing.T) {
 
 	exec.On("Execute", "foo", inputB, []string(nil)).Return([]byte{}, errors.New("test error")).Once()
 
-	_, err = as.RequestAuthorization(c)
+	_, err = as.RequestAuthorization(context.Background(), c)
 	assert.Error(t, err)
 
 	exec.AssertExpectations(t)
 }
 
+func TestAuthorizationStrategyCommand_Plugin(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	container := func(port int) tlv.Container {
+		c, err := lib.RequestDataToContainer(lib.RequestData{
+			ClientUUID:      "0561e333-9428-429c-8ab0-1106dd6e311c",
+			ClientIP:        net.IPv4(88, 200, 23, 22).To4(),
+			TargetProtocol:  lib.ProtocolTCP,
+			TargetIP:        net.IPv4(88, 200, 23, 23).To4(),
+			TargetPortStart: port,
+		}, lib.RequestExtendedData{
+			Timestamp: time.Now(),
+		})
+		require.NoError(t, err)
+		return c
+	}
+
+	as := NewAuthorizationStrategyCommandPlugin(pluginTestNew(t, PluginSettings{Timeout: 5 * time.Second}))
+	assert.Equal(t, HealthStatusStarting, as.Health().Status)
+
+	d, err := as.RequestAuthorization(context.Background(), container(80))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, d)
+	assert.Equal(t, HealthStatusOK, as.Health().Status)
+
+	// The plugin denies the request
+	_, err = as.RequestAuthorization(context.Background(), container(22))
+	assert.ErrorContains(t, err, "denied")
+
+	assert.NoError(t, as.Stop())
+	_, err = as.RequestAuthorization(context.Background(), container(80))
+	assert.Error(t, err)
+}
+
 func TestAuthorizationStrategyCommand_AuthorizeInputGenerate(t *testing.T) {
 	c, err := lib.RequestDataToContainer(lib.RequestData{
 		TransactionID:   0,
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
@@ -11,6 +13,8 @@ import (
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 var ServerCmd = &cobra.Command{
@@ -22,6 +26,8 @@ var ServerCmd = &cobra.Command{
 
 func ServerCmdSetup(c *cobra.Command) {
 	c.Flags().StringP("config", "c", "config.yaml", "Server configuration file")
+	c.Flags().Bool("firewall-dry-run", false, "Print the rules the firewall setup would install and exit")
+	serverControlCmdSetup(c)
 }
 
 func serverCmdRunFn(cmd *cobra.Command, args []string) {
@@ -30,35 +36,47 @@ func serverCmdRunFn(cmd *cobra.Command, args []string) {
 		log.Fatal().Err(err).Msgf("Failed to get config file path")
 	}
 
-	cBytes, err := os.ReadFile(configFilePath)
+	sc, err := internal.ServerConfigFromFile(configFilePath)
 	if err != nil {
 		log.Fatal().Err(err).Msgf("Failed to read config file")
 	}
 
-	sc, err := internal.ServerConfigParse(cBytes)
+	if err := sc.Verify(); err != nil {
+		log.Fatal().Err(err).Msgf("Server config file invalid")
+	}
+
+	dryRun, err := cmd.Flags().GetBool("firewall-dry-run")
 	if err != nil {
-		log.Fatal().Err(err).Msgf("Failed to parse config file")
+		log.Fatal().Err(err).Msgf("Failed to get firewall dry run flag")
 	}
 
-	if err := sc.Verify(); err != nil {
-		log.Fatal().Err(err).Msgf("Server config file invalid")
+	if dryRun {
+		serverFirewallDryRun(sc)
+		return
 	}
 
-	server(cmd, sc)
+	server(cmd, sc, configFilePath)
 }
 
-func server(_ *cobra.Command, config internal.ServerConfig) {
+func server(_ *cobra.Command, config internal.ServerConfig, configFilePath string) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	reloadSigs := make(chan os.Signal, 1)
+	signal.Notify(reloadSigs, syscall.SIGHUP)
 	done := make(chan bool, 1)
 
 	xdkMetricsStop := make(chan bool)
-	xadk, err := xdpSetup(config, xdkMetricsStop)
+	xadk, adkProofGen, err := xdpSetup(config, xdkMetricsStop)
 	if err != nil {
 		log.Fatal().Err(err).Msgf("ADK/XDP setup error")
 	}
 
-	cs, err := internal.NewServerCipherSuite(config.Crypto)
+	keyStore := internal.NewPublicKeyStore(config.Crypto.RSA.Client.PublicKeyLookupDir)
+	if err := keyStore.Start(); err != nil {
+		log.Fatal().Err(err).Msgf("Failed to start client public key store")
+	}
+
+	cs, err := internal.NewServerCipherSuite(config.Crypto, keyStore)
 	if err != nil {
 		log.Fatal().Err(err).Msgf("Failed to setup server cipher suite")
 	}
@@ -68,25 +86,84 @@ func server(_ *cobra.Command, config internal.ServerConfig) {
 		log.Fatal().Err(err).Msgf("Failed to initialize firewall backend")
 	}
 
+	frmOpt := internal.FirewallRuleManagerOpt{
+		Reconcile: config.Firewall.Reconcile.Settings(),
+		Removal:   config.Firewall.Removal.Settings(),
+	}
+	if config.Firewall.State.Path != "" {
+		frmOpt.Journal = internal.NewGrantJournal(config.Firewall.State.Path)
+		frmOpt.KeepRules = config.Firewall.State.KeepRules
+	}
+
 	authz, err := internal.NewAuthorizationStrategyFromServerConfigAuthorization(config.Authorization)
 	if err != nil {
 		log.Fatal().Err(err).Msgf("Failed to initialize authorization backend")
 	}
 
+	var audit *internal.AuditLog
+	if config.Audit.Path != "" {
+		audit = internal.NewAuditLog(config.Audit.Path, config.Audit.Opt())
+		if err := audit.Open(); err != nil {
+			log.Fatal().Err(err).Msgf("Failed to open audit log")
+		}
+	}
+
+	var notifier *internal.WebhookNotifier
+	if len(config.Notify.Webhooks) != 0 {
+		notifier = internal.NewWebhookNotifier(config.Notify.WebhookSettings())
+		notifier.Start()
+	}
+
+	var tp *sdktrace.TracerProvider
+	if config.Tracing.Enable {
+		tp, err = internal.NewTracerProvider(config.Tracing.Settings())
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed to initialize tracing")
+		}
+		otel.SetTracerProvider(tp)
+	}
+
 	httpIP, httpPort := serverHTTPServerSettingsFromConfig(config)
+	controlPath, controlMode := serverControlSocketSettingsFromConfig(config)
 
 	s := internal.NewServer(internal.ServerSettings{
 		UDPServerIP:       net.ParseIP(config.Server.IP),
 		UDPServerPort:     config.Server.Port,
 		NoRequestHandlers: config.Server.RequestHandlers,
-		FW:                fw,
-		CS:                cs,
-		Authz:             authz,
-		ADKSecret:         config.Server.ADK.Secret,
-		HTTPServerIP:      httpIP,
-		HTTPServerPort:    httpPort,
+		RequestCoordinator: internal.RequestCoordinatorOpt{
+			QueueSize:   config.Server.RequestQueue.Size,
+			DropPolicy:  internal.RequestQueueDropPolicy(config.Server.RequestQueue.DropPolicy),
+			MaxHandlers: config.Server.RequestHandlersMax,
+		},
+		FirewallRuleManager: frmOpt,
+		FW:                  fw,
+		CS:                  cs,
+		Authz:               authz,
+		ADKSecret:           config.Server.ADK.Secret,
+		SourceIPRateLimit:   config.Server.RateLimit.SourceIP.Settings(),
+		ClientUUIDRateLimit: config.Server.RateLimit.ClientUUID.Settings(),
+		TargetPolicy:        config.TargetPolicy.TargetPolicy(),
+		HTTPServerIP:        httpIP,
+		HTTPServerPort:      httpPort,
+		HTTPServerOpt: internal.HTTPServerOpt{
+			AdminToken:      config.Server.HTTP.AdminToken,
+			MetricsToken:    config.Server.HTTP.MetricsToken,
+			TLSCertFile:     config.Server.HTTP.TLS.Cert,
+			TLSKeyFile:      config.Server.HTTP.TLS.Key,
+			TLSClientCAFile: config.Server.HTTP.TLS.ClientCA,
+		},
+		ControlSocketPath: controlPath,
+		ControlSocketMode: controlMode,
+		Clients:           keyStore,
+		FirewallBackend:   config.Firewall.Backend,
+		XDPMode:           config.Server.ADK.XDP.Mode,
+		Audit:             serverAuditLogger(audit, notifier),
+		HealthChecks:      serverHealthChecks(keyStore, xadk),
 	})
 
+	reloader := internal.NewServerConfigReloader(configFilePath, config, s, keyStore, adkProofGen)
+	s.SetConfigReloader(reloader)
+
 	if xadk != nil {
 		if err := xadk.Start(); err != nil {
 			log.Fatal().Err(err).Msgf("XDP/ADK start error")
@@ -99,6 +176,15 @@ func server(_ *cobra.Command, config internal.ServerConfig) {
 		done <- true
 	}()
 
+	go func() {
+		for sig := range reloadSigs {
+			log.Info().Msgf("Received signal %s", sig.String())
+			if _, err := reloader.Reload(); err != nil {
+				log.Error().Err(err).Msgf("Configuration reload refused")
+			}
+		}
+	}()
+
 	go func() {
 		if err := s.Start(); err != nil {
 			log.Fatal().Err(err).Msgf("Server error")
@@ -119,9 +205,49 @@ func server(_ *cobra.Command, config internal.ServerConfig) {
 	if err := s.Stop(); err != nil {
 		log.Error().Err(err).Msgf("Server stop")
 	}
+
+	if err := keyStore.Stop(); err != nil {
+		log.Error().Err(err).Msgf("Client public key store stop")
+	}
+
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			log.Error().Err(err).Msgf("Audit log close")
+		}
+	}
+
+	if notifier != nil {
+		notifier.Stop()
+	}
+
+	if tp != nil {
+		if err := tp.Shutdown(context.Background()); err != nil {
+			log.Error().Err(err).Msgf("Tracer provider shutdown")
+		}
+	}
 	log.Info().Msgf("Successfully stopped server")
 }
 
+// serverFirewallDryRun prints the rules the setup of the configured firewall backend would install.
+func serverFirewallDryRun(config internal.ServerConfig) {
+	fw, err := internal.NewFirewallFromServerConfigFirewall(config.Firewall)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Failed to initialize firewall backend")
+	}
+
+	rules := ""
+	if d, ok := fw.(internal.FirewallSetupDryRunner); ok {
+		rules = d.SetupDryRun()
+	}
+
+	if rules == "" {
+		fmt.Printf("The setup of the %s firewall backend installs no rules\n", config.Firewall.Backend)
+		return
+	}
+
+	fmt.Print(rules)
+}
+
 func serverHTTPServerSettingsFromConfig(config internal.ServerConfig) (net.IP, int) {
 	port := config.Server.HTTP.Port
 	if !config.Server.HTTP.Enable {
@@ -131,6 +257,51 @@ func serverHTTPServerSettingsFromConfig(config internal.ServerConfig) (net.IP, i
 	return net.ParseIP(config.Server.HTTP.IP), port
 }
 
+func serverControlSocketSettingsFromConfig(config internal.ServerConfig) (string, os.FileMode) {
+	if !config.Server.Control.Enable {
+		return "", 0
+	}
+
+	// Verified when the config was read
+	mode, _ := config.Server.Control.FileMode()
+	return config.Server.Control.Socket, mode
+}
+
+// serverAuditLogger combines the enabled audit loggers, it returns nil if none are enabled.
+func serverAuditLogger(a *internal.AuditLog, n *internal.WebhookNotifier) internal.AuditLogger {
+	l := internal.AuditLoggers{}
+	if a != nil {
+		l = append(l, a)
+	}
+	if n != nil {
+		l = append(l, n)
+	}
+
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// serverHealthChecks returns the health checks of the components that are set up outside of internal.Server.
+func serverHealthChecks(keyStore *internal.PublicKeyStore, xadk xdp.ADK) map[string]internal.HealthCheck {
+	checks := map[string]internal.HealthCheck{
+		"keyStore": keyStore.Health,
+	}
+
+	if xadk != nil {
+		checks["xdp"] = internal.HealthCheckFromError(func() error {
+			err := xadk.Check()
+			if errors.Is(err, xdp.ErrNotStarted) {
+				return internal.ErrHealthNotStarted
+			}
+			return err
+		})
+	}
+
+	return checks
+}
+
 func xdpADKEnabled(config internal.ServerConfig) bool {
 	return config.Server.ADK.XDP.Mode != ""
 }
@@ -147,13 +318,13 @@ func xdpPrecheck(config internal.ServerConfig) error {
 	return nil
 }
 
-func xdpSetup(config internal.ServerConfig, metricsStop chan bool) (xdp.ADK, error) {
+func xdpSetup(config internal.ServerConfig, metricsStop chan bool) (xdp.ADK, *internal.ADKProofGen, error) {
 	if err := xdpPrecheck(config); err != nil {
-		return nil, errors.Wrap(err, "xdp precheck")
+		return nil, nil, errors.Wrap(err, "xdp precheck")
 	}
 
 	if !xdpADKEnabled(config) {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	log.Info().Msgf("Setting up XDP ADK acceleration")
@@ -161,7 +332,7 @@ func xdpSetup(config internal.ServerConfig, metricsStop chan bool) (xdp.ADK, err
 	xdpConf := config.Server.ADK.XDP
 	mode, ok := xdp.ModeFromString(xdpConf.Mode)
 	if !ok {
-		return nil, errors.New("unsupported mode")
+		return nil, nil, errors.New("unsupported mode")
 	}
 
 	iName := xdpConf.Interfaces[0] // currently we only support a single interface
@@ -173,12 +344,13 @@ func xdpSetup(config internal.ServerConfig, metricsStop chan bool) (xdp.ADK, err
 		UDPServerPort:   config.Server.Port,
 	}
 
-	adk, err := xdp.NewADK(set, internal.NewADKProofGen(config.Server.ADK.Secret))
+	proofGen := internal.NewADKProofGen(config.Server.ADK.Secret)
+	adk, err := xdp.NewADK(set, proofGen)
 	if err != nil {
-		return nil, errors.Wrap(err, "new adk")
+		return nil, nil, errors.Wrap(err, "new adk")
 	}
 
 	internal.SetupXDPADKMetrics(adk, metricsStop)
 
-	return adk, nil
+	return adk, proofGen, nil
 }
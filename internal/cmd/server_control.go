@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/greenstatic/openspa/internal"
+	"github.com/spf13/cobra"
+)
+
+var ServerGrantsCmd = &cobra.Command{
+	Use:   "grants",
+	Short: "Manage the active grants of a running server",
+	Run:   serverControlHelpRunFn,
+}
+
+var ServerGrantsListCmd = &cobra.Command{
+	Use:    "list",
+	Short:  "List active grants",
+	Run:    serverGrantsListCmdRunFn,
+	PreRun: PreRunLogSetupFn,
+	Args:   cobra.NoArgs,
+}
+
+var ServerGrantsRevokeCmd = &cobra.Command{
+	Use:    "revoke [<grant ID>]",
+	Short:  "Revoke a grant or all the grants of a client (--client)",
+	Run:    serverGrantsRevokeCmdRunFn,
+	PreRun: PreRunLogSetupFn,
+	Args:   cobra.MaximumNArgs(1),
+}
+
+var ServerClientsCmd = &cobra.Command{
+	Use:   "clients",
+	Short: "Inspect the clients of a running server",
+	Run:   serverControlHelpRunFn,
+}
+
+var ServerClientsListCmd = &cobra.Command{
+	Use:    "list",
+	Short:  "List clients with a public key",
+	Run:    serverClientsListCmdRunFn,
+	PreRun: PreRunLogSetupFn,
+	Args:   cobra.NoArgs,
+}
+
+var ServerReloadCmd = &cobra.Command{
+	Use:    "reload",
+	Short:  "Reload the configuration of a running server",
+	Run:    serverReloadCmdRunFn,
+	PreRun: PreRunLogSetupFn,
+	Args:   cobra.NoArgs,
+}
+
+var ServerStatusCmd = &cobra.Command{
+	Use:    "status",
+	Short:  "Show the status of a running server",
+	Run:    serverStatusCmdRunFn,
+	PreRun: PreRunLogSetupFn,
+	Args:   cobra.NoArgs,
+}
+
+// serverControlCmdSetup adds the subcommands that manage a running server through its control socket.
+func serverControlCmdSetup(c *cobra.Command) {
+	ServerGrantsCmd.AddCommand(ServerGrantsListCmd)
+	ServerGrantsCmd.AddCommand(ServerGrantsRevokeCmd)
+	ServerClientsCmd.AddCommand(ServerClientsListCmd)
+
+	ServerGrantsListCmd.Flags().String("client", "", "Only list the grants of the client (UUID)")
+	ServerGrantsRevokeCmd.Flags().String("client", "", "Revoke all the grants of the client (UUID)")
+
+	for _, sc := range []*cobra.Command{ServerGrantsCmd, ServerClientsCmd, ServerReloadCmd, ServerStatusCmd} {
+		sc.PersistentFlags().String("socket", internal.ControlSocketPathDefault, "Server control socket")
+		c.AddCommand(sc)
+	}
+}
+
+func serverControlHelpRunFn(cmd *cobra.Command, args []string) {
+	_ = cmd.Help()
+}
+
+func serverControlClient(cmd *cobra.Command) *internal.ControlClient {
+	path, err := cmd.Flags().GetString("socket")
+	if err != nil {
+		serverControlExit("failed to get socket path", err)
+	}
+	return internal.NewControlClient(path)
+}
+
+func serverControlExit(msg string, err error) {
+	fmt.Fprintf(os.Stderr, "%s, err: %s\n", msg, err)
+	os.Exit(1)
+}
+
+func serverGrantsListCmdRunFn(cmd *cobra.Command, args []string) {
+	client, _ := cmd.Flags().GetString("client")
+
+	grants, err := serverControlClient(cmd).Grants(client)
+	if err != nil {
+		serverControlExit("failed to list grants", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCLIENT\tPROTO\tSOURCE\tDESTINATION\tPORTS\tEXPIRES IN")
+	for _, g := range grants {
+		ports := "-"
+		if g.Rule.DstPortStart != 0 {
+			ports = fmt.Sprintf("%d-%d", g.Rule.DstPortStart, g.Rule.DstPortEnd)
+		}
+
+		expires := (time.Duration(g.RemainingSeconds) * time.Second).String()
+		if g.RemoveFailing {
+			expires = "expired, removal failing"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", g.ID, g.ClientUUID, g.Rule.Proto, g.Rule.SrcIP, g.Rule.DstIP, ports,
+			expires)
+	}
+	_ = w.Flush()
+}
+
+func serverGrantsRevokeCmdRunFn(cmd *cobra.Command, args []string) {
+	client, _ := cmd.Flags().GetString("client")
+
+	if (client == "") == (len(args) == 0) {
+		fmt.Fprintf(os.Stderr, "either a grant ID or --client is required\n")
+		os.Exit(1)
+	}
+
+	c := serverControlClient(cmd)
+
+	if client != "" {
+		n, err := c.RevokeClient(client)
+		if err != nil {
+			serverControlExit("failed to revoke grants", err)
+		}
+		fmt.Fprintf(os.Stdout, "Revoked %d grants of client %s\n", n, client)
+		return
+	}
+
+	if err := c.Revoke(args[0]); err != nil {
+		serverControlExit("failed to revoke grant", err)
+	}
+	fmt.Fprintf(os.Stdout, "Revoked grant %s\n", args[0])
+}
+
+func serverClientsListCmdRunFn(cmd *cobra.Command, args []string) {
+	clients, err := serverControlClient(cmd).Clients()
+	if err != nil {
+		serverControlExit("failed to list clients", err)
+	}
+
+	for _, c := range clients {
+		fmt.Fprintln(os.Stdout, c)
+	}
+}
+
+func serverReloadCmdRunFn(cmd *cobra.Command, args []string) {
+	changes, err := serverControlClient(cmd).Reload()
+	if err != nil {
+		serverControlExit("failed to reload configuration", err)
+	}
+
+	fmt.Fprintf(os.Stdout, "Reloaded: %s\n", serverControlList(changes.Reloaded))
+	fmt.Fprintf(os.Stdout, "Restart required: %s\n", serverControlList(changes.RestartRequired))
+}
+
+func serverStatusCmdRunFn(cmd *cobra.Command, args []string) {
+	st, err := serverControlClient(cmd).Status()
+	if err != nil {
+		serverControlExit("failed to get status", err)
+	}
+
+	adk := "disabled"
+	if st.ADK.Enabled {
+		adk = "enabled"
+		if st.ADK.XDPMode != "" {
+			adk += fmt.Sprintf(" (XDP: %s)", st.ADK.XDPMode)
+		}
+	}
+
+	queue := fmt.Sprintf("%d queued, %d handlers", st.RequestQueue.Depth, st.RequestQueue.Handlers)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Version:\t%s\n", st.Version)
+	fmt.Fprintf(w, "Uptime:\t%s\n", (time.Duration(st.UptimeSeconds) * time.Second).String())
+	fmt.Fprintf(w, "ADK:\t%s\n", adk)
+	fmt.Fprintf(w, "Request queue:\t%s\n", queue)
+	fmt.Fprintf(w, "Firewall backend:\t%s\n", st.FirewallBackend)
+	fmt.Fprintf(w, "Active grants:\t%d\n", st.Grants)
+	_ = w.Flush()
+}
+
+func serverControlList(s []string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"net"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrConntrackNotSupported = errors.New("conntrack is only supported on linux")
+
+// ConntrackDeleter deletes the connection tracking entries (flows) of a rule, so that the connections established
+// while the rule was in effect are closed once it is removed.
+type ConntrackDeleter interface {
+	// ConntrackDelete deletes the flows of the rule and returns the number of deleted flows.
+	ConntrackDelete(r FirewallRule) (int, error)
+}
+
+// conntrackProtoNumbers are the IP protocol numbers of the firewall rule protocols.
+var conntrackProtoNumbers = map[string]uint8{
+	FirewallProtoICMP:   1,
+	FirewallProtoTCP:    6,
+	FirewallProtoUDP:    17,
+	FirewallProtoICMPv6: 58,
+}
+
+// conntrackTuple is the original direction of a flow.
+type conntrackTuple struct {
+	Proto   uint8
+	SrcIP   net.IP
+	DstIP   net.IP
+	DstPort uint16
+}
+
+// conntrackRuleMatch returns whether the flow is one the rule allowed: the protocol, source and destination have to be
+// the rule's and, for TCP and UDP, the destination port has to be in the rule's port range.
+func conntrackRuleMatch(r FirewallRule, t conntrackTuple) bool {
+	proto, ok := conntrackProtoNumbers[r.Proto]
+	if !ok || t.Proto != proto {
+		return false
+	}
+
+	if !t.SrcIP.Equal(r.SrcIP) || !t.DstIP.Equal(r.DstIP) {
+		return false
+	}
+
+	if r.Proto == FirewallProtoTCP || r.Proto == FirewallProtoUDP {
+		end := r.DstPortEnd
+		if end == 0 {
+			end = r.DstPortStart
+		}
+		if int(t.DstPort) < r.DstPortStart || int(t.DstPort) > end {
+			return false
+		}
+	}
+
+	return true
+}
+
+// firewallConntrack deletes the flows of the rules a backend removed. A failure is only logged (and counted), since
+// the rule itself has been removed.
+type firewallConntrack struct {
+	deleter ConntrackDeleter
+	backend string
+
+	duration observability.HistogramVec
+	deleted  observability.Counter
+	failures observability.Counter
+}
+
+func newFirewallConntrack(d ConntrackDeleter, backend string) firewallConntrack {
+	mr := getMetricsRepository()
+	lbl := observability.NewLabels().Add("backend", backend)
+
+	return firewallConntrack{
+		deleter:  d,
+		backend:  backend,
+		duration: newFirewallMetrics().duration,
+		deleted:  mr.Count("fw_conntrack_flows_deleted", lbl),
+		failures: mr.Count("fw_conntrack_delete_failures", lbl),
+	}
+}
+
+func (ct firewallConntrack) delete(r FirewallRule) {
+	start := time.Now()
+	n, err := ct.deleter.ConntrackDelete(r)
+	observability.ObserveDurationVec(ct.duration, start, ct.backend, firewallOperationConntrackDelete)
+
+	if err != nil {
+		ct.failures.Inc()
+		log.Error().Err(err).Msgf("Failed to delete the connection tracking entries of rule %s", r.String())
+		return
+	}
+
+	ct.deleted.Add(n)
+	if n > 0 {
+		log.Debug().Msgf("Deleted %d connection tracking entries of rule %s", n, r.String())
+	}
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package internal
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+var _ ConntrackDeleter = &ConntrackNetlink{}
+
+// ConntrackNetlink deletes the flows through the netfilter netlink interface, so conntrack-tools are not required.
+type ConntrackNetlink struct {
+	// netNS is the file descriptor of the network namespace, the current network namespace if 0
+	netNS int
+}
+
+func NewConntrackNetlink() *ConntrackNetlink {
+	return &ConntrackNetlink{}
+}
+
+func (ct *ConntrackNetlink) ConntrackDelete(r FirewallRule) (int, error) {
+	src6 := isIPv6(r.SrcIP)
+	if src6 != isIPv6(r.DstIP) {
+		return 0, errors.New("src and dst are not same ip family")
+	}
+
+	family := netlink.InetFamily(unix.AF_INET)
+	if src6 {
+		family = unix.AF_INET6
+	}
+
+	h, err := ct.handle()
+	if err != nil {
+		return 0, errors.Wrap(err, "netlink")
+	}
+	defer h.Delete()
+
+	n, err := h.ConntrackDeleteFilter(netlink.ConntrackTable, family, conntrackRuleFilter{r: r})
+	if err != nil {
+		return 0, errors.Wrap(err, "conntrack delete")
+	}
+
+	return int(n), nil
+}
+
+func (ct *ConntrackNetlink) handle() (*netlink.Handle, error) {
+	if ct.netNS == 0 {
+		return netlink.NewHandle(unix.NETLINK_NETFILTER)
+	}
+	return netlink.NewHandleAt(netns.NsHandle(ct.netNS), unix.NETLINK_NETFILTER)
+}
+
+// conntrackRuleFilter matches the flows of the rule, see conntrackRuleMatch.
+type conntrackRuleFilter struct {
+	r FirewallRule
+}
+
+func (f conntrackRuleFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	return conntrackRuleMatch(f.r, conntrackTuple{
+		Proto:   flow.Forward.Protocol,
+		SrcIP:   flow.Forward.SrcIP,
+		DstIP:   flow.Forward.DstIP,
+		DstPort: flow.Forward.DstPort,
+	})
+}
@@ -0,0 +1,162 @@
+//go:build linux
+
+package internal
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// newTestNetNS returns a new (empty) network namespace, which is closed once the test finishes. The test is skipped
+// if the network namespace can not be created.
+func newTestNetNS(t *testing.T) netns.NsHandle {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace requires root")
+	}
+
+	runtime.LockOSThread()
+	orig, err := netns.Get()
+	require.NoError(t, err)
+
+	ns, err := netns.New()
+	require.NoError(t, netns.Set(orig))
+	runtime.UnlockOSThread()
+	_ = orig.Close()
+	if err != nil {
+		t.Skipf("creating a network namespace: %v", err)
+	}
+	t.Cleanup(func() { _ = ns.Close() })
+
+	return ns
+}
+
+// runInNetNS runs f (on the current thread) in the network namespace, e.g. to open sockets in it.
+func runInNetNS(t *testing.T, ns netns.NsHandle, f func()) {
+	t.Helper()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	require.NoError(t, err)
+	defer func() { _ = orig.Close() }()
+
+	require.NoError(t, netns.Set(ns))
+	defer func() { require.NoError(t, netns.Set(orig)) }()
+
+	f()
+}
+
+func TestConntrackRuleFilter(t *testing.T) {
+	r := FirewallRule{Proto: FirewallProtoTCP, SrcIP: net.IPv4(88, 200, 23, 12), DstIP: net.IPv4(88, 200, 23, 3),
+		DstPortStart: 22}
+	f := conntrackRuleFilter{r: r}
+
+	flow := &netlink.ConntrackFlow{}
+	flow.Forward.Protocol = 6
+	flow.Forward.SrcIP = net.IPv4(88, 200, 23, 12).To4()
+	flow.Forward.DstIP = net.IPv4(88, 200, 23, 3).To4()
+	flow.Forward.SrcPort = 40000
+	flow.Forward.DstPort = 22
+	assert.True(t, f.MatchConntrackFlow(flow))
+
+	flow.Forward.DstPort = 80
+	assert.False(t, f.MatchConntrackFlow(flow))
+}
+
+func TestConntrackNetlink_ConntrackDelete(t *testing.T) {
+	ns := newTestNetNS(t)
+	ct := &ConntrackNetlink{netNS: int(ns)}
+
+	// The new network namespace has no flows
+	n, err := ct.ConntrackDelete(FirewallRule{Proto: FirewallProtoUDP, SrcIP: net.ParseIP("2001:1470:fffd:66::23:12"),
+		DstIP: net.ParseIP("2001:1470:fffd:66::23:3"), DstPortStart: 5000})
+	if err != nil {
+		t.Skipf("conntrack not available: %v", err)
+	}
+	assert.Equal(t, 0, n)
+
+	_, err = ct.ConntrackDelete(FirewallRule{Proto: FirewallProtoICMP, SrcIP: net.IPv4(88, 200, 23, 12),
+		DstIP: net.ParseIP("2001:1470:fffd:66::23:3")})
+	assert.Error(t, err)
+}
+
+func TestConntrackNetlink_ConntrackDeleteFlows(t *testing.T) {
+	ns := newTestNetNS(t)
+
+	nl, err := netlink.NewHandleAt(ns)
+	require.NoError(t, err)
+	defer nl.Delete()
+	lo, err := nl.LinkByName("lo")
+	require.NoError(t, err)
+	require.NoError(t, nl.LinkSetUp(lo))
+
+	// The flows of a network namespace are only tracked once its ruleset uses conntrack
+	c, err := nftables.New(nftables.WithNetNSFd(int(ns)))
+	require.NoError(t, err)
+	table := c.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "test"})
+	chain := c.AddChain(&nftables.Chain{
+		Name:     "output",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+	}})
+	if err := c.Flush(); err != nil {
+		t.Skipf("nftables not available: %v", err)
+	}
+
+	runInNetNS(t, ns, func() {
+		for _, port := range []int{5000, 6000} {
+			conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+			require.NoError(t, err)
+			_, err = conn.Write([]byte("test"))
+			assert.NoError(t, err)
+			_ = conn.Close()
+		}
+	})
+
+	ct := &ConntrackNetlink{netNS: int(ns)}
+	ports := func() []int {
+		h, err := ct.handle()
+		require.NoError(t, err)
+		defer h.Delete()
+
+		flows, err := h.ConntrackTableList(netlink.ConntrackTable, unix.AF_INET)
+		require.NoError(t, err)
+
+		p := make([]int, 0, len(flows))
+		for _, f := range flows {
+			p = append(p, int(f.Forward.DstPort))
+		}
+		sort.Ints(p)
+		return p
+	}
+
+	if p := ports(); len(p) != 2 {
+		t.Skipf("conntrack is not tracking the flows: %v", p)
+	}
+
+	// Only the flow of the rule is deleted
+	n, err := ct.ConntrackDelete(FirewallRule{Proto: FirewallProtoUDP, SrcIP: net.IPv4(127, 0, 0, 1),
+		DstIP: net.IPv4(127, 0, 0, 1), DstPortStart: 5000})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []int{6000}, ports())
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package internal
+
+var _ ConntrackDeleter = &ConntrackNetlink{}
+
+// ConntrackNetlink is only supported on linux, see conntrack_linux.go.
+type ConntrackNetlink struct{}
+
+func NewConntrackNetlink() *ConntrackNetlink {
+	return &ConntrackNetlink{}
+}
+
+func (ct *ConntrackNetlink) ConntrackDelete(r FirewallRule) (int, error) {
+	return 0, ErrConntrackNotSupported
+}
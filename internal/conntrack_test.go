@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"net"
+	"testing"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConntrackRuleMatch(t *testing.T) {
+	src, dst := net.IPv4(88, 200, 23, 12), net.IPv4(88, 200, 23, 3)
+	tcp := FirewallRule{Proto: FirewallProtoTCP, SrcIP: src, DstIP: dst, DstPortStart: 22}
+	udp := FirewallRule{Proto: FirewallProtoUDP, SrcIP: src, DstIP: dst, DstPortStart: 5000, DstPortEnd: 5010}
+	icmp := FirewallRule{Proto: FirewallProtoICMP, SrcIP: src, DstIP: dst}
+	src6, dst6 := net.ParseIP("2001:1470:fffd:66::23:12"), net.ParseIP("2001:1470:fffd:66::23:3")
+	icmp6 := FirewallRule{Proto: FirewallProtoICMPv6, SrcIP: src6, DstIP: dst6}
+
+	tests := []struct {
+		name  string
+		r     FirewallRule
+		t     conntrackTuple
+		match bool
+	}{
+		{"tcp", tcp, conntrackTuple{Proto: 6, SrcIP: src, DstIP: dst, DstPort: 22}, true},
+		{"tcp other port", tcp, conntrackTuple{Proto: 6, SrcIP: src, DstIP: dst, DstPort: 23}, false},
+		{"tcp as udp", tcp, conntrackTuple{Proto: 17, SrcIP: src, DstIP: dst, DstPort: 22}, false},
+		{"tcp other src", tcp, conntrackTuple{Proto: 6, SrcIP: net.IPv4(88, 200, 23, 13), DstIP: dst, DstPort: 22}, false},
+		{"tcp other dst", tcp, conntrackTuple{Proto: 6, SrcIP: src, DstIP: net.IPv4(88, 200, 23, 4), DstPort: 22}, false},
+		{"tcp reply", tcp, conntrackTuple{Proto: 6, SrcIP: dst, DstIP: src, DstPort: 22}, false},
+		{"udp range start", udp, conntrackTuple{Proto: 17, SrcIP: src, DstIP: dst, DstPort: 5000}, true},
+		{"udp range end", udp, conntrackTuple{Proto: 17, SrcIP: src, DstIP: dst, DstPort: 5010}, true},
+		{"udp out of range", udp, conntrackTuple{Proto: 17, SrcIP: src, DstIP: dst, DstPort: 5011}, false},
+		{"icmp", icmp, conntrackTuple{Proto: 1, SrcIP: src, DstIP: dst}, true},
+		{"icmpv6", icmp6, conntrackTuple{Proto: 58, SrcIP: src6, DstIP: dst6}, true},
+		{"icmpv6 as icmp", icmp6, conntrackTuple{Proto: 1, SrcIP: src6, DstIP: dst6}, false},
+		{"unknown proto", FirewallRule{Proto: "SCTP", SrcIP: src, DstIP: dst},
+			conntrackTuple{Proto: 132, SrcIP: src, DstIP: dst}, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.match, conntrackRuleMatch(test.r, test.t), test.name)
+	}
+}
+
+func TestFirewallConntrack_Delete(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	d := &ConntrackDeleterMock{}
+	ct := newFirewallConntrack(d, ServerConfigFirewallBackendIPTables)
+	r := FirewallRule{Proto: FirewallProtoTCP, SrcIP: net.IPv4(88, 200, 23, 12), DstIP: net.IPv4(88, 200, 23, 3),
+		DstPortStart: 22}
+
+	d.On("ConntrackDelete", r).Return(3, nil).Once()
+	ct.delete(r)
+	d.On("ConntrackDelete", r).Return(2, nil).Once()
+	ct.delete(r)
+	d.On("ConntrackDelete", r).Return(0, errors.New("test")).Once()
+	ct.delete(r)
+
+	assert.Equal(t, 5, ct.deleted.Get())
+	assert.Equal(t, 1, ct.failures.Get())
+	d.AssertExpectations(t)
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/greenstatic/openspa/internal/observability"
 	"github.com/pkg/errors"
 )
 
@@ -25,15 +26,54 @@ type FirewallRule struct {
 
 type FirewallRuleMetadata struct {
 	ClientUUID string
-	Duration   time.Duration
+	// GrantID is the ID of the FirewallRuleManager grant the rule belongs to, empty if the rule is not managed
+	GrantID  string
+	Duration time.Duration
 }
 
 type Firewall interface {
 	FirewallSetup() error
+	// Check verifies that the firewall backend is reachable (e.g. that the required binaries exist)
+	Check() error
 	RuleAdd(r FirewallRule, meta FirewallRuleMetadata) error
 	RuleRemove(r FirewallRule, meta FirewallRuleMetadata) error
 }
 
+// FirewallRuleExtender is optionally implemented by firewalls whose rules expire on their own (e.g. with kernel-side
+// timeouts). RuleExtend is called when the expiration of a rule is postponed, meta.Duration is the rule's new remaining
+// duration.
+type FirewallRuleExtender interface {
+	RuleExtend(r FirewallRule, meta FirewallRuleMetadata) error
+}
+
+// FirewallBatcher is optionally implemented by firewalls that apply concurrent rule operations in a single transaction.
+// The FirewallRuleManager removes the rules of a batching firewall concurrently (with a bounded number of workers) and
+// the rules of other firewalls one at a time.
+type FirewallBatcher interface {
+	Batching() bool
+}
+
+// ErrFirewallRuleListNotSupported is returned by RuleList if the firewall (as configured) can not list its rules.
+var ErrFirewallRuleListNotSupported = errors.New("firewall rule list is not supported")
+
+// FirewallRuleLister is optionally implemented by firewalls that can list the rules they currently own, which allows
+// the FirewallRuleManager to reconcile its grants with the firewall. The metadata of the listed rules is what the
+// firewall knows about them (e.g. the client UUID and grant ID from a rule's comment), the duration is not known.
+type FirewallRuleLister interface {
+	RuleList() ([]FirewallRuleWithMetadata, error)
+}
+
+// FirewallSetupDryRunner is optionally implemented by firewalls whose setup installs rules of their own (besides the
+// rules of the grants). SetupDryRun returns the rules the setup would install, without installing them.
+type FirewallSetupDryRunner interface {
+	SetupDryRun() string
+}
+
+type FirewallRuleWithMetadata struct {
+	Rule FirewallRule
+	Meta FirewallRuleMetadata
+}
+
 func (r *FirewallRule) String() string {
 	s := fmt.Sprintf("%s -> %s %s/%d", r.SrcIP.String(), r.DstIP.String(), r.Proto, r.DstPortStart)
 	if r.DstPortEnd != r.DstPortStart && r.DstPortEnd != 0 {
@@ -42,12 +82,42 @@ func (r *FirewallRule) String() string {
 	return s
 }
 
+const (
+	firewallOperationSetup      = "setup"
+	firewallOperationRuleAdd    = "rule_add"
+	firewallOperationRuleRemove = "rule_remove"
+	// firewallOperationConntrackDelete is the removal of the connection tracking entries of a removed rule
+	firewallOperationConntrackDelete = "conntrack_delete"
+	// firewallOperationBatch is the application of a batch of rule additions and removals in a single transaction
+	firewallOperationBatch = "batch"
+)
+
+// firewallMetrics are shared by the firewall backends, the duration is labeled with the backend and operation
+// (firewallOperation*).
+type firewallMetrics struct {
+	duration observability.HistogramVec
+}
+
+func newFirewallMetrics() firewallMetrics {
+	f := firewallMetrics{}
+	mr := getMetricsRepository()
+
+	f.duration = mr.HistogramVec("fw_operation_duration_seconds", nil, "backend", "operation")
+	return f
+}
+
 func NewFirewallFromServerConfigFirewall(fc ServerConfigFirewall) (Firewall, error) {
 	switch fc.Backend {
 	case ServerConfigFirewallBackendIPTables:
 		return newIPTablesFromServerConfigFirewall(fc)
 	case ServerConfigFirewallBackendCommand:
 		return newFirewallCommandFromServerConfigFirewall(fc)
+	case ServerConfigFirewallBackendNFTables:
+		return newNFTablesFromServerConfigFirewall(fc)
+	case ServerConfigFirewallBackendIPSet:
+		return newIPSetFromServerConfigFirewall(fc)
+	case ServerConfigFirewallBackendComposite:
+		return newFirewallCompositeFromServerConfigFirewall(fc)
 	case ServerConfigFirewallBackendNone:
 		return firewallDummy{}, nil
 	}
@@ -63,6 +133,10 @@ func (f firewallDummy) FirewallSetup() error {
 	return nil
 }
 
+func (f firewallDummy) Check() error {
+	return nil
+}
+
 func (f firewallDummy) RuleAdd(r FirewallRule, meta FirewallRuleMetadata) error {
 	return nil
 }
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"time"
+)
+
+// firewallElementTimeoutMin is the timeout of an element whose grants have all expired but have not been removed yet,
+// a timeout of zero would make the element permanent.
+const firewallElementTimeoutMin = time.Second
+
+// firewallElementRefs reference counts the firewall elements (e.g. nftables set elements or ipset entries) that are
+// shared by several grants. Such an element is identified by the rule alone, so the identical rules of different
+// clients (or the grants of a client whose rule has not been removed yet) are the same element. The element is kept
+// until its last grant is removed and expires with the latest of its grants. The refs are not safe for concurrent use.
+type firewallElementRefs struct {
+	// elements holds the expiration of each grant (key is firewallElementGrant()) of the element, the expiration is zero
+	// if the grant does not expire
+	elements map[string]map[string]time.Time
+}
+
+func newFirewallElementRefs() firewallElementRefs {
+	return firewallElementRefs{elements: make(map[string]map[string]time.Time)}
+}
+
+// firewallElementGrant returns the key of the rule's grant, the client UUID for the rules that are not managed by the
+// FirewallRuleManager.
+func firewallElementGrant(meta FirewallRuleMetadata) string {
+	if meta.GrantID != "" {
+		return meta.GrantID
+	}
+	return meta.ClientUUID
+}
+
+// add adds the grant to the element (or updates the grant's expiration if it already references the element). It
+// returns the timeout of the element (zero if it does not expire), whether the element was already referenced by
+// another grant and a function that undoes the change, in case the firewall operation fails.
+func (e firewallElementRefs) add(element string, meta FirewallRuleMetadata, now time.Time) (time.Duration, bool,
+	func()) {
+	grants, ok := e.elements[element]
+	if !ok {
+		grants = make(map[string]time.Time)
+		e.elements[element] = grants
+	}
+
+	grant := firewallElementGrant(meta)
+	prev, existed := grants[grant]
+	shared := len(grants) > 1 || (len(grants) == 1 && !existed)
+
+	exp := time.Time{}
+	if meta.Duration > 0 {
+		exp = now.Add(meta.Duration)
+	}
+	grants[grant] = exp
+
+	undo := func() {
+		if existed {
+			grants[grant] = prev
+			return
+		}
+		delete(grants, grant)
+		if len(grants) == 0 {
+			delete(e.elements, element)
+		}
+	}
+
+	return firewallElementTimeout(grants, now), shared, undo
+}
+
+// remove removes the grant from the element. It returns whether the element is still referenced by other grants (and
+// should be kept) along with its timeout, and a function that undoes the change, in case the firewall operation fails.
+func (e firewallElementRefs) remove(element string, meta FirewallRuleMetadata, now time.Time) (time.Duration, bool,
+	func()) {
+	grants, ok := e.elements[element]
+	if !ok {
+		return 0, false, func() {}
+	}
+
+	grant := firewallElementGrant(meta)
+	prev, existed := grants[grant]
+	delete(grants, grant)
+	if len(grants) == 0 {
+		delete(e.elements, element)
+	}
+
+	undo := func() {
+		if existed {
+			grants[grant] = prev
+			e.elements[element] = grants
+		}
+	}
+
+	if len(grants) == 0 {
+		return 0, false, undo
+	}
+
+	return firewallElementTimeout(grants, now), true, undo
+}
+
+// firewallElementTimeout returns the timeout of the latest expiring grant, zero if one of the grants does not expire.
+func firewallElementTimeout(grants map[string]time.Time, now time.Time) time.Duration {
+	latest := time.Time{}
+	for _, exp := range grants {
+		if exp.IsZero() {
+			return 0
+		}
+		if exp.After(latest) {
+			latest = exp
+		}
+	}
+
+	if d := latest.Sub(now); d > firewallElementTimeoutMin {
+		return d
+	}
+	return firewallElementTimeoutMin
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirewallElementRefs(t *testing.T) {
+	refs := newFirewallElementRefs()
+	now := time.Now()
+
+	meta1 := FirewallRuleMetadata{ClientUUID: "c1", GrantID: "g1", Duration: time.Hour}
+	meta2 := FirewallRuleMetadata{ClientUUID: "c2", GrantID: "g2", Duration: 2 * time.Hour}
+
+	timeout, shared, _ := refs.add("e", meta1, now)
+	assert.Equal(t, time.Hour, timeout)
+	assert.False(t, shared)
+
+	// Updating the only grant of the element
+	timeout, shared, _ = refs.add("e", meta1, now)
+	assert.Equal(t, time.Hour, timeout)
+	assert.False(t, shared)
+
+	timeout, shared, _ = refs.add("e", meta2, now)
+	assert.Equal(t, 2*time.Hour, timeout)
+	assert.True(t, shared)
+
+	// The element expires with the latest grant
+	timeout, shared, _ = refs.add("e", FirewallRuleMetadata{GrantID: "g2", Duration: time.Minute}, now)
+	assert.Equal(t, time.Hour, timeout)
+	assert.True(t, shared)
+
+	// A failed operation is undone
+	_, _, undo := refs.add("e", FirewallRuleMetadata{GrantID: "g3"}, now)
+	undo()
+	timeout, referenced, undo := refs.remove("e", meta1, now)
+	assert.True(t, referenced)
+	assert.Equal(t, time.Minute, timeout)
+	undo()
+
+	timeout, referenced, _ = refs.remove("e", meta2, now)
+	assert.True(t, referenced)
+	assert.Equal(t, time.Hour, timeout)
+
+	_, referenced, _ = refs.remove("e", meta1, now)
+	assert.False(t, referenced)
+	assert.Len(t, refs.elements, 0)
+
+	// Unknown elements (e.g. orphaned rules) are not referenced
+	_, referenced, _ = refs.remove("e", meta1, now)
+	assert.False(t, referenced)
+}
+
+func TestFirewallElementRefs_Timeout(t *testing.T) {
+	refs := newFirewallElementRefs()
+	now := time.Now()
+
+	// A grant without a duration does not expire, neither does the element
+	refs.add("e", FirewallRuleMetadata{GrantID: "g1", Duration: time.Hour}, now)
+	timeout, _, _ := refs.add("e", FirewallRuleMetadata{GrantID: "g2"}, now)
+	assert.Equal(t, time.Duration(0), timeout)
+
+	// The element of expired grants (that have not been removed yet) still expires
+	timeout, referenced, _ := refs.remove("e", FirewallRuleMetadata{GrantID: "g2"}, now.Add(2*time.Hour))
+	assert.True(t, referenced)
+	assert.Equal(t, firewallElementTimeoutMin, timeout)
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const FirewallReconcileIntervalDefault = time.Minute
+
+type FirewallRuleManagerReconcileOpt struct {
+	// Interval between the reconciliations, if 0 the grants are only reconciled on Start
+	Interval time.Duration
+	// RemoveOrphans removes the firewall's rules that do not belong to a grant, otherwise they are only reported
+	RemoveOrphans bool
+}
+
+// FirewallReconcileResult is the drift found (and repaired) by a reconciliation.
+type FirewallReconcileResult struct {
+	// Missing is the number of grants whose rule was missing from the firewall
+	Missing int
+	// Orphaned is the number of the firewall's rules that do not belong to a grant
+	Orphaned int
+	Readded  int
+	Removed  int
+}
+
+func (frm *FirewallRuleManager) reconcileRoutine(stop chan struct{}, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if _, err := frm.Reconcile(); err != nil {
+				log.Error().Err(err).Msgf("Firewall Rule Manager failed to reconcile")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Reconcile compares the grants with the rules listed by the firewall (which needs to be a FirewallRuleLister). The
+// missing rules of the grants are added again, while the rules that do not belong to a grant (orphans) are removed if
+// FirewallRuleManagerReconcileOpt.RemoveOrphans is set.
+func (frm *FirewallRuleManager) Reconcile() (FirewallReconcileResult, error) {
+	lister, ok := frm.fw.(FirewallRuleLister)
+	if !ok {
+		return FirewallReconcileResult{}, ErrFirewallRuleListNotSupported
+	}
+
+	defer observability.ObserveDuration(frm.metrics.reconcileDuration, time.Now())
+
+	frm.lock.Lock()
+	defer frm.lock.Unlock()
+
+	listed, err := lister.RuleList()
+	if err != nil {
+		if !errors.Is(err, ErrFirewallRuleListNotSupported) {
+			frm.metrics.reconcileFailed.Inc()
+		}
+		return FirewallReconcileResult{}, errors.Wrap(err, "firewall rule list")
+	}
+
+	missing, orphans := frm.reconcileDiff(listed, time.Now())
+	res := FirewallReconcileResult{
+		Missing:  len(missing),
+		Orphaned: len(orphans),
+	}
+	frm.metrics.reconcileMissing.Set(float64(res.Missing))
+	frm.metrics.reconcileOrphaned.Set(float64(res.Orphaned))
+
+	var firstErr error
+	for _, g := range missing {
+		log.Warn().Msgf("Firewall Rule Manager found the rule of grant %s missing from the firewall: %s", g.ID,
+			g.String())
+
+		meta := g.Meta
+		meta.Duration = time.Until(g.Expiration())
+		if err := frm.fw.RuleAdd(g.Rule, meta); err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrap(err, "firewall rule add")
+			}
+			continue
+		}
+
+		res.Readded++
+		frm.metrics.reconcileReadded.Inc()
+	}
+
+	removeOrphans := frm.reconcile != nil && frm.reconcile.RemoveOrphans
+	for _, o := range orphans {
+		log.Warn().Msgf("Firewall Rule Manager found an orphaned firewall rule (client: %s, grant: %s): %s",
+			o.Meta.ClientUUID, o.Meta.GrantID, o.Rule.String())
+
+		if !removeOrphans {
+			continue
+		}
+
+		if err := frm.fw.RuleRemove(o.Rule, o.Meta); err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrap(err, "firewall rule remove")
+			}
+			continue
+		}
+
+		res.Removed++
+		frm.metrics.reconcileRemoved.Inc()
+	}
+
+	if firstErr != nil {
+		frm.metrics.reconcileFailed.Inc()
+	}
+
+	return res, firstErr
+}
+
+// reconcileDiff returns the (unexpired) grants whose rule is not listed and the listed rules that do not belong to a
+// grant. A listed rule belongs to the grant with its grant ID, or if the firewall does not know the grant ID, to the
+// grants with the same rule. The rules that are being added are not orphans, they will belong to a grant. Needs to be
+// called with lock held.
+func (frm *FirewallRuleManager) reconcileDiff(listed []FirewallRuleWithMetadata,
+	now time.Time) ([]*firewallRuleManagerGrant, []FirewallRuleWithMetadata) {
+	pending := make(map[string]*firewallRuleManagerGrant, len(frm.grantsByID))
+	for id, g := range frm.grantsByID {
+		pending[id] = g
+	}
+
+	unmatched := make([]FirewallRuleWithMetadata, 0)
+	for _, l := range listed {
+		// Duplicates of a grant's rule are not orphans either, since the rule can not be removed without its duplicates
+		if g, ok := frm.grantsByID[l.Meta.GrantID]; ok && l.Rule.String() == g.Rule.String() {
+			delete(pending, g.ID)
+			continue
+		}
+		unmatched = append(unmatched, l)
+	}
+
+	pendingByRule := make(map[string][]*firewallRuleManagerGrant)
+	for _, g := range frm.expiration {
+		if _, ok := pending[g.ID]; ok {
+			pendingByRule[g.Rule.String()] = append(pendingByRule[g.Rule.String()], g)
+		}
+	}
+
+	adding := make(map[string]bool, len(frm.adding))
+	for _, a := range frm.adding {
+		adding[a.rule.String()] = true
+	}
+
+	orphans := make([]FirewallRuleWithMetadata, 0)
+	for _, l := range unmatched {
+		key := l.Rule.String()
+		if gs := pendingByRule[key]; l.Meta.GrantID == "" && len(gs) > 0 {
+			// The firewall does not distinguish the grants, the rule is in effect for all of them
+			for _, g := range gs {
+				delete(pending, g.ID)
+			}
+			delete(pendingByRule, key)
+			continue
+		}
+
+		if !adding[key] {
+			orphans = append(orphans, l)
+		}
+	}
+
+	missing := make([]*firewallRuleManagerGrant, 0)
+	for _, g := range frm.expiration {
+		if _, ok := pending[g.ID]; ok && now.Before(g.Expiration()) {
+			missing = append(missing, g)
+		}
+	}
+
+	return missing, orphans
+}
@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type firewallRuleListerMock struct {
+	FirewallMock
+}
+
+func (fw *firewallRuleListerMock) RuleList() ([]FirewallRuleWithMetadata, error) {
+	args := fw.Called()
+	return args.Get(0).([]FirewallRuleWithMetadata), args.Error(1)
+}
+
+func TestFirewallRuleManager_ReconcileMissing(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &firewallRuleListerMock{}
+	rm := NewFirewallRuleManager(fw)
+
+	r1, r2 := firewallTestRule(22), firewallTestRule(443)
+	fw.On("RuleAdd", r1, mock.Anything).Return(nil).Once()
+	fw.On("RuleAdd", r2, mock.Anything).Return(nil).Once()
+	g1, err := rm.AddGrant(r1, FirewallRuleMetadata{ClientUUID: "c1", Duration: time.Hour})
+	require.NoError(t, err)
+	_, err = rm.AddGrant(r2, FirewallRuleMetadata{ClientUUID: "c2", Duration: time.Hour})
+	require.NoError(t, err)
+
+	// The rule of the second grant was removed (e.g. the chain was flushed by hand)
+	fw.On("RuleList").Return([]FirewallRuleWithMetadata{
+		{Rule: r1, Meta: FirewallRuleMetadata{ClientUUID: "c1", GrantID: g1.ID}},
+	}, nil).Once()
+	fw.On("RuleAdd", r2, mock.MatchedBy(func(m FirewallRuleMetadata) bool {
+		return m.ClientUUID == "c2" && m.Duration > 59*time.Minute && m.Duration <= time.Hour
+	})).Return(nil).Once()
+
+	res, err := rm.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, FirewallReconcileResult{Missing: 1, Readded: 1}, res)
+	assert.Equal(t, 1, rm.metrics.reconcileReadded.Get())
+	assert.Equal(t, 2, rm.Count())
+
+	fw.AssertExpectations(t)
+}
+
+func TestFirewallRuleManager_ReconcileOrphans(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	r1, r2 := firewallTestRule(22), firewallTestRule(443)
+	orphan := FirewallRuleWithMetadata{Rule: r2, Meta: FirewallRuleMetadata{ClientUUID: "c2", GrantID: "g2"}}
+
+	// The orphans are only reported by default
+	fw := &firewallRuleListerMock{}
+	rm := NewFirewallRuleManagerWithOpt(fw, FirewallRuleManagerOpt{Reconcile: &FirewallRuleManagerReconcileOpt{}})
+
+	fw.On("RuleAdd", r1, mock.Anything).Return(nil).Once()
+	g1, err := rm.AddGrant(r1, FirewallRuleMetadata{ClientUUID: "c1", Duration: time.Hour})
+	require.NoError(t, err)
+
+	listed := []FirewallRuleWithMetadata{
+		{Rule: r1, Meta: FirewallRuleMetadata{ClientUUID: "c1", GrantID: g1.ID}},
+		orphan,
+	}
+	fw.On("RuleList").Return(listed, nil).Once()
+
+	res, err := rm.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, FirewallReconcileResult{Orphaned: 1}, res)
+	fw.AssertExpectations(t)
+
+	// Removed with the policy
+	rm.reconcile.RemoveOrphans = true
+	fw.On("RuleList").Return(listed, nil).Once()
+	fw.On("RuleRemove", orphan.Rule, orphan.Meta).Return(nil).Once()
+
+	res, err = rm.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, FirewallReconcileResult{Orphaned: 1, Removed: 1}, res)
+	assert.Equal(t, 1, rm.metrics.reconcileRemoved.Get())
+	fw.AssertExpectations(t)
+
+	// A failed removal fails the reconciliation
+	fw.On("RuleList").Return(listed, nil).Once()
+	fw.On("RuleRemove", orphan.Rule, orphan.Meta).Return(errors.New("test")).Once()
+
+	res, err = rm.Reconcile()
+	assert.Error(t, err)
+	assert.Equal(t, FirewallReconcileResult{Orphaned: 1}, res)
+	assert.Equal(t, 1, rm.metrics.reconcileFailed.Get())
+	fw.AssertExpectations(t)
+}
+
+func TestFirewallRuleManager_ReconcileGrantID(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &firewallRuleListerMock{}
+	rm := NewFirewallRuleManager(fw)
+
+	r := firewallTestRule(22)
+	fw.On("RuleAdd", r, mock.Anything).Return(nil).Once()
+	g, err := rm.AddGrant(r, FirewallRuleMetadata{ClientUUID: "c1", Duration: time.Hour})
+	require.NoError(t, err)
+
+	// The same rule, but of a different (unknown) grant, is an orphan and the grant's rule is missing
+	fw.On("RuleList").Return([]FirewallRuleWithMetadata{
+		{Rule: r, Meta: FirewallRuleMetadata{ClientUUID: "c1", GrantID: "unknown"}},
+	}, nil).Once()
+	fw.On("RuleAdd", r, mock.Anything).Return(nil).Once()
+
+	res, err := rm.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, FirewallReconcileResult{Missing: 1, Orphaned: 1, Readded: 1}, res)
+	fw.AssertExpectations(t)
+
+	// Duplicates of the grant's rule are not orphans
+	fw.On("RuleList").Return([]FirewallRuleWithMetadata{
+		{Rule: r, Meta: FirewallRuleMetadata{ClientUUID: "c1", GrantID: g.ID}},
+		{Rule: r, Meta: FirewallRuleMetadata{ClientUUID: "c1", GrantID: g.ID}},
+	}, nil).Once()
+
+	res, err = rm.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, FirewallReconcileResult{}, res)
+	fw.AssertExpectations(t)
+}
+
+func TestFirewallRuleManager_ReconcileWithoutGrantID(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &firewallRuleListerMock{}
+	rm := NewFirewallRuleManager(fw)
+
+	r1, r2 := firewallTestRule(22), firewallTestRule(443)
+	fw.On("RuleAdd", r1, mock.Anything).Return(nil).Twice()
+	fw.On("RuleAdd", r2, mock.Anything).Return(nil).Once()
+	_, err := rm.AddGrant(r1, FirewallRuleMetadata{ClientUUID: "c1", Duration: time.Hour})
+	require.NoError(t, err)
+	_, err = rm.AddGrant(r1, FirewallRuleMetadata{ClientUUID: "c2", Duration: time.Hour})
+	require.NoError(t, err)
+	_, err = rm.AddGrant(r2, FirewallRuleMetadata{ClientUUID: "c1", Duration: time.Hour})
+	require.NoError(t, err)
+
+	// The firewall does not know the grants (e.g. nftables), a rule is in effect for all the grants with the rule
+	fw.On("RuleList").Return([]FirewallRuleWithMetadata{{Rule: r1}, {Rule: r2}}, nil).Once()
+
+	res, err := rm.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, FirewallReconcileResult{}, res)
+	fw.AssertExpectations(t)
+}
+
+func TestFirewallRuleManager_ReconcileAddingIsNotOrphan(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &firewallRuleListerMock{}
+	rm := NewFirewallRuleManager(fw)
+
+	r := firewallTestRule(22)
+	key := firewallRuleKey(r, FirewallRuleMetadata{})
+	rm.adding[key] = &firewallRuleManagerAdding{rule: r, added: make(chan struct{})}
+
+	fw.On("RuleList").Return([]FirewallRuleWithMetadata{{Rule: r}}, nil).Once()
+
+	res, err := rm.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, FirewallReconcileResult{}, res)
+	fw.AssertExpectations(t)
+}
+
+func TestFirewallRuleManager_ReconcileNotSupported(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	rm := NewFirewallRuleManager(&FirewallMock{})
+	_, err := rm.Reconcile()
+	assert.ErrorIs(t, err, ErrFirewallRuleListNotSupported)
+
+	fw := &firewallRuleListerMock{}
+	rm = NewFirewallRuleManager(fw)
+	fw.On("RuleList").Return([]FirewallRuleWithMetadata(nil), ErrFirewallRuleListNotSupported).Once()
+
+	_, err = rm.Reconcile()
+	assert.ErrorIs(t, err, ErrFirewallRuleListNotSupported)
+	assert.Equal(t, 0, rm.metrics.reconcileFailed.Get())
+	fw.AssertExpectations(t)
+}
+
+func TestFirewallRuleManager_ReconcileOnStart(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &firewallRuleListerMock{}
+	rm := NewFirewallRuleManagerWithOpt(fw, FirewallRuleManagerOpt{
+		Reconcile: &FirewallRuleManagerReconcileOpt{Interval: 100 * time.Millisecond, RemoveOrphans: true},
+	})
+
+	// The rule of a grant from before a crash
+	orphan := FirewallRuleWithMetadata{Rule: firewallTestRule(22)}
+	fw.On("RuleList").Return([]FirewallRuleWithMetadata{orphan}, nil).Once()
+	fw.On("RuleRemove", orphan.Rule, orphan.Meta).Return(nil).Once()
+	fw.On("RuleList").Return([]FirewallRuleWithMetadata{}, nil)
+
+	require.NoError(t, rm.Start())
+	time.Sleep(250 * time.Millisecond)
+	require.NoError(t, rm.Stop())
+
+	fw.AssertExpectations(t)
+	assert.GreaterOrEqual(t, len(fw.Calls), 3)
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"encoding/json"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const FirewallRemovalEscalateAfterDefault = 5
+
+type FirewallRuleManagerRemovalOpt struct {
+	// EscalateAfter is the number of failed attempts to remove an expired grant's rule after which the removal has
+	// failed and is escalated, FirewallRemovalEscalateAfterDefault if 0. The removal is still retried afterwards.
+	EscalateAfter int
+	// Escalator is called once the removal of a grant has failed, optional
+	Escalator FirewallRemovalEscalator
+}
+
+func (o FirewallRuleManagerRemovalOpt) escalateAfter() int {
+	if o.EscalateAfter <= 0 {
+		return FirewallRemovalEscalateAfterDefault
+	}
+	return o.EscalateAfter
+}
+
+// FirewallRemovalEscalator handles the grants whose rule could not be removed from the firewall after they expired,
+// e.g. by blocking the client by other means or alerting an administrator. err is the last removal error.
+type FirewallRemovalEscalator interface {
+	Escalate(re FirewallRuleWithExpiration, attempts int, err error) error
+}
+
+var _ FirewallRemovalEscalator = &FirewallRemovalEscalationCommand{}
+
+// FirewallRemovalEscalationCommand executes a command with the grant (FirewallRemovalEscalationCommandInput) as JSON
+// on stdin.
+type FirewallRemovalEscalationCommand struct {
+	Cmd string
+
+	exec CommandExecuter
+}
+
+type FirewallRemovalEscalationCommandInput struct {
+	GrantID        string `json:"grantID"`
+	ClientUUID     string `json:"clientUUID"`
+	IPIsIPv6       bool   `json:"ipIsIPv6"`
+	ClientIP       net.IP `json:"clientIP"`
+	TargetIP       net.IP `json:"targetIP"`
+	TargetProtocol string `json:"targetProtocol"`
+	PortStart      int    `json:"portStart"`
+	PortEnd        int    `json:"portEnd,omitempty"`
+	Expired        int64  `json:"expired"` // unix timestamp
+	Attempts       int    `json:"attempts"`
+	Error          string `json:"error"`
+}
+
+func NewFirewallRemovalEscalationCommand(cmd string) *FirewallRemovalEscalationCommand {
+	return &FirewallRemovalEscalationCommand{
+		Cmd:  cmd,
+		exec: &CommandExecute{},
+	}
+}
+
+func (e *FirewallRemovalEscalationCommand) Escalate(re FirewallRuleWithExpiration, attempts int, err error) error {
+	input := FirewallRemovalEscalationCommandInput{
+		GrantID:        re.ID,
+		ClientUUID:     re.Meta.ClientUUID,
+		IPIsIPv6:       isIPv6(re.Rule.SrcIP),
+		ClientIP:       re.Rule.SrcIP,
+		TargetIP:       re.Rule.DstIP,
+		TargetProtocol: re.Rule.Proto,
+		PortStart:      re.Rule.DstPortStart,
+		PortEnd:        re.Rule.DstPortEnd,
+		Expired:        re.Expiration().Unix(),
+		Attempts:       attempts,
+	}
+	if err != nil {
+		input.Error = err.Error()
+	}
+
+	stdin, jerr := json.Marshal(input)
+	if jerr != nil {
+		return errors.Wrap(jerr, "json marshal input")
+	}
+
+	output, xerr := e.exec.Execute(e.Cmd, stdin)
+	if xerr != nil {
+		log.Warn().Msgf("Failed to escalate removal of grant %s, external command output: %s", re.ID, output)
+		return errors.Wrap(xerr, "execute escalation command")
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type firewallRemovalEscalatorMock struct {
+	mock.Mock
+}
+
+func (e *firewallRemovalEscalatorMock) Escalate(re FirewallRuleWithExpiration, attempts int, err error) error {
+	args := e.Called(re, attempts, err)
+	return args.Error(0)
+}
+
+func firewallRemovalTestGrant(rm *FirewallRuleManager, id string, port int) FirewallRuleWithExpiration {
+	re := FirewallRuleWithExpiration{
+		ID:       id,
+		Rule:     firewallTestRule(port),
+		Meta:     FirewallRuleMetadata{ClientUUID: "c1", GrantID: id},
+		Duration: time.Second,
+		Created:  time.Now().Add(-time.Minute),
+	}
+	rm.insert(re)
+	return re
+}
+
+// firewallRemovalTestRetryNow makes the failed removals due.
+func firewallRemovalTestRetryNow(rm *FirewallRuleManager) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	for _, g := range rm.removing {
+		g.removeRetry = time.Now().Add(-time.Millisecond)
+	}
+}
+
+func TestFirewallRuleManager_RemoveRetry(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &FirewallMock{}
+	rm := NewFirewallRuleManager(fw)
+
+	g1 := firewallRemovalTestGrant(rm, "g1", 22)
+	g2 := firewallRemovalTestGrant(rm, "g2", 443)
+
+	// A failed removal does not prevent the removal of the other expired grants
+	fw.On("RuleRemove", g1.Rule, g1.Meta).Return(errors.New("test")).Once()
+	fw.On("RuleRemove", g2.Rule, g2.Meta).Return(nil).Once()
+
+	assert.Error(t, rm.cleanup())
+	assert.Equal(t, 1, rm.Count())
+	require.Contains(t, rm.removing, "g1")
+	assert.Equal(t, 1, rm.removing["g1"].removeAttempts)
+	assert.WithinDuration(t, time.Now().Add(firewallRuleManagerRetryInterval), rm.removing["g1"].removeRetry,
+		100*time.Millisecond)
+	assert.Equal(t, 1, rm.metrics.removeFailures.Get())
+	assert.LessOrEqual(t, rm.nextCleanup(), firewallRuleManagerRetryInterval)
+	fw.AssertExpectations(t)
+
+	// The grant is listed until its rule is removed
+	grants := rm.Grants()
+	require.Len(t, grants, 1)
+	assert.Equal(t, "g1", grants[0].ID)
+	assert.True(t, grants[0].RemoveFailing)
+	re, err := rm.Grant("g1")
+	require.NoError(t, err)
+	assert.True(t, re.RemoveFailing)
+
+	// The retry is not due yet
+	assert.NoError(t, rm.cleanup())
+	fw.AssertExpectations(t)
+
+	// The backoff doubles
+	firewallRemovalTestRetryNow(rm)
+	fw.On("RuleRemove", g1.Rule, g1.Meta).Return(errors.New("test")).Once()
+	assert.Error(t, rm.cleanup())
+	assert.Equal(t, 2, rm.removing["g1"].removeAttempts)
+	assert.WithinDuration(t, time.Now().Add(2*firewallRuleManagerRetryInterval), rm.removing["g1"].removeRetry,
+		100*time.Millisecond)
+	fw.AssertExpectations(t)
+
+	firewallRemovalTestRetryNow(rm)
+	fw.On("RuleRemove", g1.Rule, g1.Meta).Return(nil).Once()
+	assert.NoError(t, rm.cleanup())
+	assert.Equal(t, 0, rm.Count())
+	assert.Len(t, rm.removing, 0)
+	assert.Equal(t, 2, rm.metrics.rulesRemoved.Get())
+	fw.AssertExpectations(t)
+}
+
+func TestFirewallRuleManager_RemoveEscalation(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &FirewallMock{}
+	escalator := &firewallRemovalEscalatorMock{}
+	audit := &AuditLoggerStub{}
+	rm := NewFirewallRuleManagerWithOpt(fw, FirewallRuleManagerOpt{
+		Audit:   audit,
+		Removal: FirewallRuleManagerRemovalOpt{EscalateAfter: 2, Escalator: escalator},
+	})
+
+	g := firewallRemovalTestGrant(rm, "g1", 22)
+	removeErr := errors.New("test")
+	fw.On("RuleRemove", g.Rule, g.Meta).Return(removeErr).Times(3)
+	escalator.On("Escalate", g, 2, removeErr).Return(nil).Once()
+
+	assert.Error(t, rm.cleanup())
+	assert.Equal(t, HealthStatusOK, rm.Health().Status)
+
+	firewallRemovalTestRetryNow(rm)
+	assert.Error(t, rm.cleanup())
+	rm.escalating.Wait()
+	assert.Equal(t, HealthStatusFailing, rm.Health().Status)
+	assert.Equal(t, 1, rm.metrics.removeEscalation.Get())
+
+	// Escalated only once, but still retried
+	firewallRemovalTestRetryNow(rm)
+	assert.Error(t, rm.cleanup())
+	rm.escalating.Wait()
+	assert.Equal(t, 1, rm.metrics.removeEscalation.Get())
+
+	events := audit.Events()
+	require.Len(t, events, 1)
+	assert.Equal(t, AuditEventRemoveFailed, events[0].Event)
+	assert.Equal(t, "g1", events[0].GrantID)
+
+	fw.AssertExpectations(t)
+	escalator.AssertExpectations(t)
+}
+
+func TestFirewallRuleManager_RemoveFailedGrantExtended(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &FirewallMock{}
+	rm := NewFirewallRuleManager(fw)
+
+	g := firewallRemovalTestGrant(rm, "g1", 22)
+	fw.On("RuleRemove", g.Rule, g.Meta).Return(errors.New("test")).Once()
+	assert.Error(t, rm.cleanup())
+	require.Contains(t, rm.removing, "g1")
+
+	// The client requests the rule again, the grant (whose rule is still in the firewall) is in effect again
+	re, err := rm.AddGrant(g.Rule, FirewallRuleMetadata{ClientUUID: "c1", Duration: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, "g1", re.ID)
+	assert.Len(t, rm.removing, 0)
+	assert.Equal(t, 1, rm.expiration.Len())
+	assert.Equal(t, 0, rm.expiration[0].removeAttempts)
+
+	// Revoking a grant whose removal is failing
+	g2 := firewallRemovalTestGrant(rm, "g2", 443)
+	fw.On("RuleRemove", g2.Rule, g2.Meta).Return(errors.New("test")).Once()
+	assert.Error(t, rm.cleanup())
+	require.Contains(t, rm.removing, "g2")
+
+	fw.On("RuleRemove", g2.Rule, g2.Meta).Return(nil).Once()
+	assert.NoError(t, rm.Revoke("g2"))
+	assert.Len(t, rm.removing, 0)
+	assert.Equal(t, 1, rm.Count())
+
+	fw.AssertExpectations(t)
+}
+
+func TestFirewallRemovalEscalationCommand(t *testing.T) {
+	exec := &CommandExecuteMock{}
+	e := NewFirewallRemovalEscalationCommand("escalate")
+	e.exec = exec
+
+	re := FirewallRuleWithExpiration{
+		ID: "g1",
+		Rule: FirewallRule{
+			Proto:        FirewallProtoTCP,
+			SrcIP:        net.IPv4(88, 200, 23, 12),
+			DstIP:        net.IPv4(88, 200, 23, 3),
+			DstPortStart: 22,
+		},
+		Meta:     FirewallRuleMetadata{ClientUUID: "c1"},
+		Duration: time.Minute,
+		Created:  time.Unix(1700000000, 0),
+	}
+
+	stdin, err := json.Marshal(FirewallRemovalEscalationCommandInput{
+		GrantID:        "g1",
+		ClientUUID:     "c1",
+		ClientIP:       net.IPv4(88, 200, 23, 12),
+		TargetIP:       net.IPv4(88, 200, 23, 3),
+		TargetProtocol: FirewallProtoTCP,
+		PortStart:      22,
+		Expired:        1700000060,
+		Attempts:       5,
+		Error:          "test",
+	})
+	require.NoError(t, err)
+
+	exec.On("Execute", "escalate", stdin, []string(nil)).Return([]byte{}, nil).Once()
+	assert.NoError(t, e.Escalate(re, 5, errors.New("test")))
+
+	exec.On("Execute", "escalate", stdin, []string(nil)).Return([]byte{}, errors.New("exit status 1")).Once()
+	assert.Error(t, e.Escalate(re, 5, errors.New("test")))
+
+	exec.AssertExpectations(t)
+}
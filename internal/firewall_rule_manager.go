@@ -1,103 +1,480 @@
 package internal
 
 import (
+	"container/heap"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/emirpasic/gods/lists"
-	"github.com/emirpasic/gods/lists/doublylinkedlist"
 	"github.com/greenstatic/openspa/internal/observability"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
 )
 
+var ErrGrantNotFound = errors.New("grant not found")
+
+// ErrFirewallRuleManagerStopping is returned by Add (and AddGrant) once the rule manager is stopping, the rules it
+// would add would not be removed.
+var ErrFirewallRuleManagerStopping = errors.New("firewall rule manager is stopping")
+
+const (
+	// firewallRuleManagerIdleInterval is how long the cleanup routine sleeps when there are no rules
+	firewallRuleManagerIdleInterval = time.Minute
+	// firewallRuleManagerRetryInterval is how long the cleanup routine waits before retrying a failed rule removal, the
+	// interval doubles with each failed attempt up to firewallRuleManagerRetryIntervalMax
+	firewallRuleManagerRetryInterval    = time.Second
+	firewallRuleManagerRetryIntervalMax = time.Minute
+	// firewallRuleManagerCleanupStale is the time since the last successful cleanup after which the rule manager is
+	// reported as failing. The cleanup routine runs at least every firewallRuleManagerIdleInterval.
+	firewallRuleManagerCleanupStale = 5 * firewallRuleManagerIdleInterval
+	// firewallRuleManagerRemoveWorkers is the number of rules a batching firewall removes concurrently
+	firewallRuleManagerRemoveWorkers = 32
+)
+
+// FirewallRuleManager adds rules to the firewall and removes them once they expire. Rules are scheduled for removal
+// using a min-heap ordered by expiration. Identical rules requested by the same client are managed as a single grant,
+// a repeated request extends the expiration of the existing grant instead of adding the rule to the firewall again.
 type FirewallRuleManager struct {
 	fw Firewall
 
-	rules lists.List
-	lock  sync.Mutex
-
-	stop    chan struct{}
-	metrics firewallRuleManagerMetrics
+	grants     map[string]*firewallRuleManagerGrant // key is firewallRuleKey()
+	grantsByID map[string]*firewallRuleManagerGrant
+	expiration firewallRuleManagerHeap
+	// adding are the rules being added to the firewall (key is firewallRuleKey())
+	adding map[string]*firewallRuleManagerAdding
+	// removing are the expired grants whose removal failed and is retried (key is the grant ID), they are not in the
+	// expiration heap
+	removing map[string]*firewallRuleManagerGrant
+	lock     sync.Mutex
+
+	journal   *GrantJournal
+	keepRules bool
+	audit     AuditLogger
+	reconcile *FirewallRuleManagerReconcileOpt
+	removal   FirewallRuleManagerRemovalOpt
+
+	stop       chan struct{}
+	wake       chan struct{}
+	escalating sync.WaitGroup
+	metrics    firewallRuleManagerMetrics
+
+	// lastCleanup is the time of the last cleanup, zero if the cleanup routine is not running
+	lastCleanup time.Time
+	// stopping is set by Stop, no rules are added afterwards
+	stopping bool
 }
 
 type firewallRuleManagerMetrics struct {
-	rulesAdded   observability.Counter
-	rulesRemoved observability.Counter
+	rulesAdded          observability.Counter
+	rulesRemoved        observability.Counter
+	rulesExtended       observability.Counter
+	rulesActive         observability.Gauge
+	rulesNextExpiration observability.Gauge
+	cleanupDuration     observability.Histogram
+
+	removeRetrying   observability.Gauge
+	removeEscalated  observability.Gauge
+	removeFailures   observability.Counter
+	removeEscalation observability.Counter
+
+	reconcileMissing  observability.Gauge
+	reconcileOrphaned observability.Gauge
+	reconcileReadded  observability.Counter
+	reconcileRemoved  observability.Counter
+	reconcileFailed   observability.Counter
+	reconcileDuration observability.Histogram
+}
+
+type FirewallRuleManagerOpt struct {
+	// Journal persists the grants so that they survive a server restart, optional
+	Journal *GrantJournal
+	// KeepRules leaves the firewall rules in place on Stop (requires Journal), so that clients are not disconnected
+	// while the server restarts
+	KeepRules bool
+	// Audit records the removal of grants (expiration, revocation and release on Stop), optional
+	Audit AuditLogger
+	// Reconcile periodically reconciles the grants with the rules of the firewall (if it is a FirewallRuleLister),
+	// optional
+	Reconcile *FirewallRuleManagerReconcileOpt
+	// Removal configures the handling of the expired grants whose rule can not be removed, optional
+	Removal FirewallRuleManagerRemovalOpt
 }
 
 func NewFirewallRuleManager(fw Firewall) *FirewallRuleManager {
+	return NewFirewallRuleManagerWithOpt(fw, FirewallRuleManagerOpt{})
+}
+
+func NewFirewallRuleManagerWithOpt(fw Firewall, opt FirewallRuleManagerOpt) *FirewallRuleManager {
 	r := &FirewallRuleManager{
-		fw:      fw,
-		rules:   doublylinkedlist.New(),
-		metrics: newFirewallRuleManagerMetrics(),
+		fw:         fw,
+		grants:     make(map[string]*firewallRuleManagerGrant),
+		grantsByID: make(map[string]*firewallRuleManagerGrant),
+		expiration: make(firewallRuleManagerHeap, 0),
+		adding:     make(map[string]*firewallRuleManagerAdding),
+		removing:   make(map[string]*firewallRuleManagerGrant),
+		journal:    opt.Journal,
+		keepRules:  opt.KeepRules && opt.Journal != nil,
+		audit:      opt.Audit,
+		reconcile:  opt.Reconcile,
+		removal:    opt.Removal,
+		wake:       make(chan struct{}, 1),
+		metrics:    newFirewallRuleManagerMetrics(),
 	}
 	return r
 }
 
 func (frm *FirewallRuleManager) Start() error {
+	if frm.journal != nil {
+		if err := frm.restore(); err != nil {
+			return errors.Wrap(err, "restore grants")
+		}
+	}
+
+	reconcile := frm.reconcile != nil
+	if reconcile {
+		// Cleans up after a crash (e.g. the orphaned rules of grants that were not journaled)
+		if _, err := frm.Reconcile(); errors.Is(err, ErrFirewallRuleListNotSupported) {
+			log.Warn().Msgf("Firewall Rule Manager reconciliation is disabled, the firewall can not list its rules")
+			reconcile = false
+		} else if err != nil {
+			log.Error().Err(err).Msgf("Firewall Rule Manager failed to reconcile")
+		}
+	}
+
+	frm.lock.Lock()
+	frm.lastCleanup = time.Now()
+	frm.stopping = false
+	frm.lock.Unlock()
+
 	frm.stop = make(chan struct{})
 	go frm.cleanupRoutine(frm.stop)
+	if reconcile && frm.reconcile.Interval > 0 {
+		go frm.reconcileRoutine(frm.stop, frm.reconcile.Interval)
+	}
+
+	return nil
+}
+
+// Health reports whether the cleanup routine is running and when it last ran. The rule manager is failing if the
+// removal of an expired grant has failed (see FirewallRuleManagerRemovalOpt.EscalateAfter).
+func (frm *FirewallRuleManager) Health() HealthComponent {
+	frm.lock.Lock()
+	last := frm.lastCleanup
+	_, escalated := frm.removingCount()
+	frm.lock.Unlock()
+
+	if last.IsZero() {
+		return HealthComponent{Status: HealthStatusStarting}
+	}
+
+	if escalated > 0 {
+		return HealthComponent{
+			Status:  HealthStatusFailing,
+			Message: fmt.Sprintf("failed to remove the rules of %d expired grants", escalated),
+		}
+	}
+
+	since := time.Since(last).Truncate(time.Second)
+	msg := fmt.Sprintf("last cleanup %s ago", since)
+	if since > firewallRuleManagerCleanupStale {
+		return HealthComponent{Status: HealthStatusFailing, Message: msg}
+	}
+
+	return HealthComponent{Status: HealthStatusOK, Message: msg}
+}
+
+// restore reads the grants from the journal. Unexpired grants are (re)added to the firewall and managed again, while
+// expired grants are removed from the firewall, since they could have been orphaned (e.g. due to a crash).
+func (frm *FirewallRuleManager) restore() error {
+	grants, err := frm.journal.Open()
+	if err != nil {
+		return errors.Wrap(err, "journal open")
+	}
+
+	frm.lock.Lock()
+	defer frm.lock.Unlock()
+
+	restored, expired := 0, 0
+	for _, re := range grants {
+		if now := time.Now(); now.After(re.Expiration()) {
+			if err := frm.fw.RuleRemove(re.Rule, re.Meta); err != nil {
+				log.Error().Err(err).Msgf("Firewall Rule Manager failed to remove expired journaled rule: %s", re.String())
+				frm.restoreRemoveFailed(re, now, err)
+				continue
+			}
+			expired++
+			frm.journalRemove(re)
+			frm.auditGrant(AuditEventExpire, re)
+			continue
+		}
+
+		if g, ok := frm.grants[firewallRuleKey(re.Rule, re.Meta)]; ok {
+			// Duplicate grant, merge it into the existing one
+			frm.extend(g, re.Expiration())
+			frm.journalRemove(re)
+			continue
+		}
+
+		// The firewall is given the remaining duration, so that the rule does not outlive the grant
+		meta := re.Meta
+		meta.Duration = time.Until(re.Expiration())
+		if err := frm.fw.RuleAdd(re.Rule, meta); err != nil {
+			log.Error().Err(err).Msgf("Firewall Rule Manager failed to restore journaled rule: %s", re.String())
+			frm.journalRemove(re)
+			continue
+		}
+
+		restored++
+		frm.metrics.rulesAdded.Inc()
+		frm.insert(re)
+	}
+
+	frm.updateGauges()
+
+	log.Info().Msgf("Firewall Rule Manager restored %d grants (%d expired grants removed) from journal", restored, expired)
+
 	return nil
 }
 
+// restoreRemoveFailed manages the expired journaled grant whose rule failed to be removed, so that the removal is
+// retried (and the grant is kept in the journal) until it succeeds. Needs to be called with lock held.
+func (frm *FirewallRuleManager) restoreRemoveFailed(re FirewallRuleWithExpiration, now time.Time, err error) {
+	g := &firewallRuleManagerGrant{
+		FirewallRuleWithExpiration: re,
+		key:                        firewallRuleKey(re.Rule, re.Meta),
+		index:                      -1,
+	}
+
+	frm.grants[g.key] = g
+	frm.grantsByID[g.ID] = g
+	if frm.removeFailed(g, now, err) {
+		frm.escalate(firewallRuleManagerEscalation{grant: re, attempts: g.removeAttempts, err: err})
+	}
+}
+
+// cleanupRoutine sleeps until the earliest expiration or removal retry (or until a rule is added) and removes the
+// expired rules.
 func (frm *FirewallRuleManager) cleanupRoutine(stop chan struct{}) {
-	t := time.NewTicker(time.Second)
+	d := frm.nextCleanup()
+	scheduled := time.Now().Add(d)
+	t := time.NewTimer(d)
 	for {
 		select {
 		case <-t.C:
 			if err := frm.cleanup(); err != nil {
 				log.Error().Err(err).Msgf("Firewall Rule Manager failed to cleanup")
 			}
+		case <-frm.wake:
+			// Only reschedule if a rule expires before the scheduled cleanup, otherwise frequent additions would
+			// postpone the cleanup indefinitely
+			if d := frm.nextCleanup(); !time.Now().Add(d).Before(scheduled) {
+				continue
+			}
 		case <-stop:
 			t.Stop()
 			return
 		}
+
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		d := frm.nextCleanup()
+		scheduled = time.Now().Add(d)
+		t.Reset(d)
 	}
 }
 
+// nextCleanup returns the duration until the earliest expiration or removal retry, but at most
+// firewallRuleManagerIdleInterval so that the cleanup routine's health can be monitored.
+func (frm *FirewallRuleManager) nextCleanup() time.Duration {
+	frm.lock.Lock()
+	defer frm.lock.Unlock()
+
+	next := time.Time{}
+	if frm.expiration.Len() > 0 {
+		next = frm.expiration[0].Expiration()
+	}
+	for _, g := range frm.removing {
+		if next.IsZero() || g.removeRetry.Before(next) {
+			next = g.removeRetry
+		}
+	}
+
+	if next.IsZero() {
+		return firewallRuleManagerIdleInterval
+	}
+
+	d := time.Until(next)
+	if d < 0 {
+		d = 0
+	}
+	if d > firewallRuleManagerIdleInterval {
+		d = firewallRuleManagerIdleInterval
+	}
+
+	return d
+}
+
+// cleanup removes the expired rules and retries the failed removals that are due. A grant whose rule can not be
+// removed is retried with a backoff, once the removal has failed FirewallRuleManagerRemovalOpt.EscalateAfter times
+// the failure is escalated.
 func (frm *FirewallRuleManager) cleanup() error {
+	defer observability.ObserveDuration(frm.metrics.cleanupDuration, time.Now())
+
+	escalate, err := frm.removeExpired()
+	for _, g := range escalate {
+		frm.escalate(g)
+	}
+
+	return err
+}
+
+// removeExpired returns the grants whose removal needs to be escalated.
+func (frm *FirewallRuleManager) removeExpired() ([]firewallRuleManagerEscalation, error) {
 	frm.lock.Lock()
 	defer frm.lock.Unlock()
+	defer frm.updateGauges()
 
-	last := 0
-mainloop:
-	for {
-		size := frm.rules.Size()
-		if size == 0 {
-			break
+	now := time.Now()
+	expired := make([]*firewallRuleManagerGrant, 0)
+	for frm.expiration.Len() > 0 && now.After(frm.expiration[0].Expiration()) {
+		expired = append(expired, heap.Pop(&frm.expiration).(*firewallRuleManagerGrant))
+	}
+	for _, g := range frm.removing {
+		if !now.Before(g.removeRetry) {
+			expired = append(expired, g)
 		}
-		for i, elm := range frm.rules.Values() {
-			if i < last {
-				continue
-			}
+	}
 
-			re, ok := elm.(FirewallRuleWithExpiration)
-			if !ok {
-				panic("invalid type in rule manger list")
+	var err error
+	escalate := make([]firewallRuleManagerEscalation, 0)
+	for i, rerr := range frm.removeRules(expired) {
+		g := expired[i]
+		if rerr != nil {
+			if err == nil {
+				err = errors.Wrap(rerr, "firewall rule remove")
 			}
-
-			if time.Now().After(re.Expiration()) {
-				// remove
-				err := frm.fw.RuleRemove(re.Rule, re.Meta)
-				if err != nil {
-					return errors.Wrap(err, "firewall rule remove")
-				}
-				frm.metrics.rulesRemoved.Inc()
-
-				frm.rules.Remove(i)
-				last = i
-				break
+			if frm.removeFailed(g, now, rerr) {
+				escalate = append(escalate, firewallRuleManagerEscalation{
+					grant:    g.FirewallRuleWithExpiration,
+					attempts: g.removeAttempts,
+					err:      rerr,
+				})
 			}
+			continue
+		}
 
-			if i+1 == size {
-				break mainloop
-			}
+		frm.metrics.rulesRemoved.Inc()
+		frm.journalRemove(g.FirewallRuleWithExpiration)
+		frm.auditGrant(AuditEventExpire, g.FirewallRuleWithExpiration)
+		delete(frm.grants, g.key)
+		delete(frm.grantsByID, g.ID)
+		delete(frm.removing, g.ID)
+	}
+
+	frm.lastCleanup = now
+	return escalate, err
+}
+
+// removeFailed schedules the retry of the grant's removal, returns true if the removal needs to be escalated. Needs to
+// be called with lock held.
+func (frm *FirewallRuleManager) removeFailed(g *firewallRuleManagerGrant, now time.Time, err error) bool {
+	g.removeAttempts++
+	frm.removing[g.ID] = g
+	frm.metrics.removeFailures.Inc()
+
+	backoff := firewallRuleManagerRetryIntervalMax
+	if g.removeAttempts <= 16 {
+		backoff = firewallRuleManagerRetryInterval << (g.removeAttempts - 1)
+	}
+	if backoff > firewallRuleManagerRetryIntervalMax {
+		backoff = firewallRuleManagerRetryIntervalMax
+	}
+	g.removeRetry = now.Add(backoff)
+
+	log.Warn().Err(err).Msgf("Firewall Rule Manager failed to remove expired rule of grant %s (attempt %d, retry in "+
+		"%s): %s", g.ID, g.removeAttempts, backoff, g.Rule.String())
+
+	return g.removeAttempts == frm.removal.escalateAfter()
+}
+
+// escalate reports the grant whose rule could not be removed and passes it to the escalator.
+func (frm *FirewallRuleManager) escalate(e firewallRuleManagerEscalation) {
+	log.Error().Err(e.err).Msgf("Firewall Rule Manager failed to remove expired rule of grant %s after %d attempts, "+
+		"the client still has access: %s", e.grant.ID, e.attempts, e.grant.Rule.String())
+
+	frm.metrics.removeEscalation.Inc()
+	frm.auditGrant(AuditEventRemoveFailed, e.grant)
+
+	if frm.removal.Escalator == nil {
+		return
+	}
+
+	frm.escalating.Add(1)
+	go func() {
+		defer frm.escalating.Done()
+		if err := frm.removal.Escalator.Escalate(e.grant, e.attempts, e.err); err != nil {
+			log.Error().Err(err).Msgf("Firewall Rule Manager failed to escalate the removal of grant %s", e.grant.ID)
+		}
+	}()
+}
+
+// removingCount returns the number of grants whose removal is retried and the number of grants whose removal was
+// escalated. Needs to be called with lock held.
+func (frm *FirewallRuleManager) removingCount() (retrying int, escalated int) {
+	n := frm.removal.escalateAfter()
+	for _, g := range frm.removing {
+		if g.removeAttempts >= n {
+			escalated++
+		} else {
+			retrying++
 		}
 	}
 
-	return nil
+	return retrying, escalated
+}
+
+// removeRules removes the rules of the grants from the firewall. If the firewall batches its operations (e.g.
+// IPTables), the rules are removed concurrently by up to firewallRuleManagerRemoveWorkers workers, so that they are
+// removed in a few transactions. The errors are in the order of the grants.
+func (frm *FirewallRuleManager) removeRules(grants []*firewallRuleManagerGrant) []error {
+	errs := make([]error, len(grants))
+
+	if b, ok := frm.fw.(FirewallBatcher); !ok || !b.Batching() {
+		for i, g := range grants {
+			errs[i] = frm.fw.RuleRemove(g.Rule, g.Meta)
+		}
+		return errs
+	}
+
+	workers := firewallRuleManagerRemoveWorkers
+	if len(grants) < workers {
+		workers = len(grants)
+	}
+
+	next := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = frm.fw.RuleRemove(grants[i].Rule, grants[i].Meta)
+			}
+		}()
+	}
+	for i := range grants {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return errs
 }
 
 func (frm *FirewallRuleManager) removeAllRules() []error {
@@ -106,79 +483,372 @@ func (frm *FirewallRuleManager) removeAllRules() []error {
 
 	errs := make([]error, 0)
 
-	for _, elm := range frm.rules.Values() {
-		re, ok := elm.(FirewallRuleWithExpiration)
-		if !ok {
-			panic("invalid type in rule manger list")
-		}
-
-		err := frm.fw.RuleRemove(re.Rule, re.Meta)
+	grants := append([]*firewallRuleManagerGrant{}, frm.expiration...)
+	for _, g := range frm.removing {
+		grants = append(grants, g)
+	}
+	for i, err := range frm.removeRules(grants) {
+		g := grants[i]
 		if err != nil {
-			errs = append(errs, errors.Wrap(err, fmt.Sprintf("firewall rule: %s", re.String())))
+			errs = append(errs, errors.Wrap(err, fmt.Sprintf("firewall rule: %s", g.String())))
+		} else {
+			frm.auditGrant(AuditEventRelease, g.FirewallRuleWithExpiration)
 		}
+		frm.journalRemove(g.FirewallRuleWithExpiration)
 	}
 
-	frm.rules.Clear()
+	frm.clear()
 
 	return errs
 }
 
+// waitAdding waits until the rules that are being added to the firewall are added (and managed).
+func (frm *FirewallRuleManager) waitAdding() {
+	frm.lock.Lock()
+	adding := make([]chan struct{}, 0, len(frm.adding))
+	for _, a := range frm.adding {
+		adding = append(adding, a.added)
+	}
+	frm.lock.Unlock()
+
+	for _, c := range adding {
+		<-c
+	}
+}
+
 func (frm *FirewallRuleManager) Stop() error {
-	frm.stop <- struct{}{}
-	errs := frm.removeAllRules()
-	if len(errs) != 0 {
-		for _, err := range errs {
-			log.Error().Msgf(err.Error())
+	// The rules that are being added are waited for, the rules requested afterwards are refused
+	frm.lock.Lock()
+	frm.stopping = true
+	frm.lock.Unlock()
+
+	close(frm.stop)
+	frm.waitAdding()
+	frm.escalating.Wait()
+
+	frm.lock.Lock()
+	frm.lastCleanup = time.Time{}
+	frm.lock.Unlock()
+
+	if frm.keepRules {
+		frm.lock.Lock()
+		log.Info().Msgf("Firewall Rule Manager keeping %d rules in place", len(frm.grants))
+		frm.clear()
+		frm.lock.Unlock()
+	} else {
+		errs := frm.removeAllRules()
+		if len(errs) != 0 {
+			for _, err := range errs {
+				log.Error().Msgf(err.Error())
+			}
 		}
 	}
+
+	if frm.journal != nil {
+		if err := frm.journal.Close(); err != nil {
+			return errors.Wrap(err, "journal close")
+		}
+	}
+
 	return nil
 }
 
+// Add adds the rule to the firewall. If the client already has an identical rule, the rule's expiration is extended
+// (if the new expiration is later) instead.
 func (frm *FirewallRuleManager) Add(r FirewallRule, meta FirewallRuleMetadata) error {
+	_, err := frm.AddGrant(r, meta)
+	return err
+}
+
+// AddGrant is the same as Add, but returns the (new or extended) grant. The lock is not held while the rule is added
+// to the firewall, so that a firewall that batches its operations (e.g. IPTables) can add concurrently requested rules
+// in a single transaction.
+func (frm *FirewallRuleManager) AddGrant(r FirewallRule,
+	meta FirewallRuleMetadata) (FirewallRuleWithExpiration, error) {
+	key := firewallRuleKey(r, meta)
+
+	frm.lock.Lock()
+	for {
+		if frm.stopping {
+			frm.lock.Unlock()
+			return FirewallRuleWithExpiration{}, ErrFirewallRuleManagerStopping
+		}
+
+		if g, ok := frm.grants[key]; ok {
+			frm.extend(g, time.Now().Add(meta.Duration))
+			frm.metrics.rulesExtended.Inc()
+			frm.updateGauges()
+			re := g.FirewallRuleWithExpiration
+			frm.lock.Unlock()
+			return re, nil
+		}
+
+		adding, ok := frm.adding[key]
+		if !ok {
+			break
+		}
+
+		// An identical rule is being added, wait for it and extend it instead
+		frm.lock.Unlock()
+		<-adding.added
+		frm.lock.Lock()
+	}
+
+	adding := &firewallRuleManagerAdding{rule: r, added: make(chan struct{})}
+	frm.adding[key] = adding
+	frm.lock.Unlock()
+
 	re := FirewallRuleWithExpiration{
+		ID:       uuid.NewV4().String(),
 		Rule:     r,
 		Meta:     meta,
 		Duration: meta.Duration,
 		Created:  time.Now(),
 	}
+	re.Meta.GrantID = re.ID
+
+	err := frm.fw.RuleAdd(r, re.Meta)
+
+	frm.lock.Lock()
+	defer frm.lock.Unlock()
+	delete(frm.adding, key)
+	close(adding.added)
 
-	err := frm.fw.RuleAdd(r, meta)
 	if err != nil {
-		return errors.Wrap(err, "firewall rule add")
+		return FirewallRuleWithExpiration{}, errors.Wrap(err, "firewall rule add")
 	}
 
 	frm.metrics.rulesAdded.Inc()
 
-	frm.lock.Lock()
-	frm.rules.Add(re)
-	frm.lock.Unlock()
+	frm.insert(re)
+	frm.updateGauges()
 
-	return nil
+	if frm.journal != nil {
+		if err := frm.journal.Add(re); err != nil {
+			// The grant is in effect, it just won't survive a restart
+			log.Error().Err(err).Msgf("Firewall Rule Manager failed to journal rule: %s", re.String())
+		}
+	}
+
+	return re, nil
+}
+
+// insert needs to be called with lock held.
+func (frm *FirewallRuleManager) insert(re FirewallRuleWithExpiration) {
+	g := &firewallRuleManagerGrant{
+		FirewallRuleWithExpiration: re,
+		key:                        firewallRuleKey(re.Rule, re.Meta),
+	}
+
+	frm.grants[g.key] = g
+	frm.grantsByID[g.ID] = g
+	heap.Push(&frm.expiration, g)
+	frm.wakeCleanup()
+}
+
+// remove needs to be called with lock held.
+func (frm *FirewallRuleManager) remove(g *firewallRuleManagerGrant) {
+	if g.index >= 0 {
+		heap.Remove(&frm.expiration, g.index)
+	}
+	delete(frm.grants, g.key)
+	delete(frm.grantsByID, g.ID)
+	delete(frm.removing, g.ID)
+}
+
+// clear needs to be called with lock held.
+func (frm *FirewallRuleManager) clear() {
+	frm.grants = make(map[string]*firewallRuleManagerGrant)
+	frm.grantsByID = make(map[string]*firewallRuleManagerGrant)
+	frm.expiration = make(firewallRuleManagerHeap, 0)
+	frm.removing = make(map[string]*firewallRuleManagerGrant)
+	frm.updateGauges()
+}
+
+// extend postpones the grant's expiration to exp, if exp is later than the current expiration. Needs to be called with
+// lock held.
+func (frm *FirewallRuleManager) extend(g *firewallRuleManagerGrant, exp time.Time) {
+	if !exp.After(g.Expiration()) {
+		return
+	}
+
+	g.Duration = exp.Sub(g.Created)
+	if g.index < 0 {
+		// The removal of the expired grant failed, its rule is still in the firewall and is in effect again
+		delete(frm.removing, g.ID)
+		g.removeAttempts = 0
+		heap.Push(&frm.expiration, g)
+	} else {
+		heap.Fix(&frm.expiration, g.index)
+	}
+	frm.wakeCleanup()
+
+	if ext, ok := frm.fw.(FirewallRuleExtender); ok {
+		meta := g.Meta
+		meta.Duration = time.Until(exp)
+		if err := ext.RuleExtend(g.Rule, meta); err != nil {
+			log.Error().Err(err).Msgf("Firewall Rule Manager failed to extend rule: %s", g.String())
+		}
+	}
+
+	if frm.journal != nil {
+		if err := frm.journal.Add(g.FirewallRuleWithExpiration); err != nil {
+			log.Error().Err(err).Msgf("Firewall Rule Manager failed to journal rule extension: %s", g.String())
+		}
+	}
+}
+
+func (frm *FirewallRuleManager) wakeCleanup() {
+	select {
+	case frm.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (frm *FirewallRuleManager) journalRemove(re FirewallRuleWithExpiration) {
+	if frm.journal == nil {
+		return
+	}
+
+	if err := frm.journal.Remove(re.ID); err != nil {
+		log.Error().Err(err).Msgf("Firewall Rule Manager failed to journal rule removal: %s", re.String())
+	}
+}
+
+func (frm *FirewallRuleManager) auditGrant(t AuditEventType, re FirewallRuleWithExpiration) {
+	if frm.audit == nil {
+		return
+	}
+
+	frm.audit.Audit(auditGrantEvent(t, re))
+}
+
+// updateGauges needs to be called with lock held.
+func (frm *FirewallRuleManager) updateGauges() {
+	frm.metrics.rulesActive.Set(float64(len(frm.grants)))
+
+	next := float64(0)
+	if frm.expiration.Len() > 0 {
+		next = float64(frm.expiration[0].Expiration().Unix())
+	}
+	frm.metrics.rulesNextExpiration.Set(next)
+
+	retrying, escalated := frm.removingCount()
+	frm.metrics.removeRetrying.Set(float64(retrying))
+	frm.metrics.removeEscalated.Set(float64(escalated))
 }
 
 func (frm *FirewallRuleManager) Count() int {
 	frm.lock.Lock()
 	defer frm.lock.Unlock()
-	return frm.rules.Size()
+	return len(frm.grants)
 }
 
-func (frm *FirewallRuleManager) Debug() map[string]interface{} {
+// Grants returns the active grants sorted by creation time, including the expired grants whose removal is failing
+// (their rules are still in effect).
+func (frm *FirewallRuleManager) Grants() []FirewallRuleWithExpiration {
 	frm.lock.Lock()
 	defer frm.lock.Unlock()
 
-	rules := make([]string, 0, frm.rules.Size())
-	for _, elm := range frm.rules.Values() {
-		r, ok := elm.(FirewallRule)
-		if !ok {
-			panic("invalid type in rules list")
+	l := make([]FirewallRuleWithExpiration, 0, len(frm.grants))
+	for _, g := range frm.expiration {
+		l = append(l, g.FirewallRuleWithExpiration)
+	}
+	for _, g := range frm.removing {
+		re := g.FirewallRuleWithExpiration
+		re.RemoveFailing = true
+		l = append(l, re)
+	}
+
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Created.Before(l[j].Created)
+	})
+
+	return l
+}
+
+func (frm *FirewallRuleManager) Grant(id string) (FirewallRuleWithExpiration, error) {
+	frm.lock.Lock()
+	defer frm.lock.Unlock()
+
+	g, ok := frm.grantsByID[id]
+	if !ok {
+		return FirewallRuleWithExpiration{}, ErrGrantNotFound
+	}
+
+	re := g.FirewallRuleWithExpiration
+	_, re.RemoveFailing = frm.removing[id]
+	return re, nil
+}
+
+// Extend postpones the expiration of the grant by d.
+func (frm *FirewallRuleManager) Extend(id string, d time.Duration) (FirewallRuleWithExpiration, error) {
+	if d <= 0 {
+		return FirewallRuleWithExpiration{}, errors.New("duration should be positive")
+	}
+
+	frm.lock.Lock()
+	defer frm.lock.Unlock()
+
+	g, ok := frm.grantsByID[id]
+	if !ok {
+		return FirewallRuleWithExpiration{}, ErrGrantNotFound
+	}
+
+	frm.extend(g, g.Expiration().Add(d))
+	frm.metrics.rulesExtended.Inc()
+	frm.updateGauges()
+
+	return g.FirewallRuleWithExpiration, nil
+}
+
+// Revoke removes the grant's rule from the firewall before it expires.
+func (frm *FirewallRuleManager) Revoke(id string) error {
+	frm.lock.Lock()
+	defer frm.lock.Unlock()
+
+	g, ok := frm.grantsByID[id]
+	if !ok {
+		return ErrGrantNotFound
+	}
+
+	return frm.revoke(g)
+}
+
+// RevokeClient removes all the rules of the client from the firewall. Returns the number of revoked grants.
+func (frm *FirewallRuleManager) RevokeClient(clientUUID string) (int, error) {
+	frm.lock.Lock()
+	defer frm.lock.Unlock()
+
+	revoke := make([]*firewallRuleManagerGrant, 0)
+	for _, g := range frm.grantsByID {
+		if g.Meta.ClientUUID == clientUUID {
+			revoke = append(revoke, g)
 		}
+	}
 
-		rules = append(rules, r.String())
+	for i, g := range revoke {
+		if err := frm.revoke(g); err != nil {
+			return i, err
+		}
 	}
 
-	return map[string]interface{}{
-		"rules": rules,
+	return len(revoke), nil
+}
+
+// revoke needs to be called with lock held.
+func (frm *FirewallRuleManager) revoke(g *firewallRuleManagerGrant) error {
+	if err := frm.fw.RuleRemove(g.Rule, g.Meta); err != nil {
+		return errors.Wrap(err, "firewall rule remove")
 	}
+
+	frm.metrics.rulesRemoved.Inc()
+	frm.journalRemove(g.FirewallRuleWithExpiration)
+	frm.auditGrant(AuditEventRevoke, g.FirewallRuleWithExpiration)
+	frm.remove(g)
+	frm.updateGauges()
+
+	return nil
 }
 
 func newFirewallRuleManagerMetrics() firewallRuleManagerMetrics {
@@ -188,15 +858,39 @@ func newFirewallRuleManagerMetrics() firewallRuleManagerMetrics {
 
 	f.rulesAdded = mr.Count("fw_rules_added", lbl)
 	f.rulesRemoved = mr.Count("fw_rules_removed", lbl)
+	f.rulesExtended = mr.Count("fw_rules_extended", lbl)
+	f.rulesActive = mr.Gauge("fw_rules_active", lbl)
+	f.rulesNextExpiration = mr.Gauge("fw_rules_next_expiration_timestamp_seconds", lbl)
+	f.cleanupDuration = mr.Histogram("fw_rules_cleanup_duration_seconds", lbl, nil)
+
+	f.removeRetrying = mr.Gauge("fw_rules_remove_failing", lbl.Add("state", "retrying"))
+	f.removeEscalated = mr.Gauge("fw_rules_remove_failing", lbl.Add("state", "escalated"))
+	f.removeFailures = mr.Count("fw_rules_remove_failures", lbl)
+	f.removeEscalation = mr.Count("fw_rules_remove_escalations", lbl)
+
+	f.reconcileMissing = mr.Gauge("fw_reconcile_drift_rules", lbl.Add("kind", "missing"))
+	f.reconcileOrphaned = mr.Gauge("fw_reconcile_drift_rules", lbl.Add("kind", "orphaned"))
+	f.reconcileReadded = mr.Count("fw_reconcile_rules_readded", lbl)
+	f.reconcileRemoved = mr.Count("fw_reconcile_rules_removed", lbl)
+	f.reconcileFailed = mr.Count("fw_reconcile_failed", lbl)
+	f.reconcileDuration = mr.Histogram("fw_reconcile_duration_seconds", lbl, nil)
 
 	return f
 }
 
+// firewallRuleKey identifies identical rules of the same client.
+func firewallRuleKey(r FirewallRule, meta FirewallRuleMetadata) string {
+	return fmt.Sprintf("%s/%s", meta.ClientUUID, r.String())
+}
+
 type FirewallRuleWithExpiration struct {
+	ID       string
 	Rule     FirewallRule
 	Meta     FirewallRuleMetadata
 	Duration time.Duration
 	Created  time.Time
+	// RemoveFailing is set (by Grants and Grant) if the grant expired, but the removal of its rule is failing
+	RemoveFailing bool
 }
 
 func (re *FirewallRuleWithExpiration) String() string {
@@ -206,3 +900,58 @@ func (re *FirewallRuleWithExpiration) String() string {
 func (re *FirewallRuleWithExpiration) Expiration() time.Time {
 	return re.Created.Add(re.Duration)
 }
+
+// firewallRuleManagerAdding is a rule being added to the firewall, added is closed once the rule is added.
+type firewallRuleManagerAdding struct {
+	rule  FirewallRule
+	added chan struct{}
+}
+
+type firewallRuleManagerGrant struct {
+	FirewallRuleWithExpiration
+	key   string
+	index int // index in firewallRuleManagerHeap, -1 if the grant is not in the heap
+
+	// removeAttempts is the number of failed removals of the expired grant, removeRetry is when the removal is retried
+	removeAttempts int
+	removeRetry    time.Time
+}
+
+type firewallRuleManagerEscalation struct {
+	grant    FirewallRuleWithExpiration
+	attempts int
+	err      error
+}
+
+// firewallRuleManagerHeap implements heap.Interface, the grant with the earliest expiration is at index 0.
+type firewallRuleManagerHeap []*firewallRuleManagerGrant
+
+func (h firewallRuleManagerHeap) Len() int {
+	return len(h)
+}
+
+func (h firewallRuleManagerHeap) Less(i, j int) bool {
+	return h[i].Expiration().Before(h[j].Expiration())
+}
+
+func (h firewallRuleManagerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *firewallRuleManagerHeap) Push(x interface{}) {
+	g := x.(*firewallRuleManagerGrant)
+	g.index = len(*h)
+	*h = append(*h, g)
+}
+
+func (h *firewallRuleManagerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	g := old[n-1]
+	old[n-1] = nil
+	g.index = -1
+	*h = old[:n-1]
+	return g
+}
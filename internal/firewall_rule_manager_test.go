@@ -2,6 +2,10 @@ package internal
 
 import (
 	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -9,6 +13,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 var firewallRuleManagerExpirationTestingSleep = time.Second
@@ -134,18 +139,18 @@ func TestFirewallRuleManager_RemoveAllRules(t *testing.T) {
 	assert.Equal(t, 0, rm.Count())
 
 	dur := time.Hour
-	r := FirewallRule{
-		Proto:        FirewallProtoTCP,
-		SrcIP:        net.IPv4(1, 2, 3, 4),
-		DstIP:        net.IPv4(1, 1, 1, 1),
-		DstPortStart: 80,
-	}
 
 	fw.On("RuleAdd", mock.Anything, mock.Anything).Return(nil).Times(5)
 	fw.On("RuleRemove", mock.Anything, mock.Anything).Return(nil).Times(4)
 	fw.On("RuleRemove", mock.Anything, mock.Anything).Return(errors.New("simulated error")).Times(1)
 
 	for i := 0; i < 5; i++ {
+		r := FirewallRule{
+			Proto:        FirewallProtoTCP,
+			SrcIP:        net.IPv4(1, 2, 3, 4),
+			DstIP:        net.IPv4(1, 1, 1, 1),
+			DstPortStart: 80 + i,
+		}
 		assert.NoError(t, rm.Add(r, FirewallRuleMetadata{Duration: dur}))
 	}
 	assert.Equal(t, 5, rm.Count())
@@ -156,6 +161,421 @@ func TestFirewallRuleManager_RemoveAllRules(t *testing.T) {
 	fw.AssertExpectations(t)
 }
 
+func TestFirewallRuleManager_DuplicateRuleExtendsExpiration(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &FirewallMock{}
+	rm := NewFirewallRuleManager(fw)
+
+	assert.NoError(t, rm.Start())
+
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(1, 2, 3, 4),
+		DstIP:        net.IPv4(1, 1, 1, 1),
+		DstPortStart: 80,
+	}
+	meta := FirewallRuleMetadata{ClientUUID: "c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43", Duration: time.Second}
+	metaOtherClient := FirewallRuleMetadata{ClientUUID: "0a6d1b3b-2d1e-4b7e-9c4a-6c3d2f1e0b9a", Duration: time.Second}
+
+	fw.On("RuleAdd", r, firewallRuleManagerMeta(meta)).Return(nil).Once()
+	fw.On("RuleAdd", r, firewallRuleManagerMeta(metaOtherClient)).Return(nil).Once()
+
+	assert.NoError(t, rm.Add(r, meta))
+	assert.NoError(t, rm.Add(r, metaOtherClient))
+	assert.Equal(t, 2, rm.Count())
+
+	// The repeated request extends the expiration
+	time.Sleep(500 * time.Millisecond)
+	assert.NoError(t, rm.Add(r, FirewallRuleMetadata{ClientUUID: meta.ClientUUID, Duration: 2 * time.Second}))
+	assert.Equal(t, 2, rm.Count())
+	assert.Equal(t, 2, rm.metrics.rulesAdded.Get())
+	assert.Equal(t, 1, rm.metrics.rulesExtended.Get())
+
+	fw.On("RuleRemove", r, firewallRuleManagerMeta(metaOtherClient)).Return(nil).Once()
+	time.Sleep(firewallRuleManagerExpirationTestingSleep)
+	assert.Equal(t, 1, rm.Count())
+
+	fw.On("RuleRemove", r, firewallRuleManagerMeta(meta)).Return(nil).Once()
+	time.Sleep(firewallRuleManagerExpirationTestingSleep + time.Second)
+	assert.Equal(t, 0, rm.Count())
+
+	assert.NoError(t, rm.Stop())
+	fw.AssertExpectations(t)
+}
+
+// firewallTestRule returns a TCP rule from 88.200.23.12 to 88.200.23.3 and the port.
+func firewallTestRule(port int) FirewallRule {
+	return FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: port,
+	}
+}
+
+// firewallRuleManagerMeta matches the metadata the rule manager passes to the firewall, which is meta with the grant's
+// ID set.
+func firewallRuleManagerMeta(meta FirewallRuleMetadata) interface{} {
+	return mock.MatchedBy(func(m FirewallRuleMetadata) bool {
+		grantID := m.GrantID
+		m.GrantID = ""
+		return grantID != "" && m == meta
+	})
+}
+
+type firewallRuleExtenderMock struct {
+	FirewallMock
+}
+
+func (fw *firewallRuleExtenderMock) RuleExtend(r FirewallRule, meta FirewallRuleMetadata) error {
+	args := fw.Called(r, meta)
+	return args.Error(0)
+}
+
+func TestFirewallRuleManager_ExtendFirewallRuleExtender(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &firewallRuleExtenderMock{}
+	rm := NewFirewallRuleManager(fw)
+
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(1, 2, 3, 4),
+		DstIP:        net.IPv4(1, 1, 1, 1),
+		DstPortStart: 80,
+	}
+	meta := FirewallRuleMetadata{ClientUUID: "c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43", Duration: time.Hour}
+
+	fw.On("RuleAdd", r, firewallRuleManagerMeta(meta)).Return(nil).Once()
+	g, err := rm.AddGrant(r, meta)
+	require.NoError(t, err)
+
+	// The firewall is given the remaining duration of the extended rule
+	fw.On("RuleExtend", r, mock.MatchedBy(func(m FirewallRuleMetadata) bool {
+		return m.ClientUUID == meta.ClientUUID && m.Duration > time.Hour && m.Duration <= 2*time.Hour
+	})).Return(nil).Once()
+	_, err = rm.Extend(g.ID, time.Hour)
+	require.NoError(t, err)
+
+	// Not extended, the requested duration is shorter than the remaining one
+	assert.NoError(t, rm.Add(r, FirewallRuleMetadata{ClientUUID: meta.ClientUUID, Duration: time.Minute}))
+
+	fw.AssertExpectations(t)
+}
+
+func TestFirewallRuleManager_ConcurrentAdd(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &FirewallMock{}
+	rm := NewFirewallRuleManager(fw)
+
+	meta := FirewallRuleMetadata{ClientUUID: "c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43", Duration: time.Hour}
+	rule := func(port int) FirewallRule {
+		return FirewallRule{Proto: FirewallProtoTCP, SrcIP: net.IPv4(1, 2, 3, 4), DstIP: net.IPv4(1, 1, 1, 1),
+			DstPortStart: port}
+	}
+
+	// The rules are added concurrently, identical rules are added once
+	fw.On("RuleAdd", rule(80), firewallRuleManagerMeta(meta)).Return(nil).After(200 * time.Millisecond).Once()
+	fw.On("RuleAdd", rule(443), firewallRuleManagerMeta(meta)).Return(nil).After(200 * time.Millisecond).Once()
+
+	ids := make([]string, 4)
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			g, err := rm.AddGrant(rule(80+(i%2)*363), meta)
+			assert.NoError(t, err)
+			ids[i] = g.ID
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+	assert.Equal(t, 2, rm.Count())
+	assert.Equal(t, ids[0], ids[2])
+	assert.Equal(t, ids[1], ids[3])
+	assert.NotEqual(t, ids[0], ids[1])
+	assert.Equal(t, 2, rm.metrics.rulesExtended.Get())
+
+	fw.AssertExpectations(t)
+}
+
+func TestFirewallRuleManager_AddWhileStopping(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &FirewallMock{}
+	rm := NewFirewallRuleManager(fw)
+	require.NoError(t, rm.Start())
+
+	meta := FirewallRuleMetadata{ClientUUID: "c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43", Duration: time.Hour}
+	r1 := FirewallRule{Proto: FirewallProtoTCP, SrcIP: net.IPv4(1, 2, 3, 4), DstIP: net.IPv4(1, 1, 1, 1),
+		DstPortStart: 80}
+	r2 := r1
+	r2.DstPortStart = 443
+
+	// The rule that is being added when the rule manager stops is removed by Stop
+	fw.On("RuleAdd", r1, firewallRuleManagerMeta(meta)).Return(nil).After(200 * time.Millisecond).Once()
+	fw.On("RuleRemove", r1, firewallRuleManagerMeta(meta)).Return(nil).Once()
+
+	added := make(chan error)
+	go func() {
+		_, err := rm.AddGrant(r1, meta)
+		added <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- rm.Stop()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The rules requested after Stop are refused, they would not be removed
+	_, err := rm.AddGrant(r2, meta)
+	assert.ErrorIs(t, err, ErrFirewallRuleManagerStopping)
+	_, err = rm.AddGrant(r1, meta)
+	assert.ErrorIs(t, err, ErrFirewallRuleManagerStopping)
+
+	assert.NoError(t, <-added)
+	assert.NoError(t, <-stopped)
+	assert.Equal(t, 0, rm.Count())
+
+	fw.AssertExpectations(t)
+}
+
+// firewallRemoveConcurrencyStub records the largest number of concurrent rule removals.
+type firewallRemoveConcurrencyStub struct {
+	FirewallStub
+	batching bool
+	active   int32
+	max      int32
+}
+
+func (f *firewallRemoveConcurrencyStub) Batching() bool {
+	return f.batching
+}
+
+func (f *firewallRemoveConcurrencyStub) RuleRemove(r FirewallRule, meta FirewallRuleMetadata) error {
+	n := atomic.AddInt32(&f.active, 1)
+	for {
+		m := atomic.LoadInt32(&f.max)
+		if n <= m || atomic.CompareAndSwapInt32(&f.max, m, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	atomic.AddInt32(&f.active, -1)
+	return nil
+}
+
+func TestFirewallRuleManager_RemoveRulesConcurrency(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	for _, batching := range []bool{false, true} {
+		fw := &firewallRemoveConcurrencyStub{batching: batching}
+		rm := NewFirewallRuleManager(fw)
+
+		grants := make([]*firewallRuleManagerGrant, 2*firewallRuleManagerRemoveWorkers)
+		for i := range grants {
+			grants[i] = &firewallRuleManagerGrant{FirewallRuleWithExpiration: FirewallRuleWithExpiration{
+				Rule: FirewallRule{Proto: FirewallProtoTCP, SrcIP: net.IPv4(1, 2, 3, 4), DstPortStart: i},
+			}}
+		}
+
+		for _, err := range rm.removeRules(grants) {
+			assert.NoError(t, err)
+		}
+
+		// Only a batching firewall removes the rules concurrently, with a bounded number of workers
+		if batching {
+			assert.Greater(t, fw.max, int32(1))
+			assert.LessOrEqual(t, fw.max, int32(firewallRuleManagerRemoveWorkers))
+		} else {
+			assert.Equal(t, int32(1), fw.max)
+		}
+	}
+}
+
+func TestFirewallRuleManager_ExpirationOrder(t *testing.T) {
+	rm := NewFirewallRuleManager(&FirewallStub{})
+
+	now := time.Now()
+	for i, d := range []time.Duration{time.Hour, time.Minute, -time.Minute, time.Second, -time.Hour} {
+		rm.insert(FirewallRuleWithExpiration{
+			ID:       strconv.Itoa(i),
+			Rule:     FirewallRule{Proto: FirewallProtoTCP, SrcIP: net.IPv4(1, 2, 3, 4), DstPortStart: i},
+			Duration: d,
+			Created:  now,
+		})
+	}
+
+	assert.Equal(t, "4", rm.expiration[0].ID)
+	assert.NoError(t, rm.cleanup())
+	assert.Equal(t, 3, rm.Count())
+	assert.Equal(t, "3", rm.expiration[0].ID)
+
+	rm.extend(rm.expiration[0], now.Add(2*time.Hour))
+	assert.Equal(t, "1", rm.expiration[0].ID)
+}
+
+func TestFirewallRuleManager_Grants(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &FirewallMock{}
+	rm := NewFirewallRuleManager(fw)
+
+	client1 := "c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43"
+	client2 := "0a6d1b3b-2d1e-4b7e-9c4a-6c3d2f1e0b9a"
+
+	fw.On("RuleAdd", mock.Anything, mock.Anything).Return(nil).Times(3)
+	for i, c := range []string{client1, client1, client2} {
+		r := FirewallRule{
+			Proto:        FirewallProtoTCP,
+			SrcIP:        net.IPv4(1, 2, 3, 4),
+			DstIP:        net.IPv4(1, 1, 1, 1),
+			DstPortStart: 80 + i,
+		}
+		assert.NoError(t, rm.Add(r, FirewallRuleMetadata{ClientUUID: c, Duration: time.Hour}))
+	}
+
+	grants := rm.Grants()
+	require.Len(t, grants, 3)
+	assert.Equal(t, 80, grants[0].Rule.DstPortStart)
+	assert.Equal(t, 82, grants[2].Rule.DstPortStart)
+
+	g, err := rm.Grant(grants[2].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, client2, g.Meta.ClientUUID)
+
+	_, err = rm.Grant("unknown")
+	assert.ErrorIs(t, err, ErrGrantNotFound)
+
+	g, err = rm.Extend(grants[2].ID, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, grants[2].Expiration().Add(time.Hour), g.Expiration())
+
+	_, err = rm.Extend(grants[2].ID, -time.Hour)
+	assert.Error(t, err)
+
+	fw.On("RuleRemove", grants[2].Rule, mock.Anything).Return(nil).Once()
+	assert.NoError(t, rm.Revoke(grants[2].ID))
+	assert.ErrorIs(t, rm.Revoke(grants[2].ID), ErrGrantNotFound)
+
+	fw.On("RuleRemove", mock.Anything, mock.Anything).Return(nil).Twice()
+	n, err := rm.RevokeClient(client1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 0, rm.Count())
+
+	fw.AssertExpectations(t)
+}
+
+func TestFirewallRuleManager_Journal(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	path := filepath.Join(t.TempDir(), "grants.journal")
+
+	active := grantJournalTestGrant("active", 22, time.Now().Add(-30*time.Minute), time.Hour)
+	expired := grantJournalTestGrant("expired", 80, time.Now().Add(-2*time.Hour), time.Hour)
+
+	j := NewGrantJournal(path)
+	_, err := j.Open()
+	require.NoError(t, err)
+	require.NoError(t, j.Add(active))
+	require.NoError(t, j.Add(expired))
+	require.NoError(t, j.Close())
+
+	fw := &FirewallMock{}
+	// The firewall is given the remaining duration of the restored grant
+	fw.On("RuleAdd", active.Rule, mock.MatchedBy(func(m FirewallRuleMetadata) bool {
+		d := m.Duration
+		m.Duration = active.Meta.Duration
+		return m == active.Meta && d > 29*time.Minute && d <= 30*time.Minute
+	})).Return(nil).Once()
+	fw.On("RuleRemove", expired.Rule, expired.Meta).Return(nil).Once()
+
+	rm := NewFirewallRuleManagerWithOpt(fw, FirewallRuleManagerOpt{Journal: NewGrantJournal(path), KeepRules: true})
+	require.NoError(t, rm.Start())
+	assert.Equal(t, 1, rm.Count())
+
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(1, 2, 3, 4),
+		DstIP:        net.IPv4(1, 1, 1, 1),
+		DstPortStart: 443,
+	}
+	meta := FirewallRuleMetadata{Duration: time.Hour}
+	fw.On("RuleAdd", r, firewallRuleManagerMeta(meta)).Return(nil).Once()
+	assert.NoError(t, rm.Add(r, meta))
+	assert.Equal(t, 2, rm.Count())
+
+	// Rules are kept in place
+	assert.NoError(t, rm.Stop())
+	fw.AssertExpectations(t)
+
+	fw2 := &FirewallMock{}
+	fw2.On("RuleAdd", mock.Anything, mock.Anything).Return(nil).Twice()
+	fw2.On("RuleRemove", mock.Anything, mock.Anything).Return(nil).Twice()
+
+	rm = NewFirewallRuleManagerWithOpt(fw2, FirewallRuleManagerOpt{Journal: NewGrantJournal(path)})
+	require.NoError(t, rm.Start())
+	assert.Equal(t, 2, rm.Count())
+
+	// Rules are removed along with their journal entries
+	assert.NoError(t, rm.Stop())
+	fw2.AssertExpectations(t)
+
+	j = NewGrantJournal(path)
+	grants, err := j.Open()
+	require.NoError(t, err)
+	assert.Len(t, grants, 0)
+	assert.NoError(t, j.Close())
+}
+
+func TestFirewallRuleManager_JournalExpiredRemoveFailed(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	path := filepath.Join(t.TempDir(), "grants.journal")
+
+	expired := grantJournalTestGrant("expired", 80, time.Now().Add(-2*time.Hour), time.Hour)
+
+	j := NewGrantJournal(path)
+	_, err := j.Open()
+	require.NoError(t, err)
+	require.NoError(t, j.Add(expired))
+	require.NoError(t, j.Close())
+
+	fw := &FirewallMock{}
+	fw.On("RuleRemove", expired.Rule, expired.Meta).Return(errors.New("test")).Once()
+
+	// The removal is retried and the grant is kept in the journal until the removal succeeds
+	rm := NewFirewallRuleManagerWithOpt(fw, FirewallRuleManagerOpt{Journal: NewGrantJournal(path), KeepRules: true})
+	require.NoError(t, rm.Start())
+	assert.Equal(t, 1, rm.Count())
+	rm.lock.Lock()
+	require.Contains(t, rm.removing, "expired")
+	rm.lock.Unlock()
+	assert.NoError(t, rm.Stop())
+	fw.AssertExpectations(t)
+
+	fw2 := &FirewallMock{}
+	fw2.On("RuleRemove", expired.Rule, expired.Meta).Return(nil).Once()
+
+	rm = NewFirewallRuleManagerWithOpt(fw2, FirewallRuleManagerOpt{Journal: NewGrantJournal(path)})
+	require.NoError(t, rm.Start())
+	assert.Equal(t, 0, rm.Count())
+	assert.NoError(t, rm.Stop())
+	fw2.AssertExpectations(t)
+
+	j = NewGrantJournal(path)
+	grants, err := j.Open()
+	require.NoError(t, err)
+	assert.Len(t, grants, 0)
+	assert.NoError(t, j.Close())
+}
+
 func BenchmarkFirewallRuleManagerCleanupWithoutRemove_10Rules(b *testing.B) {
 	firewallRuleManagerCleanup(b, 10, time.Hour)
 }
@@ -210,3 +630,66 @@ func firewallRuleManagerCleanup(b *testing.B, size int, dur time.Duration) {
 		}
 	}
 }
+
+func TestFirewallRuleManager_Audit(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &FirewallMock{}
+	audit := &AuditLoggerStub{}
+	rm := NewFirewallRuleManagerWithOpt(fw, FirewallRuleManagerOpt{Audit: audit})
+	require.NoError(t, rm.Start())
+
+	rule := func(port int) FirewallRule {
+		return FirewallRule{
+			Proto:        FirewallProtoTCP,
+			SrcIP:        net.IPv4(1, 2, 3, 4),
+			DstIP:        net.IPv4(1, 1, 1, 1),
+			DstPortStart: port,
+			DstPortEnd:   port,
+		}
+	}
+
+	fw.On("RuleAdd", mock.Anything, mock.Anything).Return(nil).Times(3)
+	fw.On("RuleRemove", mock.Anything, mock.Anything).Return(nil).Times(3)
+
+	require.NoError(t, rm.Add(rule(22), FirewallRuleMetadata{ClientUUID: "a", Duration: time.Second}))
+	require.NoError(t, rm.Add(rule(80), FirewallRuleMetadata{ClientUUID: "b", Duration: time.Hour}))
+	require.NoError(t, rm.Add(rule(443), FirewallRuleMetadata{ClientUUID: "c", Duration: time.Hour}))
+
+	time.Sleep(firewallRuleManagerExpirationTestingSleep + time.Second)
+	_, err := rm.RevokeClient("b")
+	require.NoError(t, err)
+	require.NoError(t, rm.Stop())
+
+	events := audit.Events()
+	require.Len(t, events, 3)
+	assert.Equal(t, AuditEventExpire, events[0].Event)
+	assert.Equal(t, "a", events[0].ClientUUID)
+	assert.Equal(t, 22, events[0].Granted.DstPortStart)
+	assert.NotEmpty(t, events[0].GrantID)
+	assert.Equal(t, AuditEventRevoke, events[1].Event)
+	assert.Equal(t, "b", events[1].ClientUUID)
+	assert.Equal(t, int64(3600), events[1].DurationSeconds)
+	assert.Equal(t, AuditEventRelease, events[2].Event)
+	assert.Equal(t, "c", events[2].ClientUUID)
+
+	fw.AssertExpectations(t)
+}
+
+func TestFirewallRuleManager_Health(t *testing.T) {
+	fw := &FirewallMock{}
+	rm := NewFirewallRuleManager(fw)
+
+	assert.Equal(t, HealthStatusStarting, rm.Health().Status)
+
+	assert.NoError(t, rm.Start())
+	assert.Equal(t, HealthStatusOK, rm.Health().Status)
+
+	rm.lock.Lock()
+	rm.lastCleanup = time.Now().Add(-2 * firewallRuleManagerCleanupStale)
+	rm.lock.Unlock()
+	assert.Equal(t, HealthStatusFailing, rm.Health().Status)
+
+	assert.NoError(t, rm.Stop())
+	assert.Equal(t, HealthStatusStarting, rm.Health().Status)
+}
@@ -1,21 +1,32 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"net"
+	"os/exec"
+	"time"
 
+	"github.com/greenstatic/openspa/internal/observability"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 )
 
 var _ Firewall = &FirewallCommand{}
+var _ FirewallRuleLister = &FirewallCommand{}
 
+// FirewallCommand executes a command per operation, with the operation's input as JSON on stdin. Alternatively (see
+// NewFirewallCommandPlugin) the operations are requests to a plugin, with the same JSON as the request's params.
 type FirewallCommand struct {
 	FirewallSetupCmd string
 	RuleAddCmd       string
 	RuleRemoveCmd    string
+	// RuleListCmd is optional, without it the rules can not be listed
+	RuleListCmd string
 
-	exec CommandExecuter
+	exec    CommandExecuter
+	plugin  *Plugin // nil if the commands are executed
+	metrics firewallMetrics
 }
 
 type FirewallCommandRuleAddInput struct {
@@ -39,26 +50,72 @@ type FirewallCommandRuleRemoveInput struct {
 	PortEnd        int    `json:"portEnd,omitempty"`
 }
 
+// FirewallCommandRuleListOutput is the output of the rule list command, each rule is in the format of the rule remove
+// command's input.
+type FirewallCommandRuleListOutput []FirewallCommandRuleRemoveInput
+
 func NewFirewallCommand(setupCmd, ruleAddCmd, ruleRemoveCmd string) *FirewallCommand {
 	fc := &FirewallCommand{
 		FirewallSetupCmd: setupCmd,
 		RuleAddCmd:       ruleAddCmd,
 		RuleRemoveCmd:    ruleRemoveCmd,
 		exec:             &CommandExecute{},
+		metrics:          newFirewallMetrics(),
+	}
+
+	return fc
+}
+
+// NewFirewallCommandPlugin returns a FirewallCommand that sends the operations to the plugin (PluginMethodRuleAdd,
+// PluginMethodRuleRemove, PluginMethodRuleList and PluginMethodFirewallSetup). The plugin has to respond to all of
+// them, e.g. with an empty result to the firewall setup request if there is nothing to set up.
+func NewFirewallCommandPlugin(p *Plugin) *FirewallCommand {
+	fc := &FirewallCommand{
+		plugin:  p,
+		metrics: newFirewallMetrics(),
 	}
 
 	return fc
 }
 
 func (fc *FirewallCommand) FirewallSetup() error {
-	if fc.FirewallSetupCmd == "" {
+	if fc.plugin != nil {
+		if err := fc.plugin.Start(); err != nil {
+			return errors.Wrap(err, "plugin start")
+		}
+	} else if fc.FirewallSetupCmd == "" {
 		return nil
 	}
 
-	_, err := fc.exec.Execute(fc.FirewallSetupCmd, nil)
+	start := time.Now()
+	_, err := fc.execute(PluginMethodFirewallSetup, fc.FirewallSetupCmd, nil)
+	fc.observeDuration(firewallOperationSetup, start)
 	return err
 }
 
+// Check verifies that the commands exist and are executable, or pings the plugin.
+func (fc *FirewallCommand) Check() error {
+	if fc.plugin != nil {
+		return fc.plugin.Check()
+	}
+
+	cmds := []string{fc.RuleAddCmd, fc.RuleRemoveCmd}
+	if fc.FirewallSetupCmd != "" {
+		cmds = append(cmds, fc.FirewallSetupCmd)
+	}
+	if fc.RuleListCmd != "" {
+		cmds = append(cmds, fc.RuleListCmd)
+	}
+
+	for _, cmd := range cmds {
+		if _, err := exec.LookPath(cmd); err != nil {
+			return errors.Wrap(err, "lookup command")
+		}
+	}
+
+	return nil
+}
+
 func (fc *FirewallCommand) RuleAdd(r FirewallRule, meta FirewallRuleMetadata) error {
 	input := FirewallCommandRuleAddInput{
 		ClientUUID:     meta.ClientUUID,
@@ -71,12 +128,9 @@ func (fc *FirewallCommand) RuleAdd(r FirewallRule, meta FirewallRuleMetadata) er
 		Duration:       int(meta.Duration.Seconds()),
 	}
 
-	stdin, err := json.Marshal(input)
-	if err != nil {
-		return errors.Wrap(err, "json marshal input")
-	}
-
-	output, err := fc.exec.Execute(fc.RuleAddCmd, stdin)
+	start := time.Now()
+	output, err := fc.execute(PluginMethodRuleAdd, fc.RuleAddCmd, input)
+	fc.observeDuration(firewallOperationRuleAdd, start)
 	if err != nil {
 		log.Warn().Msgf("Failed to add rule %s, external command output: %s", r.String(), output)
 		return errors.Wrap(err, "execute rule add command")
@@ -96,12 +150,9 @@ func (fc *FirewallCommand) RuleRemove(r FirewallRule, meta FirewallRuleMetadata)
 		PortEnd:        r.DstPortEnd,
 	}
 
-	stdin, err := json.Marshal(input)
-	if err != nil {
-		return errors.Wrap(err, "json marshal input")
-	}
-
-	output, err := fc.exec.Execute(fc.RuleRemoveCmd, stdin)
+	start := time.Now()
+	output, err := fc.execute(PluginMethodRuleRemove, fc.RuleRemoveCmd, input)
+	fc.observeDuration(firewallOperationRuleRemove, start)
 	if err != nil {
 		log.Warn().Msgf("Failed to remove rule %s, external command output: %s", r.String(), output)
 		return errors.Wrap(err, "execute rule remove command")
@@ -110,7 +161,80 @@ func (fc *FirewallCommand) RuleRemove(r FirewallRule, meta FirewallRuleMetadata)
 	return nil
 }
 
+// RuleList executes the rule list command, which outputs the rules (FirewallCommandRuleListOutput) as JSON.
+func (fc *FirewallCommand) RuleList() ([]FirewallRuleWithMetadata, error) {
+	if fc.plugin == nil && fc.RuleListCmd == "" {
+		return nil, ErrFirewallRuleListNotSupported
+	}
+
+	output, err := fc.execute(PluginMethodRuleList, fc.RuleListCmd, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "execute rule list command")
+	}
+
+	list := FirewallCommandRuleListOutput{}
+	if err := json.Unmarshal(output, &list); err != nil {
+		return nil, errors.Wrap(err, "json unmarshal output")
+	}
+
+	rules := make([]FirewallRuleWithMetadata, 0, len(list))
+	for _, l := range list {
+		rules = append(rules, FirewallRuleWithMetadata{
+			Rule: FirewallRule{
+				Proto:        l.TargetProtocol,
+				SrcIP:        l.ClientIP,
+				DstIP:        l.TargetIP,
+				DstPortStart: l.PortStart,
+				DstPortEnd:   l.PortEnd,
+			},
+			Meta: FirewallRuleMetadata{
+				ClientUUID: l.ClientUUID,
+			},
+		})
+	}
+
+	return rules, nil
+}
+
+// Stop stops the plugin, if any.
+func (fc *FirewallCommand) Stop() error {
+	if fc.plugin == nil {
+		return nil
+	}
+	return fc.plugin.Stop()
+}
+
+// execute sends the input to the plugin (as the method's params) or executes the command (with the input as JSON on
+// stdin, nothing if input is nil) and returns the output.
+func (fc *FirewallCommand) execute(method, cmd string, input interface{}) ([]byte, error) {
+	if fc.plugin != nil {
+		return fc.plugin.Call(context.Background(), method, input)
+	}
+
+	var stdin []byte
+	if input != nil {
+		b, err := json.Marshal(input)
+		if err != nil {
+			return nil, errors.Wrap(err, "json marshal input")
+		}
+		stdin = b
+	}
+
+	return fc.exec.Execute(cmd, stdin)
+}
+
+func (fc *FirewallCommand) observeDuration(operation string, start time.Time) {
+	observability.ObserveDurationVec(fc.metrics.duration, start, ServerConfigFirewallBackendCommand, operation)
+}
+
 func newFirewallCommandFromServerConfigFirewall(fc ServerConfigFirewall) (*FirewallCommand, error) {
+	if p := fc.Command.Plugin; p != nil {
+		if len(p.Command) == 0 {
+			return nil, errors.New("plugin command is empty")
+		}
+		return NewFirewallCommandPlugin(NewPlugin("firewall", p.Command, p.Settings())), nil
+	}
+
 	setup := fc.Command.FirewallSetup
 	add := fc.Command.RuleAdd
 	remove := fc.Command.RuleRemove
@@ -123,5 +247,7 @@ func newFirewallCommandFromServerConfigFirewall(fc ServerConfigFirewall) (*Firew
 		return nil, errors.New("rule remove command is empty")
 	}
 
-	return NewFirewallCommand(setup, add, remove), nil
+	c := NewFirewallCommand(setup, add, remove)
+	c.RuleListCmd = fc.Command.RuleList
+	return c, nil
 }
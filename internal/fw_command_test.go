@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/greenstatic/openspa/internal/observability"
 	"github.com/greenstatic/openspa/pkg/openspalib"
 	"github.com/stretchr/testify/assert"
 )
@@ -101,3 +102,75 @@ func TestFirewallCommand_RuleRemove(t *testing.T) {
 
 	exec.AssertExpectations(t)
 }
+
+func TestFirewallCommand_Check(t *testing.T) {
+	assert.NoError(t, NewFirewallCommand("", "true", "true").Check())
+	assert.Error(t, NewFirewallCommand("", "true", "openspa-command-that-does-not-exist").Check())
+	assert.Error(t, NewFirewallCommand("openspa-command-that-does-not-exist", "true", "true").Check())
+}
+
+func TestFirewallCommand_RuleList(t *testing.T) {
+	fc := NewFirewallCommand("setup-cmd", "rule-add", "rule-remove")
+	exec := &CommandExecuteMock{}
+	fc.exec = exec
+
+	_, err := fc.RuleList()
+	assert.ErrorIs(t, err, ErrFirewallRuleListNotSupported)
+
+	fc.RuleListCmd = "rule-list"
+	output := `[{"clientUUID":"c1","ipIsIPv6":false,"clientIP":"88.200.12.32","targetIP":"88.200.98.23",` +
+		`"targetProtocol":"TCP","portStart":80,"portEnd":1000}]`
+	exec.On("Execute", "rule-list", []byte(nil), []string(nil)).Return([]byte(output), nil).Once()
+
+	rules, err := fc.RuleList()
+	assert.NoError(t, err)
+	assert.Equal(t, []FirewallRuleWithMetadata{{
+		Rule: FirewallRule{
+			Proto:        FirewallProtoTCP,
+			SrcIP:        net.ParseIP("88.200.12.32"),
+			DstIP:        net.ParseIP("88.200.98.23"),
+			DstPortStart: 80,
+			DstPortEnd:   1000,
+		},
+		Meta: FirewallRuleMetadata{ClientUUID: "c1"},
+	}}, rules)
+
+	exec.On("Execute", "rule-list", []byte(nil), []string(nil)).Return([]byte("foo"), nil).Once()
+	_, err = fc.RuleList()
+	assert.Error(t, err)
+
+	exec.AssertExpectations(t)
+}
+
+func TestFirewallCommand_Plugin(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fc := NewFirewallCommandPlugin(pluginTestNew(t, PluginSettings{Timeout: 5 * time.Second}))
+	assert.NoError(t, fc.FirewallSetup())
+	assert.NoError(t, fc.Check())
+
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 22,
+	}
+	assert.NoError(t, fc.RuleAdd(r, FirewallRuleMetadata{ClientUUID: "c1", Duration: time.Minute}))
+	assert.NoError(t, fc.RuleRemove(r, FirewallRuleMetadata{ClientUUID: "c1"}))
+
+	// The plugin responds with an error
+	assert.Error(t, fc.RuleAdd(FirewallRule{Proto: FirewallProtoTCP, SrcIP: r.SrcIP, DstIP: r.DstIP},
+		FirewallRuleMetadata{}))
+
+	rules, err := fc.RuleList()
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 1) {
+		assert.True(t, rules[0].Rule.SrcIP.Equal(r.SrcIP))
+		assert.True(t, rules[0].Rule.DstIP.Equal(r.DstIP))
+		assert.Equal(t, 22, rules[0].Rule.DstPortStart)
+		assert.Equal(t, "c1", rules[0].Meta.ClientUUID)
+	}
+
+	assert.NoError(t, fc.Stop())
+	assert.Error(t, fc.Check())
+}
@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// firewallCompositeRollbackRetryInterval is how long to wait before retrying a failed rollback, the interval doubles
+	// with each failed attempt up to firewallCompositeRollbackRetryIntervalMax
+	firewallCompositeRollbackRetryInterval    = time.Second
+	firewallCompositeRollbackRetryIntervalMax = time.Minute
+)
+
+var _ Firewall = &FirewallComposite{}
+var _ FirewallRuleExtender = &FirewallComposite{}
+var _ FirewallSetupDryRunner = &FirewallComposite{}
+var _ FirewallBatcher = &FirewallComposite{}
+
+// FirewallComposite applies the rules to several firewall backends, in order. A rule is either added to all the
+// backends or to none: if a backend fails to add the rule, the rule is removed from the backends that added it (a
+// failed removal is retried until it succeeds). The composite can not list its rules, so the reconciliation is not
+// supported.
+type FirewallComposite struct {
+	backends []FirewallCompositeBackend
+
+	// removing are the backends (by index) that still have to remove a rule (by firewallRuleKey), after a removal
+	// failed on some of the backends. The removal is retried only on those.
+	removing map[string]map[int]struct{}
+	// rollingBack are the failed rollbacks (key is the rule's key and backend) that are being retried
+	rollingBack   map[string]struct{}
+	rollbackRetry time.Duration
+	stopped       bool
+	lock          sync.Mutex
+
+	stop      chan struct{}
+	rollbacks sync.WaitGroup
+	metrics   firewallCompositeMetrics
+}
+
+type FirewallCompositeBackend struct {
+	Name string // used in errors and metrics, e.g. ServerConfigFirewallBackendIPTables
+	FW   Firewall
+}
+
+type firewallCompositeMetrics struct {
+	firewallMetrics
+	rollbacks observability.Counter
+}
+
+func NewFirewallComposite(backends ...FirewallCompositeBackend) *FirewallComposite {
+	c := &FirewallComposite{
+		backends:      backends,
+		removing:      make(map[string]map[int]struct{}),
+		rollingBack:   make(map[string]struct{}),
+		rollbackRetry: firewallCompositeRollbackRetryInterval,
+		stop:          make(chan struct{}),
+		metrics:       newFirewallCompositeMetrics(),
+	}
+	return c
+}
+
+func (c *FirewallComposite) FirewallSetup() error {
+	start := time.Now()
+	defer c.observeDuration(firewallOperationSetup, start)
+
+	for _, b := range c.backends {
+		if err := b.FW.FirewallSetup(); err != nil {
+			return errors.Wrap(err, b.Name+" setup")
+		}
+	}
+
+	return nil
+}
+
+func (c *FirewallComposite) Check() error {
+	for _, b := range c.backends {
+		if err := b.FW.Check(); err != nil {
+			return errors.Wrap(err, b.Name)
+		}
+	}
+
+	return nil
+}
+
+// RuleAdd adds the rule to the backends in order. If a backend fails, the rule is removed from the preceding backends
+// (in reverse order). The rule has no grant to be removed with, so the failed removals are retried in the background
+// until they succeed or the rule is added again.
+func (c *FirewallComposite) RuleAdd(r FirewallRule, meta FirewallRuleMetadata) error {
+	start := time.Now()
+	defer c.observeDuration(firewallOperationRuleAdd, start)
+
+	// The backends that failed to remove the rule still have it
+	present := c.takeRemoving(r, meta)
+
+	for i, b := range c.backends {
+		if _, ok := present[i]; ok {
+			continue
+		}
+
+		err := b.FW.RuleAdd(r, meta)
+		if err == nil {
+			continue
+		}
+
+		c.metrics.rollbacks.Inc()
+		for j := i - 1; j >= 0; j-- {
+			if _, ok := present[j]; ok {
+				c.removeLater(r, meta, j)
+				continue
+			}
+
+			if rerr := c.backends[j].FW.RuleRemove(r, meta); rerr != nil {
+				log.Error().Err(rerr).Msgf("Composite firewall failed to roll back rule %s on %s", r.String(),
+					c.backends[j].Name)
+				c.rollbackLater(r, meta, j)
+			}
+		}
+
+		return errors.Wrap(err, b.Name+" rule add")
+	}
+
+	return nil
+}
+
+// RuleRemove removes the rule from all the backends, in order. If the removal fails on some of the backends, the next
+// removal of the rule is attempted only on those.
+func (c *FirewallComposite) RuleRemove(r FirewallRule, meta FirewallRuleMetadata) error {
+	start := time.Now()
+	defer c.observeDuration(firewallOperationRuleRemove, start)
+
+	pending := c.takeRemoving(r, meta)
+	retry := pending != nil
+
+	var failed []string
+	for i, b := range c.backends {
+		if _, ok := pending[i]; retry && !ok {
+			continue
+		}
+
+		if err := b.FW.RuleRemove(r, meta); err != nil {
+			log.Error().Err(err).Msgf("Composite firewall failed to remove rule %s on %s", r.String(), b.Name)
+			failed = append(failed, b.Name)
+			c.removeLater(r, meta, i)
+		}
+	}
+
+	if len(failed) != 0 {
+		return errors.Errorf("rule remove failed on %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// RuleExtend extends the rule on the backends that implement FirewallRuleExtender.
+func (c *FirewallComposite) RuleExtend(r FirewallRule, meta FirewallRuleMetadata) error {
+	for _, b := range c.backends {
+		ext, ok := b.FW.(FirewallRuleExtender)
+		if !ok {
+			continue
+		}
+
+		if err := ext.RuleExtend(r, meta); err != nil {
+			return errors.Wrap(err, b.Name+" rule extend")
+		}
+	}
+
+	return nil
+}
+
+// Batching returns true if one of the backends batches its operations.
+func (c *FirewallComposite) Batching() bool {
+	for _, b := range c.backends {
+		if bt, ok := b.FW.(FirewallBatcher); ok && bt.Batching() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetupDryRun returns the rules the backends' setup would install.
+func (c *FirewallComposite) SetupDryRun() string {
+	b := strings.Builder{}
+	for _, backend := range c.backends {
+		if d, ok := backend.FW.(FirewallSetupDryRunner); ok {
+			b.WriteString(d.SetupDryRun())
+		}
+	}
+
+	return b.String()
+}
+
+// Stop stops retrying the failed rollbacks and stops the backends that have to be stopped (e.g. plugins).
+func (c *FirewallComposite) Stop() error {
+	c.lock.Lock()
+	if !c.stopped {
+		c.stopped = true
+		close(c.stop)
+	}
+	c.lock.Unlock()
+	c.rollbacks.Wait()
+
+	var err error
+	for _, b := range c.backends {
+		if st, ok := b.FW.(stopper); ok {
+			if serr := st.Stop(); serr != nil && err == nil {
+				err = errors.Wrap(serr, b.Name+" stop")
+			}
+		}
+	}
+
+	return err
+}
+
+// takeRemoving returns (and unmarks) the backends that still have to remove the rule, nil if none.
+func (c *FirewallComposite) takeRemoving(r FirewallRule, meta FirewallRuleMetadata) map[int]struct{} {
+	key := firewallRuleKey(r, meta)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pending := c.removing[key]
+	delete(c.removing, key)
+	return pending
+}
+
+// removeLater marks the rule to be removed from the backend, by the next RuleRemove of the rule.
+func (c *FirewallComposite) removeLater(r FirewallRule, meta FirewallRuleMetadata, backend int) {
+	key := firewallRuleKey(r, meta)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.removing[key] == nil {
+		c.removing[key] = make(map[int]struct{})
+	}
+	c.removing[key][backend] = struct{}{}
+}
+
+// rollbackLater marks the rule to be removed from the backend and retries the removal in the background, unless it
+// is already being retried.
+func (c *FirewallComposite) rollbackLater(r FirewallRule, meta FirewallRuleMetadata, backend int) {
+	c.removeLater(r, meta, backend)
+
+	id := firewallRuleKey(r, meta) + " " + strconv.Itoa(backend)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.rollingBack[id]; ok || c.stopped {
+		return
+	}
+	c.rollingBack[id] = struct{}{}
+
+	c.rollbacks.Add(1)
+	go func() {
+		defer c.rollbacks.Done()
+		c.rollbackRetryRoutine(r, meta, backend)
+
+		c.lock.Lock()
+		delete(c.rollingBack, id)
+		c.lock.Unlock()
+	}()
+}
+
+// rollbackRetryRoutine retries the removal of the rule from the backend (with backoff) until it succeeds, the rule is
+// no longer marked to be removed from the backend (it was added or removed again) or the composite is stopped.
+func (c *FirewallComposite) rollbackRetryRoutine(r FirewallRule, meta FirewallRuleMetadata, backend int) {
+	key := firewallRuleKey(r, meta)
+	b := c.backends[backend]
+
+	wait := c.rollbackRetry
+	for attempt := 2; ; attempt++ {
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		// The lock is held during the removal, so that the rule is not added again meanwhile
+		c.lock.Lock()
+		if _, ok := c.removing[key][backend]; !ok {
+			c.lock.Unlock()
+			return
+		}
+		err := b.FW.RuleRemove(r, meta)
+		if err == nil {
+			delete(c.removing[key], backend)
+			if len(c.removing[key]) == 0 {
+				delete(c.removing, key)
+			}
+		}
+		c.lock.Unlock()
+
+		if err == nil {
+			log.Info().Msgf("Composite firewall rolled back rule %s on %s (attempts: %d)", r.String(), b.Name, attempt)
+			return
+		}
+
+		log.Error().Err(err).Msgf("Composite firewall failed to roll back rule %s on %s (attempts: %d)", r.String(),
+			b.Name, attempt)
+
+		wait *= 2
+		if wait > firewallCompositeRollbackRetryIntervalMax {
+			wait = firewallCompositeRollbackRetryIntervalMax
+		}
+	}
+}
+
+func (c *FirewallComposite) observeDuration(operation string, start time.Time) {
+	observability.ObserveDurationVec(c.metrics.duration, start, ServerConfigFirewallBackendComposite, operation)
+}
+
+func newFirewallCompositeMetrics() firewallCompositeMetrics {
+	m := firewallCompositeMetrics{firewallMetrics: newFirewallMetrics()}
+	mr := getMetricsRepository()
+
+	m.rollbacks = mr.Count("fw_composite_rollbacks", observability.NewLabels())
+	return m
+}
+
+func newFirewallCompositeFromServerConfigFirewall(fc ServerConfigFirewall) (*FirewallComposite, error) {
+	backends := make([]FirewallCompositeBackend, 0, len(fc.Backends))
+	for i, bc := range fc.Backends {
+		fw, err := NewFirewallFromServerConfigFirewall(bc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "backend %d (%s)", i, bc.Backend)
+		}
+
+		backends = append(backends, FirewallCompositeBackend{Name: bc.Backend, FW: fw})
+	}
+
+	return NewFirewallComposite(backends...), nil
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func firewallCompositeTestNew() (*FirewallComposite, *FirewallMock, *FirewallMock, *FirewallMock) {
+	fw1, fw2, fw3 := &FirewallMock{}, &FirewallMock{}, &FirewallMock{}
+	c := NewFirewallComposite(
+		FirewallCompositeBackend{Name: "fw1", FW: fw1},
+		FirewallCompositeBackend{Name: "fw2", FW: fw2},
+		FirewallCompositeBackend{Name: "fw3", FW: fw3},
+	)
+	return c, fw1, fw2, fw3
+}
+
+func firewallCompositeTestRule() (FirewallRule, FirewallRuleMetadata) {
+	return firewallTestRule(22), FirewallRuleMetadata{ClientUUID: "c1", GrantID: "g1", Duration: time.Minute}
+}
+
+func TestFirewallComposite_SetupAndCheck(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	c, fw1, fw2, fw3 := firewallCompositeTestNew()
+
+	fw1.On("FirewallSetup").Return(nil).Once()
+	fw2.On("FirewallSetup").Return(nil).Once()
+	fw3.On("FirewallSetup").Return(nil).Once()
+	assert.NoError(t, c.FirewallSetup())
+
+	fw1.On("Check").Return(nil).Once()
+	fw2.On("Check").Return(errors.New("test")).Once()
+	assert.EqualError(t, c.Check(), "fw2: test")
+
+	fw1.AssertExpectations(t)
+	fw2.AssertExpectations(t)
+	fw3.AssertExpectations(t)
+}
+
+func TestFirewallComposite_Batching(t *testing.T) {
+	c, _, _, _ := firewallCompositeTestNew()
+	assert.False(t, c.Batching())
+
+	c = NewFirewallComposite(
+		FirewallCompositeBackend{Name: "fw1", FW: &FirewallMock{}},
+		FirewallCompositeBackend{Name: "fw2", FW: &firewallRemoveConcurrencyStub{batching: true}},
+	)
+	assert.True(t, c.Batching())
+}
+
+func TestFirewallComposite_RuleAdd(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	c, fw1, fw2, fw3 := firewallCompositeTestNew()
+	r, meta := firewallCompositeTestRule()
+
+	fw1.On("RuleAdd", r, meta).Return(nil).Once()
+	fw2.On("RuleAdd", r, meta).Return(nil).Once()
+	fw3.On("RuleAdd", r, meta).Return(nil).Once()
+	assert.NoError(t, c.RuleAdd(r, meta))
+
+	fw1.AssertExpectations(t)
+	fw2.AssertExpectations(t)
+	fw3.AssertExpectations(t)
+}
+
+func TestFirewallComposite_RuleAddRollback(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	c, fw1, fw2, fw3 := firewallCompositeTestNew()
+	r, meta := firewallCompositeTestRule()
+
+	// The third backend fails, the rule is removed from the first two (in reverse order)
+	var removed []string
+	fw1.On("RuleAdd", r, meta).Return(nil).Once()
+	fw2.On("RuleAdd", r, meta).Return(nil).Once()
+	fw3.On("RuleAdd", r, meta).Return(errors.New("test")).Once()
+	fw2.On("RuleRemove", r, meta).Return(nil).Once().Run(func(mock.Arguments) { removed = append(removed, "fw2") })
+	fw1.On("RuleRemove", r, meta).Return(nil).Once().Run(func(mock.Arguments) { removed = append(removed, "fw1") })
+
+	assert.EqualError(t, c.RuleAdd(r, meta), "fw3 rule add: test")
+	assert.Equal(t, []string{"fw2", "fw1"}, removed)
+	assert.Equal(t, 1, c.metrics.rollbacks.Get())
+	assert.Len(t, c.removing, 0)
+
+	fw1.AssertExpectations(t)
+	fw2.AssertExpectations(t)
+	fw3.AssertExpectations(t)
+}
+
+func TestFirewallComposite_RuleAddRollbackFailed(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	c, fw1, fw2, fw3 := firewallCompositeTestNew()
+	r, meta := firewallCompositeTestRule()
+
+	// The rollback fails on the first backend, it still has the rule
+	fw1.On("RuleAdd", r, meta).Return(nil).Once()
+	fw2.On("RuleAdd", r, meta).Return(errors.New("test")).Once()
+	fw1.On("RuleRemove", r, meta).Return(errors.New("test")).Once()
+	assert.Error(t, c.RuleAdd(r, meta))
+	fw1.AssertExpectations(t)
+	fw2.AssertExpectations(t)
+
+	// Added again, the first backend is skipped
+	fw2.On("RuleAdd", r, meta).Return(nil).Once()
+	fw3.On("RuleAdd", r, meta).Return(nil).Once()
+	assert.NoError(t, c.RuleAdd(r, meta))
+	assert.Len(t, c.removing, 0)
+
+	fw1.AssertExpectations(t)
+	fw2.AssertExpectations(t)
+	fw3.AssertExpectations(t)
+}
+
+func TestFirewallComposite_RuleAddRollbackRetried(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	c, fw1, fw2, _ := firewallCompositeTestNew()
+	c.rollbackRetry = 10 * time.Millisecond
+	r, meta := firewallCompositeTestRule()
+
+	// Both the addition and the rollback fail, the rollback is retried until it succeeds
+	fw1.On("RuleAdd", r, meta).Return(nil).Once()
+	fw2.On("RuleAdd", r, meta).Return(errors.New("test")).Once()
+	fw1.On("RuleRemove", r, meta).Return(errors.New("test")).Times(3)
+	fw1.On("RuleRemove", r, meta).Return(nil).Once()
+	assert.Error(t, c.RuleAdd(r, meta))
+
+	assert.Eventually(t, func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return len(c.removing) == 0 && len(c.rollingBack) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, c.Stop())
+	fw1.AssertExpectations(t)
+	fw2.AssertExpectations(t)
+}
+
+func TestFirewallComposite_RuleAddRollbackRetryStopped(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	c, fw1, fw2, _ := firewallCompositeTestNew()
+	c.rollbackRetry = 10 * time.Millisecond
+	r, meta := firewallCompositeTestRule()
+
+	fw1.On("RuleAdd", r, meta).Return(nil).Once()
+	fw2.On("RuleAdd", r, meta).Return(errors.New("test")).Once()
+	fw1.On("RuleRemove", r, meta).Return(errors.New("test"))
+	assert.Error(t, c.RuleAdd(r, meta))
+
+	// The retries end once the composite is stopped, the rule is still marked to be removed
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, c.Stop())
+	assert.Len(t, c.rollingBack, 0)
+	assert.Len(t, c.removing, 1)
+}
+
+func TestFirewallComposite_RuleRemove(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	c, fw1, fw2, fw3 := firewallCompositeTestNew()
+	r, meta := firewallCompositeTestRule()
+
+	// A failure does not prevent the removal from the other backends
+	fw1.On("RuleRemove", r, meta).Return(nil).Once()
+	fw2.On("RuleRemove", r, meta).Return(errors.New("test")).Once()
+	fw3.On("RuleRemove", r, meta).Return(nil).Once()
+	assert.EqualError(t, c.RuleRemove(r, meta), "rule remove failed on fw2")
+
+	// The removal is retried only on the backend that failed
+	fw2.On("RuleRemove", r, meta).Return(nil).Once()
+	assert.NoError(t, c.RuleRemove(r, meta))
+	assert.Len(t, c.removing, 0)
+
+	fw1.AssertExpectations(t)
+	fw2.AssertExpectations(t)
+	fw3.AssertExpectations(t)
+}
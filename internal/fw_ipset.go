@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/pkg/errors"
+)
+
+const (
+	IPSetSetIPv4Default = "OPENSPA-ALLOW"
+	IPSetSetIPv6Default = "OPENSPA-ALLOW6"
+
+	ipsetSetType = "hash:ip,port,ip"
+	// ipsetPortRangeMax is the widest port range of a rule. The set holds an entry per port of the range, wider ranges
+	// would fill the set (65536 entries by default).
+	ipsetPortRangeMax = 1024
+)
+
+var _ Firewall = &IPSet{}
+var _ FirewallRuleExtender = &IPSet{}
+
+// IPSet adds the rules as entries (source IP, protocol and destination port, destination IP) of ipsets, one per address
+// family, with timeouts equal to the rule's duration. The sets are meant to be matched by the host's own iptables
+// rules, e.g.:
+//
+//	iptables -A INPUT -m set --match-set OPENSPA-ALLOW src,dst,dst -j ACCEPT
+//
+// The ICMP (and ICMPv6) rules allow echo requests. The identical rules of several grants share an entry, which is kept
+// until the last of them is removed.
+type IPSet struct {
+	c         CommandExecuter
+	Settings  IPSetSettings
+	metrics   firewallMetrics
+	conntrack firewallConntrack
+
+	// refs are the grants of the entries (key is the set and entry)
+	refs firewallElementRefs
+	// lock serializes the entry changes and guards refs
+	lock sync.Mutex
+}
+
+type IPSetSettings struct {
+	SetIPv4 string
+	SetIPv6 string
+}
+
+var IPSetSettingsDefault = IPSetSettings{
+	SetIPv4: IPSetSetIPv4Default,
+	SetIPv6: IPSetSetIPv6Default,
+}
+
+func NewIPSet(c CommandExecuter, s IPSetSettings) *IPSet {
+	set := &IPSet{
+		c:         c,
+		Settings:  s,
+		metrics:   newFirewallMetrics(),
+		conntrack: newFirewallConntrack(NewConntrackNetlink(), ServerConfigFirewallBackendIPSet),
+		refs:      newFirewallElementRefs(),
+	}
+
+	if set.Settings.SetIPv4 == "" || set.Settings.SetIPv6 == "" {
+		panic("ipset set is empty")
+	}
+
+	return set
+}
+
+func (s *IPSet) Check() error {
+	_, err := s.c.Execute(ipsetCommand(), nil, "version")
+	if err != nil {
+		return errors.Wrap(err, "ipset")
+	}
+
+	return nil
+}
+
+// FirewallSetup creates the sets if they are missing. Existing sets (and their entries) are kept.
+func (s *IPSet) FirewallSetup() error {
+	defer s.observeDuration(firewallOperationSetup, time.Now())
+
+	sets := []struct {
+		name   string
+		family string
+	}{
+		{s.Settings.SetIPv4, "inet"},
+		{s.Settings.SetIPv6, "inet6"},
+	}
+
+	for _, set := range sets {
+		// timeout 0 enables the per entry timeouts, entries without a timeout are permanent
+		_, err := s.c.Execute(ipsetCommand(), nil, "create", set.name, ipsetSetType, "family", set.family,
+			"timeout", "0", "-exist")
+		if err != nil {
+			return errors.Wrap(err, "ipset create "+set.name)
+		}
+	}
+
+	return nil
+}
+
+// RuleAdd adds the rule's entry. If the entry already exists, its timeout is replaced with the one of the latest
+// expiring grant of the entry.
+func (s *IPSet) RuleAdd(r FirewallRule, meta FirewallRuleMetadata) error {
+	set, entry, err := s.entry(r)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	timeout, _, undo := s.refs.add(set+" "+entry, meta, time.Now())
+
+	start := time.Now()
+	err = s.add(set, entry, timeout)
+	s.observeDuration(firewallOperationRuleAdd, start)
+	if err != nil {
+		undo()
+		return err
+	}
+
+	return nil
+}
+
+// RuleExtend replaces the timeout of the rule's entry (or adds the entry again if it has already expired).
+func (s *IPSet) RuleExtend(r FirewallRule, meta FirewallRuleMetadata) error {
+	return s.RuleAdd(r, meta)
+}
+
+// RuleRemove removes the rule's entry, it is not an error if the entry has already expired. The connection tracking
+// entries of the rule are removed as well, so that established connections are closed. If the entry is shared with
+// other grants, it is kept (and expires with the latest of them) along with the connections.
+func (s *IPSet) RuleRemove(r FirewallRule, meta FirewallRuleMetadata) error {
+	set, entry, err := s.entry(r)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	timeout, shared, undo := s.refs.remove(set+" "+entry, meta, time.Now())
+
+	start := time.Now()
+	if shared {
+		err = s.add(set, entry, timeout)
+	} else if _, err = s.c.Execute(ipsetCommand(), nil, "del", set, entry, "-exist"); err != nil {
+		err = errors.Wrap(err, "ipset del")
+	}
+	s.observeDuration(firewallOperationRuleRemove, start)
+	if err != nil {
+		undo()
+		return err
+	}
+
+	if !shared {
+		s.conntrack.delete(r)
+	}
+	return nil
+}
+
+// add adds the entry or replaces its timeout, the entry does not expire if the timeout is zero.
+func (s *IPSet) add(set, entry string, timeout time.Duration) error {
+	args := []string{"add", set, entry}
+	if timeout > 0 {
+		args = append(args, "timeout", strconv.Itoa(ipsetTimeout(timeout)))
+	}
+	args = append(args, "-exist")
+
+	if _, err := s.c.Execute(ipsetCommand(), nil, args...); err != nil {
+		return errors.Wrap(err, "ipset add")
+	}
+
+	return nil
+}
+
+// entry returns the set and the rule's entry in it, e.g. 10.0.0.1,tcp:80-88,10.0.0.2.
+func (s *IPSet) entry(r FirewallRule) (string, string, error) {
+	src6 := isIPv6(r.SrcIP)
+	dst6 := isIPv6(r.DstIP)
+	if src6 != dst6 {
+		return "", "", errors.New("src and dst are not same ip family")
+	}
+
+	set := s.Settings.SetIPv4
+	if src6 {
+		set = s.Settings.SetIPv6
+	}
+
+	var port string
+	switch r.Proto {
+	case FirewallProtoTCP, FirewallProtoUDP:
+		port = strconv.Itoa(r.DstPortStart)
+		if r.DstPortEnd != 0 && r.DstPortEnd != r.DstPortStart {
+			if r.DstPortEnd-r.DstPortStart+1 > ipsetPortRangeMax {
+				return "", "", errors.Errorf("port range wider than %d ports", ipsetPortRangeMax)
+			}
+			port = fmt.Sprintf("%d-%d", r.DstPortStart, r.DstPortEnd)
+		}
+	case FirewallProtoICMP, FirewallProtoICMPv6:
+		port = "echo-request"
+	default:
+		return "", "", errors.New("unsupported protocol")
+	}
+
+	entry := fmt.Sprintf("%s,%s:%s,%s", r.SrcIP.String(), strings.ToLower(r.Proto), port, r.DstIP.String())
+	return set, entry, nil
+}
+
+func (s *IPSet) observeDuration(operation string, start time.Time) {
+	observability.ObserveDurationVec(s.metrics.duration, start, ServerConfigFirewallBackendIPSet, operation)
+}
+
+// ipsetTimeout returns the timeout in seconds (rounded up, since 0 means no timeout).
+func ipsetTimeout(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func ipsetCommand() string {
+	return osEnvLookupOrDefault("IPSET_COMMAND", "ipset")
+}
+
+func newIPSetFromServerConfigFirewall(fc ServerConfigFirewall) (*IPSet, error) {
+	s := IPSetSettingsDefault
+	if fc.IPSet != nil {
+		if fc.IPSet.SetIPv4 != "" {
+			s.SetIPv4 = fc.IPSet.SetIPv4
+		}
+		if fc.IPSet.SetIPv6 != "" {
+			s.SetIPv6 = fc.IPSet.SetIPv6
+		}
+	}
+
+	if s.SetIPv4 == s.SetIPv6 {
+		return nil, errors.New("ipv4 and ipv6 sets are the same")
+	}
+
+	return NewIPSet(&CommandExecute{}, s), nil
+}
@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPSet_Check(t *testing.T) {
+	c := &CommandExecuteMock{}
+
+	c.On("Execute", "ipset", []byte(nil), []string{"version"}).Return([]byte{}, nil).Once()
+
+	s := NewIPSet(c, IPSetSettingsDefault)
+	assert.NoError(t, s.Check())
+
+	c.AssertExpectations(t)
+}
+
+func TestIPSet_FirewallSetup(t *testing.T) {
+	c := &CommandExecuteMock{}
+	s := NewIPSet(c, IPSetSettingsDefault)
+
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"create", IPSetSetIPv4Default, "hash:ip,port,ip", "family", "inet", "timeout", "0", "-exist",
+	}).Return([]byte{}, nil).Once()
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"create", IPSetSetIPv6Default, "hash:ip,port,ip", "family", "inet6", "timeout", "0", "-exist",
+	}).Return([]byte{}, nil).Once()
+
+	assert.NoError(t, s.FirewallSetup())
+	c.AssertExpectations(t)
+}
+
+func TestIPSet_FirewallSetupError(t *testing.T) {
+	c := &CommandExecuteMock{}
+	s := NewIPSet(c, IPSetSettingsDefault)
+
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"create", IPSetSetIPv4Default, "hash:ip,port,ip", "family", "inet", "timeout", "0", "-exist",
+	}).Return([]byte{}, errors.New("set exists with a different type")).Once()
+
+	assert.Error(t, s.FirewallSetup())
+	c.AssertExpectations(t)
+}
+
+func TestIPSet_IPv4RuleAddAndRemove(t *testing.T) {
+	c := &CommandExecuteMock{}
+	s := NewIPSet(c, IPSetSettingsDefault)
+	ct := &ConntrackDeleterMock{}
+	s.conntrack.deleter = ct
+
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"add", IPSetSetIPv4Default, "88.200.23.12,tcp:443,88.200.23.3", "timeout", "30", "-exist",
+	}).Return([]byte{}, nil).Once()
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 443,
+	}
+	assert.NoError(t, s.RuleAdd(r, FirewallRuleMetadata{Duration: 29500 * time.Millisecond}))
+
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"del", IPSetSetIPv4Default, "88.200.23.12,tcp:443,88.200.23.3", "-exist",
+	}).Return([]byte{}, nil).Once()
+	ct.On("ConntrackDelete", r).Return(1, nil).Once()
+	assert.NoError(t, s.RuleRemove(r, FirewallRuleMetadata{}))
+
+	c.AssertExpectations(t)
+	ct.AssertExpectations(t)
+}
+
+func TestIPSet_IPv6RuleAddAndRemove(t *testing.T) {
+	c := &CommandExecuteMock{}
+	s := NewIPSet(c, IPSetSettingsDefault)
+	ct := &ConntrackDeleterMock{}
+	s.conntrack.deleter = ct
+
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"add", IPSetSetIPv6Default, "2001:1470:fffd:66::23:12,udp:5000-5010,2001:1470:fffd:66::23:3",
+		"timeout", "60", "-exist",
+	}).Return([]byte{}, nil).Once()
+	r := FirewallRule{
+		Proto:        FirewallProtoUDP,
+		SrcIP:        net.ParseIP("2001:1470:fffd:66::23:12"),
+		DstIP:        net.ParseIP("2001:1470:fffd:66::23:3"),
+		DstPortStart: 5000,
+		DstPortEnd:   5010,
+	}
+	assert.NoError(t, s.RuleAdd(r, FirewallRuleMetadata{Duration: time.Minute}))
+
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"del", IPSetSetIPv6Default, "2001:1470:fffd:66::23:12,udp:5000-5010,2001:1470:fffd:66::23:3", "-exist",
+	}).Return([]byte{}, nil).Once()
+	ct.On("ConntrackDelete", r).Return(1, nil).Once()
+	assert.NoError(t, s.RuleRemove(r, FirewallRuleMetadata{}))
+
+	c.AssertExpectations(t)
+	ct.AssertExpectations(t)
+}
+
+func TestIPSet_RuleAddICMPAndICMPv6(t *testing.T) {
+	c := &CommandExecuteMock{}
+	s := NewIPSet(c, IPSetSettingsDefault)
+
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"add", IPSetSetIPv4Default, "88.200.23.12,icmp:echo-request,88.200.23.3", "timeout", "10", "-exist",
+	}).Return([]byte{}, nil).Once()
+	assert.NoError(t, s.RuleAdd(FirewallRule{
+		Proto: FirewallProtoICMP,
+		SrcIP: net.IPv4(88, 200, 23, 12),
+		DstIP: net.IPv4(88, 200, 23, 3),
+	}, FirewallRuleMetadata{Duration: 10 * time.Second}))
+
+	// Without a duration the entry does not expire
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"add", IPSetSetIPv6Default, "2001:1470:fffd:66::23:12,icmpv6:echo-request,2001:1470:fffd:66::23:3", "-exist",
+	}).Return([]byte{}, nil).Once()
+	assert.NoError(t, s.RuleAdd(FirewallRule{
+		Proto: FirewallProtoICMPv6,
+		SrcIP: net.ParseIP("2001:1470:fffd:66::23:12"),
+		DstIP: net.ParseIP("2001:1470:fffd:66::23:3"),
+	}, FirewallRuleMetadata{}))
+
+	c.AssertExpectations(t)
+}
+
+func TestIPSet_RuleExtend(t *testing.T) {
+	c := &CommandExecuteMock{}
+	s := NewIPSet(c, IPSetSettingsDefault)
+
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"add", IPSetSetIPv4Default, "88.200.23.12,tcp:22,88.200.23.3", "timeout", "3600", "-exist",
+	}).Return([]byte{}, nil).Once()
+	assert.NoError(t, s.RuleExtend(FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 22,
+	}, FirewallRuleMetadata{Duration: time.Hour}))
+
+	c.AssertExpectations(t)
+}
+
+func TestIPSet_SharedEntry(t *testing.T) {
+	c := &CommandExecuteMock{}
+	s := NewIPSet(c, IPSetSettingsDefault)
+	ct := &ConntrackDeleterMock{}
+	s.conntrack.deleter = ct
+
+	// Two clients behind the same address request the same target
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 22,
+	}
+	meta1 := FirewallRuleMetadata{ClientUUID: "c1", GrantID: "g1", Duration: 2 * time.Hour}
+	meta2 := FirewallRuleMetadata{ClientUUID: "c2", GrantID: "g2", Duration: time.Hour}
+	entry := "88.200.23.12,tcp:22,88.200.23.3"
+
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"add", IPSetSetIPv4Default, entry, "timeout", "7200", "-exist",
+	}).Return([]byte{}, nil).Twice()
+	assert.NoError(t, s.RuleAdd(r, meta1))
+
+	// The entry keeps the timeout of the latest expiring grant
+	assert.NoError(t, s.RuleAdd(r, meta2))
+
+	// Removing a grant keeps the entry of the other, which expires with the remaining grant
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"add", IPSetSetIPv4Default, entry, "timeout", "3600", "-exist",
+	}).Return([]byte{}, nil).Once()
+	assert.NoError(t, s.RuleRemove(r, meta1))
+
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"del", IPSetSetIPv4Default, entry, "-exist",
+	}).Return([]byte{}, nil).Once()
+	ct.On("ConntrackDelete", r).Return(1, nil).Once()
+	assert.NoError(t, s.RuleRemove(r, meta2))
+
+	c.AssertExpectations(t)
+	ct.AssertExpectations(t)
+}
+
+func TestIPSet_RuleAddWidePortRange(t *testing.T) {
+	c := &CommandExecuteMock{}
+	s := NewIPSet(c, IPSetSettingsDefault)
+
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 1,
+		DstPortEnd:   65535,
+	}
+	assert.Error(t, s.RuleAdd(r, FirewallRuleMetadata{Duration: time.Hour}))
+
+	r.DstPortStart, r.DstPortEnd = 1024, 2047
+	c.On("Execute", "ipset", []byte(nil), []string{
+		"add", IPSetSetIPv4Default, "88.200.23.12,tcp:1024-2047,88.200.23.3", "timeout", "3600", "-exist",
+	}).Return([]byte{}, nil).Once()
+	assert.NoError(t, s.RuleAdd(r, FirewallRuleMetadata{Duration: time.Hour}))
+
+	c.AssertExpectations(t)
+}
+
+func TestIPSet_RuleAddMixedIPFamily(t *testing.T) {
+	c := &CommandExecuteMock{}
+	s := NewIPSet(c, IPSetSettingsDefault)
+
+	assert.Error(t, s.RuleAdd(FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.ParseIP("2001:1470:fffd:66::23:3"),
+		DstPortStart: 22,
+	}, FirewallRuleMetadata{Duration: time.Hour}))
+
+	c.AssertExpectations(t)
+}
+
+func TestNewIPSetFromServerConfigFirewall(t *testing.T) {
+	s, err := newIPSetFromServerConfigFirewall(ServerConfigFirewall{Backend: ServerConfigFirewallBackendIPSet})
+	assert.NoError(t, err)
+	assert.Equal(t, IPSetSettingsDefault, s.Settings)
+
+	s, err = newIPSetFromServerConfigFirewall(ServerConfigFirewall{
+		Backend: ServerConfigFirewallBackendIPSet,
+		IPSet:   &ServerConfigFirewallIPSet{SetIPv4: "FOO"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, IPSetSettings{SetIPv4: "FOO", SetIPv6: IPSetSetIPv6Default}, s.Settings)
+
+	_, err = newIPSetFromServerConfigFirewall(ServerConfigFirewall{
+		Backend: ServerConfigFirewallBackendIPSet,
+		IPSet:   &ServerConfigFirewallIPSet{SetIPv4: IPSetSetIPv6Default},
+	})
+	assert.Error(t, err)
+}
@@ -1,37 +1,84 @@
 package internal
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"net"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/greenstatic/openspa/internal/observability"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 )
 
 const (
-	IPTablesChainDefault = "OPENSPA-ALLOW"
+	IPTablesChainDefault       = "OPENSPA-ALLOW"
+	IPTablesBatchWindowDefault = 10 * time.Millisecond
+	IPTablesLockWaitDefault    = 5 * time.Second
+
+	// iptablesCommentPrefix starts the comments of the rules added by the backend
+	iptablesCommentPrefix = "openspa"
 )
 
 var _ Firewall = &IPTables{}
-
+var _ FirewallRuleLister = &IPTables{}
+var _ FirewallBatcher = &IPTables{}
+
+// IPTables adds the rules to a chain (of both iptables and ip6tables). Rule additions and removals are collected for
+// Settings.BatchWindow and applied in a single iptables-restore transaction per address family. The transaction only
+// adds the rules that are missing from the chain and removes the rules that are present (as iptables -C would check),
+// so that adding or removing a rule twice is not an error. Each rule is commented with the client and grant it
+// belongs to.
 type IPTables struct {
-	c        CommandExecuter
-	Settings IPTablesSettings
+	c         CommandExecuter
+	Settings  IPTablesSettings
+	metrics   firewallMetrics
+	conntrack firewallConntrack
+
+	batch     []*iptablesOp
+	batchLock sync.Mutex
+	// applyLock serializes the transactions, since each is based on the chain's rules at the time
+	applyLock sync.Mutex
 }
 
 type IPTablesSettings struct {
 	Chain string
+	// BatchWindow is how long the rule additions and removals are collected before they are applied, 0 applies them
+	// immediately
+	BatchWindow time.Duration
+	// LockWait is how long to wait for the xtables lock, 0 waits indefinitely
+	LockWait time.Duration
+	// Managed enables the managed mode (see IPTablesManagedSettings), optional
+	Managed *IPTablesManagedSettings
 }
 
 var IPTablesSettingsDefault = IPTablesSettings{
-	Chain: IPTablesChainDefault,
+	Chain:       IPTablesChainDefault,
+	BatchWindow: IPTablesBatchWindowDefault,
+	LockWait:    IPTablesLockWaitDefault,
+}
+
+// iptablesOp is a rule addition or removal waiting to be applied, the result is sent to done.
+type iptablesOp struct {
+	add  bool
+	ipv6 bool
+	r    FirewallRule
+	meta FirewallRuleMetadata
+	done chan error
 }
 
 func NewIPTables(c CommandExecuter, s IPTablesSettings) *IPTables {
 	ipt := &IPTables{
-		c:        c,
-		Settings: s,
+		c:         c,
+		Settings:  s,
+		metrics:   newFirewallMetrics(),
+		conntrack: newFirewallConntrack(NewConntrackNetlink(), ServerConfigFirewallBackendIPTables),
 	}
 
 	if ipt.Settings.Chain == "" {
@@ -42,144 +89,276 @@ func NewIPTables(c CommandExecuter, s IPTablesSettings) *IPTables {
 }
 
 func (ipt *IPTables) Check() error {
-	_, err := ipt.c.Execute(iptablesCommand(), nil, "-V")
-	if err != nil {
-		return errors.Wrap(err, "iptables")
-	}
-
-	_, err = ipt.c.Execute(ip6tablesCommand(), nil, "-V")
-	if err != nil {
-		return errors.Wrap(err, "ip6tables")
-	}
-
-	_, err = ipt.c.Execute(conntrackCommand(), nil, "-V")
-	if err != nil {
-		return errors.Wrap(err, "conntrack")
+	for _, cmd := range []string{iptablesCommand(), ip6tablesCommand(), iptablesRestoreCommand(),
+		ip6tablesRestoreCommand()} {
+		_, err := ipt.c.Execute(cmd, nil, "-V")
+		if err != nil {
+			return errors.Wrap(err, cmd)
+		}
 	}
 
 	return nil
 }
 
 func (ipt *IPTables) FirewallSetup() error {
-	_, err := ipt.c.Execute(iptablesCommand(), nil, "-F", ipt.Settings.Chain)
+	defer ipt.observeDuration(firewallOperationSetup, time.Now())
+
+	_, err := ipt.c.Execute(iptablesCommand(), nil, ipt.args("-F", ipt.Settings.Chain)...)
 	if err != nil {
-		_, err := ipt.c.Execute(iptablesCommand(), nil, "--new-chain", ipt.Settings.Chain)
+		_, err := ipt.c.Execute(iptablesCommand(), nil, ipt.args("--new-chain", ipt.Settings.Chain)...)
 		if err != nil {
 			return errors.Wrap(err, "iptables new chain")
 		}
 	}
 
-	_, err = ipt.c.Execute(ip6tablesCommand(), nil, "-F", ipt.Settings.Chain)
+	_, err = ipt.c.Execute(ip6tablesCommand(), nil, ipt.args("-F", ipt.Settings.Chain)...)
 	if err != nil {
-		_, err := ipt.c.Execute(ip6tablesCommand(), nil, "--new-chain", ipt.Settings.Chain)
+		_, err := ipt.c.Execute(ip6tablesCommand(), nil, ipt.args("--new-chain", ipt.Settings.Chain)...)
 		if err != nil {
 			return errors.Wrap(err, "ip6tables new chain")
 		}
 	}
 
+	if ipt.Settings.Managed != nil {
+		if err := ipt.managedSetup(); err != nil {
+			return errors.Wrap(err, "managed setup")
+		}
+	}
+
 	return nil
 }
 
-func (ipt *IPTables) RuleAdd(r FirewallRule, _ FirewallRuleMetadata) error {
-	cmd := iptablesCommand()
-	src6 := isIPv6(r.SrcIP)
-	dst6 := isIPv6(r.DstIP)
+// Stop removes the rules installed by the managed mode, if enabled.
+func (ipt *IPTables) Stop() error {
+	if ipt.Settings.Managed == nil {
+		return nil
+	}
+
+	return ipt.managedCleanup()
+}
+
+func (ipt *IPTables) RuleAdd(r FirewallRule, meta FirewallRuleMetadata) error {
+	defer ipt.observeDuration(firewallOperationRuleAdd, time.Now())
 
-	if src6 && dst6 {
-		cmd = ip6tablesCommand()
-	} else if src6 != dst6 {
-		return errors.New("src and dst are not same ip family")
+	ipv6, err := iptablesRuleFamily(r)
+	if err != nil {
+		return err
 	}
 
-	var args []string
-	//nolint:gocritic
-	if r.Proto == FirewallProtoTCP || r.Proto == FirewallProtoUDP {
-		args = []string{
-			"-A", ipt.Settings.Chain,
-			"-p", r.Proto,
-			"-s", r.SrcIP.String(),
-			"-d", r.DstIP.String(),
-			"--dport", ipt.portString(r),
-			"-j", "ACCEPT",
-		}
-	} else if r.Proto == FirewallProtoICMP || r.Proto == FirewallProtoICMPv6 {
-		args = []string{
-			"-A", ipt.Settings.Chain,
-			"-p", r.Proto,
-			"-s", r.SrcIP.String(),
-			"-d", r.DstIP.String(),
-			"-j", "ACCEPT",
-		}
-	} else {
-		return errors.New("unsupported protocol")
-	}
-
-	_, err := ipt.c.Execute(cmd, nil, args...)
+	return ipt.do(&iptablesOp{add: true, ipv6: ipv6, r: r, meta: meta})
+}
+
+// RuleRemove removes the rule (all of its copies) from the chain, it is not an error if the rule is not present. The
+// connection tracking entries of the rule are removed as well, so that established connections are closed.
+func (ipt *IPTables) RuleRemove(r FirewallRule, meta FirewallRuleMetadata) error {
+	start := time.Now()
+
+	ipv6, err := iptablesRuleFamily(r)
 	if err != nil {
-		return errors.Wrap(err, cmd)
+		return err
 	}
 
+	err = ipt.do(&iptablesOp{add: false, ipv6: ipv6, r: r, meta: meta})
+	ipt.observeDuration(firewallOperationRuleRemove, start)
+	if err != nil {
+		return err
+	}
+
+	ipt.conntrack.delete(r)
 	return nil
 }
 
-func (ipt *IPTables) RuleRemove(r FirewallRule, _ FirewallRuleMetadata) error {
-	cmd := iptablesCommand()
-	src6 := isIPv6(r.SrcIP)
-	dst6 := isIPv6(r.DstIP)
+// Batching returns true, the concurrent operations are applied together (even without a batch window, the operations
+// that arrive while a transaction is applied form the next batch).
+func (ipt *IPTables) Batching() bool {
+	return true
+}
 
-	if src6 && dst6 {
-		cmd = ip6tablesCommand()
-	} else if src6 != dst6 {
-		return errors.New("src and dst are not same ip family")
+// do adds the operation to the batch and waits until it is applied. The operation that starts a batch waits for the
+// batch window and applies the batch.
+func (ipt *IPTables) do(op *iptablesOp) error {
+	op.done = make(chan error, 1)
+
+	ipt.batchLock.Lock()
+	leader := len(ipt.batch) == 0
+	ipt.batch = append(ipt.batch, op)
+	ipt.batchLock.Unlock()
+
+	if leader {
+		if ipt.Settings.BatchWindow > 0 {
+			time.Sleep(ipt.Settings.BatchWindow)
+		}
+
+		ipt.batchLock.Lock()
+		ops := ipt.batch
+		ipt.batch = nil
+		ipt.batchLock.Unlock()
+
+		ipt.apply(ops)
 	}
 
-	var iptablesArgs []string
-	var conntrackArgs []string
-	//nolint:gocritic
-	if r.Proto == FirewallProtoTCP || r.Proto == FirewallProtoUDP {
-		iptablesArgs = []string{
-			"-D", ipt.Settings.Chain,
-			"-p", r.Proto,
-			"-s", r.SrcIP.String(),
-			"-d", r.DstIP.String(),
-			"--dport", ipt.portString(r),
-			"-j", "ACCEPT",
-		}
-		conntrackArgs = []string{
-			"-D",
-			"-p", r.Proto,
-			"-s", r.SrcIP.String(),
-			"-d", r.DstIP.String(),
-			"--dport", ipt.portString(r),
-		}
-	} else if r.Proto == FirewallProtoICMP || r.Proto == FirewallProtoICMPv6 {
-		iptablesArgs = []string{
-			"-D", ipt.Settings.Chain,
-			"-p", r.Proto,
-			"-s", r.SrcIP.String(),
-			"-d", r.DstIP.String(),
-			"-j", "ACCEPT",
-		}
-		conntrackArgs = []string{
-			"-D",
-			"-p", r.Proto,
-			"-s", r.SrcIP.String(),
-			"-d", r.DstIP.String(),
-		}
-	} else {
-		return errors.New("unsupported protocol")
-	}
-
-	_, err := ipt.c.Execute(cmd, nil, iptablesArgs...)
+	return <-op.done
+}
+
+// apply applies the operations (in order) in a transaction per address family and sends each operation the result of
+// its transaction.
+func (ipt *IPTables) apply(ops []*iptablesOp) {
+	ipt.applyLock.Lock()
+	defer ipt.applyLock.Unlock()
+	defer ipt.observeDuration(firewallOperationBatch, time.Now())
+
+	ops4 := make([]*iptablesOp, 0, len(ops))
+	ops6 := make([]*iptablesOp, 0, len(ops))
+	for _, op := range ops {
+		if op.ipv6 {
+			ops6 = append(ops6, op)
+		} else {
+			ops4 = append(ops4, op)
+		}
+	}
+
+	if len(ops4) > 0 {
+		ipt.applyOps(iptablesCommand(), iptablesRestoreCommand(), ops4)
+	}
+
+	if len(ops6) > 0 {
+		ipt.applyOps(ip6tablesCommand(), ip6tablesRestoreCommand(), ops6)
+	}
+}
+
+// applyOps applies the operations in a single transaction. If the transaction fails, the operations are applied one at
+// a time, so that an operation that can not be applied does not fail the others.
+func (ipt *IPTables) applyOps(cmd, restoreCmd string, ops []*iptablesOp) {
+	err := ipt.applyFamily(cmd, restoreCmd, ops)
+	if err == nil || len(ops) == 1 {
+		for _, op := range ops {
+			op.done <- err
+		}
+		return
+	}
+
+	log.Warn().Err(err).Msgf("Failed to apply a batch of %d %s operations, applying them one at a time", len(ops), cmd)
+	for _, op := range ops {
+		op.done <- ipt.applyFamily(cmd, restoreCmd, []*iptablesOp{op})
+	}
+}
+
+func (ipt *IPTables) applyFamily(cmd, restoreCmd string, ops []*iptablesOp) error {
+	specs, err := ipt.list(cmd)
+	if err != nil {
+		return err
+	}
+
+	present := make(map[iptablesRuleSpec]int)
+	for _, spec := range specs {
+		present[spec]++
+	}
+
+	b := &bytes.Buffer{}
+	for _, op := range ops {
+		spec := iptablesRuleSpecFromRule(op.r, op.meta)
+		rule := ipt.ruleArgs(op.r, op.meta)
+
+		if op.add {
+			if present[spec] == 0 {
+				fmt.Fprintf(b, "-A %s %s\n", ipt.Settings.Chain, rule)
+			}
+			present[spec]++
+			continue
+		}
+
+		for ; present[spec] > 0; present[spec]-- {
+			fmt.Fprintf(b, "-D %s %s\n", ipt.Settings.Chain, rule)
+		}
+	}
+
+	if b.Len() == 0 {
+		return nil
+	}
+
+	stdin := []byte("*filter\n" + b.String() + "COMMIT\n")
+	_, err = ipt.c.Execute(restoreCmd, stdin, ipt.args("--noflush")...)
 	if err != nil {
-		return errors.Wrap(err, cmd)
+		return errors.Wrap(err, restoreCmd)
 	}
-	_, _ = ipt.c.Execute(conntrackCommand(), nil, conntrackArgs...)
 
 	return nil
 }
 
+// list returns the accept rules of the chain.
+func (ipt *IPTables) list(cmd string) ([]iptablesRuleSpec, error) {
+	out, err := ipt.c.Execute(cmd, nil, ipt.args("-S", ipt.Settings.Chain)...)
+	if err != nil {
+		return nil, errors.Wrap(err, cmd+" list rules")
+	}
+
+	specs := make([]iptablesRuleSpec, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		if spec, ok := iptablesRuleSpecParse(ipt.Settings.Chain, line); ok {
+			specs = append(specs, spec)
+		}
+	}
+
+	return specs, nil
+}
+
+// RuleList lists the rules of the chain (of both iptables and ip6tables), the client UUID and grant ID are parsed from
+// the rule comments. Rules that were not added by the backend (e.g. without the comment or with a network address) are
+// skipped.
+func (ipt *IPTables) RuleList() ([]FirewallRuleWithMetadata, error) {
+	ipt.applyLock.Lock()
+	defer ipt.applyLock.Unlock()
+
+	rules := make([]FirewallRuleWithMetadata, 0)
+	for _, cmd := range []string{iptablesCommand(), ip6tablesCommand()} {
+		specs, err := ipt.list(cmd)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, spec := range specs {
+			r, ok := spec.rule()
+			if !ok {
+				log.Debug().Msgf("Skipping unknown %s rule of chain %s: %+v", cmd, ipt.Settings.Chain, spec)
+				continue
+			}
+			rules = append(rules, r)
+		}
+	}
+
+	return rules, nil
+}
+
+// ruleArgs returns the rule specification in iptables-restore format.
+func (ipt *IPTables) ruleArgs(r FirewallRule, meta FirewallRuleMetadata) string {
+	args := []string{"-p", r.Proto, "-s", r.SrcIP.String(), "-d", r.DstIP.String()}
+	if r.Proto == FirewallProtoTCP || r.Proto == FirewallProtoUDP {
+		args = append(args, "--dport", ipt.portString(r))
+	}
+	args = append(args, "-m", "comment", "--comment", `"`+iptablesComment(meta)+`"`, "-j", "ACCEPT")
+
+	return strings.Join(args, " ")
+}
+
+// args prepends the xtables lock wait argument.
+func (ipt *IPTables) args(args ...string) []string {
+	w := []string{"-w"}
+	if ipt.Settings.LockWait > 0 {
+		w = append(w, strconv.Itoa(int(math.Ceil(ipt.Settings.LockWait.Seconds()))))
+	}
+
+	return append(w, args...)
+}
+
+func (ipt *IPTables) observeDuration(operation string, start time.Time) {
+	observability.ObserveDurationVec(ipt.metrics.duration, start, ServerConfigFirewallBackendIPTables, operation)
+}
+
 func (ipt *IPTables) portString(r FirewallRule) string {
+	return iptablesPortString(r)
+}
+
+func iptablesPortString(r FirewallRule) string {
 	if r.DstPortStart == r.DstPortEnd {
 		return strconv.Itoa(r.DstPortStart)
 	}
@@ -191,6 +370,252 @@ func (ipt *IPTables) portString(r FirewallRule) string {
 	return fmt.Sprintf("%d:%d", r.DstPortStart, r.DstPortEnd)
 }
 
+// iptablesRuleFamily returns whether the rule is an IPv6 (ip6tables) rule. The rule is validated, so that an invalid
+// rule does not join (and fail) a batch.
+func iptablesRuleFamily(r FirewallRule) (bool, error) {
+	src6 := isIPv6(r.SrcIP)
+	dst6 := isIPv6(r.DstIP)
+	if src6 != dst6 {
+		return false, errors.New("src and dst are not same ip family")
+	}
+
+	switch r.Proto {
+	case FirewallProtoTCP, FirewallProtoUDP:
+		if r.DstPortStart < 0 || r.DstPortStart > 65535 || r.DstPortEnd > 65535 ||
+			(r.DstPortEnd != 0 && r.DstPortEnd < r.DstPortStart) {
+			return false, errors.New("invalid port range")
+		}
+	case FirewallProtoICMP, FirewallProtoICMPv6:
+	default:
+		return false, errors.New("unsupported protocol")
+	}
+
+	return src6, nil
+}
+
+// iptablesComment returns the comment of the rule, e.g. "openspa client=<client UUID> grant=<grant ID>". Characters
+// other than letters, digits, '-' and '_' are replaced, so that the comment does not need to be escaped.
+func iptablesComment(meta FirewallRuleMetadata) string {
+	c := iptablesCommentPrefix
+	if meta.ClientUUID != "" {
+		c += " client=" + iptablesCommentSanitize(meta.ClientUUID)
+	}
+	if meta.GrantID != "" {
+		c += " grant=" + iptablesCommentSanitize(meta.GrantID)
+	}
+
+	return c
+}
+
+// iptablesCommentParse returns the client UUID and grant ID of the comment (see iptablesComment).
+func iptablesCommentParse(c string) FirewallRuleMetadata {
+	meta := FirewallRuleMetadata{}
+
+	fields := strings.Fields(c)
+	if len(fields) == 0 || fields[0] != iptablesCommentPrefix {
+		return meta
+	}
+
+	for _, f := range fields[1:] {
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "client":
+			meta.ClientUUID = v
+		case "grant":
+			meta.GrantID = v
+		}
+	}
+
+	return meta
+}
+
+func iptablesCommentSanitize(s string) string {
+	const maxLen = 64
+	if len(s) > maxLen {
+		s = s[:maxLen]
+	}
+
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// iptablesRuleSpec identifies a rule of the chain, it is comparable between the rules we add and the rules listed
+// with iptables -S (which normalizes the addresses and protocol and adds implicit matches).
+type iptablesRuleSpec struct {
+	src     string
+	dst     string
+	proto   string
+	dport   string
+	comment string
+}
+
+func iptablesRuleSpecFromRule(r FirewallRule, meta FirewallRuleMetadata) iptablesRuleSpec {
+	spec := iptablesRuleSpec{
+		src:     r.SrcIP.String(),
+		dst:     r.DstIP.String(),
+		proto:   iptablesProtoNormalize(r.Proto),
+		comment: iptablesComment(meta),
+	}
+
+	if r.Proto == FirewallProtoTCP || r.Proto == FirewallProtoUDP {
+		spec.dport = iptablesPortString(r)
+	}
+
+	return spec
+}
+
+// rule returns the firewall rule of the specification, false if the specification is not a rule the backend adds.
+func (spec iptablesRuleSpec) rule() (FirewallRuleWithMetadata, bool) {
+	if spec.comment != iptablesCommentPrefix && !strings.HasPrefix(spec.comment, iptablesCommentPrefix+" ") {
+		return FirewallRuleWithMetadata{}, false
+	}
+
+	r := FirewallRule{
+		SrcIP: net.ParseIP(spec.src),
+		DstIP: net.ParseIP(spec.dst),
+	}
+	if r.SrcIP == nil || r.DstIP == nil {
+		return FirewallRuleWithMetadata{}, false
+	}
+
+	switch spec.proto {
+	case "tcp":
+		r.Proto = FirewallProtoTCP
+	case "udp":
+		r.Proto = FirewallProtoUDP
+	case "icmp":
+		r.Proto = FirewallProtoICMP
+	case "ipv6-icmp":
+		r.Proto = FirewallProtoICMPv6
+	default:
+		return FirewallRuleWithMetadata{}, false
+	}
+
+	if r.Proto == FirewallProtoTCP || r.Proto == FirewallProtoUDP {
+		start, end, hasEnd := strings.Cut(spec.dport, ":")
+		var err error
+		if r.DstPortStart, err = strconv.Atoi(start); err != nil {
+			return FirewallRuleWithMetadata{}, false
+		}
+		r.DstPortEnd = r.DstPortStart
+		if hasEnd {
+			if r.DstPortEnd, err = strconv.Atoi(end); err != nil {
+				return FirewallRuleWithMetadata{}, false
+			}
+		}
+	}
+
+	return FirewallRuleWithMetadata{Rule: r, Meta: iptablesCommentParse(spec.comment)}, true
+}
+
+// iptablesRuleSpecParse parses an accept rule of the chain listed with iptables -S, e.g.:
+//
+//	-A OPENSPA-ALLOW -s 10.0.0.1/32 -d 10.0.0.2/32 -p tcp -m tcp --dport 22 -m comment --comment openspa -j ACCEPT
+func iptablesRuleSpecParse(chain, line string) (iptablesRuleSpec, bool) {
+	args := iptablesSplitArgs(line)
+	if len(args) < 2 || args[0] != "-A" || args[1] != chain {
+		return iptablesRuleSpec{}, false
+	}
+
+	spec := iptablesRuleSpec{}
+	jump := ""
+	for i := 2; i+1 < len(args); i++ {
+		v := args[i+1]
+		switch args[i] {
+		case "-s":
+			spec.src = iptablesAddressNormalize(v)
+		case "-d":
+			spec.dst = iptablesAddressNormalize(v)
+		case "-p":
+			spec.proto = iptablesProtoNormalize(v)
+		case "--dport":
+			spec.dport = v
+		case "--comment":
+			spec.comment = v
+		case "-j":
+			jump = v
+		default:
+			continue
+		}
+		i++
+	}
+
+	return spec, jump == "ACCEPT"
+}
+
+// iptablesSplitArgs splits the line into arguments, double quoted arguments may contain spaces and backslash escapes.
+func iptablesSplitArgs(line string) []string {
+	args := make([]string, 0)
+	arg := strings.Builder{}
+	inArg, quoted, escaped := false, false, false
+
+	for _, c := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (c == ' ' || c == '\t' || c == '\n' || c == '\r'):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args
+}
+
+// iptablesAddressNormalize removes the host prefix length of an address (iptables -S lists 1.2.3.4 as 1.2.3.4/32).
+func iptablesAddressNormalize(s string) string {
+	addr, prefix, hasPrefix := strings.Cut(s, "/")
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return s
+	}
+
+	full := "32"
+	if isIPv6(ip) {
+		full = "128"
+	}
+	if hasPrefix && prefix != full {
+		return s
+	}
+
+	return ip.String()
+}
+
+func iptablesProtoNormalize(p string) string {
+	switch strings.ToLower(p) {
+	case "tcp", "6":
+		return "tcp"
+	case "udp", "17":
+		return "udp"
+	case "icmp", "1":
+		return "icmp"
+	case "icmpv6", "ipv6-icmp", "58":
+		return "ipv6-icmp"
+	}
+
+	return strings.ToLower(p)
+}
+
 func iptablesCommand() string {
 	return osEnvLookupOrDefault("IPTABLES_COMMAND", "iptables")
 }
@@ -199,8 +624,12 @@ func ip6tablesCommand() string {
 	return osEnvLookupOrDefault("IP6TABLES_COMMAND", "ip6tables")
 }
 
-func conntrackCommand() string {
-	return osEnvLookupOrDefault("CONNTRACK_COMMAND", "conntrack")
+func iptablesRestoreCommand() string {
+	return osEnvLookupOrDefault("IPTABLES_RESTORE_COMMAND", "iptables-restore")
+}
+
+func ip6tablesRestoreCommand() string {
+	return osEnvLookupOrDefault("IP6TABLES_RESTORE_COMMAND", "ip6tables-restore")
 }
 
 func osEnvLookupOrDefault(env, defaultVal string) string {
@@ -225,15 +654,13 @@ func execErrHandle(err error) error {
 }
 
 func newIPTablesFromServerConfigFirewall(fc ServerConfigFirewall) (*IPTables, error) {
-	chain := fc.IPTables.Chain
-
-	if len(chain) == 0 {
-		return nil, errors.New("missing chain")
+	if fc.IPTables == nil {
+		return nil, errors.New("missing iptables configuration")
 	}
 
-	ipt := NewIPTables(&CommandExecute{}, IPTablesSettings{
-		Chain: chain,
-	})
+	if err := fc.IPTables.Verify(); err != nil {
+		return nil, err
+	}
 
-	return ipt, nil
+	return NewIPTables(&CommandExecute{}, fc.IPTables.Settings()), nil
 }
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	IPTablesManagedChainDefault    = "OPENSPA-GUARD"
+	IPTablesManagedPositionDefault = 1
+
+	// iptablesManagedComment is the comment of the jumps to the managed chain
+	iptablesManagedComment = "openspa-managed"
+	// iptablesManagedJumpsMax bounds the number of (duplicate) jumps removed from a built-in chain
+	iptablesManagedJumpsMax = 16
+)
+
+var _ FirewallSetupDryRunner = &IPTables{}
+
+// IPTablesManagedSettings configure the managed mode, in which the backend installs (on setup) and removes (on stop)
+// the rules that protect the ports. The built-in chains (JumpFrom) jump to the managed chain, which:
+//   - accepts established and related traffic,
+//   - accepts the server's UDP port,
+//   - jumps to the chain of the grants (IPTablesSettings.Chain) and
+//   - drops the protected ports.
+type IPTablesManagedSettings struct {
+	Chain string
+	// JumpFrom are the built-in chains that jump to the managed chain, e.g. "INPUT" and/or "FORWARD"
+	JumpFrom []string
+	// Position of the jump in the built-in chains, 1 is the first rule
+	Position       int
+	ProtectedPorts []IPTablesProtectedPort
+	// ServerPort is the UDP port of the server, not accepted if 0
+	ServerPort int
+}
+
+type IPTablesProtectedPort struct {
+	Proto     string // FirewallProtoTCP or FirewallProtoUDP
+	PortStart int
+	PortEnd   int // optional
+}
+
+// SetupDryRun returns the rules FirewallSetup installs (in iptables-restore format), without installing them. Empty if
+// the backend is not managed, since then the setup only creates the chain.
+func (ipt *IPTables) SetupDryRun() string {
+	if ipt.Settings.Managed == nil {
+		return ""
+	}
+
+	b := strings.Builder{}
+	for _, cmd := range []string{iptablesCommand(), ip6tablesCommand()} {
+		fmt.Fprintf(&b, "# %s\n*filter\n:%s - [0:0]\n", cmd, ipt.Settings.Chain)
+		b.WriteString(ipt.managedChainRules())
+		for _, chain := range ipt.Settings.Managed.JumpFrom {
+			fmt.Fprintf(&b, "-I %s %d %s\n", chain, ipt.managedPosition(), strings.Join(ipt.managedJumpArgs(), " "))
+		}
+		b.WriteString("COMMIT\n")
+	}
+
+	return b.String()
+}
+
+// managedSetup (re)creates the managed chain and inserts the jumps to it, if they are missing.
+func (ipt *IPTables) managedSetup() error {
+	m := ipt.Settings.Managed
+	for _, cmd := range []struct{ cmd, restore string }{
+		{iptablesCommand(), iptablesRestoreCommand()},
+		{ip6tablesCommand(), ip6tablesRestoreCommand()},
+	} {
+		// Declaring the chain creates or flushes it
+		stdin := []byte("*filter\n" + ipt.managedChainRules() + "COMMIT\n")
+		if _, err := ipt.c.Execute(cmd.restore, stdin, ipt.args("--noflush")...); err != nil {
+			return errors.Wrap(err, cmd.restore+" managed chain")
+		}
+
+		for _, chain := range m.JumpFrom {
+			check := append([]string{"-C", chain}, ipt.managedJumpArgs()...)
+			if _, err := ipt.c.Execute(cmd.cmd, nil, ipt.args(check...)...); err == nil {
+				continue
+			}
+
+			args := append([]string{"-I", chain, strconv.Itoa(ipt.managedPosition())}, ipt.managedJumpArgs()...)
+			if _, err := ipt.c.Execute(cmd.cmd, nil, ipt.args(args...)...); err != nil {
+				return errors.Wrap(err, cmd.cmd+" insert jump to managed chain")
+			}
+		}
+	}
+
+	return nil
+}
+
+// managedCleanup removes the jumps and the managed chain, as well as the chain of the grants if it is empty (i.e. the
+// rules of the grants are not kept).
+func (ipt *IPTables) managedCleanup() error {
+	m := ipt.Settings.Managed
+	var err error
+	for _, cmd := range []string{iptablesCommand(), ip6tablesCommand()} {
+		for _, chain := range m.JumpFrom {
+			// Removes the duplicates as well, until there are none left
+			args := ipt.args(append([]string{"-D", chain}, ipt.managedJumpArgs()...)...)
+			for i := 0; i < iptablesManagedJumpsMax; i++ {
+				if _, derr := ipt.c.Execute(cmd, nil, args...); derr != nil {
+					break
+				}
+			}
+		}
+
+		if _, ferr := ipt.c.Execute(cmd, nil, ipt.args("-F", m.Chain)...); ferr != nil && err == nil {
+			err = errors.Wrap(ferr, cmd+" flush managed chain")
+		}
+		if _, xerr := ipt.c.Execute(cmd, nil, ipt.args("-X", m.Chain)...); xerr != nil && err == nil {
+			err = errors.Wrap(xerr, cmd+" delete managed chain")
+		}
+
+		if _, xerr := ipt.c.Execute(cmd, nil, ipt.args("-X", ipt.Settings.Chain)...); xerr != nil {
+			log.Info().Msgf("Chain %s of %s not deleted, the rules of the grants are kept", ipt.Settings.Chain, cmd)
+		}
+	}
+
+	return err
+}
+
+// managedChainRules returns the declaration and rules of the managed chain in iptables-restore format.
+func (ipt *IPTables) managedChainRules() string {
+	m := ipt.Settings.Managed
+
+	b := strings.Builder{}
+	fmt.Fprintf(&b, ":%s - [0:0]\n", m.Chain)
+	fmt.Fprintf(&b, "-A %s -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT\n", m.Chain)
+	if m.ServerPort != 0 {
+		fmt.Fprintf(&b, "-A %s -p udp --dport %d -j ACCEPT\n", m.Chain, m.ServerPort)
+	}
+	fmt.Fprintf(&b, "-A %s -j %s\n", m.Chain, ipt.Settings.Chain)
+	for _, p := range m.ProtectedPorts {
+		r := FirewallRule{Proto: p.Proto, DstPortStart: p.PortStart, DstPortEnd: p.PortEnd}
+		fmt.Fprintf(&b, "-A %s -p %s --dport %s -j DROP\n", m.Chain, strings.ToLower(p.Proto), iptablesPortString(r))
+	}
+
+	return b.String()
+}
+
+func (ipt *IPTables) managedJumpArgs() []string {
+	return []string{"-m", "comment", "--comment", iptablesManagedComment, "-j", ipt.Settings.Managed.Chain}
+}
+
+func (ipt *IPTables) managedPosition() int {
+	if ipt.Settings.Managed.Position <= 0 {
+		return IPTablesManagedPositionDefault
+	}
+	return ipt.Settings.Managed.Position
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func iptablesManagedTestSettings() IPTablesSettings {
+	s := IPTablesSettingsDefault
+	s.Managed = &IPTablesManagedSettings{
+		Chain:    IPTablesManagedChainDefault,
+		JumpFrom: []string{"INPUT", "FORWARD"},
+		Position: 2,
+		ProtectedPorts: []IPTablesProtectedPort{
+			{Proto: FirewallProtoTCP, PortStart: 22},
+			{Proto: FirewallProtoUDP, PortStart: 6000, PortEnd: 6010},
+		},
+		ServerPort: 22211,
+	}
+	return s
+}
+
+var iptablesManagedTestChain = iptablesTestRestoreInput(
+	":OPENSPA-GUARD - [0:0]",
+	"-A OPENSPA-GUARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+	"-A OPENSPA-GUARD -p udp --dport 22211 -j ACCEPT",
+	"-A OPENSPA-GUARD -j OPENSPA-ALLOW",
+	"-A OPENSPA-GUARD -p tcp --dport 22 -j DROP",
+	"-A OPENSPA-GUARD -p udp --dport 6000:6010 -j DROP",
+)
+
+func iptablesManagedTestJump(op, chain string, pos ...string) []string {
+	args := append([]string{op, chain}, pos...)
+	return iptablesTestArgs(append(args, "-m", "comment", "--comment", "openspa-managed", "-j", "OPENSPA-GUARD")...)
+}
+
+func TestIPTables_ManagedSetup(t *testing.T) {
+	c := &CommandExecuteMock{}
+
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		c.On("Execute", cmd, []byte(nil), iptablesTestArgs("-F", IPTablesChainDefault)).Return([]byte{}, nil).Once()
+		c.On("Execute", cmd+"-restore", iptablesManagedTestChain, iptablesTestArgs("--noflush")).
+			Return([]byte{}, nil).Once()
+
+		// The jump from INPUT is already there (e.g. after a restart), the jump from FORWARD is missing
+		c.On("Execute", cmd, []byte(nil), iptablesManagedTestJump("-C", "INPUT")).Return([]byte{}, nil).Once()
+		c.On("Execute", cmd, []byte(nil), iptablesManagedTestJump("-C", "FORWARD")).
+			Return([]byte{}, errors.New("exit status 1")).Once()
+		c.On("Execute", cmd, []byte(nil), iptablesManagedTestJump("-I", "FORWARD", "2")).Return([]byte{}, nil).Once()
+	}
+
+	ipt := NewIPTables(c, iptablesManagedTestSettings())
+	assert.NoError(t, ipt.FirewallSetup())
+
+	c.AssertExpectations(t)
+}
+
+func TestIPTables_ManagedSetupFailed(t *testing.T) {
+	c := &CommandExecuteMock{}
+
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-F", IPTablesChainDefault)).Return([]byte{}, nil).Once()
+	c.On("Execute", "ip6tables", []byte(nil), iptablesTestArgs("-F", IPTablesChainDefault)).Return([]byte{}, nil).Once()
+	c.On("Execute", "iptables-restore", iptablesManagedTestChain, iptablesTestArgs("--noflush")).
+		Return([]byte{}, errors.New("exit status 2")).Once()
+
+	ipt := NewIPTables(c, iptablesManagedTestSettings())
+	assert.Error(t, ipt.FirewallSetup())
+
+	c.AssertExpectations(t)
+}
+
+func TestIPTables_ManagedStop(t *testing.T) {
+	c := &CommandExecuteMock{}
+
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		// A duplicate jump from INPUT
+		c.On("Execute", cmd, []byte(nil), iptablesManagedTestJump("-D", "INPUT")).Return([]byte{}, nil).Twice()
+		c.On("Execute", cmd, []byte(nil), iptablesManagedTestJump("-D", "INPUT")).
+			Return([]byte{}, errors.New("exit status 1")).Once()
+		c.On("Execute", cmd, []byte(nil), iptablesManagedTestJump("-D", "FORWARD")).Return([]byte{}, nil).Once()
+		c.On("Execute", cmd, []byte(nil), iptablesManagedTestJump("-D", "FORWARD")).
+			Return([]byte{}, errors.New("exit status 1")).Once()
+
+		c.On("Execute", cmd, []byte(nil), iptablesTestArgs("-F", "OPENSPA-GUARD")).Return([]byte{}, nil).Once()
+		c.On("Execute", cmd, []byte(nil), iptablesTestArgs("-X", "OPENSPA-GUARD")).Return([]byte{}, nil).Once()
+	}
+
+	// The chain of the grants is deleted unless the rules of the grants are kept
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-X", IPTablesChainDefault)).Return([]byte{}, nil).Once()
+	c.On("Execute", "ip6tables", []byte(nil), iptablesTestArgs("-X", IPTablesChainDefault)).
+		Return([]byte{}, errors.New("exit status 1")).Once()
+
+	ipt := NewIPTables(c, iptablesManagedTestSettings())
+	assert.NoError(t, ipt.Stop())
+
+	c.AssertExpectations(t)
+}
+
+func TestIPTables_NotManaged(t *testing.T) {
+	c := &CommandExecuteMock{}
+
+	ipt := NewIPTables(c, IPTablesSettingsDefault)
+	assert.NoError(t, ipt.Stop())
+	assert.Equal(t, "", ipt.SetupDryRun())
+
+	c.AssertNumberOfCalls(t, "Execute", 0)
+}
+
+func TestIPTables_SetupDryRun(t *testing.T) {
+	ipt := NewIPTables(&CommandExecuteMock{}, iptablesManagedTestSettings())
+
+	family := `*filter
+:OPENSPA-ALLOW - [0:0]
+:OPENSPA-GUARD - [0:0]
+-A OPENSPA-GUARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A OPENSPA-GUARD -p udp --dport 22211 -j ACCEPT
+-A OPENSPA-GUARD -j OPENSPA-ALLOW
+-A OPENSPA-GUARD -p tcp --dport 22 -j DROP
+-A OPENSPA-GUARD -p udp --dport 6000:6010 -j DROP
+-I INPUT 2 -m comment --comment openspa-managed -j OPENSPA-GUARD
+-I FORWARD 2 -m comment --comment openspa-managed -j OPENSPA-GUARD
+COMMIT
+`
+	assert.Equal(t, "# iptables\n"+family+"# ip6tables\n"+family, ipt.SetupDryRun())
+}
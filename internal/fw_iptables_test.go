@@ -2,18 +2,35 @@ package internal
 
 import (
 	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
+const iptablesTestClientUUID = "c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43"
+
+var iptablesTestLockWait = []string{"-w", "5"}
+
+func iptablesTestArgs(args ...string) []string {
+	return append(append([]string{}, iptablesTestLockWait...), args...)
+}
+
+func iptablesTestRestoreInput(lines ...string) []byte {
+	return []byte("*filter\n" + strings.Join(lines, "\n") + "\nCOMMIT\n")
+}
+
 func TestIPTables_Check(t *testing.T) {
 	c := &CommandExecuteMock{}
 
 	c.On("Execute", "iptables", []byte(nil), []string{"-V"}).Return([]byte{}, nil).Once()
 	c.On("Execute", "ip6tables", []byte(nil), []string{"-V"}).Return([]byte{}, nil).Once()
-	c.On("Execute", "conntrack", []byte(nil), []string{"-V"}).Return([]byte{}, nil).Once()
+	c.On("Execute", "iptables-restore", []byte(nil), []string{"-V"}).Return([]byte{}, nil).Once()
+	c.On("Execute", "ip6tables-restore", []byte(nil), []string{"-V"}).Return([]byte{}, nil).Once()
 
 	ipt := NewIPTables(c, IPTablesSettingsDefault)
 	assert.NoError(t, ipt.Check())
@@ -24,138 +41,374 @@ func TestIPTables_Check(t *testing.T) {
 func TestIPTables_IPv4RuleAddAndRemove(t *testing.T) {
 	c := &CommandExecuteMock{}
 	ipt := NewIPTables(c, IPTablesSettingsDefault)
+	ct := &ConntrackDeleterMock{}
+	ipt.conntrack.deleter = ct
 
-	c.On("Execute", "iptables", []byte(nil), []string{
-		"-A", IPTablesChainDefault,
-		"-p", "TCP",
-		"-s", "88.200.23.12",
-		"-d", "88.200.23.3",
-		"--dport", "443",
-		"-j", "ACCEPT"}).Return([]byte{}, nil).Once()
 	r := FirewallRule{
 		Proto:        FirewallProtoTCP,
 		SrcIP:        net.IPv4(88, 200, 23, 12),
 		DstIP:        net.IPv4(88, 200, 23, 3),
 		DstPortStart: 443,
 	}
-	assert.NoError(t, ipt.RuleAdd(r, FirewallRuleMetadata{}))
-
-	c.On("Execute", "iptables", []byte(nil), []string{
-		"-D", IPTablesChainDefault,
-		"-p", "TCP",
-		"-s", "88.200.23.12",
-		"-d", "88.200.23.3",
-		"--dport", "443",
-		"-j", "ACCEPT"}).Return([]byte{}, nil).Once()
-	c.On("Execute", "conntrack", []byte(nil), []string{
-		"-D",
-		"-p", "TCP",
-		"-s", "88.200.23.12",
-		"-d", "88.200.23.3",
-		"--dport", "443"}).Return([]byte{}, nil).Once()
-
-	assert.NoError(t, ipt.RuleRemove(r, FirewallRuleMetadata{}))
+	meta := FirewallRuleMetadata{ClientUUID: iptablesTestClientUUID, GrantID: "g1", Duration: time.Hour}
+
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"), nil).Once()
+	c.On("Execute", "iptables-restore", iptablesTestRestoreInput(
+		"-A OPENSPA-ALLOW -p TCP -s 88.200.23.12 -d 88.200.23.3 --dport 443 -m comment "+
+			"--comment \"openspa client=c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43 grant=g1\" -j ACCEPT",
+	), iptablesTestArgs("--noflush")).Return([]byte{}, nil).Once()
+
+	assert.NoError(t, ipt.RuleAdd(r, meta))
+
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"+
+			"-A OPENSPA-ALLOW -s 88.200.23.12/32 -d 88.200.23.3/32 -p tcp -m tcp --dport 443 -m comment "+
+			"--comment \"openspa client=c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43 grant=g1\" -j ACCEPT\n"), nil).Once()
+	c.On("Execute", "iptables-restore", iptablesTestRestoreInput(
+		"-D OPENSPA-ALLOW -p TCP -s 88.200.23.12 -d 88.200.23.3 --dport 443 -m comment "+
+			"--comment \"openspa client=c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43 grant=g1\" -j ACCEPT",
+	), iptablesTestArgs("--noflush")).Return([]byte{}, nil).Once()
+	ct.On("ConntrackDelete", r).Return(1, nil).Once()
+
+	assert.NoError(t, ipt.RuleRemove(r, meta))
 
 	c.AssertExpectations(t)
+	ct.AssertExpectations(t)
 }
 
 func TestIPTables_IPv6RuleAddAndRemove(t *testing.T) {
 	c := &CommandExecuteMock{}
 	ipt := NewIPTables(c, IPTablesSettingsDefault)
+	ct := &ConntrackDeleterMock{}
+	ipt.conntrack.deleter = ct
 
-	c.On("Execute", "ip6tables", []byte(nil), []string{
-		"-A", IPTablesChainDefault,
-		"-p", "TCP",
-		"-s", "2001:1470:fffd:66::23:12",
-		"-d", "2001:1470:fffd:66::23:3",
-		"--dport", "443",
-		"-j", "ACCEPT"}).Return([]byte{}, nil).Once()
 	r := FirewallRule{
-		Proto:        FirewallProtoTCP,
+		Proto:        FirewallProtoUDP,
 		SrcIP:        net.ParseIP("2001:1470:fffd:66::23:12"),
 		DstIP:        net.ParseIP("2001:1470:fffd:66::23:3"),
-		DstPortStart: 443,
+		DstPortStart: 5000,
+		DstPortEnd:   5010,
 	}
-	assert.NoError(t, ipt.RuleAdd(r, FirewallRuleMetadata{}))
-
-	c.On("Execute", "ip6tables", []byte(nil), []string{
-		"-D", IPTablesChainDefault,
-		"-p", "TCP",
-		"-s", "2001:1470:fffd:66::23:12",
-		"-d", "2001:1470:fffd:66::23:3",
-		"--dport", "443",
-		"-j", "ACCEPT"}).Return([]byte{}, nil).Once()
-	c.On("Execute", "conntrack", []byte(nil), []string{
-		"-D",
-		"-p", "TCP",
-		"-s", "2001:1470:fffd:66::23:12",
-		"-d", "2001:1470:fffd:66::23:3",
-		"--dport", "443"}).Return([]byte{}, nil).Once()
-	assert.NoError(t, ipt.RuleRemove(r, FirewallRuleMetadata{}))
+	meta := FirewallRuleMetadata{ClientUUID: iptablesTestClientUUID, GrantID: "g1", Duration: time.Hour}
+
+	c.On("Execute", "ip6tables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"), nil).Once()
+	c.On("Execute", "ip6tables-restore", iptablesTestRestoreInput(
+		"-A OPENSPA-ALLOW -p UDP -s 2001:1470:fffd:66::23:12 -d 2001:1470:fffd:66::23:3 --dport 5000:5010 -m comment "+
+			"--comment \"openspa client=c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43 grant=g1\" -j ACCEPT",
+	), iptablesTestArgs("--noflush")).Return([]byte{}, nil).Once()
+
+	assert.NoError(t, ipt.RuleAdd(r, meta))
+
+	c.On("Execute", "ip6tables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"+
+			"-A OPENSPA-ALLOW -s 2001:1470:fffd:66::23:12/128 -d 2001:1470:fffd:66::23:3/128 -p udp -m udp "+
+			"--dport 5000:5010 -m comment "+
+			"--comment \"openspa client=c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43 grant=g1\" -j ACCEPT\n"), nil).Once()
+	c.On("Execute", "ip6tables-restore", iptablesTestRestoreInput(
+		"-D OPENSPA-ALLOW -p UDP -s 2001:1470:fffd:66::23:12 -d 2001:1470:fffd:66::23:3 --dport 5000:5010 -m comment "+
+			"--comment \"openspa client=c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43 grant=g1\" -j ACCEPT",
+	), iptablesTestArgs("--noflush")).Return([]byte{}, nil).Once()
+	ct.On("ConntrackDelete", r).Return(1, nil).Once()
+
+	assert.NoError(t, ipt.RuleRemove(r, meta))
 
 	c.AssertExpectations(t)
+	ct.AssertExpectations(t)
 }
 
-func TestIPTables_IPv4RuleAddRemoveICMPAndICMPv6(t *testing.T) {
+func TestIPTables_RuleAddICMPAndICMPv6(t *testing.T) {
 	c := &CommandExecuteMock{}
 	ipt := NewIPTables(c, IPTablesSettingsDefault)
 
-	c.On("Execute", "iptables", []byte(nil), []string{
-		"-A", IPTablesChainDefault,
-		"-p", "ICMP",
-		"-s", "88.200.23.12",
-		"-d", "88.200.23.3",
-		"-j", "ACCEPT"}).Return([]byte{}, nil).Once()
-	r := FirewallRule{
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"), nil).Once()
+	c.On("Execute", "iptables-restore", iptablesTestRestoreInput(
+		"-A OPENSPA-ALLOW -p ICMP -s 88.200.23.12 -d 88.200.23.3 -m comment --comment \"openspa\" -j ACCEPT",
+	), iptablesTestArgs("--noflush")).Return([]byte{}, nil).Once()
+
+	assert.NoError(t, ipt.RuleAdd(FirewallRule{
 		Proto:        FirewallProtoICMP,
 		SrcIP:        net.IPv4(88, 200, 23, 12),
 		DstIP:        net.IPv4(88, 200, 23, 3),
 		DstPortStart: 443,
-	}
-	assert.NoError(t, ipt.RuleAdd(r, FirewallRuleMetadata{}))
-
-	c.On("Execute", "iptables", []byte(nil), []string{
-		"-D", IPTablesChainDefault,
-		"-p", "ICMP",
-		"-s", "88.200.23.12",
-		"-d", "88.200.23.3",
-		"-j", "ACCEPT"}).Return([]byte{}, nil).Once()
-	c.On("Execute", "conntrack", []byte(nil), []string{
-		"-D",
-		"-p", "ICMP",
-		"-s", "88.200.23.12",
-		"-d", "88.200.23.3"}).Return([]byte{}, nil).Once()
-
-	assert.NoError(t, ipt.RuleRemove(r, FirewallRuleMetadata{}))
-
-	// ICMPv6
-	c.On("Execute", "iptables", []byte(nil), []string{
-		"-A", IPTablesChainDefault,
-		"-p", "ICMPv6",
-		"-s", "88.200.23.12",
-		"-d", "88.200.23.3",
-		"-j", "ACCEPT"}).Return([]byte{}, nil).Once()
-	r = FirewallRule{
-		Proto:        FirewallProtoICMPv6,
+	}, FirewallRuleMetadata{}))
+
+	c.On("Execute", "ip6tables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"), nil).Once()
+	c.On("Execute", "ip6tables-restore", iptablesTestRestoreInput(
+		"-A OPENSPA-ALLOW -p ICMPv6 -s 2001:1470:fffd:66::23:12 -d 2001:1470:fffd:66::23:3 -m comment "+
+			"--comment \"openspa grant=g1\" -j ACCEPT",
+	), iptablesTestArgs("--noflush")).Return([]byte{}, nil).Once()
+
+	assert.NoError(t, ipt.RuleAdd(FirewallRule{
+		Proto: FirewallProtoICMPv6,
+		SrcIP: net.ParseIP("2001:1470:fffd:66::23:12"),
+		DstIP: net.ParseIP("2001:1470:fffd:66::23:3"),
+	}, FirewallRuleMetadata{GrantID: "g1"}))
+
+	c.AssertExpectations(t)
+}
+
+func TestIPTables_Idempotent(t *testing.T) {
+	c := &CommandExecuteMock{}
+	ipt := NewIPTables(c, IPTablesSettingsDefault)
+	ct := &ConntrackDeleterMock{}
+	ipt.conntrack.deleter = ct
+
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
 		SrcIP:        net.IPv4(88, 200, 23, 12),
 		DstIP:        net.IPv4(88, 200, 23, 3),
 		DstPortStart: 443,
 	}
-	assert.NoError(t, ipt.RuleAdd(r, FirewallRuleMetadata{}))
-
-	c.On("Execute", "iptables", []byte(nil), []string{
-		"-D", IPTablesChainDefault,
-		"-p", "ICMPv6",
-		"-s", "88.200.23.12",
-		"-d", "88.200.23.3",
-		"-j", "ACCEPT"}).Return([]byte{}, nil).Once()
-	c.On("Execute", "conntrack", []byte(nil), []string{
-		"-D",
-		"-p", "ICMPv6",
-		"-s", "88.200.23.12",
-		"-d", "88.200.23.3"}).Return([]byte{}, nil).Once()
-
-	assert.NoError(t, ipt.RuleRemove(r, FirewallRuleMetadata{}))
+	meta := FirewallRuleMetadata{ClientUUID: iptablesTestClientUUID, GrantID: "g1", Duration: time.Hour}
+
+	// The rule is already present, it is not added again
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"+
+			"-A OPENSPA-ALLOW -s 88.200.23.12/32 -d 88.200.23.3/32 -p tcp -m tcp --dport 443 -m comment "+
+			"--comment \"openspa client=c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43 grant=g1\" -j ACCEPT\n"), nil).Once()
+	assert.NoError(t, ipt.RuleAdd(r, meta))
+
+	// The rule has been removed (e.g. by hand), removing it is not an error
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"), nil).Once()
+	ct.On("ConntrackDelete", r).Return(0, nil).Once()
+	assert.NoError(t, ipt.RuleRemove(r, meta))
+
+	c.AssertExpectations(t)
+	ct.AssertExpectations(t)
+}
+
+func TestIPTables_Batch(t *testing.T) {
+	c := &CommandExecuteMock{}
+	s := IPTablesSettingsDefault
+	s.BatchWindow = 200 * time.Millisecond
+	ipt := NewIPTables(c, s)
+
+	rules := []FirewallRule{
+		{Proto: FirewallProtoTCP, SrcIP: net.IPv4(88, 200, 23, 12), DstIP: net.IPv4(88, 200, 23, 3), DstPortStart: 22},
+		{Proto: FirewallProtoTCP, SrcIP: net.IPv4(88, 200, 23, 13), DstIP: net.IPv4(88, 200, 23, 3), DstPortStart: 22},
+		{Proto: FirewallProtoTCP, SrcIP: net.IPv4(88, 200, 23, 14), DstIP: net.IPv4(88, 200, 23, 3), DstPortStart: 22},
+		{Proto: FirewallProtoTCP, SrcIP: net.ParseIP("2001:1470:fffd:66::23:12"),
+			DstIP: net.ParseIP("2001:1470:fffd:66::23:3"), DstPortStart: 22},
+	}
+
+	restoreLines := func(n int) interface{} {
+		return mock.MatchedBy(func(b []byte) bool {
+			return strings.HasPrefix(string(b), "*filter\n") && strings.Count(string(b), "-A OPENSPA-ALLOW") == n
+		})
+	}
+
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"), nil).Once()
+	c.On("Execute", "iptables-restore", restoreLines(3), iptablesTestArgs("--noflush")).Return([]byte{}, nil).Once()
+	c.On("Execute", "ip6tables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"), nil).Once()
+	c.On("Execute", "ip6tables-restore", restoreLines(1), iptablesTestArgs("--noflush")).
+		Return([]byte{}, errors.New("simulate error")).Once()
+
+	errs := make([]error, len(rules))
+	wg := sync.WaitGroup{}
+	for i, r := range rules {
+		wg.Add(1)
+		go func(i int, r FirewallRule) {
+			defer wg.Done()
+			errs[i] = ipt.RuleAdd(r, FirewallRuleMetadata{ClientUUID: iptablesTestClientUUID})
+		}(i, r)
+	}
+	wg.Wait()
+
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+	assert.NoError(t, errs[2])
+	assert.Error(t, errs[3])
+
+	c.AssertExpectations(t)
+}
+
+func TestIPTables_BatchFailed(t *testing.T) {
+	c := &CommandExecuteMock{}
+	s := IPTablesSettingsDefault
+	s.BatchWindow = 200 * time.Millisecond
+	ipt := NewIPTables(c, s)
+
+	rules := []FirewallRule{
+		{Proto: FirewallProtoTCP, SrcIP: net.IPv4(88, 200, 23, 12), DstIP: net.IPv4(88, 200, 23, 3), DstPortStart: 22},
+		{Proto: FirewallProtoTCP, SrcIP: net.IPv4(88, 200, 23, 13), DstIP: net.IPv4(88, 200, 23, 3), DstPortStart: 22},
+		{Proto: FirewallProtoTCP, SrcIP: net.IPv4(88, 200, 23, 14), DstIP: net.IPv4(88, 200, 23, 3), DstPortStart: 22},
+	}
+
+	restore := func(n int, contains string) interface{} {
+		return mock.MatchedBy(func(b []byte) bool {
+			return strings.Count(string(b), "-A OPENSPA-ALLOW") == n && strings.Contains(string(b), contains)
+		})
+	}
+
+	// The transaction fails, the rules are added one at a time and only the failing one is an error
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"), nil).Times(4)
+	c.On("Execute", "iptables-restore", restore(3, ""), iptablesTestArgs("--noflush")).
+		Return([]byte{}, errors.New("simulate error")).Once()
+	c.On("Execute", "iptables-restore", restore(1, "-s 88.200.23.13 "), iptablesTestArgs("--noflush")).
+		Return([]byte{}, errors.New("simulate error")).Once()
+	c.On("Execute", "iptables-restore", restore(1, ""), iptablesTestArgs("--noflush")).Return([]byte{}, nil).Twice()
+
+	errs := make([]error, len(rules))
+	wg := sync.WaitGroup{}
+	for i, r := range rules {
+		wg.Add(1)
+		go func(i int, r FirewallRule) {
+			defer wg.Done()
+			errs[i] = ipt.RuleAdd(r, FirewallRuleMetadata{ClientUUID: iptablesTestClientUUID})
+		}(i, r)
+	}
+	wg.Wait()
+
+	assert.NoError(t, errs[0])
+	assert.Error(t, errs[1])
+	assert.NoError(t, errs[2])
+
+	c.AssertExpectations(t)
+}
+
+func TestIPTables_RuleAddInvalidPortRange(t *testing.T) {
+	c := &CommandExecuteMock{}
+	ipt := NewIPTables(c, IPTablesSettingsDefault)
+
+	// Refused before it joins a batch
+	assert.Error(t, ipt.RuleAdd(FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 23,
+		DstPortEnd:   22,
+	}, FirewallRuleMetadata{ClientUUID: iptablesTestClientUUID}))
+
+	c.AssertExpectations(t)
+}
+
+func TestIPTables_RuleAddMixedIPFamily(t *testing.T) {
+	c := &CommandExecuteMock{}
+	ipt := NewIPTables(c, IPTablesSettingsDefault)
+
+	assert.Error(t, ipt.RuleAdd(FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.ParseIP("2001:1470:fffd:66::23:3"),
+		DstPortStart: 22,
+	}, FirewallRuleMetadata{}))
+
+	c.AssertExpectations(t)
+}
+
+func TestIPTablesRuleSpecParse(t *testing.T) {
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.ParseIP("2001:1470:fffd:66::23:12"),
+		DstIP:        net.ParseIP("2001:1470:fffd:66::23:3"),
+		DstPortStart: 80,
+		DstPortEnd:   88,
+	}
+	meta := FirewallRuleMetadata{ClientUUID: iptablesTestClientUUID, GrantID: "g1"}
+
+	spec, ok := iptablesRuleSpecParse(IPTablesChainDefault, "-A OPENSPA-ALLOW -s 2001:1470:fffd:66:0:0:23:12/128 "+
+		"-d 2001:1470:fffd:66::23:3/128 -p tcp -m tcp --dport 80:88 -m comment "+
+		"--comment \"openspa client=c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43 grant=g1\" -j ACCEPT")
+	assert.True(t, ok)
+	assert.Equal(t, iptablesRuleSpecFromRule(r, meta), spec)
+
+	// Other chain
+	_, ok = iptablesRuleSpecParse(IPTablesChainDefault, "-A INPUT -s 10.0.0.1/32 -j ACCEPT")
+	assert.False(t, ok)
+
+	// Not an accept rule
+	_, ok = iptablesRuleSpecParse(IPTablesChainDefault, "-A OPENSPA-ALLOW -s 10.0.0.1/32 -j DROP")
+	assert.False(t, ok)
+
+	// Network instead of host address
+	spec, ok = iptablesRuleSpecParse(IPTablesChainDefault, "-A OPENSPA-ALLOW -s 10.0.0.0/8 -j ACCEPT")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.0/8", spec.src)
+}
+
+func TestIPTablesSplitArgs(t *testing.T) {
+	assert.Equal(t, []string{"-A", "FOO", "--comment", "a \"quoted\" comment", "-j", "ACCEPT"},
+		iptablesSplitArgs(`-A FOO  --comment "a \"quoted\" comment" -j ACCEPT`))
+	assert.Equal(t, []string{"--comment", ""}, iptablesSplitArgs(`--comment ""`))
+	assert.Len(t, iptablesSplitArgs(""), 0)
+}
+
+func TestIPTablesComment(t *testing.T) {
+	assert.Equal(t, "openspa", iptablesComment(FirewallRuleMetadata{}))
+	assert.Equal(t, "openspa client=c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43 grant=g1",
+		iptablesComment(FirewallRuleMetadata{ClientUUID: iptablesTestClientUUID, GrantID: "g1"}))
+	assert.Equal(t, "openspa client=foo__-j_DROP", iptablesComment(FirewallRuleMetadata{ClientUUID: "foo\" -j DROP"}))
+}
+
+func TestIPTablesCommentParse(t *testing.T) {
+	assert.Equal(t, FirewallRuleMetadata{ClientUUID: iptablesTestClientUUID, GrantID: "g1"},
+		iptablesCommentParse(iptablesComment(FirewallRuleMetadata{ClientUUID: iptablesTestClientUUID, GrantID: "g1"})))
+	assert.Equal(t, FirewallRuleMetadata{GrantID: "g1"}, iptablesCommentParse("openspa grant=g1"))
+	assert.Equal(t, FirewallRuleMetadata{}, iptablesCommentParse("openspa"))
+	assert.Equal(t, FirewallRuleMetadata{}, iptablesCommentParse("foo client=bar"))
+}
+
+func TestIPTables_RuleList(t *testing.T) {
+	c := &CommandExecuteMock{}
+	ipt := NewIPTables(c, IPTablesSettingsDefault)
+
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"+
+			"-A OPENSPA-ALLOW -s 88.200.23.12/32 -d 88.200.23.3/32 -p tcp -m tcp --dport 443 -m comment "+
+			"--comment \"openspa client=c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43 grant=g1\" -j ACCEPT\n"+
+			"-A OPENSPA-ALLOW -s 88.200.23.12/32 -d 88.200.23.3/32 -p udp -m udp --dport 5000:5010 -m comment "+
+			"--comment openspa -j ACCEPT\n"+
+			// Not added by the backend
+			"-A OPENSPA-ALLOW -s 88.200.23.12/32 -d 88.200.23.3/32 -p tcp -m tcp --dport 22 -j ACCEPT\n"+
+			"-A OPENSPA-ALLOW -s 88.200.23.0/24 -d 88.200.23.3/32 -p tcp -m tcp --dport 22 -m comment "+
+			"--comment openspa -j ACCEPT\n"), nil).Once()
+	c.On("Execute", "ip6tables", []byte(nil), iptablesTestArgs("-S", IPTablesChainDefault)).
+		Return([]byte("-N OPENSPA-ALLOW\n"+
+			"-A OPENSPA-ALLOW -s 2001:1470:fffd:66::23:12/128 -d 2001:1470:fffd:66::23:3/128 -p ipv6-icmp -m comment "+
+			"--comment \"openspa grant=g2\" -j ACCEPT\n"), nil).Once()
+
+	rules, err := ipt.RuleList()
+	assert.NoError(t, err)
+	assert.Len(t, rules, 3)
+
+	expect := []FirewallRuleWithMetadata{
+		{
+			Rule: FirewallRule{
+				Proto:        FirewallProtoTCP,
+				SrcIP:        net.ParseIP("88.200.23.12"),
+				DstIP:        net.ParseIP("88.200.23.3"),
+				DstPortStart: 443,
+				DstPortEnd:   443,
+			},
+			Meta: FirewallRuleMetadata{ClientUUID: iptablesTestClientUUID, GrantID: "g1"},
+		},
+		{
+			Rule: FirewallRule{
+				Proto:        FirewallProtoUDP,
+				SrcIP:        net.ParseIP("88.200.23.12"),
+				DstIP:        net.ParseIP("88.200.23.3"),
+				DstPortStart: 5000,
+				DstPortEnd:   5010,
+			},
+		},
+		{
+			Rule: FirewallRule{
+				Proto: FirewallProtoICMPv6,
+				SrcIP: net.ParseIP("2001:1470:fffd:66::23:12"),
+				DstIP: net.ParseIP("2001:1470:fffd:66::23:3"),
+			},
+			Meta: FirewallRuleMetadata{GrantID: "g2"},
+		},
+	}
+	assert.Equal(t, expect, rules)
 
 	c.AssertExpectations(t)
 }
@@ -190,8 +443,8 @@ func TestIPTables_PortString(t *testing.T) {
 func TestIPTables_Setup(t *testing.T) {
 	c := &CommandExecuteMock{}
 
-	c.On("Execute", "iptables", []byte(nil), []string{"-F", IPTablesChainDefault}).Return([]byte{}, nil).Once()
-	c.On("Execute", "ip6tables", []byte(nil), []string{"-F", IPTablesChainDefault}).Return([]byte{}, nil).Once()
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-F", IPTablesChainDefault)).Return([]byte{}, nil).Once()
+	c.On("Execute", "ip6tables", []byte(nil), iptablesTestArgs("-F", IPTablesChainDefault)).Return([]byte{}, nil).Once()
 
 	ipt := NewIPTables(c, IPTablesSettingsDefault)
 	assert.NoError(t, ipt.FirewallSetup())
@@ -202,12 +455,12 @@ func TestIPTables_Setup(t *testing.T) {
 func TestIPTables_SetupWithNonExistingIPTables(t *testing.T) {
 	c := &CommandExecuteMock{}
 
-	c.On("Execute", "iptables", []byte(nil), []string{"-F", IPTablesChainDefault}).
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-F", IPTablesChainDefault)).
 		Return([]byte{}, errors.New("simulate error")).Once()
 
-	c.On("Execute", "iptables", []byte(nil), []string{"--new-chain", IPTablesChainDefault}).
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("--new-chain", IPTablesChainDefault)).
 		Return([]byte{}, nil).Once()
-	c.On("Execute", "ip6tables", []byte(nil), []string{"-F", IPTablesChainDefault}).
+	c.On("Execute", "ip6tables", []byte(nil), iptablesTestArgs("-F", IPTablesChainDefault)).
 		Return([]byte{}, nil).Once()
 
 	ipt := NewIPTables(c, IPTablesSettingsDefault)
@@ -219,12 +472,12 @@ func TestIPTables_SetupWithNonExistingIPTables(t *testing.T) {
 func TestIPTables_SetupWithNonExistingIP6Tables(t *testing.T) {
 	c := &CommandExecuteMock{}
 
-	c.On("Execute", "iptables", []byte(nil), []string{"-F", IPTablesChainDefault}).
+	c.On("Execute", "iptables", []byte(nil), iptablesTestArgs("-F", IPTablesChainDefault)).
 		Return([]byte{}, nil).Once()
 
-	c.On("Execute", "ip6tables", []byte(nil), []string{"-F", IPTablesChainDefault}).
+	c.On("Execute", "ip6tables", []byte(nil), iptablesTestArgs("-F", IPTablesChainDefault)).
 		Return([]byte{}, errors.New("simulate error")).Once()
-	c.On("Execute", "ip6tables", []byte(nil), []string{"--new-chain", IPTablesChainDefault}).
+	c.On("Execute", "ip6tables", []byte(nil), iptablesTestArgs("--new-chain", IPTablesChainDefault)).
 		Return([]byte{}, nil).Once()
 
 	ipt := NewIPTables(c, IPTablesSettingsDefault)
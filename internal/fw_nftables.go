@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"encoding/binary"
+	"net"
+
+	lib "github.com/greenstatic/openspa/pkg/openspalib"
+	"github.com/pkg/errors"
+)
+
+const (
+	NFTablesTableDefault = "openspa"
+	NFTablesChainDefault = "allow"
+
+	NFTablesHookInput   = "input"
+	NFTablesHookForward = "forward"
+
+	// nftablesSetIPv4 and nftablesSetIPv6 are the sets of the allowed (saddr, daddr, proto, dport) elements
+	nftablesSetIPv4 = "allow_ipv4"
+	nftablesSetIPv6 = "allow_ipv6"
+)
+
+var ErrNFTablesNotSupported = errors.New("nftables is only supported on linux")
+
+type NFTablesSettings struct {
+	// Table is the name of the inet table that is managed by the backend
+	Table string
+	// Chain is the name of the base chain that accepts the packets matching the allowed sets
+	Chain string
+	// Hook of the chain, NFTablesHookInput or NFTablesHookForward
+	Hook string
+	// Priority of the chain, 0 is the priority of the filter chains
+	Priority int
+}
+
+var NFTablesSettingsDefault = NFTablesSettings{
+	Table: NFTablesTableDefault,
+	Chain: NFTablesChainDefault,
+	Hook:  NFTablesHookInput,
+}
+
+// nftablesSetElementKey returns the key of the rule's set element, the concatenation of the source address, destination
+// address, protocol and destination port (each field is padded to 4 bytes, as the nftables registers are). The key end
+// differs only in the port and is the upper bound of the port range. The port is zero for protocols without ports.
+func nftablesSetElementKey(r FirewallRule) (key, keyEnd []byte, ipv6 bool, err error) {
+	src6 := isIPv6(r.SrcIP)
+	dst6 := isIPv6(r.DstIP)
+	if src6 != dst6 {
+		return nil, nil, false, errors.New("src and dst are not same ip family")
+	}
+
+	src, dst := r.SrcIP.To4(), r.DstIP.To4()
+	if src6 {
+		src, dst = r.SrcIP.To16(), r.DstIP.To16()
+	}
+	if src == nil || dst == nil {
+		return nil, nil, false, errors.New("invalid ip")
+	}
+
+	proto, err := lib.InternetProtocolFromString(r.Proto)
+	if err != nil {
+		return nil, nil, false, errors.Wrap(err, "protocol")
+	}
+
+	portStart, portEnd := 0, 0
+	switch proto {
+	case lib.ProtocolTCP, lib.ProtocolUDP:
+		portStart, portEnd = r.DstPortStart, r.DstPortEnd
+		if portEnd == 0 {
+			portEnd = portStart
+		}
+		if portStart <= 0 || portEnd < portStart || portEnd > 65535 {
+			return nil, nil, false, errors.New("invalid port range")
+		}
+	case lib.ProtocolICMP, lib.ProtocolICMPv6:
+	default:
+		return nil, nil, false, errors.New("unsupported protocol")
+	}
+
+	prefix := make([]byte, 0, len(src)+len(dst)+4)
+	prefix = append(prefix, src...)
+	prefix = append(prefix, dst...)
+	prefix = append(prefix, proto.ToBin(), 0, 0, 0)
+
+	key = nftablesAppendPort(prefix, portStart)
+	keyEnd = nftablesAppendPort(prefix, portEnd)
+
+	return key, keyEnd, src6, nil
+}
+
+func nftablesAppendPort(prefix []byte, port int) []byte {
+	b := make([]byte, len(prefix), len(prefix)+4)
+	copy(b, prefix)
+
+	p := make([]byte, 4)
+	binary.BigEndian.PutUint16(p, uint16(port))
+	return append(b, p...)
+}
+
+// nftablesRuleFromSetElementKey is the inverse of nftablesSetElementKey, it returns the rule of the set element.
+func nftablesRuleFromSetElementKey(key, keyEnd []byte, ipv6 bool) (FirewallRule, error) {
+	addrLen := net.IPv4len
+	if ipv6 {
+		addrLen = net.IPv6len
+	}
+	if len(key) != 2*addrLen+8 || (len(keyEnd) != 0 && len(keyEnd) != len(key)) {
+		return FirewallRule{}, errors.New("invalid key length")
+	}
+	if len(keyEnd) == 0 {
+		keyEnd = key
+	}
+
+	proto, err := lib.InternetProtocolFromNumber(key[2*addrLen])
+	if err != nil {
+		return FirewallRule{}, errors.Wrap(err, "protocol")
+	}
+
+	r := FirewallRule{
+		Proto: proto.String(),
+		SrcIP: net.IP(append([]byte{}, key[:addrLen]...)),
+		DstIP: net.IP(append([]byte{}, key[addrLen:2*addrLen]...)),
+	}
+
+	switch proto {
+	case lib.ProtocolTCP, lib.ProtocolUDP:
+		r.DstPortStart = int(binary.BigEndian.Uint16(key[2*addrLen+4:]))
+		r.DstPortEnd = int(binary.BigEndian.Uint16(keyEnd[2*addrLen+4:]))
+	case lib.ProtocolICMP, lib.ProtocolICMPv6:
+	default:
+		return FirewallRule{}, errors.New("unsupported protocol")
+	}
+
+	return r, nil
+}
+
+func newNFTablesFromServerConfigFirewall(fc ServerConfigFirewall) (*NFTables, error) {
+	s := NFTablesSettingsDefault
+	if fc.NFTables != nil {
+		if fc.NFTables.Table != "" {
+			s.Table = fc.NFTables.Table
+		}
+		if fc.NFTables.Chain != "" {
+			s.Chain = fc.NFTables.Chain
+		}
+		if fc.NFTables.Hook != "" {
+			s.Hook = fc.NFTables.Hook
+		}
+		s.Priority = fc.NFTables.Priority
+	}
+
+	return NewNFTables(s)
+}
@@ -0,0 +1,432 @@
+//go:build linux
+
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/greenstatic/openspa/internal/observability"
+	lib "github.com/greenstatic/openspa/pkg/openspalib"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var _ Firewall = &NFTables{}
+var _ FirewallRuleExtender = &NFTables{}
+var _ FirewallRuleLister = &NFTables{}
+
+// NFTables manages the rules with netlink in an inet table. Each rule is an element of a typed set (one per address
+// family) with a timeout, so the kernel removes the rules once they expire even if the server is not running. The set
+// elements are matched by a base chain, which accepts the packets and leaves the rest to the remaining rule set. The
+// identical rules of several grants share an element, which is kept until the last of them is removed.
+type NFTables struct {
+	Settings NFTablesSettings
+
+	// netNS is the file descriptor of the network namespace, the current network namespace if 0
+	netNS     int
+	metrics   firewallMetrics
+	conntrack firewallConntrack
+
+	table *nftables.Table
+	chain *nftables.Chain
+	set4  *nftables.Set
+	set6  *nftables.Set
+
+	// refs are the grants of the set elements (key is nftablesElementKey())
+	refs firewallElementRefs
+	// lock serializes the netlink batches and guards refs
+	lock sync.Mutex
+}
+
+func NewNFTables(s NFTablesSettings) (*NFTables, error) {
+	if s.Table == "" {
+		return nil, errors.New("table is empty")
+	}
+
+	if s.Chain == "" {
+		return nil, errors.New("chain is empty")
+	}
+
+	hook := nftables.ChainHookInput
+	switch s.Hook {
+	case NFTablesHookInput:
+	case NFTablesHookForward:
+		hook = nftables.ChainHookForward
+	default:
+		return nil, errors.New("invalid hook")
+	}
+
+	key4, err := nftables.ConcatSetType(nftables.TypeIPAddr, nftables.TypeIPAddr, nftables.TypeInetProto,
+		nftables.TypeInetService)
+	if err != nil {
+		return nil, errors.Wrap(err, "ipv4 set type")
+	}
+
+	key6, err := nftables.ConcatSetType(nftables.TypeIP6Addr, nftables.TypeIP6Addr, nftables.TypeInetProto,
+		nftables.TypeInetService)
+	if err != nil {
+		return nil, errors.Wrap(err, "ipv6 set type")
+	}
+
+	nft := &NFTables{
+		Settings:  s,
+		metrics:   newFirewallMetrics(),
+		conntrack: newFirewallConntrack(NewConntrackNetlink(), ServerConfigFirewallBackendNFTables),
+		refs:      newFirewallElementRefs(),
+	}
+
+	policy := nftables.ChainPolicyAccept
+	nft.table = &nftables.Table{Name: s.Table, Family: nftables.TableFamilyINet}
+	nft.chain = &nftables.Chain{
+		Name:     s.Chain,
+		Table:    nft.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  hook,
+		Priority: nftables.ChainPriorityRef(nftables.ChainPriority(s.Priority)),
+		Policy:   &policy,
+	}
+	nft.set4 = nftablesAllowSet(nft.table, nftablesSetIPv4, key4)
+	nft.set6 = nftablesAllowSet(nft.table, nftablesSetIPv6, key6)
+
+	return nft, nil
+}
+
+func nftablesAllowSet(t *nftables.Table, name string, key nftables.SetDatatype) *nftables.Set {
+	return &nftables.Set{
+		Table:         t,
+		Name:          name,
+		KeyType:       key,
+		Concatenation: true,
+		Interval:      true, // port ranges
+		HasTimeout:    true,
+	}
+}
+
+func (nft *NFTables) conn() (*nftables.Conn, error) {
+	return nftables.New(nftables.WithNetNSFd(nft.netNS))
+}
+
+// Check verifies that the nftables netlink interface is reachable.
+func (nft *NFTables) Check() error {
+	c, err := nft.conn()
+	if err != nil {
+		return errors.Wrap(err, "netlink")
+	}
+
+	if _, err := c.ListTablesOfFamily(nftables.TableFamilyINet); err != nil {
+		return errors.Wrap(err, "list tables")
+	}
+
+	return nil
+}
+
+// FirewallSetup creates the table, sets and chain if they are missing and (re)creates the chain's rules. The set
+// elements are kept, they expire on their own.
+func (nft *NFTables) FirewallSetup() error {
+	defer nft.observeDuration(firewallOperationSetup, time.Now())
+
+	nft.lock.Lock()
+	defer nft.lock.Unlock()
+
+	c, err := nft.conn()
+	if err != nil {
+		return errors.Wrap(err, "netlink")
+	}
+
+	c.AddTable(nft.table)
+	if err := c.AddSet(nft.set4, nil); err != nil {
+		return errors.Wrap(err, "ipv4 set")
+	}
+	if err := c.AddSet(nft.set6, nil); err != nil {
+		return errors.Wrap(err, "ipv6 set")
+	}
+	c.AddChain(nft.chain)
+	c.FlushChain(nft.chain)
+
+	for _, r := range nft.rules() {
+		c.AddRule(r)
+	}
+
+	if err := c.Flush(); err != nil {
+		return errors.Wrap(err, "nftables setup")
+	}
+
+	return nil
+}
+
+// rules returns the rules of the chain, for each address family and protocol a rule that accepts the packets found in
+// the family's set.
+func (nft *NFTables) rules() []*nftables.Rule {
+	rules := make([]*nftables.Rule, 0, 6)
+	for _, proto := range []lib.InternetProtocolNumber{lib.ProtocolTCP, lib.ProtocolUDP, lib.ProtocolICMP} {
+		rules = append(rules, &nftables.Rule{
+			Table: nft.table,
+			Chain: nft.chain,
+			Exprs: nftablesRuleExprs(nft.set4, unix.NFPROTO_IPV4, 12, 4, proto),
+		})
+	}
+
+	for _, proto := range []lib.InternetProtocolNumber{lib.ProtocolTCP, lib.ProtocolUDP, lib.ProtocolICMPv6} {
+		rules = append(rules, &nftables.Rule{
+			Table: nft.table,
+			Chain: nft.chain,
+			Exprs: nftablesRuleExprs(nft.set6, unix.NFPROTO_IPV6, 8, 16, proto),
+		})
+	}
+
+	return rules
+}
+
+// nftablesRuleExprs returns the expressions of:
+//
+//	meta nfproto <family> meta l4proto <proto> ip saddr . ip daddr . meta l4proto . th dport @set accept
+//
+// For protocols without ports the port is zero. The source address is at addrOffset of the network header and is
+// followed by the destination address, both are addrLen long.
+func nftablesRuleExprs(set *nftables.Set, family byte, addrOffset, addrLen uint32,
+	proto lib.InternetProtocolNumber) []expr.Any {
+	// Concatenations are built in consecutive 32-bit registers
+	const regStart = 8 // NFT_REG32_00
+	regDst := regStart + addrLen/4
+	regProto := regDst + addrLen/4
+	regPort := regProto + 1
+
+	var port expr.Any = &expr.Immediate{Register: regPort, Data: []byte{0, 0, 0, 0}}
+	if proto == lib.ProtocolTCP || proto == lib.ProtocolUDP {
+		port = &expr.Payload{DestRegister: regPort, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2}
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto.ToBin()}},
+		&expr.Payload{DestRegister: regStart, Base: expr.PayloadBaseNetworkHeader, Offset: addrOffset, Len: addrLen},
+		&expr.Payload{DestRegister: regDst, Base: expr.PayloadBaseNetworkHeader, Offset: addrOffset + addrLen,
+			Len: addrLen},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: regProto},
+		port,
+		&expr.Lookup{SourceRegister: regStart, SetName: set.Name},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	}
+}
+
+// RuleAdd adds the rule's set element. If the element is shared with other grants, it is replaced with one that
+// expires with the latest of them.
+func (nft *NFTables) RuleAdd(r FirewallRule, meta FirewallRuleMetadata) error {
+	defer nft.observeDuration(firewallOperationRuleAdd, time.Now())
+
+	set, el, err := nft.setElement(r)
+	if err != nil {
+		return err
+	}
+
+	nft.lock.Lock()
+	defer nft.lock.Unlock()
+
+	timeout, shared, undo := nft.refs.add(nftablesElementKey(el), meta, time.Now())
+	el.Timeout = timeout
+
+	if shared {
+		err = nft.replaceElement(set, el)
+	} else {
+		err = nft.addElement(set, el)
+	}
+	if err != nil {
+		undo()
+		return err
+	}
+
+	return nil
+}
+
+// RuleRemove removes the rule's set element, it is not an error if the element has already expired. The connection
+// tracking entries of the rule are removed as well, so that established connections are closed. If the element is
+// shared with other grants, it is kept (and expires with the latest of them) along with the connections.
+func (nft *NFTables) RuleRemove(r FirewallRule, meta FirewallRuleMetadata) error {
+	removed, err := nft.ruleRemove(r, meta)
+	if err != nil {
+		return err
+	}
+
+	if removed {
+		nft.conntrack.delete(r)
+	}
+	return nil
+}
+
+// ruleRemove returns false if the element is kept for the other grants.
+func (nft *NFTables) ruleRemove(r FirewallRule, meta FirewallRuleMetadata) (bool, error) {
+	defer nft.observeDuration(firewallOperationRuleRemove, time.Now())
+
+	set, el, err := nft.setElement(r)
+	if err != nil {
+		return false, err
+	}
+
+	nft.lock.Lock()
+	defer nft.lock.Unlock()
+
+	timeout, shared, undo := nft.refs.remove(nftablesElementKey(el), meta, time.Now())
+	if shared {
+		el.Timeout = timeout
+		if err := nft.replaceElement(set, el); err != nil {
+			undo()
+			return false, err
+		}
+		return false, nil
+	}
+
+	if err := nft.deleteElement(set, el); err != nil {
+		undo()
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RuleExtend replaces the rule's set element with one that expires after meta.Duration (or later, if the element is
+// shared with a grant that expires later).
+func (nft *NFTables) RuleExtend(r FirewallRule, meta FirewallRuleMetadata) error {
+	set, el, err := nft.setElement(r)
+	if err != nil {
+		return err
+	}
+
+	nft.lock.Lock()
+	defer nft.lock.Unlock()
+
+	timeout, _, undo := nft.refs.add(nftablesElementKey(el), meta, time.Now())
+	el.Timeout = timeout
+
+	if err := nft.replaceElement(set, el); err != nil {
+		undo()
+		return err
+	}
+
+	return nil
+}
+
+// addElement needs to be called with lock held.
+func (nft *NFTables) addElement(set *nftables.Set, el nftables.SetElement) error {
+	c, err := nft.conn()
+	if err != nil {
+		return errors.Wrap(err, "netlink")
+	}
+
+	if err := c.SetAddElements(set, []nftables.SetElement{el}); err != nil {
+		return errors.Wrap(err, "set add element")
+	}
+
+	if err := c.Flush(); err != nil {
+		return errors.Wrap(err, "nftables add element")
+	}
+
+	return nil
+}
+
+// deleteElement needs to be called with lock held.
+func (nft *NFTables) deleteElement(set *nftables.Set, el nftables.SetElement) error {
+	c, err := nft.conn()
+	if err != nil {
+		return errors.Wrap(err, "netlink")
+	}
+
+	if err := c.SetDeleteElements(set, []nftables.SetElement{el}); err != nil {
+		return errors.Wrap(err, "set delete element")
+	}
+
+	if err := c.Flush(); err != nil && !errors.Is(err, unix.ENOENT) {
+		return errors.Wrap(err, "nftables delete element")
+	}
+
+	return nil
+}
+
+// replaceElement replaces the element (with a different timeout) in a single batch, so the rule is in effect the whole
+// time. If the element has already expired, it is added again. Needs to be called with lock held.
+func (nft *NFTables) replaceElement(set *nftables.Set, el nftables.SetElement) error {
+	c, err := nft.conn()
+	if err != nil {
+		return errors.Wrap(err, "netlink")
+	}
+
+	if err := c.SetDeleteElements(set, []nftables.SetElement{el}); err != nil {
+		return errors.Wrap(err, "set delete element")
+	}
+	if err := c.SetAddElements(set, []nftables.SetElement{el}); err != nil {
+		return errors.Wrap(err, "set add element")
+	}
+
+	err = c.Flush()
+	if errors.Is(err, unix.ENOENT) {
+		if err := c.SetAddElements(set, []nftables.SetElement{el}); err != nil {
+			return errors.Wrap(err, "set add element")
+		}
+		err = c.Flush()
+	}
+	if err != nil {
+		return errors.Wrap(err, "nftables replace element")
+	}
+
+	return nil
+}
+
+// RuleList lists the elements of the sets. The elements do not hold the client UUID and grant ID, so the metadata of
+// the rules is empty.
+func (nft *NFTables) RuleList() ([]FirewallRuleWithMetadata, error) {
+	nft.lock.Lock()
+	defer nft.lock.Unlock()
+
+	c, err := nft.conn()
+	if err != nil {
+		return nil, errors.Wrap(err, "netlink")
+	}
+
+	rules := make([]FirewallRuleWithMetadata, 0)
+	for _, set := range []*nftables.Set{nft.set4, nft.set6} {
+		elements, err := c.GetSetElements(set)
+		if err != nil {
+			return nil, errors.Wrapf(err, "set %s get elements", set.Name)
+		}
+
+		for _, el := range elements {
+			if el.IntervalEnd {
+				continue
+			}
+			r, err := nftablesRuleFromSetElementKey(el.Key, el.KeyEnd, set == nft.set6)
+			if err != nil {
+				return nil, errors.Wrapf(err, "set %s element", set.Name)
+			}
+			rules = append(rules, FirewallRuleWithMetadata{Rule: r})
+		}
+	}
+
+	return rules, nil
+}
+
+// setElement returns the rule's set and element, without a timeout.
+func (nft *NFTables) setElement(r FirewallRule) (*nftables.Set, nftables.SetElement, error) {
+	key, keyEnd, ipv6, err := nftablesSetElementKey(r)
+	if err != nil {
+		return nil, nftables.SetElement{}, err
+	}
+
+	set := nft.set4
+	if ipv6 {
+		set = nft.set6
+	}
+
+	return set, nftables.SetElement{Key: key, KeyEnd: keyEnd}, nil
+}
+
+func nftablesElementKey(el nftables.SetElement) string {
+	return string(el.Key) + string(el.KeyEnd)
+}
+
+func (nft *NFTables) observeDuration(operation string, start time.Time) {
+	observability.ObserveDurationVec(nft.metrics.duration, start, ServerConfigFirewallBackendNFTables, operation)
+}
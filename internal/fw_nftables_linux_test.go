@@ -0,0 +1,237 @@
+//go:build linux
+
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newNFTablesInNetNS returns a NFTables backend that manages a new (empty) network namespace.
+func newNFTablesInNetNS(t *testing.T) *NFTables {
+	t.Helper()
+
+	ns := newTestNetNS(t)
+
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	nft, err := NewNFTables(NFTablesSettingsDefault)
+	require.NoError(t, err)
+	nft.netNS = int(ns)
+	nft.conntrack = newFirewallConntrack(&ConntrackNetlink{netNS: int(ns)}, ServerConfigFirewallBackendNFTables)
+
+	if err := nft.Check(); err != nil {
+		t.Skipf("nftables not available: %v", err)
+	}
+
+	return nft
+}
+
+func nftablesTestSetElements(t *testing.T, nft *NFTables, set *nftables.Set) []nftables.SetElement {
+	t.Helper()
+
+	c, err := nft.conn()
+	require.NoError(t, err)
+
+	el, err := c.GetSetElements(set)
+	require.NoError(t, err)
+	return el
+}
+
+func nftablesTestRules(t *testing.T, nft *NFTables) []*nftables.Rule {
+	t.Helper()
+
+	c, err := nft.conn()
+	require.NoError(t, err)
+
+	rules, err := c.GetRules(nft.table, nft.chain)
+	require.NoError(t, err)
+	return rules
+}
+
+func TestNFTables_FirewallSetup(t *testing.T) {
+	nft := newNFTablesInNetNS(t)
+
+	require.NoError(t, nft.FirewallSetup())
+	assert.Len(t, nftablesTestRules(t, nft), 6)
+
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 443,
+	}
+	require.NoError(t, nft.RuleAdd(r, FirewallRuleMetadata{Duration: time.Hour}))
+
+	// Idempotent, the rules are not duplicated and the elements are kept
+	require.NoError(t, nft.FirewallSetup())
+	assert.Len(t, nftablesTestRules(t, nft), 6)
+	assert.Len(t, nftablesTestSetElements(t, nft, nft.set4), 1)
+}
+
+func TestNFTables_RuleAddAndRemove(t *testing.T) {
+	nft := newNFTablesInNetNS(t)
+	require.NoError(t, nft.FirewallSetup())
+
+	rules := []FirewallRule{
+		{
+			Proto:        FirewallProtoTCP,
+			SrcIP:        net.IPv4(88, 200, 23, 12),
+			DstIP:        net.IPv4(88, 200, 23, 3),
+			DstPortStart: 443,
+		},
+		{
+			Proto:        FirewallProtoUDP,
+			SrcIP:        net.IPv4(88, 200, 23, 12),
+			DstIP:        net.IPv4(88, 200, 23, 3),
+			DstPortStart: 5000,
+			DstPortEnd:   5010,
+		},
+		{
+			Proto: FirewallProtoICMP,
+			SrcIP: net.IPv4(88, 200, 23, 12),
+			DstIP: net.IPv4(88, 200, 23, 3),
+		},
+		{
+			Proto:        FirewallProtoTCP,
+			SrcIP:        net.ParseIP("2001:1470:fffd:66::23:12"),
+			DstIP:        net.ParseIP("2001:1470:fffd:66::23:3"),
+			DstPortStart: 22,
+		},
+	}
+
+	for _, r := range rules {
+		assert.NoError(t, nft.RuleAdd(r, FirewallRuleMetadata{Duration: time.Hour}), r.String())
+	}
+
+	el4 := nftablesTestSetElements(t, nft, nft.set4)
+	require.Len(t, el4, 3)
+	el6 := nftablesTestSetElements(t, nft, nft.set6)
+	require.Len(t, el6, 1)
+
+	key, keyEnd, _, err := nftablesSetElementKey(rules[3])
+	require.NoError(t, err)
+	assert.Equal(t, key, el6[0].Key)
+	assert.Equal(t, keyEnd, el6[0].KeyEnd)
+	assert.Greater(t, el6[0].Timeout, time.Duration(0))
+
+	for _, r := range rules {
+		assert.NoError(t, nft.RuleRemove(r, FirewallRuleMetadata{}), r.String())
+	}
+	assert.Len(t, nftablesTestSetElements(t, nft, nft.set4), 0)
+	assert.Len(t, nftablesTestSetElements(t, nft, nft.set6), 0)
+
+	// Already removed
+	assert.NoError(t, nft.RuleRemove(rules[0], FirewallRuleMetadata{}))
+}
+
+func TestNFTables_RuleExpirationAndExtend(t *testing.T) {
+	nft := newNFTablesInNetNS(t)
+	require.NoError(t, nft.FirewallSetup())
+
+	r1 := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 443,
+	}
+	r2 := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 13),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 443,
+	}
+
+	require.NoError(t, nft.RuleAdd(r1, FirewallRuleMetadata{Duration: time.Second}))
+	require.NoError(t, nft.RuleAdd(r2, FirewallRuleMetadata{Duration: time.Second}))
+	require.NoError(t, nft.RuleExtend(r2, FirewallRuleMetadata{Duration: time.Hour}))
+
+	time.Sleep(1500 * time.Millisecond)
+
+	// The kernel expired r1
+	el := nftablesTestSetElements(t, nft, nft.set4)
+	require.Len(t, el, 1)
+	key, _, _, err := nftablesSetElementKey(r2)
+	require.NoError(t, err)
+	assert.Equal(t, key, el[0].Key)
+
+	assert.NoError(t, nft.RuleRemove(r1, FirewallRuleMetadata{}))
+
+	// Extending an expired rule adds it again
+	require.NoError(t, nft.RuleExtend(r1, FirewallRuleMetadata{Duration: time.Hour}))
+	assert.Len(t, nftablesTestSetElements(t, nft, nft.set4), 2)
+}
+
+func TestNFTables_SharedElement(t *testing.T) {
+	nft := newNFTablesInNetNS(t)
+	require.NoError(t, nft.FirewallSetup())
+
+	// Two clients behind the same address request the same target
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 443,
+	}
+	meta1 := FirewallRuleMetadata{ClientUUID: "c1", GrantID: "g1", Duration: time.Hour}
+	meta2 := FirewallRuleMetadata{ClientUUID: "c2", GrantID: "g2", Duration: 2 * time.Hour}
+
+	timeout := func() time.Duration {
+		el := nftablesTestSetElements(t, nft, nft.set4)
+		require.Len(t, el, 1)
+		return el[0].Timeout
+	}
+
+	require.NoError(t, nft.RuleAdd(r, meta1))
+	require.NoError(t, nft.RuleAdd(r, meta2))
+	assert.InDelta(t, 2*time.Hour, timeout(), float64(time.Minute))
+
+	// Extending a grant does not shorten the element of the other
+	require.NoError(t, nft.RuleExtend(r, FirewallRuleMetadata{ClientUUID: "c1", GrantID: "g1",
+		Duration: 30 * time.Minute}))
+	assert.InDelta(t, 2*time.Hour, timeout(), float64(time.Minute))
+
+	// Removing a grant keeps the element of the other, which expires with the remaining grant
+	require.NoError(t, nft.RuleRemove(r, meta2))
+	assert.InDelta(t, 30*time.Minute, timeout(), float64(time.Minute))
+
+	require.NoError(t, nft.RuleRemove(r, meta1))
+	assert.Len(t, nftablesTestSetElements(t, nft, nft.set4), 0)
+}
+
+func TestNFTables_RuleList(t *testing.T) {
+	nft := newNFTablesInNetNS(t)
+	require.NoError(t, nft.FirewallSetup())
+
+	rules := []FirewallRule{
+		{
+			Proto:        FirewallProtoUDP,
+			SrcIP:        net.IPv4(88, 200, 23, 12),
+			DstIP:        net.IPv4(88, 200, 23, 3),
+			DstPortStart: 5000,
+			DstPortEnd:   5010,
+		},
+		{
+			Proto: FirewallProtoICMPv6,
+			SrcIP: net.ParseIP("2001:1470:fffd:66::23:12"),
+			DstIP: net.ParseIP("2001:1470:fffd:66::23:3"),
+		},
+	}
+	for _, r := range rules {
+		require.NoError(t, nft.RuleAdd(r, FirewallRuleMetadata{Duration: time.Hour}), r.String())
+	}
+
+	listed, err := nft.RuleList()
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+	for i, r := range rules {
+		assert.Equal(t, r.String(), listed[i].Rule.String())
+		assert.Equal(t, FirewallRuleMetadata{}, listed[i].Meta)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+
+package internal
+
+var _ Firewall = &NFTables{}
+
+// NFTables is only supported on linux, see fw_nftables_linux.go.
+type NFTables struct {
+	Settings NFTablesSettings
+}
+
+func NewNFTables(s NFTablesSettings) (*NFTables, error) {
+	return nil, ErrNFTablesNotSupported
+}
+
+func (nft *NFTables) Check() error {
+	return ErrNFTablesNotSupported
+}
+
+func (nft *NFTables) FirewallSetup() error {
+	return ErrNFTablesNotSupported
+}
+
+func (nft *NFTables) RuleAdd(r FirewallRule, meta FirewallRuleMetadata) error {
+	return ErrNFTablesNotSupported
+}
+
+func (nft *NFTables) RuleRemove(r FirewallRule, meta FirewallRuleMetadata) error {
+	return ErrNFTablesNotSupported
+}
+
+func (nft *NFTables) RuleList() ([]FirewallRuleWithMetadata, error) {
+	return nil, ErrNFTablesNotSupported
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNFTablesSetElementKey(t *testing.T) {
+	key, keyEnd, ipv6, err := nftablesSetElementKey(FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 443,
+	})
+	require.NoError(t, err)
+	assert.False(t, ipv6)
+	assert.Equal(t, []byte{88, 200, 23, 12, 88, 200, 23, 3, 6, 0, 0, 0, 0x01, 0xbb, 0, 0}, key)
+	assert.Equal(t, key, keyEnd)
+
+	key, keyEnd, _, err = nftablesSetElementKey(FirewallRule{
+		Proto:        FirewallProtoUDP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 5000,
+		DstPortEnd:   5010,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{88, 200, 23, 12, 88, 200, 23, 3, 17, 0, 0, 0, 0x13, 0x88, 0, 0}, key)
+	assert.Equal(t, []byte{88, 200, 23, 12, 88, 200, 23, 3, 17, 0, 0, 0, 0x13, 0x92, 0, 0}, keyEnd)
+
+	key, keyEnd, ipv6, err = nftablesSetElementKey(FirewallRule{
+		Proto: FirewallProtoICMPv6,
+		SrcIP: net.ParseIP("2001:1470:fffd:66::23:12"),
+		DstIP: net.ParseIP("2001:1470:fffd:66::23:3"),
+	})
+	require.NoError(t, err)
+	assert.True(t, ipv6)
+	assert.Len(t, key, 40)
+	assert.Equal(t, []byte{58, 0, 0, 0, 0, 0, 0, 0}, key[32:])
+	assert.Equal(t, key, keyEnd)
+
+	_, _, _, err = nftablesSetElementKey(FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.ParseIP("2001:1470:fffd:66::23:3"),
+		DstPortStart: 443,
+	})
+	assert.Error(t, err)
+
+	_, _, _, err = nftablesSetElementKey(FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 3),
+		DstPortStart: 443,
+		DstPortEnd:   80,
+	})
+	assert.Error(t, err)
+
+	_, _, _, err = nftablesSetElementKey(FirewallRule{
+		Proto: "SCTP",
+		SrcIP: net.IPv4(88, 200, 23, 12),
+		DstIP: net.IPv4(88, 200, 23, 3),
+	})
+	assert.Error(t, err)
+}
+
+func TestNFTablesRuleFromSetElementKey(t *testing.T) {
+	rules := []FirewallRule{
+		{
+			Proto:        FirewallProtoTCP,
+			SrcIP:        net.IPv4(88, 200, 23, 12),
+			DstIP:        net.IPv4(88, 200, 23, 3),
+			DstPortStart: 443,
+			DstPortEnd:   443,
+		},
+		{
+			Proto:        FirewallProtoUDP,
+			SrcIP:        net.ParseIP("2001:1470:fffd:66::23:12"),
+			DstIP:        net.ParseIP("2001:1470:fffd:66::23:3"),
+			DstPortStart: 5000,
+			DstPortEnd:   5010,
+		},
+		{
+			Proto: FirewallProtoICMP,
+			SrcIP: net.IPv4(88, 200, 23, 12),
+			DstIP: net.IPv4(88, 200, 23, 3),
+		},
+	}
+
+	for _, r := range rules {
+		key, keyEnd, ipv6, err := nftablesSetElementKey(r)
+		require.NoError(t, err)
+
+		r2, err := nftablesRuleFromSetElementKey(key, keyEnd, ipv6)
+		require.NoError(t, err)
+		assert.Equal(t, r.String(), r2.String())
+		assert.True(t, r.SrcIP.Equal(r2.SrcIP))
+		assert.True(t, r.DstIP.Equal(r2.DstIP))
+	}
+
+	// Without a key end the port range is a single port
+	r, err := nftablesRuleFromSetElementKey([]byte{88, 200, 23, 12, 88, 200, 23, 3, 6, 0, 0, 0, 0x01, 0xbb, 0, 0}, nil,
+		false)
+	require.NoError(t, err)
+	assert.Equal(t, 443, r.DstPortStart)
+	assert.Equal(t, 443, r.DstPortEnd)
+
+	_, err = nftablesRuleFromSetElementKey([]byte{88, 200, 23, 12, 88, 200, 23, 3, 6, 0, 0, 0, 0x01, 0xbb, 0, 0}, nil,
+		true)
+	assert.Error(t, err)
+
+	_, err = nftablesRuleFromSetElementKey([]byte{88, 200, 23, 12, 88, 200, 23, 3, 132, 0, 0, 0, 0, 0, 0, 0}, nil,
+		false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	grantJournalOpAdd    = "add"
+	grantJournalOpRemove = "remove"
+
+	// grantJournalCompactMinEntries is the minimum number of journal entries before the journal is compacted
+	grantJournalCompactMinEntries = 1000
+)
+
+// GrantJournal persists the grants (firewall rules along with their expiration) managed by the FirewallRuleManager in
+// an append-only file, one JSON object per line. Each grant is journaled once when added and once when removed. On Open
+// the journal is replayed and compacted (rewritten with only the grants that were not removed). The journal is also
+// compacted once removed grants outnumber the active ones.
+type GrantJournal struct {
+	path string
+
+	f       *os.File
+	grants  map[string]FirewallRuleWithExpiration
+	entries int
+	lock    sync.Mutex
+}
+
+type grantJournalEntry struct {
+	Op           string        `json:"op"`
+	ID           string        `json:"id"`
+	Proto        string        `json:"proto,omitempty"`
+	SrcIP        net.IP        `json:"srcIP,omitempty"`
+	DstIP        net.IP        `json:"dstIP,omitempty"`
+	DstPortStart int           `json:"dstPortStart,omitempty"`
+	DstPortEnd   int           `json:"dstPortEnd,omitempty"`
+	ClientUUID   string        `json:"clientUUID,omitempty"`
+	Created      time.Time     `json:"created,omitempty"`
+	Duration     time.Duration `json:"duration,omitempty"`
+}
+
+func NewGrantJournal(path string) *GrantJournal {
+	j := &GrantJournal{
+		path:   path,
+		grants: make(map[string]FirewallRuleWithExpiration),
+	}
+	return j
+}
+
+// Open replays and compacts the journal and opens it for appending. Returns the journaled grants sorted by creation
+// time (including expired grants, which are up to the caller to remove).
+func (j *GrantJournal) Open() ([]FirewallRuleWithExpiration, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.f != nil {
+		return nil, errors.New("journal already open")
+	}
+
+	grants, err := j.replay()
+	if err != nil {
+		return nil, errors.Wrap(err, "replay")
+	}
+	j.grants = grants
+
+	if err := j.compact(); err != nil {
+		return nil, errors.Wrap(err, "compact")
+	}
+
+	l := make([]FirewallRuleWithExpiration, 0, len(j.grants))
+	for _, g := range j.grants {
+		l = append(l, g)
+	}
+	sort.Slice(l, func(i, k int) bool {
+		return l[i].Created.Before(l[k].Created)
+	})
+
+	return l, nil
+}
+
+func (j *GrantJournal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.f == nil {
+		return nil
+	}
+
+	err := j.f.Close()
+	j.f = nil
+
+	return err
+}
+
+// Add journals the grant, the grant needs to have a unique ID.
+func (j *GrantJournal) Add(re FirewallRuleWithExpiration) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if err := j.append(grantJournalEntryFromGrant(re)); err != nil {
+		return err
+	}
+
+	j.grants[re.ID] = re
+	return nil
+}
+
+// Remove journals the removal of the grant with id.
+func (j *GrantJournal) Remove(id string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if _, ok := j.grants[id]; !ok {
+		return nil
+	}
+
+	if err := j.append(grantJournalEntry{Op: grantJournalOpRemove, ID: id}); err != nil {
+		return err
+	}
+
+	delete(j.grants, id)
+
+	if j.entries > grantJournalCompactMinEntries && j.entries > 2*len(j.grants) {
+		if err := j.compact(); err != nil {
+			return errors.Wrap(err, "compact")
+		}
+	}
+
+	return nil
+}
+
+func (j *GrantJournal) append(e grantJournalEntry) error {
+	if j.f == nil {
+		return errors.New("journal not open")
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "json marshal")
+	}
+
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "write")
+	}
+
+	if err := j.f.Sync(); err != nil {
+		return errors.Wrap(err, "sync")
+	}
+
+	j.entries++
+	return nil
+}
+
+func (j *GrantJournal) replay() (map[string]FirewallRuleWithExpiration, error) {
+	grants := make(map[string]FirewallRuleWithExpiration)
+
+	f, err := os.Open(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return grants, nil
+		}
+		return nil, errors.Wrap(err, "open")
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	line := 0
+	for s.Scan() {
+		line++
+
+		e := grantJournalEntry{}
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			// Most likely a partially written entry due to a crash
+			log.Warn().Err(err).Msgf("Grant journal skipping invalid entry on line %d: %s", line, j.path)
+			continue
+		}
+
+		switch e.Op {
+		case grantJournalOpAdd:
+			grants[e.ID] = e.grant()
+		case grantJournalOpRemove:
+			delete(grants, e.ID)
+		default:
+			log.Warn().Msgf("Grant journal skipping entry with unknown op on line %d: %s", line, j.path)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "read")
+	}
+
+	return grants, nil
+}
+
+// compact atomically replaces the journal with one that contains only the active grants and (re)opens it for
+// appending.
+func (j *GrantJournal) compact() error {
+	tmpPath := j.path + ".tmp"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open temporary file")
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, g := range j.grants {
+		b, err := json.Marshal(grantJournalEntryFromGrant(g))
+		if err != nil {
+			_ = tmp.Close()
+			return errors.Wrap(err, "json marshal")
+		}
+
+		_, _ = w.Write(append(b, '\n'))
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "write temporary file")
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "sync temporary file")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "close temporary file")
+	}
+
+	if j.f != nil {
+		_ = j.f.Close()
+		j.f = nil
+	}
+
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return errors.Wrap(err, "rename")
+	}
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+
+	j.f = f
+	j.entries = len(j.grants)
+
+	return nil
+}
+
+func grantJournalEntryFromGrant(re FirewallRuleWithExpiration) grantJournalEntry {
+	return grantJournalEntry{
+		Op:           grantJournalOpAdd,
+		ID:           re.ID,
+		Proto:        re.Rule.Proto,
+		SrcIP:        re.Rule.SrcIP,
+		DstIP:        re.Rule.DstIP,
+		DstPortStart: re.Rule.DstPortStart,
+		DstPortEnd:   re.Rule.DstPortEnd,
+		ClientUUID:   re.Meta.ClientUUID,
+		Created:      re.Created,
+		Duration:     re.Duration,
+	}
+}
+
+func (e grantJournalEntry) grant() FirewallRuleWithExpiration {
+	return FirewallRuleWithExpiration{
+		ID: e.ID,
+		Rule: FirewallRule{
+			Proto:        e.Proto,
+			SrcIP:        e.SrcIP,
+			DstIP:        e.DstIP,
+			DstPortStart: e.DstPortStart,
+			DstPortEnd:   e.DstPortEnd,
+		},
+		Meta: FirewallRuleMetadata{
+			ClientUUID: e.ClientUUID,
+			GrantID:    e.ID,
+			Duration:   e.Duration,
+		},
+		Duration: e.Duration,
+		Created:  e.Created,
+	}
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func grantJournalTestGrant(id string, port int, created time.Time, dur time.Duration) FirewallRuleWithExpiration {
+	return FirewallRuleWithExpiration{
+		ID:   id,
+		Rule: firewallTestRule(port),
+		Meta: FirewallRuleMetadata{
+			ClientUUID: "c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43",
+			GrantID:    id,
+			Duration:   dur,
+		},
+		Duration: dur,
+		Created:  created,
+	}
+}
+
+func TestGrantJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grants.journal")
+	now := time.Now().Truncate(time.Second)
+
+	j := NewGrantJournal(path)
+	grants, err := j.Open()
+	require.NoError(t, err)
+	assert.Len(t, grants, 0)
+
+	g1 := grantJournalTestGrant("1", 22, now, time.Hour)
+	g2 := grantJournalTestGrant("2", 80, now.Add(time.Second), time.Minute)
+	g3 := grantJournalTestGrant("3", 443, now.Add(2*time.Second), time.Hour)
+
+	assert.NoError(t, j.Add(g1))
+	assert.NoError(t, j.Add(g2))
+	assert.NoError(t, j.Add(g3))
+	assert.NoError(t, j.Remove("2"))
+	assert.NoError(t, j.Remove("unknown"))
+	assert.NoError(t, j.Close())
+
+	j = NewGrantJournal(path)
+	grants, err = j.Open()
+	require.NoError(t, err)
+	require.Len(t, grants, 2)
+	assert.NoError(t, j.Close())
+
+	assert.Equal(t, "1", grants[0].ID)
+	assert.Equal(t, g1.Rule.String(), grants[0].Rule.String())
+	assert.Equal(t, g1.Meta, grants[0].Meta)
+	assert.True(t, g1.Expiration().Equal(grants[0].Expiration()))
+	assert.Equal(t, "3", grants[1].ID)
+
+	// Journal is compacted on open
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(b)), "\n"), 2)
+}
+
+func TestGrantJournal_PartialEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grants.journal")
+
+	j := NewGrantJournal(path)
+	_, err := j.Open()
+	require.NoError(t, err)
+	assert.NoError(t, j.Add(grantJournalTestGrant("1", 22, time.Now(), time.Hour)))
+	assert.NoError(t, j.Close())
+
+	// Simulate a crash while writing an entry
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"add","id":"2","pro`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	j = NewGrantJournal(path)
+	grants, err := j.Open()
+	require.NoError(t, err)
+	require.Len(t, grants, 1)
+	assert.Equal(t, "1", grants[0].ID)
+	assert.NoError(t, j.Close())
+}
+
+func TestGrantJournal_Compaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grants.journal")
+
+	j := NewGrantJournal(path)
+	_, err := j.Open()
+	require.NoError(t, err)
+
+	for i := 0; i < grantJournalCompactMinEntries; i++ {
+		id := strconv.Itoa(i)
+		assert.NoError(t, j.Add(grantJournalTestGrant(id, 22, time.Now(), time.Hour)))
+		assert.NoError(t, j.Remove(id))
+	}
+
+	assert.Less(t, j.entries, grantJournalCompactMinEntries)
+	assert.NoError(t, j.Close())
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrHealthNotStarted should be returned by health checks of components that have not (yet) started.
+var ErrHealthNotStarted = errors.New("not started")
+
+type HealthStatus string
+
+const (
+	HealthStatusOK       HealthStatus = "ok"
+	HealthStatusStarting HealthStatus = "starting"
+	HealthStatusFailing  HealthStatus = "failing"
+)
+
+type HealthComponent struct {
+	Status  HealthStatus `json:"status"`
+	Message string       `json:"message,omitempty"`
+}
+
+// HealthCheck returns the current status of a component.
+type HealthCheck func() HealthComponent
+
+// HealthCheckFromError adapts a check that returns an error (e.g. Firewall.Check) to a HealthCheck. The component is
+// starting if the error is ErrHealthNotStarted and failing on any other error.
+func HealthCheckFromError(check func() error) HealthCheck {
+	return func() HealthComponent {
+		return healthComponentFromError(check())
+	}
+}
+
+func healthComponentFromError(err error) HealthComponent {
+	switch {
+	case err == nil:
+		return HealthComponent{Status: HealthStatusOK}
+	case errors.Is(err, ErrHealthNotStarted):
+		return HealthComponent{Status: HealthStatusStarting}
+	default:
+		return HealthComponent{Status: HealthStatusFailing, Message: err.Error()}
+	}
+}
+
+type HealthReport struct {
+	Status     HealthStatus               `json:"status"`
+	Components map[string]HealthComponent `json:"components"`
+}
+
+// Live is true if no component is failing, components that are still starting are considered alive.
+func (r HealthReport) Live() bool {
+	for _, c := range r.Components {
+		if c.Status == HealthStatusFailing {
+			return false
+		}
+	}
+	return true
+}
+
+// Ready is true once every component has started and is not failing.
+func (r HealthReport) Ready() bool {
+	for _, c := range r.Components {
+		if c.Status != HealthStatusOK {
+			return false
+		}
+	}
+	return true
+}
+
+// Health aggregates the health checks of the server's components.
+type Health struct {
+	checks map[string]HealthCheck
+	lock   sync.Mutex
+}
+
+func NewHealth() *Health {
+	h := &Health{
+		checks: make(map[string]HealthCheck),
+	}
+	return h
+}
+
+// Register adds (or replaces) the health check of the named component.
+func (h *Health) Register(name string, check HealthCheck) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.checks[name] = check
+}
+
+func (h *Health) Report() HealthReport {
+	h.lock.Lock()
+	checks := make(map[string]HealthCheck, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.lock.Unlock()
+
+	r := HealthReport{
+		Components: make(map[string]HealthComponent, len(checks)),
+	}
+	for name, check := range checks {
+		r.Components[name] = check()
+	}
+
+	switch {
+	case r.Ready():
+		r.Status = HealthStatusOK
+	case r.Live():
+		r.Status = HealthStatusStarting
+	default:
+		r.Status = HealthStatusFailing
+	}
+
+	return r
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckFromError(t *testing.T) {
+	assert.Equal(t, HealthComponent{Status: HealthStatusOK}, HealthCheckFromError(func() error { return nil })())
+	assert.Equal(t, HealthComponent{Status: HealthStatusStarting},
+		HealthCheckFromError(func() error { return errors.Wrap(ErrHealthNotStarted, "udp") })())
+	assert.Equal(t, HealthComponent{Status: HealthStatusFailing, Message: "boom"},
+		HealthCheckFromError(func() error { return errors.New("boom") })())
+}
+
+func TestHealth_Report(t *testing.T) {
+	h := NewHealth()
+	status := HealthStatusOK
+	h.Register("a", func() HealthComponent { return HealthComponent{Status: HealthStatusOK} })
+	h.Register("b", func() HealthComponent { return HealthComponent{Status: status} })
+
+	r := h.Report()
+	assert.Equal(t, HealthStatusOK, r.Status)
+	assert.Len(t, r.Components, 2)
+	assert.True(t, r.Live())
+	assert.True(t, r.Ready())
+
+	status = HealthStatusStarting
+	r = h.Report()
+	assert.Equal(t, HealthStatusStarting, r.Status)
+	assert.True(t, r.Live())
+	assert.False(t, r.Ready())
+
+	status = HealthStatusFailing
+	r = h.Report()
+	assert.Equal(t, HealthStatusFailing, r.Status)
+	assert.False(t, r.Live())
+	assert.False(t, r.Ready())
+}
+
+func TestHealth_ReportEmpty(t *testing.T) {
+	r := NewHealth().Report()
+	assert.Equal(t, HealthStatusOK, r.Status)
+	assert.True(t, r.Ready())
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"net"
+	"sync"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -83,6 +84,11 @@ func (fw *FirewallMock) FirewallSetup() error {
 	return args.Error(0)
 }
 
+func (fw *FirewallMock) Check() error {
+	args := fw.Called()
+	return args.Error(0)
+}
+
 var _ Firewall = FirewallStub{}
 
 type FirewallStub struct{}
@@ -99,6 +105,10 @@ func (FirewallStub) FirewallSetup() error {
 	return nil
 }
 
+func (FirewallStub) Check() error {
+	return nil
+}
+
 var _ CommandExecuter = &CommandExecuteMock{}
 
 type CommandExecuteMock struct {
@@ -109,3 +119,34 @@ func (c *CommandExecuteMock) Execute(cmd string, stdin []byte, args ...string) (
 	a := c.Called(cmd, stdin, args)
 	return a.Get(0).([]byte), a.Error(1)
 }
+
+var _ ConntrackDeleter = &ConntrackDeleterMock{}
+
+type ConntrackDeleterMock struct {
+	mock.Mock
+}
+
+func (c *ConntrackDeleterMock) ConntrackDelete(r FirewallRule) (int, error) {
+	a := c.Called(r)
+	return a.Int(0), a.Error(1)
+}
+
+var _ AuditLogger = &AuditLoggerStub{}
+
+// AuditLoggerStub records the audit events in memory.
+type AuditLoggerStub struct {
+	events []AuditEvent
+	lock   sync.Mutex
+}
+
+func (a *AuditLoggerStub) Audit(e AuditEvent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.events = append(a.events, e)
+}
+
+func (a *AuditLoggerStub) Events() []AuditEvent {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]AuditEvent{}, a.events...)
+}
@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	WebhookQueueSizeDefault  = 100
+	WebhookRetriesDefault    = 3
+	WebhookTimeoutDefault    = 5 * time.Second
+	WebhookSignatureHeader   = "X-OpenSPA-Signature"
+	WebhookEventHeader       = "X-OpenSPA-Event"
+	webhookRetryBackoffStart = time.Second
+)
+
+type WebhookSettings struct {
+	URL string
+	// Secret is the key of the HMAC-SHA256 signature of the body, sent in WebhookSignatureHeader as sha256=<hex>.
+	// Optional, if empty the request is not signed.
+	Secret string
+	// Events that are sent, if empty all events are sent
+	Events []AuditEventType
+	// Timeout of a single delivery attempt, WebhookTimeoutDefault if 0
+	Timeout time.Duration
+	// QueueSize is the number of events that can wait for delivery, further events are dropped.
+	// WebhookQueueSizeDefault if 0.
+	QueueSize int
+	// Retries is the number of delivery retries (with exponential backoff) after a failed attempt,
+	// WebhookRetriesDefault if 0 and no retries if negative.
+	Retries int
+}
+
+var _ AuditLogger = &WebhookNotifier{}
+
+// WebhookNotifier POSTs events as JSON to webhooks. Each webhook has a bounded queue that is delivered by its own
+// goroutine, so Audit never blocks. Events that do not fit in the queue are dropped.
+type WebhookNotifier struct {
+	webhooks []*webhook
+	wg       sync.WaitGroup
+	stop     chan struct{}
+	metrics  webhookNotifierMetrics
+}
+
+type webhook struct {
+	WebhookSettings
+	events map[AuditEventType]bool
+	queue  chan AuditEvent
+	client *http.Client
+}
+
+type webhookNotifierMetrics struct {
+	sent    observability.Counter
+	failed  observability.Counter
+	dropped observability.Counter
+}
+
+func NewWebhookNotifier(webhooks []WebhookSettings) *WebhookNotifier {
+	n := &WebhookNotifier{
+		webhooks: make([]*webhook, 0, len(webhooks)),
+		metrics:  newWebhookNotifierMetrics(),
+	}
+
+	for _, set := range webhooks {
+		if set.Timeout == 0 {
+			set.Timeout = WebhookTimeoutDefault
+		}
+		if set.QueueSize <= 0 {
+			set.QueueSize = WebhookQueueSizeDefault
+		}
+		if set.Retries == 0 {
+			set.Retries = WebhookRetriesDefault
+		}
+
+		w := &webhook{
+			WebhookSettings: set,
+			events:          make(map[AuditEventType]bool),
+			queue:           make(chan AuditEvent, set.QueueSize),
+			client:          &http.Client{Timeout: set.Timeout},
+		}
+		for _, e := range set.Events {
+			w.events[e] = true
+		}
+
+		n.webhooks = append(n.webhooks, w)
+	}
+
+	return n
+}
+
+func (n *WebhookNotifier) Start() {
+	n.stop = make(chan struct{})
+	for _, w := range n.webhooks {
+		n.wg.Add(1)
+		go n.deliveryRoutine(w, n.stop)
+	}
+}
+
+// Stop stops delivery, events that are still queued are dropped.
+func (n *WebhookNotifier) Stop() {
+	close(n.stop)
+	n.wg.Wait()
+}
+
+// Audit queues the event for delivery to the webhooks that are subscribed to the event.
+func (n *WebhookNotifier) Audit(e AuditEvent) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+
+	for _, w := range n.webhooks {
+		if len(w.events) != 0 && !w.events[e.Event] {
+			continue
+		}
+
+		select {
+		case w.queue <- e:
+		default:
+			n.metrics.dropped.Inc()
+			log.Warn().Msgf("Webhook queue full, dropping %s event for: %s", e.Event, w.URL)
+		}
+	}
+}
+
+func (n *WebhookNotifier) deliveryRoutine(w *webhook, stop chan struct{}) {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case e := <-w.queue:
+			n.deliver(w, e, stop)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// deliver sends the event, retrying with exponential backoff on failure.
+func (n *WebhookNotifier) deliver(w *webhook, e AuditEvent, stop chan struct{}) {
+	backoff := webhookRetryBackoffStart
+
+	for attempt := 0; ; attempt++ {
+		err := w.send(e)
+		if err == nil {
+			n.metrics.sent.Inc()
+			return
+		}
+
+		if attempt >= w.Retries {
+			n.metrics.failed.Inc()
+			log.Error().Err(err).Msgf("Webhook delivery of %s event failed (attempts: %d): %s", e.Event, attempt+1, w.URL)
+			return
+		}
+
+		log.Debug().Err(err).Msgf("Webhook delivery of %s event failed, retrying in %s: %s", e.Event, backoff, w.URL)
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-stop:
+			t.Stop()
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (w *webhook) send(e AuditEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "json marshal")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "new request")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "OpenSPA/"+Version())
+	req.Header.Set(WebhookEventHeader, string(e.Event))
+	if w.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, WebhookSignature(w.Secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request")
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// WebhookSignature returns the value of the WebhookSignatureHeader for body, receivers should compare it (in constant
+// time) with the signature they compute.
+func WebhookSignature(secret string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	_, _ = m.Write(body)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+func newWebhookNotifierMetrics() webhookNotifierMetrics {
+	m := webhookNotifierMetrics{}
+	mr := getMetricsRepository()
+	lbl := observability.NewLabels()
+
+	m.sent = mr.Count("webhook_sent", lbl)
+	m.failed = mr.Count("webhook_failed", lbl)
+	m.dropped = mr.Count("webhook_dropped", lbl)
+	return m
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type webhookTestReceiver struct {
+	events    []AuditEvent
+	failFirst int // number of requests to fail with 500
+	requests  int
+	lock      sync.Mutex
+	t         *testing.T
+	secret    string
+}
+
+func (wr *webhookTestReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+
+	wr.requests++
+	if wr.requests <= wr.failFirst {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	require.NoError(wr.t, err)
+
+	assert.Equal(wr.t, http.MethodPost, r.Method)
+	assert.Equal(wr.t, "application/json", r.Header.Get("Content-Type"))
+	if wr.secret != "" {
+		assert.Equal(wr.t, WebhookSignature(wr.secret, body), r.Header.Get(WebhookSignatureHeader))
+	} else {
+		assert.Empty(wr.t, r.Header.Get(WebhookSignatureHeader))
+	}
+
+	e := AuditEvent{}
+	require.NoError(wr.t, json.Unmarshal(body, &e))
+	assert.Equal(wr.t, string(e.Event), r.Header.Get(WebhookEventHeader))
+	wr.events = append(wr.events, e)
+}
+
+func (wr *webhookTestReceiver) Requests() int {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	return wr.requests
+}
+
+func (wr *webhookTestReceiver) Events() []AuditEvent {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	return append([]AuditEvent{}, wr.events...)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	all := &webhookTestReceiver{t: t, secret: "s3cret"}
+	sAll := httptest.NewServer(all)
+	defer sAll.Close()
+
+	grants := &webhookTestReceiver{t: t}
+	sGrants := httptest.NewServer(grants)
+	defer sGrants.Close()
+
+	n := NewWebhookNotifier([]WebhookSettings{
+		{URL: sAll.URL, Secret: "s3cret"},
+		{URL: sGrants.URL, Events: []AuditEventType{AuditEventGrant, AuditEventRevoke}},
+	})
+	n.Start()
+
+	n.Audit(AuditEvent{Event: AuditEventGrant, ClientUUID: "09896692-c299-4f90-9906-2e23cfcc417c"})
+	n.Audit(AuditEvent{Event: AuditEventDeny, Reason: AuditReasonUnauthorized})
+	n.Audit(AuditEvent{Event: AuditEventExpire})
+
+	assert.Eventually(t, func() bool {
+		return len(all.Events()) == 3 && len(grants.Events()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	n.Stop()
+	assert.Equal(t, 4, n.metrics.sent.Get())
+
+	events := all.Events()
+	assert.Equal(t, AuditEventGrant, events[0].Event)
+	assert.Equal(t, "09896692-c299-4f90-9906-2e23cfcc417c", events[0].ClientUUID)
+	assert.False(t, events[0].Timestamp.IsZero())
+	assert.Equal(t, AuditEventDeny, events[1].Event)
+	assert.Equal(t, AuditReasonUnauthorized, events[1].Reason)
+	assert.Equal(t, AuditEventExpire, events[2].Event)
+
+	require.Len(t, grants.Events(), 1)
+	assert.Equal(t, AuditEventGrant, grants.Events()[0].Event)
+}
+
+func TestWebhookNotifier_Retry(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	r := &webhookTestReceiver{t: t, failFirst: 1}
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	n := NewWebhookNotifier([]WebhookSettings{{URL: s.URL}})
+	n.Start()
+	n.Audit(AuditEvent{Event: AuditEventRevoke})
+
+	assert.Eventually(t, func() bool {
+		return len(r.Events()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	n.Stop()
+
+	assert.Equal(t, 1, n.metrics.sent.Get())
+	assert.Equal(t, 0, n.metrics.failed.Get())
+
+	// Without retries
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	r = &webhookTestReceiver{t: t, failFirst: 1}
+	s2 := httptest.NewServer(r)
+	defer s2.Close()
+
+	n = NewWebhookNotifier([]WebhookSettings{{URL: s2.URL, Retries: -1}})
+	n.Start()
+	n.Audit(AuditEvent{Event: AuditEventRevoke})
+
+	assert.Eventually(t, func() bool {
+		return r.Requests() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	n.Stop()
+	assert.Len(t, r.Events(), 0)
+	assert.Equal(t, 1, n.metrics.failed.Get())
+}
+
+func TestWebhookNotifier_QueueFullDrops(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	// Not started, so nothing is consumed from the queue
+	n := NewWebhookNotifier([]WebhookSettings{{URL: "http://localhost", QueueSize: 2}})
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			n.Audit(AuditEvent{Event: AuditEventGrant})
+		}
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Audit blocked")
+	}
+
+	assert.Equal(t, 3, n.metrics.dropped.Get())
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// echo -n '{"event":"grant"}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "sha256=99863476dc1e505ca9fee6be736f7fcb03bab64b382a3eac2ecaaefdb1760f26",
+		WebhookSignature("secret", []byte(`{"event":"grant"}`)))
+}
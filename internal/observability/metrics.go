@@ -1,8 +1,11 @@
 package observability
 
+import "time"
+
 type MetricsRepository interface {
 	CountRegistry
 	GaugeRegistry
+	HistogramRegistry
 }
 
 type Labels map[string]string
@@ -49,6 +52,38 @@ type GaugeFunc interface {
 	GaugeFuncDeregister()
 }
 
+// HistogramRegistry implements Histogram metrics, which sample observations (e.g. latencies) into buckets.
+type HistogramRegistry interface {
+	// Histogram uses the bucket upper bounds, DurationBuckets if buckets is nil
+	Histogram(name string, l Labels, buckets []float64) Histogram
+
+	// HistogramVec doesn't need constant labels, just constant label keys (see CountVec)
+	HistogramVec(name string, buckets []float64, labelKeys ...string) HistogramVec
+}
+
+type Histogram interface {
+	Observe(f float64)
+}
+
+type HistogramVec interface {
+	Observe(f float64, labelValues ...string)
+}
+
+// DurationBuckets are the default Histogram buckets, in seconds. They span from 100µs (e.g. a decryption) to 10s
+// (e.g. a slow external command).
+var DurationBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+	2.5, 5, 10}
+
+// ObserveDuration observes the seconds elapsed since start.
+func ObserveDuration(h Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// ObserveDurationVec observes the seconds elapsed since start with the label values.
+func ObserveDurationVec(h HistogramVec, start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
 func NewLabels() Labels {
 	return make(map[string]string)
 }
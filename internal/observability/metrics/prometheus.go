@@ -201,6 +201,57 @@ func (r *PrometheusRepository) gaugeFuncGet(name string, l observability.Labels)
 	return c
 }
 
+func (r *PrometheusRepository) Histogram(name string, l observability.Labels,
+	buckets []float64) observability.Histogram {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.histogramGet(name, l, buckets)
+}
+
+func (r *PrometheusRepository) histogramGet(name string, l observability.Labels,
+	buckets []float64) *PrometheusHistogram {
+	key := countNameKey(name, l)
+	m, ok := r.m[key]
+	var h *PrometheusHistogram
+	if !ok {
+		h = NewPrometheusHistogram(r.reg, name, l, buckets)
+		m = metric{h}
+		r.m[key] = m
+	} else {
+		h, ok = m.m.(*PrometheusHistogram)
+		if !ok {
+			panic(errors.New("failed to type assert"))
+		}
+	}
+
+	return h
+}
+
+func (r *PrometheusRepository) HistogramVec(name string, buckets []float64,
+	labelKeys ...string) observability.HistogramVec {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.histogramVecGet(name, buckets, labelKeys...)
+}
+
+func (r *PrometheusRepository) histogramVecGet(name string, buckets []float64,
+	labelKeys ...string) *PrometheusHistogramVec {
+	m, ok := r.m[name]
+	var h *PrometheusHistogramVec
+	if !ok {
+		h = NewPrometheusHistogramVec(r.reg, name, buckets, labelKeys...)
+		m = metric{h}
+		r.m[name] = m
+	} else {
+		h, ok = m.m.(*PrometheusHistogramVec)
+		if !ok {
+			panic(errors.New("failed to type assert"))
+		}
+	}
+
+	return h
+}
+
 type metric struct {
 	m interface{}
 }
@@ -381,6 +432,68 @@ func (cf *PrometheusGaugeFunc) defaultCallback() float64 {
 	return float64(0)
 }
 
+var _ observability.Histogram = &PrometheusHistogram{}
+
+type PrometheusHistogram struct {
+	h prometheus.Histogram
+}
+
+func NewPrometheusHistogram(r prometheus.Registerer, name string, l observability.Labels,
+	buckets []float64) *PrometheusHistogram {
+	h := &PrometheusHistogram{}
+
+	h.h = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:   MetricNamespace,
+		Subsystem:   MetricSubsystem,
+		Name:        name,
+		Help:        "",
+		ConstLabels: l.ToMap(),
+		Buckets:     histogramBuckets(buckets),
+	})
+
+	r.MustRegister(h.h)
+
+	return h
+}
+
+func (h PrometheusHistogram) Observe(f float64) {
+	h.h.Observe(f)
+}
+
+var _ observability.HistogramVec = &PrometheusHistogramVec{}
+
+type PrometheusHistogramVec struct {
+	h *prometheus.HistogramVec
+}
+
+func NewPrometheusHistogramVec(r prometheus.Registerer, name string, buckets []float64,
+	labelKeys ...string) *PrometheusHistogramVec {
+	hv := &PrometheusHistogramVec{}
+
+	hv.h = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricNamespace,
+		Subsystem: MetricSubsystem,
+		Name:      name,
+		Help:      "",
+		Buckets:   histogramBuckets(buckets),
+	}, labelKeys)
+
+	r.MustRegister(hv.h)
+
+	return hv
+}
+
+func (h *PrometheusHistogramVec) Observe(f float64, labelValues ...string) {
+	h.h.WithLabelValues(labelValues...).Observe(f)
+}
+
+func histogramBuckets(buckets []float64) []float64 {
+	if buckets == nil {
+		return observability.DurationBuckets
+	}
+	return buckets
+}
+
 func countNameKey(name string, l observability.Labels) string {
 	return countNameKeyWithForLoop(name, l)
 }
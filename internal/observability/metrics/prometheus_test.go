@@ -727,3 +727,69 @@ func TestPrometheusGaugeFunc_Concurrently(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestPrometheusRepositoryHistogram_ShouldReturnSameEntityOnSameLabel(t *testing.T) {
+	repo := NewPrometheusRepository(false)
+
+	h1 := repo.Histogram("foo", observability.NewLabels().Add("state", "success"), nil)
+	h2 := repo.Histogram("foo", observability.NewLabels().Add("state", "success"), nil)
+	h3 := repo.Histogram("foo", observability.NewLabels().Add("state", "failure"), nil)
+
+	assert.Equal(t, h1, h2)
+	assert.NotEqual(t, h1, h3)
+
+	v1 := repo.HistogramVec("bar", nil, "stage")
+	v2 := repo.HistogramVec("bar", nil, "stage")
+	assert.Equal(t, v1, v2)
+}
+
+func TestPrometheusHistogram_Observe(t *testing.T) {
+	r := prometheus.NewRegistry()
+	h := NewPrometheusHistogram(r, "foo", nil, nil)
+
+	h.Observe(0.0002)
+	h.Observe(0.3)
+	h.Observe(20)
+
+	m := &dto.Metric{}
+	assert.NoError(t, h.h.(prometheus.Metric).Write(m))
+	require.NotNil(t, m.Histogram)
+	assert.Equal(t, uint64(3), m.Histogram.GetSampleCount())
+	assert.InDelta(t, 20.3002, m.Histogram.GetSampleSum(), 0.00001)
+	require.Len(t, m.Histogram.Bucket, len(observability.DurationBuckets))
+	assert.Equal(t, uint64(1), m.Histogram.Bucket[1].GetCumulativeCount()) // <= 0.00025
+	assert.Equal(t, uint64(2), m.Histogram.Bucket[len(m.Histogram.Bucket)-1].GetCumulativeCount())
+}
+
+func TestPrometheusHistogram_CustomBuckets(t *testing.T) {
+	r := prometheus.NewRegistry()
+	h := NewPrometheusHistogram(r, "foo", nil, []float64{1, 2})
+
+	h.Observe(1.5)
+
+	m := &dto.Metric{}
+	assert.NoError(t, h.h.(prometheus.Metric).Write(m))
+	require.Len(t, m.Histogram.Bucket, 2)
+	assert.Equal(t, uint64(0), m.Histogram.Bucket[0].GetCumulativeCount())
+	assert.Equal(t, uint64(1), m.Histogram.Bucket[1].GetCumulativeCount())
+}
+
+func TestPrometheusHistogramVec_Observe(t *testing.T) {
+	r := prometheus.NewRegistry()
+	h := NewPrometheusHistogramVec(r, "foo", nil, "stage")
+
+	h.Observe(0.1, "decrypt")
+	h.Observe(0.2, "decrypt")
+	h.Observe(1, "authorization")
+
+	o, err := h.h.GetMetricWith(map[string]string{"stage": "decrypt"})
+	require.NoError(t, err)
+	m := &dto.Metric{}
+	assert.NoError(t, o.(prometheus.Metric).Write(m))
+	assert.Equal(t, uint64(2), m.Histogram.GetSampleCount())
+
+	o, err = h.h.GetMetricWith(map[string]string{"stage": "authorization"})
+	require.NoError(t, err)
+	assert.NoError(t, o.(prometheus.Metric).Write(m))
+	assert.Equal(t, uint64(1), m.Histogram.GetSampleCount())
+}
@@ -1,10 +1,17 @@
 package observability
 
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
 var _ MetricsRepository = MetricsRepositoryStub{}
 
 type MetricsRepositoryStub struct {
 	CountRegistryStub
 	GaugeRegistryStub
+	HistogramRegistryStub
 }
 
 var _ CountRegistry = CountRegistryStub{}
@@ -17,7 +24,7 @@ func (c CountRegistryStub) Count(_ string, _ Labels) Counter {
 }
 
 func (c CountRegistryStub) CountVec(_ string, _ ...string) CounterVec {
-	return CounterVecStub{}
+	return NewCounterVecStub()
 }
 
 func (c CountRegistryStub) CountFunc(_ string, _ Labels) CounterFunc {
@@ -34,25 +41,65 @@ func (g GaugeRegistryStub) GaugeFunc(_ string, _ Labels) GaugeFunc {
 	return GaugeFuncStub{}
 }
 
-type CounterStub int
+// CounterStub counts in memory, it is safe for concurrent use.
+type CounterStub int64
 
 func (c *CounterStub) Inc() {
-	*c++
+	atomic.AddInt64((*int64)(c), 1)
 }
 
 func (c *CounterStub) Add(i int) {
-	*c += CounterStub(i)
+	atomic.AddInt64((*int64)(c), int64(i))
 }
 
 func (c *CounterStub) Get() int {
-	return int(*c)
+	return int(atomic.LoadInt64((*int64)(c)))
+}
+
+// CounterVecStub counts in memory per label values, it is safe for concurrent use.
+type CounterVecStub struct {
+	m    map[string]int
+	lock sync.Mutex
+}
+
+func NewCounterVecStub() *CounterVecStub {
+	return &CounterVecStub{
+		m: make(map[string]int),
+	}
+}
+
+func (c *CounterVecStub) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVecStub) Add(i int, labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.m[counterVecStubKey(labelValues)] += i
+}
+
+// Get returns the count of the label values.
+func (c *CounterVecStub) Get(labelValues ...string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.m[counterVecStubKey(labelValues)]
 }
 
-type CounterVecStub struct{}
+// Total returns the count of all label values.
+func (c *CounterVecStub) Total() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-func (c CounterVecStub) Inc(_ ...string) {}
+	t := 0
+	for _, i := range c.m {
+		t += i
+	}
+	return t
+}
 
-func (c CounterVecStub) Add(_ int, _ ...string) {}
+func counterVecStubKey(labelValues []string) string {
+	return strings.Join(labelValues, "\x00")
+}
 
 type CounterFuncStub struct{}
 
@@ -69,3 +116,21 @@ type GaugeFuncStub struct{}
 func (g GaugeFuncStub) GaugeFuncRegister(_ func() float64) {}
 
 func (g GaugeFuncStub) GaugeFuncDeregister() {}
+
+type HistogramRegistryStub struct{}
+
+func (h HistogramRegistryStub) Histogram(_ string, _ Labels, _ []float64) Histogram {
+	return HistogramStub{}
+}
+
+func (h HistogramRegistryStub) HistogramVec(_ string, _ []float64, _ ...string) HistogramVec {
+	return HistogramVecStub{}
+}
+
+type HistogramStub struct{}
+
+func (h HistogramStub) Observe(_ float64) {}
+
+type HistogramVecStub struct{}
+
+func (h HistogramVecStub) Observe(_ float64, _ ...string) {}
@@ -0,0 +1,528 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	PluginTimeoutDefault             = 5 * time.Second
+	PluginHealthCheckIntervalDefault = 10 * time.Second
+
+	PluginMethodPing          = "ping"
+	PluginMethodAuthorize     = "authorize"
+	PluginMethodFirewallSetup = "firewallSetup"
+	PluginMethodRuleAdd       = "ruleAdd"
+	PluginMethodRuleRemove    = "ruleRemove"
+	PluginMethodRuleList      = "ruleList"
+
+	// pluginRestartBackoffMin and pluginRestartBackoffMax bound the wait before the plugin is restarted, the wait doubles
+	// with each consecutive crash. A plugin that ran for at least pluginRestartBackoffMax is restarted immediately.
+	pluginRestartBackoffMin = 100 * time.Millisecond
+	pluginRestartBackoffMax = 30 * time.Second
+	// pluginStopGrace is how long a stopping plugin has to exit after its stdin is closed, before it is killed
+	pluginStopGrace = 5 * time.Second
+	// pluginResponseMaxSize is the maximum size of a response line
+	pluginResponseMaxSize = 1024 * 1024
+)
+
+var (
+	ErrPluginNotRunning = errors.New("plugin is not running")
+	ErrPluginStopped    = errors.New("plugin is stopped")
+)
+
+type PluginSettings struct {
+	// Timeout of a call
+	Timeout time.Duration
+	// HealthCheckInterval between the pings of the plugin, the plugin is restarted if it does not respond. The plugin
+	// is not pinged if 0.
+	HealthCheckInterval time.Duration
+}
+
+var PluginSettingsDefault = PluginSettings{
+	Timeout:             PluginTimeoutDefault,
+	HealthCheckInterval: PluginHealthCheckIntervalDefault,
+}
+
+// PluginRequest is a line written to the plugin's stdin. Params is the JSON input of the equivalent command (e.g.
+// AuthorizationStrategyCommandAuthorizeInput for the authorize method).
+type PluginRequest struct {
+	ID     uint64      `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params,omitempty"`
+}
+
+// PluginResponse is a line written by the plugin to its stdout, the ID is the ID of the request. Result is the JSON
+// output of the equivalent command, Error is set if the request failed. The responses can be out of order.
+type PluginResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Plugin is a long-running command that handles the requests of a command backend (instead of executing a command per
+// request). The requests and responses are exchanged as newline-delimited JSON (PluginRequest and PluginResponse) over
+// the plugin's stdin and stdout, stderr is logged. The plugin is restarted if it exits or does not respond to pings,
+// it should exit once its stdin is closed.
+type Plugin struct {
+	Cmd      string
+	Settings PluginSettings
+
+	// name identifies the plugin in the logs and metrics
+	name string
+	// args of the command, only used in tests
+	args []string
+
+	proc    *pluginProcess // nil if the plugin is not running
+	nextID  uint64
+	started bool
+	stopped bool
+	// backoff is the wait before the next restart, err is the reason the plugin is failing (nil if healthy)
+	backoff time.Duration
+	err     error
+	lock    sync.Mutex
+
+	stop    chan struct{}
+	done    chan struct{}
+	metrics pluginMetrics
+}
+
+type pluginMetrics struct {
+	restarts observability.Counter
+	timeouts observability.Counter
+}
+
+type pluginProcess struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	started time.Time
+
+	pending   map[uint64]chan PluginResponse
+	calls     sync.WaitGroup
+	lock      sync.Mutex
+	writeLock sync.Mutex
+
+	// exited is closed once the process exited, err is the reason
+	exited chan struct{}
+	err    error
+}
+
+func NewPlugin(name, cmd string, s PluginSettings) *Plugin {
+	p := &Plugin{
+		Cmd:      cmd,
+		Settings: s,
+		name:     name,
+		backoff:  pluginRestartBackoffMin,
+		metrics:  newPluginMetrics(name),
+	}
+	return p
+}
+
+// Start starts the plugin and the routine that restarts it, if it exits or does not respond to pings.
+func (p *Plugin) Start() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stopped {
+		return ErrPluginStopped
+	}
+	if p.started {
+		return nil
+	}
+
+	proc, err := p.startProcess()
+	if err != nil {
+		return err
+	}
+
+	p.proc = proc
+	p.started = true
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.monitor(p.stop, p.done)
+
+	return nil
+}
+
+// Stop waits for the pending calls (at most Settings.Timeout) and stops the plugin. The plugin can not be started
+// again.
+func (p *Plugin) Stop() error {
+	p.lock.Lock()
+	if p.stopped {
+		p.lock.Unlock()
+		return nil
+	}
+	p.stopped = true
+	started := p.started
+	p.lock.Unlock()
+
+	if !started {
+		return nil
+	}
+
+	// Once the monitor returns the plugin is not restarted anymore
+	close(p.stop)
+	<-p.done
+
+	p.lock.Lock()
+	proc := p.proc
+	p.proc = nil
+	p.lock.Unlock()
+
+	if proc == nil {
+		return nil
+	}
+
+	calls := make(chan struct{})
+	go func() {
+		proc.calls.Wait()
+		close(calls)
+	}()
+	select {
+	case <-calls:
+	case <-time.After(p.Settings.Timeout):
+	}
+
+	_ = proc.stdin.Close()
+	select {
+	case <-proc.exited:
+		return nil
+	case <-time.After(pluginStopGrace):
+	}
+
+	log.Warn().Msgf("Plugin %s did not exit after its stdin was closed, killing it", p.name)
+	_ = proc.cmd.Process.Kill()
+	<-proc.exited
+
+	return nil
+}
+
+// Call sends the request to the plugin and returns the result of its response. The plugin is started if needed.
+func (p *Plugin) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	if err := p.Start(); err != nil {
+		return nil, errors.Wrap(err, "plugin start")
+	}
+
+	p.lock.Lock()
+	proc := p.proc
+	p.nextID++
+	id := p.nextID
+	p.lock.Unlock()
+
+	if proc == nil {
+		return nil, ErrPluginNotRunning
+	}
+
+	line, err := json.Marshal(PluginRequest{ID: id, Method: method, Params: params})
+	if err != nil {
+		return nil, errors.Wrap(err, "json marshal request")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.Settings.Timeout)
+	defer cancel()
+
+	resp := proc.register(id)
+	defer proc.unregister(id)
+
+	if err := proc.write(ctx, append(line, '\n')); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			p.metrics.timeouts.Inc()
+		}
+		return nil, errors.Wrap(err, "plugin write")
+	}
+
+	select {
+	case r := <-resp:
+		if r.Error != "" {
+			return nil, errors.Errorf("plugin error: %s", r.Error)
+		}
+		return r.Result, nil
+	case <-proc.exited:
+		return nil, errors.Wrap(proc.err, "plugin exited")
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			p.metrics.timeouts.Inc()
+		}
+		return nil, errors.Wrap(ctx.Err(), "plugin "+method)
+	}
+}
+
+// Check pings the plugin.
+func (p *Plugin) Check() error {
+	_, err := p.Call(context.Background(), PluginMethodPing, nil)
+	return err
+}
+
+// Health reports whether the plugin is running and responded to the last ping.
+func (p *Plugin) Health() HealthComponent {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch {
+	case !p.started:
+		return HealthComponent{Status: HealthStatusStarting}
+	case p.proc == nil && p.err != nil:
+		return HealthComponent{Status: HealthStatusFailing, Message: "not running: " + p.err.Error()}
+	case p.proc == nil:
+		return HealthComponent{Status: HealthStatusFailing, Message: "not running"}
+	case p.err != nil:
+		return HealthComponent{Status: HealthStatusFailing, Message: p.err.Error()}
+	}
+
+	return HealthComponent{Status: HealthStatusOK}
+}
+
+// monitor restarts the plugin once it exits and pings it every Settings.HealthCheckInterval.
+func (p *Plugin) monitor(stop, done chan struct{}) {
+	defer close(done)
+
+	var tick <-chan time.Time
+	if p.Settings.HealthCheckInterval > 0 {
+		t := time.NewTicker(p.Settings.HealthCheckInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	// The pings are asynchronous so that a plugin that hangs does not block the restarts, pinging is set while a ping is
+	// pending
+	pinged := make(chan pluginPing, 1)
+	pinging := false
+
+	for {
+		p.lock.Lock()
+		proc := p.proc
+		backoff := p.backoff
+		p.lock.Unlock()
+
+		var exited <-chan struct{}
+		var restart, ping <-chan time.Time
+		if proc != nil {
+			exited = proc.exited
+			ping = tick
+		} else {
+			restart = time.After(backoff)
+		}
+
+		select {
+		case <-stop:
+			return
+
+		case <-exited:
+			log.Warn().Err(proc.err).Msgf("Plugin %s exited, restarting it", p.name)
+			p.lock.Lock()
+			if p.proc == proc {
+				p.proc = nil
+			}
+			p.err = proc.err
+			if time.Since(proc.started) >= pluginRestartBackoffMax {
+				p.backoff = pluginRestartBackoffMin
+			}
+			p.lock.Unlock()
+
+		case <-restart:
+			next, err := p.startProcess()
+
+			p.lock.Lock()
+			if err != nil {
+				log.Error().Err(err).Msgf("Plugin %s failed to restart", p.name)
+				p.err = err
+			} else {
+				p.proc = next
+				p.err = nil
+				p.metrics.restarts.Inc()
+			}
+			p.backoff *= 2
+			if p.backoff > pluginRestartBackoffMax {
+				p.backoff = pluginRestartBackoffMax
+			}
+			p.lock.Unlock()
+
+		case <-ping:
+			if pinging {
+				break
+			}
+			pinging = true
+			go func(proc *pluginProcess) {
+				pinged <- pluginPing{proc: proc, err: p.ping()}
+			}(proc)
+
+		case r := <-pinged:
+			pinging = false
+
+			p.lock.Lock()
+			current := p.proc == r.proc
+			if current {
+				p.err = r.err
+			}
+			p.lock.Unlock()
+
+			if current && r.err != nil {
+				log.Error().Err(r.err).Msgf("Plugin %s failed the health check, restarting it", p.name)
+				_ = r.proc.cmd.Process.Kill()
+			}
+		}
+	}
+}
+
+// pluginPing is the result of a health check ping of the process.
+type pluginPing struct {
+	proc *pluginProcess
+	err  error
+}
+
+// ping pings the plugin, the ping times out before the next one is due.
+func (p *Plugin) ping() error {
+	timeout := p.Settings.Timeout
+	if p.Settings.HealthCheckInterval < timeout {
+		timeout = p.Settings.HealthCheckInterval
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := p.Call(ctx, PluginMethodPing, nil)
+	return err
+}
+
+func (p *Plugin) startProcess() (*pluginProcess, error) {
+	cmd := exec.Command(p.Cmd, p.args...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "stdin pipe")
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "stdout pipe")
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "stderr pipe")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "plugin start")
+	}
+
+	proc := &pluginProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		started: time.Now(),
+		pending: make(map[uint64]chan PluginResponse),
+		exited:  make(chan struct{}),
+	}
+
+	logged := make(chan struct{})
+	go func() {
+		defer close(logged)
+		s := bufio.NewScanner(stderr)
+		for s.Scan() {
+			log.Info().Msgf("Plugin %s: %s", p.name, s.Text())
+		}
+	}()
+
+	go func() {
+		proc.read(p.name, stdout)
+		<-logged
+		err := cmd.Wait()
+		if err == nil {
+			err = errors.New("exit status 0")
+		}
+		proc.err = err
+		close(proc.exited)
+	}()
+
+	log.Info().Msgf("Plugin %s started: %s", p.name, p.Cmd)
+	return proc, nil
+}
+
+// read passes the responses to the pending calls until stdout is closed.
+func (proc *pluginProcess) read(name string, stdout io.Reader) {
+	s := bufio.NewScanner(stdout)
+	s.Buffer(make([]byte, 0, 64*1024), pluginResponseMaxSize)
+
+	for s.Scan() {
+		r := PluginResponse{}
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			log.Warn().Err(err).Msgf("Plugin %s wrote an invalid response: %s", name, s.Text())
+			continue
+		}
+
+		proc.lock.Lock()
+		c, ok := proc.pending[r.ID]
+		proc.lock.Unlock()
+		if !ok {
+			log.Warn().Msgf("Plugin %s wrote a response to an unknown request (id: %d)", name, r.ID)
+			continue
+		}
+
+		select {
+		case c <- r:
+		default:
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		log.Error().Err(err).Msgf("Plugin %s stdout read", name)
+	}
+	// Unblocks a plugin that is still writing, so that it can exit
+	_, _ = io.Copy(io.Discard, stdout)
+}
+
+func (proc *pluginProcess) register(id uint64) chan PluginResponse {
+	c := make(chan PluginResponse, 1)
+
+	proc.lock.Lock()
+	proc.pending[id] = c
+	proc.lock.Unlock()
+	proc.calls.Add(1)
+
+	return c
+}
+
+func (proc *pluginProcess) unregister(id uint64) {
+	proc.lock.Lock()
+	delete(proc.pending, id)
+	proc.lock.Unlock()
+	proc.calls.Done()
+}
+
+// write writes the line to the plugin's stdin. The write blocks while the plugin does not read its stdin (and the pipe
+// is full), so it is abandoned once ctx is done. An abandoned write completes once the plugin reads its stdin or fails
+// once the plugin exits.
+func (proc *pluginProcess) write(ctx context.Context, line []byte) error {
+	done := make(chan error, 1)
+	go func() {
+		proc.writeLock.Lock()
+		defer proc.writeLock.Unlock()
+
+		_, err := proc.stdin.Write(line)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newPluginMetrics(name string) pluginMetrics {
+	m := pluginMetrics{}
+	mr := getMetricsRepository()
+	lbl := observability.NewLabels().Add("plugin", name)
+
+	m.restarts = mr.Count("plugin_restarts", lbl)
+	m.timeouts = mr.Count("plugin_call_timeouts", lbl)
+	return m
+}
@@ -0,0 +1,269 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const pluginTestEnv = "OPENSPA_TEST_PLUGIN"
+
+// pluginTestNew returns a plugin that executes the test binary as TestPluginHelperProcess.
+func pluginTestNew(t *testing.T, s PluginSettings) *Plugin {
+	t.Setenv(pluginTestEnv, "1")
+
+	p := NewPlugin("test", os.Args[0], s)
+	p.args = []string{"-test.run=^TestPluginHelperProcess$"}
+	t.Cleanup(func() { _ = p.Stop() })
+	return p
+}
+
+// TestPluginHelperProcess is the plugin of the tests, not a test.
+func TestPluginHelperProcess(_ *testing.T) {
+	if os.Getenv(pluginTestEnv) != "1" {
+		return
+	}
+
+	var lock sync.Mutex
+	hang := false
+	respond := func(r PluginResponse) {
+		b, _ := json.Marshal(r)
+		lock.Lock()
+		defer lock.Unlock()
+		_, _ = os.Stdout.Write(append(b, '\n'))
+	}
+
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		req := struct {
+			ID     uint64          `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}{}
+		if err := json.Unmarshal(s.Bytes(), &req); err != nil {
+			os.Exit(2)
+		}
+
+		r := PluginResponse{ID: req.ID}
+		switch req.Method {
+		case PluginMethodPing:
+			lock.Lock()
+			h := hang
+			lock.Unlock()
+			if h {
+				continue
+			}
+		case PluginMethodFirewallSetup, PluginMethodRuleAdd, PluginMethodRuleRemove:
+			in := FirewallCommandRuleRemoveInput{}
+			_ = json.Unmarshal(req.Params, &in)
+			if req.Method != PluginMethodFirewallSetup && in.PortStart == 0 {
+				r.Error = "port is missing"
+			}
+		case PluginMethodRuleList:
+			r.Result, _ = json.Marshal(FirewallCommandRuleListOutput{{
+				ClientUUID:     "c1",
+				ClientIP:       []byte{88, 200, 23, 12},
+				TargetIP:       []byte{88, 200, 23, 3},
+				TargetProtocol: FirewallProtoTCP,
+				PortStart:      22,
+			}})
+		case PluginMethodAuthorize:
+			in := AuthorizationStrategyCommandAuthorizeInput{}
+			_ = json.Unmarshal(req.Params, &in)
+			if in.TargetPortStart == 22 {
+				r.Error = "denied"
+			} else {
+				r.Result = json.RawMessage(`{"duration":60}`)
+			}
+		case "echo":
+			r.Result = req.Params
+		case "slow":
+			go func() {
+				time.Sleep(200 * time.Millisecond)
+				r.Result = req.Params
+				respond(r)
+			}()
+			continue
+		case "sleep":
+			continue
+		case "stall":
+			// Stops reading stdin for the duration (in milliseconds) and exits
+			ms := 0
+			_ = json.Unmarshal(req.Params, &ms)
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+			os.Exit(0)
+		case "hang":
+			lock.Lock()
+			hang = true
+			lock.Unlock()
+		case "exit":
+			os.Exit(1)
+		default:
+			r.Error = "unknown method"
+		}
+		respond(r)
+	}
+
+	os.Exit(0)
+}
+
+func TestPlugin_Call(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	p := pluginTestNew(t, PluginSettings{Timeout: 5 * time.Second})
+	assert.Equal(t, HealthStatusStarting, p.Health().Status)
+	require.NoError(t, p.Start())
+	assert.Equal(t, HealthStatusOK, p.Health().Status)
+
+	res, err := p.Call(context.Background(), "echo", map[string]int{"a": 1})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"a":1}`, string(res))
+
+	_, err = p.Call(context.Background(), "unknown", nil)
+	assert.EqualError(t, err, "plugin error: unknown method")
+
+	// The responses are matched to the requests by ID
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		method := "echo"
+		if i%2 == 0 {
+			method = "slow"
+		}
+
+		wg.Add(1)
+		go func(i int, method string) {
+			defer wg.Done()
+			res, err := p.Call(context.Background(), method, i)
+			assert.NoError(t, err)
+			assert.Equal(t, json.RawMessage(mustJSON(t, i)), res)
+		}(i, method)
+	}
+	wg.Wait()
+
+	assert.NoError(t, p.Check())
+	assert.NoError(t, p.Stop())
+
+	_, err = p.Call(context.Background(), "echo", 1)
+	assert.ErrorIs(t, err, ErrPluginStopped)
+}
+
+func TestPlugin_Timeout(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	p := pluginTestNew(t, PluginSettings{Timeout: 100 * time.Millisecond})
+
+	_, err := p.Call(context.Background(), "sleep", nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, p.metrics.timeouts.Get())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = p.Call(ctx, "sleep", nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, p.metrics.timeouts.Get())
+
+	// The plugin is still usable
+	assert.NoError(t, p.Check())
+}
+
+func TestPlugin_WriteTimeout(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	p := pluginTestNew(t, PluginSettings{Timeout: 100 * time.Millisecond})
+	require.NoError(t, p.Start())
+
+	_, err := p.Call(context.Background(), "stall", 1000)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The request does not fit in the pipe, the write blocks until the call times out
+	start := time.Now()
+	_, err = p.Call(context.Background(), "echo", strings.Repeat("a", 1024*1024))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, 2, p.metrics.timeouts.Get())
+
+	// The plugin is restarted once it exits
+	assert.Eventually(t, func() bool {
+		return p.metrics.restarts.Get() == 1 && p.Health().Status == HealthStatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, p.Check())
+}
+
+func TestPlugin_HealthCheckWriteTimeout(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	p := pluginTestNew(t, PluginSettings{Timeout: time.Second, HealthCheckInterval: 50 * time.Millisecond})
+	require.NoError(t, p.Start())
+
+	// The plugin stops reading stdin, the pending write blocks the pings until they time out and the plugin is killed
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := p.Call(ctx, "stall", 60000)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = p.Call(ctx, "echo", strings.Repeat("a", 1024*1024))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	assert.Eventually(t, func() bool {
+		return p.metrics.restarts.Get() >= 1 && p.Health().Status == HealthStatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, p.Check())
+}
+
+func TestPlugin_Restart(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	p := pluginTestNew(t, PluginSettings{Timeout: time.Second})
+	require.NoError(t, p.Start())
+
+	_, err := p.Call(context.Background(), "exit", nil)
+	assert.Error(t, err)
+
+	assert.Eventually(t, func() bool {
+		return p.metrics.restarts.Get() == 1 && p.Health().Status == HealthStatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, p.Check())
+}
+
+func TestPlugin_HealthCheck(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	p := pluginTestNew(t, PluginSettings{Timeout: 100 * time.Millisecond, HealthCheckInterval: 50 * time.Millisecond})
+	require.NoError(t, p.Start())
+
+	// The plugin stops responding to pings, it is killed and restarted
+	_, err := p.Call(context.Background(), "hang", nil)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return p.metrics.restarts.Get() >= 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return p.Health().Status == HealthStatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, p.Check())
+}
+
+func TestPlugin_StartFailed(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	p := NewPlugin("test", "/nonexistent/plugin", PluginSettingsDefault)
+	assert.Error(t, p.Start())
+	_, err := p.Call(context.Background(), PluginMethodPing, nil)
+	assert.Error(t, err)
+	assert.NoError(t, p.Stop())
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return b
+}
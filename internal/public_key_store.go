@@ -0,0 +1,283 @@
+package internal
+
+import (
+	crypt "crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/greenstatic/openspa/pkg/openspalib/crypto"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const publicKeyStoreReloadDebounce = 200 * time.Millisecond
+
+var _ crypto.PublicKeyLookuper = &PublicKeyStore{}
+
+// PublicKeyStore is an in-memory index of the client public keys found in a directory (same file naming rules as
+// PublicKeyLookupDir). The directory is read on Start and then watched (inotify on Linux) for changes, so client keys
+// that are added, modified or removed are picked up without a restart. Lookups never touch the filesystem.
+type PublicKeyStore struct {
+	dirPath string
+
+	keys    map[string]crypt.PublicKey
+	clients []string
+	// invalid contains files that failed to be parsed along with their modification time, so that each malformed file
+	// is reported only once (until it is modified).
+	invalid map[string]time.Time
+	lock    sync.RWMutex
+
+	watcher *fsnotify.Watcher
+	stop    chan struct{}
+
+	metrics publicKeyStoreMetrics
+}
+
+type publicKeyStoreMetrics struct {
+	keys         observability.Gauge
+	invalidFiles observability.Gauge
+	reloads      observability.Counter
+	reloadFailed observability.Counter
+}
+
+func NewPublicKeyStore(dirPath string) *PublicKeyStore {
+	p := &PublicKeyStore{
+		dirPath: dirPath,
+		keys:    make(map[string]crypt.PublicKey),
+		invalid: make(map[string]time.Time),
+		metrics: newPublicKeyStoreMetrics(),
+	}
+	return p
+}
+
+// Start loads the directory and starts watching it for changes.
+func (p *PublicKeyStore) Start() error {
+	if err := p.Load(); err != nil {
+		return errors.Wrap(err, "load")
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "new watcher")
+	}
+
+	if err := w.Add(p.dirPath); err != nil {
+		_ = w.Close()
+		return errors.Wrap(err, "watch dir")
+	}
+
+	p.lock.Lock()
+	p.watcher = w
+	p.lock.Unlock()
+
+	p.stop = make(chan struct{})
+	go p.watchRoutine(w, p.stop)
+
+	return nil
+}
+
+func (p *PublicKeyStore) Stop() error {
+	p.lock.Lock()
+	w := p.watcher
+	p.watcher = nil
+	p.lock.Unlock()
+
+	if w == nil {
+		return nil
+	}
+
+	close(p.stop)
+	return w.Close()
+}
+
+// Health reports whether the keys have been loaded and the directory is being watched.
+func (p *PublicKeyStore) Health() HealthComponent {
+	p.lock.RLock()
+	started := p.watcher != nil
+	clients := len(p.clients)
+	p.lock.RUnlock()
+
+	if !started {
+		return HealthComponent{Status: HealthStatusStarting}
+	}
+
+	if _, err := os.Stat(p.dirPath); err != nil {
+		return HealthComponent{Status: HealthStatusFailing, Message: err.Error()}
+	}
+
+	return HealthComponent{Status: HealthStatusOK, Message: fmt.Sprintf("%d clients", clients)}
+}
+
+func (p *PublicKeyStore) watchRoutine(w *fsnotify.Watcher, stop chan struct{}) {
+	// Events are debounced, since a single file copy results in multiple events
+	var reload <-chan time.Time
+
+	for {
+		select {
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			log.Debug().Msgf("Public key store directory event: %s", e.String())
+			if reload == nil {
+				reload = time.After(publicKeyStoreReloadDebounce)
+			}
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Err(err).Msgf("Public key store directory watch error")
+
+		case <-reload:
+			reload = nil
+			if err := p.Load(); err != nil {
+				log.Error().Err(err).Msgf("Public key store reload failed")
+			}
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Load (re)reads all the client public keys from the directory and replaces the index.
+func (p *PublicKeyStore) Load() error {
+	de, err := os.ReadDir(p.dirPath)
+	if err != nil {
+		p.metrics.reloadFailed.Inc()
+		return errors.Wrap(err, "read public key dir")
+	}
+
+	p.lock.RLock()
+	prevInvalid := p.invalid
+	p.lock.RUnlock()
+
+	keys := make(map[string]crypt.PublicKey)
+	clients := make([]string, 0, len(de))
+	invalid := make(map[string]time.Time)
+
+	// os.ReadDir returns entries sorted by filename, same as with PublicKeyLookupDir the first match wins
+	for _, e := range de {
+		if e.IsDir() {
+			continue
+		}
+
+		name := e.Name()
+		pub, modTime, err := p.readPublicKey(name)
+		if err != nil {
+			invalid[name] = modTime
+			if reported, ok := prevInvalid[name]; !ok || !reported.Equal(modTime) {
+				log.Warn().Err(err).Msgf("Public key store skipping invalid client key file: %s", name)
+			}
+			continue
+		}
+
+		uuids := p.clientUUIDsFromFilename(name)
+		// The files of the same client (e.g. client1.key and client1.pem) list the client once
+		if _, exists := keys[uuids[len(uuids)-1]]; !exists {
+			clients = append(clients, uuids[len(uuids)-1])
+		}
+		for _, uuid := range uuids {
+			if _, exists := keys[uuid]; !exists {
+				keys[uuid] = pub
+			}
+		}
+	}
+
+	sort.Strings(clients)
+
+	p.lock.Lock()
+	p.keys = keys
+	p.clients = clients
+	p.invalid = invalid
+	p.lock.Unlock()
+
+	p.metrics.reloads.Inc()
+	p.metrics.keys.Set(float64(len(clients)))
+	p.metrics.invalidFiles.Set(float64(len(invalid)))
+
+	log.Debug().Msgf("Public key store loaded %d client keys (%d invalid files) from: %s", len(clients),
+		len(invalid), p.dirPath)
+
+	return nil
+}
+
+func (p *PublicKeyStore) readPublicKey(name string) (crypt.PublicKey, time.Time, error) {
+	path := filepath.Join(p.dirPath, name)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "stat")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fi.ModTime(), errors.Wrap(err, "client key file read")
+	}
+
+	pub, err := crypto.RSADecodePublicKey(string(b))
+	if err != nil {
+		return nil, fi.ModTime(), errors.Wrap(err, "rsa decode client key")
+	}
+
+	return pub, fi.ModTime(), nil
+}
+
+// clientUUIDsFromFilename returns the keys under which the file is indexed: the filename itself and the filename
+// without the (last) extension.
+func (p *PublicKeyStore) clientUUIDsFromFilename(name string) []string {
+	fx := strings.Split(name, ".")
+	if len(fx) == 1 {
+		return []string{name}
+	}
+
+	return []string{name, strings.Join(fx[:len(fx)-1], ".")}
+}
+
+func (p *PublicKeyStore) LookupPublicKey(clientUUID string) (crypt.PublicKey, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	pub, ok := p.keys[clientUUID]
+	if !ok {
+		return nil, errors.New("no key found")
+	}
+
+	return pub, nil
+}
+
+// ClientUUIDs returns the sorted client UUIDs (filenames without extension) that have a valid public key.
+func (p *PublicKeyStore) ClientUUIDs() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	uuids := make([]string, len(p.clients))
+	copy(uuids, p.clients)
+
+	return uuids
+}
+
+func (p *PublicKeyStore) DirPath() string {
+	return p.dirPath
+}
+
+func newPublicKeyStoreMetrics() publicKeyStoreMetrics {
+	m := publicKeyStoreMetrics{}
+	mr := getMetricsRepository()
+	lbl := observability.NewLabels()
+
+	m.keys = mr.Gauge("public_key_store_keys", lbl)
+	m.invalidFiles = mr.Gauge("public_key_store_invalid_files", lbl)
+	m.reloads = mr.Count("public_key_store_reloads", lbl)
+	m.reloadFailed = mr.Count("public_key_store_reload_failed", lbl)
+
+	return m
+}
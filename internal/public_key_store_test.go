@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/greenstatic/openspa/pkg/openspalib/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func publicKeyStoreTestKey(t *testing.T) string {
+	_, pub, err := crypto.RSAKeypair(2048)
+	require.NoError(t, err)
+
+	pubStr, err := crypto.RSAEncodePublicKey(pub)
+	require.NoError(t, err)
+
+	return pubStr
+}
+
+func TestPublicKeyStore_LookupPublicKey(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "client1.key"), []byte(publicKeyStoreTestKey(t)), fs.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "client2.key"), []byte(publicKeyStoreTestKey(t)), fs.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "client3.key"), []byte("malformed"), fs.ModePerm))
+	// A second key file of the client, the first one wins
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "client1.pem"), []byte(publicKeyStoreTestKey(t)), fs.ModePerm))
+
+	p := NewPublicKeyStore(dir)
+	require.NoError(t, p.Load())
+
+	pubKey, err := p.LookupPublicKey("client1")
+	assert.NoError(t, err)
+	assert.NotNil(t, pubKey)
+
+	pubKey2, err := p.LookupPublicKey("client2.key")
+	assert.NoError(t, err)
+	assert.NotNil(t, pubKey2)
+
+	pubKey3, err := p.LookupPublicKey("client3")
+	assert.Error(t, err)
+	assert.Nil(t, pubKey3)
+
+	pubKey4, err := p.LookupPublicKey("client4")
+	assert.Error(t, err)
+	assert.Nil(t, pubKey4)
+
+	assert.Equal(t, []string{"client1", "client2"}, p.ClientUUIDs())
+	assert.Len(t, p.invalid, 1)
+}
+
+func TestPublicKeyStore_Watch(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "client1.key"), []byte(publicKeyStoreTestKey(t)), fs.ModePerm))
+
+	p := NewPublicKeyStore(dir)
+	require.NoError(t, p.Start())
+	defer func() {
+		assert.NoError(t, p.Stop())
+	}()
+
+	assert.Equal(t, 1, p.metrics.reloads.Get())
+
+	_, err := p.LookupPublicKey("client2")
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "client2.key"), []byte(publicKeyStoreTestKey(t)), fs.ModePerm))
+
+	assert.Eventually(t, func() bool {
+		_, err := p.LookupPublicKey("client2")
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "client1.key")))
+
+	assert.Eventually(t, func() bool {
+		_, err := p.LookupPublicKey("client1")
+		return err != nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.Equal(t, []string{"client2"}, p.ClientUUIDs())
+}
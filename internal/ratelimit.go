@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+const RateLimiterMaxKeysDefault = 100000
+
+type RateLimitSettings struct {
+	// Rate is the number of allowed requests per second (sustained), if 0 the rate limiter is disabled
+	Rate float64
+	// Burst is the maximum number of requests that are allowed at once
+	Burst int
+	// MaxKeys is the maximum number of tracked keys, if 0 RateLimiterMaxKeysDefault is used
+	MaxKeys int
+}
+
+func (s RateLimitSettings) Enabled() bool {
+	return s.Rate > 0
+}
+
+// RateLimiter is a token bucket rate limiter with a bucket per key. Memory usage is bounded, once MaxKeys keys are
+// tracked the least recently used key is evicted (which effectively refills its bucket).
+type RateLimiter struct {
+	rate    float64
+	burst   float64
+	maxKeys int
+
+	buckets map[string]*list.Element
+	lru     *list.List
+	lock    sync.Mutex
+
+	now func() time.Time
+}
+
+type rateLimiterBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(s RateLimitSettings) *RateLimiter {
+	r := &RateLimiter{
+		rate:    s.Rate,
+		burst:   float64(s.Burst),
+		maxKeys: s.MaxKeys,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+
+	if r.maxKeys <= 0 {
+		r.maxKeys = RateLimiterMaxKeysDefault
+	}
+
+	if r.burst < 1 {
+		r.burst = 1
+	}
+
+	return r
+}
+
+// Allow consumes a token from the key's bucket and returns true, or returns false if the bucket is empty.
+func (r *RateLimiter) Allow(key string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+
+	elm, ok := r.buckets[key]
+	if !ok {
+		if r.lru.Len() >= r.maxKeys {
+			oldest := r.lru.Back()
+			r.lru.Remove(oldest)
+			delete(r.buckets, oldest.Value.(*rateLimiterBucket).key)
+		}
+
+		elm = r.lru.PushFront(&rateLimiterBucket{
+			key:    key,
+			tokens: r.burst,
+			last:   now,
+		})
+		r.buckets[key] = elm
+	} else {
+		r.lru.MoveToFront(elm)
+	}
+
+	b := elm.Value.(*rateLimiterBucket)
+
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Size returns the number of tracked keys.
+func (r *RateLimiter) Size() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lru.Len()
+}
+
+// rateLimitKeyFromIP returns the key under which the ip is rate limited. IPv6 addresses are aggregated to their /64
+// prefix, since a single host typically controls (at least) a whole /64.
+func rateLimitKeyFromIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	r := NewRateLimiter(RateLimitSettings{Rate: 1, Burst: 2})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	assert.True(t, r.Allow("a"))
+	assert.True(t, r.Allow("a"))
+	assert.False(t, r.Allow("a"))
+
+	// Other keys have their own bucket
+	assert.True(t, r.Allow("b"))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.False(t, r.Allow("a"))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, r.Allow("a"))
+	assert.False(t, r.Allow("a"))
+
+	// Bucket does not fill above burst
+	now = now.Add(time.Hour)
+	assert.True(t, r.Allow("a"))
+	assert.True(t, r.Allow("a"))
+	assert.False(t, r.Allow("a"))
+}
+
+func TestRateLimiter_LRUEviction(t *testing.T) {
+	r := NewRateLimiter(RateLimitSettings{Rate: 1, Burst: 1, MaxKeys: 2})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	assert.True(t, r.Allow("a"))
+	assert.True(t, r.Allow("b"))
+	assert.False(t, r.Allow("a")) // a is now the most recently used
+	assert.Equal(t, 2, r.Size())
+
+	assert.True(t, r.Allow("c")) // evicts b
+	assert.Equal(t, 2, r.Size())
+
+	assert.False(t, r.Allow("a"))
+	assert.True(t, r.Allow("b")) // b was evicted, so it has a full bucket
+}
+
+func TestRateLimitKeyFromIP(t *testing.T) {
+	assert.Equal(t, "88.200.23.12", rateLimitKeyFromIP(net.IPv4(88, 200, 23, 12)))
+	assert.Equal(t, "88.200.23.12", rateLimitKeyFromIP(net.IPv4(88, 200, 23, 12).To4()))
+	assert.Equal(t, "2001:db8:1:2::/64", rateLimitKeyFromIP(net.ParseIP("2001:db8:1:2:3:4:5:6")))
+	assert.Equal(t, rateLimitKeyFromIP(net.ParseIP("2001:db8:1:2::1")), rateLimitKeyFromIP(net.ParseIP("2001:db8:1:2::2")))
+	assert.NotEqual(t, rateLimitKeyFromIP(net.ParseIP("2001:db8:1:2::1")), rateLimitKeyFromIP(net.ParseIP("2001:db8:1:3::1")))
+}
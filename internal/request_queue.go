@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const RequestQueueSizeDefault = 1000
+
+type RequestQueueDropPolicy string
+
+const (
+	// RequestQueueDropNewest drops the incoming request when the queue is full
+	RequestQueueDropNewest RequestQueueDropPolicy = "newest"
+	// RequestQueueDropOldest drops the longest waiting request when the queue is full
+	RequestQueueDropOldest RequestQueueDropPolicy = "oldest"
+)
+
+func (p RequestQueueDropPolicy) Verify() error {
+	switch p {
+	case RequestQueueDropNewest, RequestQueueDropOldest:
+		return nil
+	}
+
+	return errors.New("invalid drop policy")
+}
+
+type RequestPriority int
+
+const (
+	// RequestPriorityLow are requests that did not pass (or were not subject to) the ADK check
+	RequestPriorityLow RequestPriority = iota
+	// RequestPriorityHigh are requests that passed the ADK check
+	RequestPriorityHigh
+)
+
+func (p RequestPriority) String() string {
+	if p == RequestPriorityHigh {
+		return "high"
+	}
+	return "low"
+}
+
+// DatagramRequestPrioritizer can be optionally implemented by a UDPDatagramRequestHandler to classify requests before
+// they are queued. The classification should be cheap, since it is performed in the UDP read loop.
+type DatagramRequestPrioritizer interface {
+	DatagramRequestPriority(r DatagramRequest) RequestPriority
+}
+
+// requestQueue is a bounded two-level priority queue. When the queue is full, low priority requests are shed before
+// high priority requests. Within the same priority the drop policy decides whether the incoming or the oldest request
+// is dropped.
+type requestQueue struct {
+	size   int
+	policy RequestQueueDropPolicy
+
+	high *list.List
+	low  *list.List
+	lock sync.Mutex
+
+	// ready holds a token for each queued request, so that consumers can block on it (along with a timeout or stop
+	// signal) instead of polling.
+	ready chan struct{}
+}
+
+func newRequestQueue(size int, policy RequestQueueDropPolicy) *requestQueue {
+	if size <= 0 {
+		size = RequestQueueSizeDefault
+	}
+
+	if policy == "" {
+		policy = RequestQueueDropNewest
+	}
+
+	q := &requestQueue{
+		size:   size,
+		policy: policy,
+		high:   list.New(),
+		low:    list.New(),
+		ready:  make(chan struct{}, size),
+	}
+	return q
+}
+
+// push queues the request. If a request had to be dropped, dropped is true and droppedPriority is the priority of the
+// dropped request (which might be the request that was being pushed).
+func (q *requestQueue) push(r QueuedDatagramRequest, p RequestPriority) (dropped bool,
+	droppedPriority RequestPriority) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	l := q.list(p)
+
+	if q.high.Len()+q.low.Len() < q.size {
+		l.PushBack(r)
+		q.ready <- struct{}{}
+		return false, 0
+	}
+
+	// Queue is full, the replaced request's token is reused by the incoming request
+	if p == RequestPriorityHigh && q.low.Len() > 0 {
+		q.low.Remove(q.low.Front())
+		l.PushBack(r)
+		return true, RequestPriorityLow
+	}
+
+	if q.policy == RequestQueueDropOldest && l.Len() > 0 {
+		l.Remove(l.Front())
+		l.PushBack(r)
+		return true, p
+	}
+
+	return true, p
+}
+
+// pop returns the oldest high priority request, or if there is none, the oldest low priority request. Should be called
+// only after receiving a token from ready.
+func (q *requestQueue) pop() (QueuedDatagramRequest, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, l := range []*list.List{q.high, q.low} {
+		if e := l.Front(); e != nil {
+			l.Remove(e)
+			return e.Value.(QueuedDatagramRequest), true
+		}
+	}
+
+	return QueuedDatagramRequest{}, false
+}
+
+func (q *requestQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.high.Len() + q.low.Len()
+}
+
+func (q *requestQueue) list(p RequestPriority) *list.List {
+	if p == RequestPriorityHigh {
+		return q.high
+	}
+	return q.low
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func requestQueueTestRequest(b byte) QueuedDatagramRequest {
+	return QueuedDatagramRequest{DatagramRequest: DatagramRequest{data: []byte{b}}}
+}
+
+func requestQueueTestPopAll(t *testing.T, q *requestQueue) []byte {
+	b := make([]byte, 0)
+	for {
+		select {
+		case <-q.ready:
+			r, ok := q.pop()
+			require.True(t, ok)
+			b = append(b, r.data[0])
+		default:
+			return b
+		}
+	}
+}
+
+func TestRequestQueue_DropNewest(t *testing.T) {
+	q := newRequestQueue(2, RequestQueueDropNewest)
+
+	dropped, _ := q.push(requestQueueTestRequest(1), RequestPriorityLow)
+	assert.False(t, dropped)
+	dropped, _ = q.push(requestQueueTestRequest(2), RequestPriorityLow)
+	assert.False(t, dropped)
+	dropped, p := q.push(requestQueueTestRequest(3), RequestPriorityLow)
+	assert.True(t, dropped)
+	assert.Equal(t, RequestPriorityLow, p)
+
+	assert.Equal(t, []byte{1, 2}, requestQueueTestPopAll(t, q))
+	assert.Equal(t, 0, q.len())
+}
+
+func TestRequestQueue_DropOldest(t *testing.T) {
+	q := newRequestQueue(2, RequestQueueDropOldest)
+
+	q.push(requestQueueTestRequest(1), RequestPriorityLow)
+	q.push(requestQueueTestRequest(2), RequestPriorityLow)
+	dropped, p := q.push(requestQueueTestRequest(3), RequestPriorityLow)
+	assert.True(t, dropped)
+	assert.Equal(t, RequestPriorityLow, p)
+
+	assert.Equal(t, []byte{2, 3}, requestQueueTestPopAll(t, q))
+}
+
+func TestRequestQueue_Priority(t *testing.T) {
+	q := newRequestQueue(3, RequestQueueDropNewest)
+
+	q.push(requestQueueTestRequest(1), RequestPriorityLow)
+	q.push(requestQueueTestRequest(2), RequestPriorityHigh)
+	q.push(requestQueueTestRequest(3), RequestPriorityLow)
+
+	// High priority requests replace low priority requests
+	dropped, p := q.push(requestQueueTestRequest(4), RequestPriorityHigh)
+	assert.True(t, dropped)
+	assert.Equal(t, RequestPriorityLow, p)
+
+	// Low priority requests never replace high priority requests
+	q.push(requestQueueTestRequest(5), RequestPriorityHigh)
+	dropped, p = q.push(requestQueueTestRequest(6), RequestPriorityLow)
+	assert.True(t, dropped)
+	assert.Equal(t, RequestPriorityLow, p)
+
+	// High priority requests are processed first
+	assert.Equal(t, []byte{2, 4, 5}, requestQueueTestPopAll(t, q))
+}
+
+func TestRequestQueueDropPolicy_Verify(t *testing.T) {
+	assert.NoError(t, RequestQueueDropNewest.Verify())
+	assert.NoError(t, RequestQueueDropOldest.Verify())
+	assert.Error(t, RequestQueueDropPolicy("random").Verify())
+}
@@ -13,13 +13,14 @@ import (
 	"github.com/pkg/errors"
 )
 
-func NewServerCipherSuite(c ServerConfigCrypto) (crypto.CipherSuite, error) {
+// NewServerCipherSuite returns the server cipher suite, client public keys are looked up using l (typically a
+// PublicKeyStore for the c.RSA.Client.PublicKeyLookupDir directory).
+func NewServerCipherSuite(c ServerConfigCrypto, l crypto.PublicKeyLookuper) (crypto.CipherSuite, error) {
 	privKey, err := rsaPrivateKeyFromFile(c.RSA.Server.PrivateKeyPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "private key read")
 	}
 
-	l := NewPublicKeyLookupDir(c.RSA.Client.PublicKeyLookupDir)
 	resolve := NewPublicKeyResolveFromClientUUID(l)
 
 	cs := crypto.NewCipherSuite_RSA_SHA256_AES256CBC(privKey, resolve)
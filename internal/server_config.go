@@ -2,7 +2,11 @@ package internal
 
 import (
 	"net"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/greenstatic/openspa/pkg/openspalib"
@@ -19,21 +23,87 @@ type ServerConfig struct {
 	Server        ServerConfigServer        `yaml:"server"`
 	Firewall      ServerConfigFirewall      `yaml:"firewall"`
 	Authorization ServerConfigAuthorization `yaml:"authorization"`
+	TargetPolicy  ServerConfigTargetPolicy  `yaml:"targetPolicy"`
 	Crypto        ServerConfigCrypto        `yaml:"crypto"`
+	Audit         ServerConfigAudit         `yaml:"audit"`
+	Notify        ServerConfigNotify        `yaml:"notify"`
+	Tracing       ServerConfigTracing       `yaml:"tracing"`
 }
 
 type ServerConfigServer struct {
-	IP              string                 `yaml:"ip"`
-	Port            int                    `yaml:"port"`
-	RequestHandlers int                    `yaml:"requestHandlers"`
-	HTTP            ServerConfigServerHTTP `yaml:"http"`
-	ADK             ServerConfigADK        `yaml:"adk"`
+	IP              string `yaml:"ip"`
+	Port            int    `yaml:"port"`
+	RequestHandlers int    `yaml:"requestHandlers"`
+	// RequestHandlersMax is the upper bound to which the request handlers scale with load, optional
+	RequestHandlersMax int                       `yaml:"requestHandlersMax,omitempty"`
+	RequestQueue       ServerConfigRequestQueue  `yaml:"requestQueue"`
+	HTTP               ServerConfigServerHTTP    `yaml:"http"`
+	Control            ServerConfigServerControl `yaml:"control"`
+	ADK                ServerConfigADK           `yaml:"adk"`
+	RateLimit          ServerConfigRateLimit     `yaml:"rateLimit"`
+}
+
+type ServerConfigRequestQueue struct {
+	Size       int    `yaml:"size"`
+	DropPolicy string `yaml:"dropPolicy"` // "newest" or "oldest"
 }
 
 type ServerConfigServerHTTP struct {
 	Enable bool   `yaml:"enable"`
 	IP     string `yaml:"ip"`
 	Port   int    `yaml:"port"`
+
+	TLS ServerConfigServerHTTPTLS `yaml:"tls"`
+
+	// MetricsToken is the bearer token required by the metrics endpoint, if empty the metrics are not authenticated
+	MetricsToken string `yaml:"metricsToken,omitempty"`
+	// AdminToken is the bearer token required by the admin endpoints, if empty the admin endpoints are disabled
+	AdminToken string `yaml:"adminToken,omitempty"`
+}
+
+// ServerConfigServerHTTPTLS enables HTTPS if Cert and Key are set. If ClientCA is set, clients have to present a
+// certificate signed by it (mTLS).
+type ServerConfigServerHTTPTLS struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"clientCA,omitempty"`
+}
+
+// ServerConfigServerControl configures the control socket used for local administration (e.g. openspa server status).
+type ServerConfigServerControl struct {
+	Enable bool   `yaml:"enable"`
+	Socket string `yaml:"socket"`
+	Mode   string `yaml:"mode"` // octal file mode of the socket, e.g. "0660"
+}
+
+// ServerConfigAudit configures the audit log of authorization decisions, if Path is empty the audit log is disabled.
+type ServerConfigAudit struct {
+	Path       string `yaml:"path"`
+	MaxSize    int    `yaml:"maxSize"`    // in megabytes, optional
+	MaxBackups int    `yaml:"maxBackups"` // optional
+}
+
+type ServerConfigNotify struct {
+	Webhooks []ServerConfigNotifyWebhook `yaml:"webhooks"`
+}
+
+type ServerConfigNotifyWebhook struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"` // HMAC-SHA256 key, optional
+	Events []string `yaml:"events"` // if empty all events are sent
+
+	Timeout   string `yaml:"timeout"`   // optional
+	QueueSize int    `yaml:"queueSize"` // optional
+	Retries   int    `yaml:"retries"`   // optional, -1 disables retries
+}
+
+// ServerConfigTracing configures the OpenTelemetry tracing of requests, exported with OTLP over HTTP.
+type ServerConfigTracing struct {
+	Enable   bool   `yaml:"enable"`
+	Endpoint string `yaml:"endpoint"` // host:port of the collector, optional
+	Insecure bool   `yaml:"insecure"` // disables TLS towards the collector
+	// SampleRatio is the fraction of requests that are traced (0-1), optional, all requests are traced if 0
+	SampleRatio float64 `yaml:"sampleRatio,omitempty"`
 }
 
 type ServerConfigADK struct {
@@ -41,6 +111,18 @@ type ServerConfigADK struct {
 	XDP    ServerConfigADKXDP `yaml:"xdp"`
 }
 
+// ServerConfigRateLimit configures the token bucket rate limiters, a limiter with a rate of 0 is disabled.
+type ServerConfigRateLimit struct {
+	SourceIP   ServerConfigRateLimitLimiter `yaml:"sourceIP"`
+	ClientUUID ServerConfigRateLimitLimiter `yaml:"clientUUID"`
+}
+
+type ServerConfigRateLimitLimiter struct {
+	Rate       float64 `yaml:"rate"` // requests per second
+	Burst      int     `yaml:"burst"`
+	MaxEntries int     `yaml:"maxEntries,omitempty"` // optional
+}
+
 const (
 	ServerConfigADKXDPModeSKB    = "skb"
 	ServerConfigADKXDPModeDriver = "driver"
@@ -55,23 +137,111 @@ type ServerConfigADKXDP struct {
 const (
 	ServerConfigFirewallBackendIPTables = "iptables"
 	ServerConfigFirewallBackendCommand  = "command"
-	ServerConfigFirewallBackendNone     = "none" // used for performance measurements, not for production workload
+	ServerConfigFirewallBackendNFTables = "nftables"
+	ServerConfigFirewallBackendIPSet    = "ipset"
+	// ServerConfigFirewallBackendComposite applies the rules to all the Backends (see FirewallComposite)
+	ServerConfigFirewallBackendComposite = "composite"
+	ServerConfigFirewallBackendNone      = "none" // used for performance measurements, not for production workload
 )
 
 type ServerConfigFirewall struct {
 	Backend  string                        `yaml:"backend"`
 	IPTables *ServerConfigFirewallIPTables `yaml:"iptables"`
 	Command  *ServerConfigFirewallCommand  `yaml:"command"`
+	NFTables *ServerConfigFirewallNFTables `yaml:"nftables"` // optional, NFTablesSettingsDefault if missing
+	IPSet    *ServerConfigFirewallIPSet    `yaml:"ipset"`    // optional, IPSetSettingsDefault if missing
+	// Backends of the composite backend, in the order in which the rules are added. Only the backend and its section
+	// are used.
+	Backends  []ServerConfigFirewall        `yaml:"backends,omitempty"`
+	State     ServerConfigFirewallState     `yaml:"state"`
+	Reconcile ServerConfigFirewallReconcile `yaml:"reconcile"`
+	Removal   ServerConfigFirewallRemoval   `yaml:"removal"`
+}
+
+// ServerConfigFirewallState configures the grant journal, if Path is empty grants are not persisted.
+type ServerConfigFirewallState struct {
+	Path string `yaml:"path"`
+	// KeepRules leaves the firewall rules in place when the server stops, they are restored on the next start
+	KeepRules bool `yaml:"keepRules"`
+}
+
+const (
+	ServerConfigFirewallReconcileOrphansKeep   = "keep"
+	ServerConfigFirewallReconcileOrphansRemove = "remove"
+)
+
+// ServerConfigFirewallReconcile configures the reconciliation of the grants with the rules listed by the firewall,
+// which is supported by the iptables, nftables and command (with the rule list command) backends.
+type ServerConfigFirewallReconcile struct {
+	Enable   bool   `yaml:"enable"`
+	Interval string `yaml:"interval"` // optional, duration e.g. "1m", "0s" reconciles only on start
+	// Orphans is the policy for the rules that do not belong to a grant, "keep" (only reported, default) or "remove"
+	Orphans string `yaml:"orphans"`
+}
+
+// ServerConfigFirewallRemoval configures the handling of expired grants whose rule can not be removed, the removal is
+// retried with a backoff and escalated after EscalateAfter failed attempts.
+type ServerConfigFirewallRemoval struct {
+	EscalateAfter int `yaml:"escalateAfter,omitempty"` // optional
+	// EscalateCommand is executed with the grant as JSON on stdin once its removal is escalated, optional
+	EscalateCommand string `yaml:"escalateCommand,omitempty"`
 }
 
 type ServerConfigFirewallIPTables struct {
-	Chain string `yaml:"chain"`
+	Chain       string `yaml:"chain"`
+	BatchWindow string `yaml:"batchWindow"` // optional, duration e.g. "10ms", "0s" disables batching
+	LockWait    string `yaml:"lockWait"`    // optional, duration e.g. "5s", "0s" waits indefinitely
+	// Managed installs the rules that jump to the chain, optional
+	Managed *ServerConfigFirewallIPTablesManaged `yaml:"managed,omitempty"`
+}
+
+// ServerConfigFirewallIPTablesManaged configures the managed mode of the iptables backend (see
+// IPTablesManagedSettings).
+type ServerConfigFirewallIPTablesManaged struct {
+	Enable   bool     `yaml:"enable"`
+	Chain    string   `yaml:"chain"`    // optional, IPTablesManagedChainDefault if empty
+	JumpFrom []string `yaml:"jumpFrom"` // optional, "INPUT" and/or "FORWARD", INPUT if empty
+	Position int      `yaml:"position"` // optional, position of the jump (1 is the first rule)
+	// ProtectedPorts are dropped unless allowed by a grant
+	ProtectedPorts []ServerConfigFirewallIPTablesPort `yaml:"protectedPorts"`
+	// ServerPort is the UDP port that stays reachable, server.port if 0
+	ServerPort int `yaml:"serverPort,omitempty"`
+}
+
+type ServerConfigFirewallIPTablesPort struct {
+	Protocol string `yaml:"protocol"` // "TCP" or "UDP"
+	Port     int    `yaml:"port"`
+	PortEnd  int    `yaml:"portEnd,omitempty"` // optional, the end of the port range
+}
+
+type ServerConfigFirewallNFTables struct {
+	Table    string `yaml:"table"`    // optional
+	Chain    string `yaml:"chain"`    // optional
+	Hook     string `yaml:"hook"`     // "input" or "forward", optional
+	Priority int    `yaml:"priority"` // optional
+}
+
+// ServerConfigFirewallIPSet configures the names of the sets (of IPv4 and IPv6 entries), which can be referenced in the
+// host's iptables rules.
+type ServerConfigFirewallIPSet struct {
+	SetIPv4 string `yaml:"setIPv4"` // optional
+	SetIPv6 string `yaml:"setIPv6"` // optional
 }
 
 type ServerConfigFirewallCommand struct {
 	RuleAdd       string `yaml:"ruleAdd"`
 	RuleRemove    string `yaml:"ruleRemove"`
 	FirewallSetup string `yaml:"firewallSetup,omitempty"` // optional
+	RuleList      string `yaml:"ruleList,omitempty"`      // optional, required for the reconciliation
+	// Plugin replaces the commands with a long-running plugin, optional
+	Plugin *ServerConfigPlugin `yaml:"plugin,omitempty"`
+}
+
+// ServerConfigPlugin configures a long-running plugin (see Plugin) of the command backends.
+type ServerConfigPlugin struct {
+	Command             string `yaml:"command"`
+	Timeout             string `yaml:"timeout"`             // optional, duration of a call e.g. "5s"
+	HealthCheckInterval string `yaml:"healthCheckInterval"` // optional, duration e.g. "10s", "0s" disables the pings
 }
 
 const (
@@ -92,6 +262,27 @@ type ServerConfigAuthorizationSimple struct {
 
 type ServerConfigAuthorizationCommand struct {
 	AuthorizationCmd string `yaml:"authorizationCmd"`
+	// Plugin replaces the authorization command with a long-running plugin, optional
+	Plugin *ServerConfigPlugin `yaml:"plugin,omitempty"`
+}
+
+// ServerConfigTargetPolicy restricts the targets the clients may request (see TargetPolicy). Without any rules every
+// target is allowed.
+type ServerConfigTargetPolicy struct {
+	Allow []ServerConfigTargetPolicyRule `yaml:"allow,omitempty"`
+	// Clients (by UUID) replace the Allow rules for the listed clients
+	Clients map[string][]ServerConfigTargetPolicyRule `yaml:"clients,omitempty"`
+}
+
+type ServerConfigTargetPolicyRule struct {
+	Networks  []string                        `yaml:"networks,omitempty"`  // CIDRs or IPs, any if empty
+	Protocols []string                        `yaml:"protocols,omitempty"` // FirewallProto*, any if empty
+	Ports     []ServerConfigTargetPolicyPorts `yaml:"ports,omitempty"`     // only TCP and UDP, any if empty
+}
+
+type ServerConfigTargetPolicyPorts struct {
+	Port    int `yaml:"port"`
+	PortEnd int `yaml:"portEnd,omitempty"` // optional
 }
 
 type ServerConfigCrypto struct {
@@ -126,10 +317,26 @@ func (s ServerConfig) Verify() error {
 		return errors.Wrap(err, "authorization")
 	}
 
+	if err := s.TargetPolicy.Verify(); err != nil {
+		return errors.Wrap(err, "target policy")
+	}
+
 	if err := s.Crypto.Verify(); err != nil {
 		return errors.Wrap(err, "crypto")
 	}
 
+	if err := s.Audit.Verify(); err != nil {
+		return errors.Wrap(err, "audit")
+	}
+
+	if err := s.Notify.Verify(); err != nil {
+		return errors.Wrap(err, "notify")
+	}
+
+	if err := s.Tracing.Verify(); err != nil {
+		return errors.Wrap(err, "tracing")
+	}
+
 	return nil
 }
 func (s ServerConfigServer) Verify() error {
@@ -145,14 +352,44 @@ func (s ServerConfigServer) Verify() error {
 		return errors.New("invalid request handlers")
 	}
 
+	if s.RequestHandlersMax < 0 {
+		return errors.New("invalid request handlers max")
+	}
+
+	if err := s.RequestQueue.Verify(); err != nil {
+		return errors.Wrap(err, "request queue")
+	}
+
 	if err := s.HTTP.Verify(); err != nil {
 		return errors.Wrap(err, "http")
 	}
 
+	if err := s.Control.Verify(); err != nil {
+		return errors.Wrap(err, "control")
+	}
+
 	if err := s.ADK.Verify(); err != nil {
 		return errors.Wrap(err, "adk")
 	}
 
+	if err := s.RateLimit.Verify(); err != nil {
+		return errors.Wrap(err, "rate limit")
+	}
+
+	return nil
+}
+
+func (s ServerConfigRequestQueue) Verify() error {
+	if s.Size < 0 {
+		return errors.New("invalid size")
+	}
+
+	if s.DropPolicy != "" {
+		if err := RequestQueueDropPolicy(s.DropPolicy).Verify(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -165,10 +402,167 @@ func (s ServerConfigServerHTTP) Verify() error {
 		if s.Port == 0 {
 			return errors.New("invalid port")
 		}
+
+		if err := s.TLS.Verify(); err != nil {
+			return errors.Wrap(err, "tls")
+		}
+	}
+	return nil
+}
+
+func (s ServerConfigServerHTTPTLS) Verify() error {
+	if (s.Cert == "") != (s.Key == "") {
+		return errors.New("cert and key have to be set together")
+	}
+
+	if s.ClientCA != "" && s.Cert == "" {
+		return errors.New("client ca requires cert and key")
+	}
+
+	return nil
+}
+
+func (s ServerConfigServerControl) Verify() error {
+	if !s.Enable {
+		return nil
+	}
+
+	if s.Socket == "" {
+		return errors.New("missing socket")
+	}
+
+	if _, err := s.FileMode(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s ServerConfigServerControl) FileMode() (os.FileMode, error) {
+	if s.Mode == "" {
+		return ControlSocketModeDefault, nil
+	}
+
+	m, err := strconv.ParseUint(s.Mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, errors.New("invalid mode")
+	}
+
+	return os.FileMode(m), nil
+}
+
+func (s ServerConfigAudit) Verify() error {
+	if s.MaxSize < 0 {
+		return errors.New("invalid max size")
+	}
+
+	if s.MaxBackups < 0 {
+		return errors.New("invalid max backups")
+	}
+
+	return nil
+}
+
+func (s ServerConfigAudit) Opt() AuditLogOpt {
+	return AuditLogOpt{
+		MaxSize:    int64(s.MaxSize) * 1024 * 1024,
+		MaxBackups: s.MaxBackups,
+	}
+}
+
+func (s ServerConfigNotify) Verify() error {
+	for i, w := range s.Webhooks {
+		if err := w.Verify(); err != nil {
+			return errors.Wrapf(err, "webhook %d", i)
+		}
+	}
+
+	return nil
+}
+
+func (s ServerConfigNotify) WebhookSettings() []WebhookSettings {
+	l := make([]WebhookSettings, 0, len(s.Webhooks))
+	for _, w := range s.Webhooks {
+		l = append(l, w.Settings())
+	}
+	return l
+}
+
+func (s ServerConfigNotifyWebhook) Verify() error {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return errors.Wrap(err, "url")
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("url scheme should be http or https")
+	}
+
+	for _, e := range s.Events {
+		switch AuditEventType(e) {
+		case AuditEventGrant, AuditEventDeny, AuditEventExpire, AuditEventRevoke, AuditEventRelease,
+			AuditEventRemoveFailed:
+		default:
+			return errors.Errorf("invalid event: %s", e)
+		}
 	}
+
+	if s.Timeout != "" {
+		if d, err := time.ParseDuration(s.Timeout); err != nil || d <= 0 {
+			return errors.New("invalid timeout")
+		}
+	}
+
+	if s.QueueSize < 0 {
+		return errors.New("invalid queue size")
+	}
+
 	return nil
 }
 
+// Settings returns the webhook settings, should be called only if Verify succeeds.
+func (s ServerConfigNotifyWebhook) Settings() WebhookSettings {
+	set := WebhookSettings{
+		URL:       s.URL,
+		Secret:    s.Secret,
+		Events:    make([]AuditEventType, 0, len(s.Events)),
+		QueueSize: s.QueueSize,
+		Retries:   s.Retries,
+	}
+
+	for _, e := range s.Events {
+		set.Events = append(set.Events, AuditEventType(e))
+	}
+
+	if s.Timeout != "" {
+		set.Timeout, _ = time.ParseDuration(s.Timeout)
+	}
+
+	return set
+}
+
+func (s ServerConfigTracing) Verify() error {
+	if s.SampleRatio < 0 || s.SampleRatio > 1 {
+		return errors.New("sample ratio should be between 0 and 1")
+	}
+
+	return nil
+}
+
+func (s ServerConfigTracing) Settings() TracingSettings {
+	set := TracingSettings{
+		Endpoint:    s.Endpoint,
+		Insecure:    s.Insecure,
+		SampleRatio: s.SampleRatio,
+	}
+
+	if set.SampleRatio == 0 {
+		set.SampleRatio = 1
+	}
+
+	return set
+}
+
 func (s ServerConfigADK) Verify() error {
 	if len(s.Secret) > 0 {
 		if len(s.Secret) != openspalib.ADKSecretEncodedLen {
@@ -201,17 +595,61 @@ func (s ServerConfigADKXDP) Verify() error {
 	return nil
 }
 
+func (s ServerConfigRateLimit) Verify() error {
+	if err := s.SourceIP.Verify(); err != nil {
+		return errors.Wrap(err, "source ip")
+	}
+
+	if err := s.ClientUUID.Verify(); err != nil {
+		return errors.Wrap(err, "client uuid")
+	}
+
+	return nil
+}
+
+func (s ServerConfigRateLimitLimiter) Verify() error {
+	if s.Rate < 0 {
+		return errors.New("invalid rate")
+	}
+
+	if s.Rate > 0 && s.Burst < 1 {
+		return errors.New("burst should be at least 1")
+	}
+
+	if s.MaxEntries < 0 {
+		return errors.New("invalid max entries")
+	}
+
+	return nil
+}
+
+func (s ServerConfigRateLimitLimiter) Settings() RateLimitSettings {
+	return RateLimitSettings{
+		Rate:    s.Rate,
+		Burst:   s.Burst,
+		MaxKeys: s.MaxEntries,
+	}
+}
+
 func (s ServerConfigFirewall) Verify() error {
+	if err := s.State.Verify(); err != nil {
+		return errors.Wrap(err, "state")
+	}
+
+	if err := s.Reconcile.Verify(); err != nil {
+		return errors.Wrap(err, "reconcile")
+	}
+
+	if err := s.Removal.Verify(); err != nil {
+		return errors.Wrap(err, "removal")
+	}
+
 	switch s.Backend {
 	case ServerConfigFirewallBackendIPTables:
 		if s.IPTables == nil {
 			return errors.New("iptables field is missing")
 		}
 
-		if s.Command != nil {
-			return errors.New("command is defined while using iptables backend")
-		}
-
 		if err := s.IPTables.Verify(); err != nil {
 			return errors.Wrap(err, "iptables")
 		}
@@ -221,14 +659,35 @@ func (s ServerConfigFirewall) Verify() error {
 			return errors.New("command field is missing")
 		}
 
-		if s.IPTables != nil {
-			return errors.New("iptables is defined while using command backend")
-		}
-
 		if err := s.Command.Verify(); err != nil {
 			return errors.Wrap(err, "command")
 		}
 
+	case ServerConfigFirewallBackendNFTables:
+		if s.NFTables != nil {
+			if err := s.NFTables.Verify(); err != nil {
+				return errors.Wrap(err, "nftables")
+			}
+		}
+
+	case ServerConfigFirewallBackendIPSet:
+		if s.IPSet != nil {
+			if err := s.IPSet.Verify(); err != nil {
+				return errors.Wrap(err, "ipset")
+			}
+		}
+
+	case ServerConfigFirewallBackendComposite:
+		if len(s.Backends) == 0 {
+			return errors.New("backends are missing")
+		}
+
+		for i, b := range s.Backends {
+			if err := b.verifyCompositeBackend(); err != nil {
+				return errors.Wrapf(err, "backends[%d]", i)
+			}
+		}
+
 	case ServerConfigFirewallBackendNone:
 		return nil
 
@@ -236,17 +695,281 @@ func (s ServerConfigFirewall) Verify() error {
 		return errors.New("invalid backend")
 	}
 
+	return s.verifyBackendSections()
+}
+
+// verifyBackendSections checks that only the configuration section of the selected backend is defined.
+func (s ServerConfigFirewall) verifyBackendSections() error {
+	sections := []struct {
+		backend string
+		defined bool
+	}{
+		{ServerConfigFirewallBackendIPTables, s.IPTables != nil},
+		{ServerConfigFirewallBackendCommand, s.Command != nil},
+		{ServerConfigFirewallBackendNFTables, s.NFTables != nil},
+		{ServerConfigFirewallBackendIPSet, s.IPSet != nil},
+		{ServerConfigFirewallBackendComposite, len(s.Backends) != 0},
+	}
+
+	for _, sec := range sections {
+		if sec.defined && sec.backend != s.Backend {
+			return errors.Errorf("%s is defined while using %s backend", sec.backend, s.Backend)
+		}
+	}
+
+	return nil
+}
+
+// verifyCompositeBackend verifies a backend of the composite backend, which can not be composite itself and has no
+// settings of the Firewall Rule Manager.
+func (s ServerConfigFirewall) verifyCompositeBackend() error {
+	switch s.Backend {
+	case ServerConfigFirewallBackendComposite, ServerConfigFirewallBackendNone:
+		return errors.Errorf("%s backend can not be composed", s.Backend)
+	}
+
+	if s.State != (ServerConfigFirewallState{}) || s.Reconcile != (ServerConfigFirewallReconcile{}) ||
+		s.Removal != (ServerConfigFirewallRemoval{}) {
+		return errors.New("state, reconcile and removal can only be defined for the composite backend")
+	}
+
+	return s.Verify()
+}
+
+func (s ServerConfigFirewallState) Verify() error {
+	if s.KeepRules && s.Path == "" {
+		return errors.New("keep rules requires path")
+	}
+
+	return nil
+}
+
+func (s ServerConfigFirewallReconcile) Verify() error {
+	if s.Interval != "" {
+		if d, err := time.ParseDuration(s.Interval); err != nil || d < 0 {
+			return errors.New("invalid interval")
+		}
+	}
+
+	switch s.Orphans {
+	case "", ServerConfigFirewallReconcileOrphansKeep, ServerConfigFirewallReconcileOrphansRemove:
+	default:
+		return errors.New("invalid orphans policy")
+	}
+
+	return nil
+}
+
+// Settings returns the reconciliation options of the Firewall Rule Manager, nil if disabled. Should be called only if
+// Verify succeeds.
+func (s ServerConfigFirewallReconcile) Settings() *FirewallRuleManagerReconcileOpt {
+	if !s.Enable {
+		return nil
+	}
+
+	opt := &FirewallRuleManagerReconcileOpt{
+		Interval:      FirewallReconcileIntervalDefault,
+		RemoveOrphans: s.Orphans == ServerConfigFirewallReconcileOrphansRemove,
+	}
+
+	if s.Interval != "" {
+		opt.Interval, _ = time.ParseDuration(s.Interval)
+	}
+
+	return opt
+}
+
+func (s ServerConfigFirewallRemoval) Verify() error {
+	if s.EscalateAfter < 0 {
+		return errors.New("escalate after should be positive")
+	}
+
 	return nil
 }
 
+func (s ServerConfigFirewallRemoval) Settings() FirewallRuleManagerRemovalOpt {
+	opt := FirewallRuleManagerRemovalOpt{
+		EscalateAfter: s.EscalateAfter,
+	}
+
+	if s.EscalateCommand != "" {
+		opt.Escalator = NewFirewallRemovalEscalationCommand(s.EscalateCommand)
+	}
+
+	return opt
+}
+
 func (s ServerConfigFirewallIPTables) Verify() error {
 	if len(s.Chain) == 0 {
 		return errors.New("chain parameter is empty")
 	}
+
+	if s.BatchWindow != "" {
+		if d, err := time.ParseDuration(s.BatchWindow); err != nil || d < 0 {
+			return errors.New("invalid batch window")
+		}
+	}
+
+	if s.LockWait != "" {
+		if d, err := time.ParseDuration(s.LockWait); err != nil || d < 0 {
+			return errors.New("invalid lock wait")
+		}
+	}
+
+	if s.Managed != nil {
+		if err := s.Managed.Verify(); err != nil {
+			return errors.Wrap(err, "managed")
+		}
+
+		if m := s.Managed.Settings(); m != nil && m.Chain == s.Chain {
+			return errors.New("managed chain should differ from chain")
+		}
+	}
+
+	return nil
+}
+
+// Settings returns the iptables settings, should be called only if Verify succeeds.
+func (s ServerConfigFirewallIPTables) Settings() IPTablesSettings {
+	set := IPTablesSettingsDefault
+	set.Chain = s.Chain
+
+	if s.BatchWindow != "" {
+		set.BatchWindow, _ = time.ParseDuration(s.BatchWindow)
+	}
+
+	if s.LockWait != "" {
+		set.LockWait, _ = time.ParseDuration(s.LockWait)
+	}
+
+	if s.Managed != nil {
+		set.Managed = s.Managed.Settings()
+	}
+
+	return set
+}
+
+func (s ServerConfigFirewallIPTablesManaged) Verify() error {
+	if !s.Enable {
+		return nil
+	}
+
+	// iptables' limit (XT_EXTENSION_MAXNAMELEN - 1)
+	if len(s.Chain) > 28 {
+		return errors.New("chain is too long")
+	}
+
+	for _, c := range s.JumpFrom {
+		if c != "INPUT" && c != "FORWARD" {
+			return errors.Errorf("invalid jump from chain %s", c)
+		}
+	}
+
+	if s.Position < 0 {
+		return errors.New("position should be positive")
+	}
+
+	if len(s.ProtectedPorts) == 0 {
+		return errors.New("protected ports are missing")
+	}
+
+	for _, p := range s.ProtectedPorts {
+		if err := p.Verify(); err != nil {
+			return errors.Wrap(err, "protected port")
+		}
+	}
+
+	if s.ServerPort < 0 || s.ServerPort > 65535 {
+		return errors.New("invalid server port")
+	}
+
+	return nil
+}
+
+// Settings returns the managed mode settings, nil if disabled. Should be called only if Verify succeeds.
+func (s ServerConfigFirewallIPTablesManaged) Settings() *IPTablesManagedSettings {
+	if !s.Enable {
+		return nil
+	}
+
+	set := &IPTablesManagedSettings{
+		Chain:      s.Chain,
+		JumpFrom:   s.JumpFrom,
+		Position:   s.Position,
+		ServerPort: s.ServerPort,
+	}
+
+	if set.Chain == "" {
+		set.Chain = IPTablesManagedChainDefault
+	}
+	if len(set.JumpFrom) == 0 {
+		set.JumpFrom = []string{"INPUT"}
+	}
+	if set.Position == 0 {
+		set.Position = IPTablesManagedPositionDefault
+	}
+
+	for _, p := range s.ProtectedPorts {
+		set.ProtectedPorts = append(set.ProtectedPorts, IPTablesProtectedPort{
+			Proto:     strings.ToUpper(p.Protocol),
+			PortStart: p.Port,
+			PortEnd:   p.PortEnd,
+		})
+	}
+
+	return set
+}
+
+func (s ServerConfigFirewallIPTablesPort) Verify() error {
+	switch strings.ToUpper(s.Protocol) {
+	case FirewallProtoTCP, FirewallProtoUDP:
+	default:
+		return errors.New("protocol should be TCP or UDP")
+	}
+
+	if s.Port < 1 || s.Port > 65535 {
+		return errors.New("invalid port")
+	}
+
+	if s.PortEnd != 0 && (s.PortEnd < s.Port || s.PortEnd > 65535) {
+		return errors.New("invalid port end")
+	}
+
+	return nil
+}
+
+func (s ServerConfigFirewallNFTables) Verify() error {
+	switch s.Hook {
+	case "", NFTablesHookInput, NFTablesHookForward:
+	default:
+		return errors.New("invalid hook")
+	}
+
+	return nil
+}
+
+func (s ServerConfigFirewallIPSet) Verify() error {
+	if s.SetIPv4 != "" && s.SetIPv4 == s.SetIPv6 {
+		return errors.New("ipv4 and ipv6 sets should differ")
+	}
+
+	// ipset's limit (IPSET_MAXNAMELEN - 1)
+	if len(s.SetIPv4) > 31 || len(s.SetIPv6) > 31 {
+		return errors.New("set name is too long")
+	}
+
 	return nil
 }
 
 func (s ServerConfigFirewallCommand) Verify() error {
+	if s.Plugin != nil {
+		if s.RuleAdd != "" || s.RuleRemove != "" || s.FirewallSetup != "" || s.RuleList != "" {
+			return errors.New("commands are defined while using a plugin")
+		}
+
+		return errors.Wrap(s.Plugin.Verify(), "plugin")
+	}
+
 	//nolint:staticcheck
 	if len(s.FirewallSetup) == 0 {
 		// It's okay if the firewall setup command is empty, it is optional
@@ -327,6 +1050,14 @@ func (s ServerConfigAuthorizationSimple) GetDuration() time.Duration {
 }
 
 func (s ServerConfigAuthorizationCommand) Verify() error {
+	if s.Plugin != nil {
+		if s.AuthorizationCmd != "" {
+			return errors.New("authorization cmd is defined while using a plugin")
+		}
+
+		return errors.Wrap(s.Plugin.Verify(), "plugin")
+	}
+
 	if s.AuthorizationCmd == "" {
 		return errors.New("authorization cmd empty")
 	}
@@ -334,6 +1065,166 @@ func (s ServerConfigAuthorizationCommand) Verify() error {
 	return nil
 }
 
+func (s ServerConfigPlugin) Verify() error {
+	if s.Command == "" {
+		return errors.New("command is empty")
+	}
+
+	if s.Timeout != "" {
+		if d, err := time.ParseDuration(s.Timeout); err != nil || d <= 0 {
+			return errors.New("invalid timeout")
+		}
+	}
+
+	if s.HealthCheckInterval != "" {
+		if d, err := time.ParseDuration(s.HealthCheckInterval); err != nil || d < 0 {
+			return errors.New("invalid health check interval")
+		}
+	}
+
+	return nil
+}
+
+// Settings should be called only if Verify succeeds.
+func (s ServerConfigPlugin) Settings() PluginSettings {
+	set := PluginSettingsDefault
+
+	if s.Timeout != "" {
+		set.Timeout, _ = time.ParseDuration(s.Timeout)
+	}
+
+	if s.HealthCheckInterval != "" {
+		set.HealthCheckInterval, _ = time.ParseDuration(s.HealthCheckInterval)
+	}
+
+	return set
+}
+
+func (s ServerConfigTargetPolicy) Verify() error {
+	for i, r := range s.Allow {
+		if err := r.Verify(); err != nil {
+			return errors.Wrapf(err, "allow rule %d", i)
+		}
+	}
+
+	for uuid, rules := range s.Clients {
+		if uuid == "" {
+			return errors.New("client uuid is empty")
+		}
+
+		// Without rules the client's requests would be allowed (as by the empty Allow rules), not denied
+		if len(rules) == 0 {
+			return errors.Errorf("client %s has no rules", uuid)
+		}
+
+		for i, r := range rules {
+			if err := r.Verify(); err != nil {
+				return errors.Wrapf(err, "client %s rule %d", uuid, i)
+			}
+		}
+	}
+
+	return nil
+}
+
+// TargetPolicy returns nil if there are no rules, should be called only if Verify succeeds.
+func (s ServerConfigTargetPolicy) TargetPolicy() *TargetPolicy {
+	if len(s.Allow) == 0 && len(s.Clients) == 0 {
+		return nil
+	}
+
+	p := &TargetPolicy{
+		Default: serverConfigTargetPolicyRules(s.Allow),
+		Clients: make(map[string][]TargetPolicyRule, len(s.Clients)),
+	}
+	for uuid, rules := range s.Clients {
+		p.Clients[uuid] = serverConfigTargetPolicyRules(rules)
+	}
+
+	return p
+}
+
+func (s ServerConfigTargetPolicyRule) Verify() error {
+	for _, n := range s.Networks {
+		if _, err := parseTargetPolicyNetwork(n); err != nil {
+			return errors.Errorf("invalid network %s", n)
+		}
+	}
+
+	for _, p := range s.Protocols {
+		if targetPolicyProto(p) == "" {
+			return errors.Errorf("invalid protocol %s", p)
+		}
+	}
+
+	for _, p := range s.Ports {
+		if p.Port < 1 || p.Port > 65535 {
+			return errors.New("invalid port")
+		}
+
+		if p.PortEnd != 0 && (p.PortEnd < p.Port || p.PortEnd > 65535) {
+			return errors.New("invalid port end")
+		}
+	}
+
+	return nil
+}
+
+func (s ServerConfigTargetPolicyRule) Settings() TargetPolicyRule {
+	r := TargetPolicyRule{}
+
+	for _, n := range s.Networks {
+		network, _ := parseTargetPolicyNetwork(n)
+		r.Networks = append(r.Networks, network)
+	}
+
+	for _, p := range s.Protocols {
+		r.Protos = append(r.Protos, targetPolicyProto(p))
+	}
+
+	for _, p := range s.Ports {
+		r.Ports = append(r.Ports, TargetPolicyPortRange{Start: p.Port, End: p.PortEnd})
+	}
+
+	return r
+}
+
+func serverConfigTargetPolicyRules(rules []ServerConfigTargetPolicyRule) []TargetPolicyRule {
+	set := make([]TargetPolicyRule, 0, len(rules))
+	for _, r := range rules {
+		set = append(set, r.Settings())
+	}
+	return set
+}
+
+// parseTargetPolicyNetwork parses a CIDR or an IP (a single address network).
+func parseTargetPolicyNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid ip")
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// targetPolicyProto returns the FirewallProto* matching p (case-insensitive), empty if there is none.
+func targetPolicyProto(p string) string {
+	for _, proto := range []string{FirewallProtoTCP, FirewallProtoUDP, FirewallProtoICMP, FirewallProtoICMPv6} {
+		if strings.EqualFold(p, proto) {
+			return proto
+		}
+	}
+	return ""
+}
+
 func (s ServerConfigCrypto) Verify() error {
 	if len(s.CipherSuitePriority) == 0 {
 		return errors.New("cipherSuitePriority empty")
@@ -391,6 +1282,15 @@ func (s ServerConfig) Merge(sc ServerConfig) ServerConfig {
 	}
 
 	f.Server.RequestHandlers = sc.Server.RequestHandlers
+	f.Server.RequestHandlersMax = sc.Server.RequestHandlersMax
+
+	if sc.Server.RequestQueue.Size != 0 {
+		f.Server.RequestQueue.Size = sc.Server.RequestQueue.Size
+	}
+
+	if sc.Server.RequestQueue.DropPolicy != "" {
+		f.Server.RequestQueue.DropPolicy = sc.Server.RequestQueue.DropPolicy
+	}
 
 	f.Server.HTTP.Enable = sc.Server.HTTP.Enable
 
@@ -398,21 +1298,89 @@ func (s ServerConfig) Merge(sc ServerConfig) ServerConfig {
 		f.Server.HTTP.IP = sc.Server.HTTP.IP
 	}
 
+	if sc.Server.HTTP.TLS != (ServerConfigServerHTTPTLS{}) {
+		f.Server.HTTP.TLS = sc.Server.HTTP.TLS
+	}
+
+	if sc.Server.HTTP.MetricsToken != "" {
+		f.Server.HTTP.MetricsToken = sc.Server.HTTP.MetricsToken
+	}
+
+	if sc.Server.HTTP.AdminToken != "" {
+		f.Server.HTTP.AdminToken = sc.Server.HTTP.AdminToken
+	}
+
 	if sc.Server.HTTP.Port != 0 {
 		f.Server.HTTP.IP = sc.Server.HTTP.IP
 	}
 
+	f.Server.Control.Enable = sc.Server.Control.Enable
+
+	if sc.Server.Control.Socket != "" {
+		f.Server.Control.Socket = sc.Server.Control.Socket
+	}
+
+	if sc.Server.Control.Mode != "" {
+		f.Server.Control.Mode = sc.Server.Control.Mode
+	}
+
 	if len(sc.Server.ADK.Secret) != 0 {
 		f.Server.ADK = sc.Server.ADK
 	}
 
-	f.Firewall = sc.Firewall
+	if sc.Server.RateLimit != (ServerConfigRateLimit{}) {
+		f.Server.RateLimit = sc.Server.RateLimit
+	}
+
+	f.Firewall = sc.Firewall.withServerPort(f.Server.Port)
 	f.Authorization = sc.Authorization
+	f.TargetPolicy = sc.TargetPolicy
 	f.Crypto = sc.Crypto
 
+	if sc.Audit != (ServerConfigAudit{}) {
+		f.Audit = sc.Audit
+	}
+
+	if len(sc.Notify.Webhooks) != 0 {
+		f.Notify = sc.Notify
+	}
+
+	f.Tracing = sc.Tracing
+
 	return f
 }
 
+// withServerPort sets the server port of the managed iptables backends (including those of the composite backend)
+// that do not configure one.
+func (s ServerConfigFirewall) withServerPort(port int) ServerConfigFirewall {
+	if s.IPTables != nil && s.IPTables.Managed != nil && s.IPTables.Managed.ServerPort == 0 {
+		ipt := *s.IPTables
+		managed := *ipt.Managed
+		managed.ServerPort = port
+		ipt.Managed = &managed
+		s.IPTables = &ipt
+	}
+
+	if len(s.Backends) != 0 {
+		backends := make([]ServerConfigFirewall, 0, len(s.Backends))
+		for _, b := range s.Backends {
+			backends = append(backends, b.withServerPort(port))
+		}
+		s.Backends = backends
+	}
+
+	return s
+}
+
+func ServerConfigFromFile(path string) (ServerConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ServerConfig{}, errors.Wrap(err, "file read")
+	}
+
+	return ServerConfigParse(b)
+}
+
 func ServerConfigParse(b []byte) (ServerConfig, error) {
 	sc := ServerConfig{}
 	if err := yaml.Unmarshal(b, &sc); err != nil {
@@ -430,11 +1398,20 @@ func DefaultServerConfig() ServerConfig {
 			IP:              "::",
 			Port:            openspalib.DefaultServerPort,
 			RequestHandlers: NoRequestHandlersDefault,
+			RequestQueue: ServerConfigRequestQueue{
+				Size:       RequestQueueSizeDefault,
+				DropPolicy: string(RequestQueueDropNewest),
+			},
 			HTTP: ServerConfigServerHTTP{
 				Enable: true,
 				IP:     "::",
 				Port:   ServerHTTPPortDefault,
 			},
+			Control: ServerConfigServerControl{
+				Enable: false,
+				Socket: ControlSocketPathDefault,
+				Mode:   "0600",
+			},
 			ADK: ServerConfigADK{
 				Secret: "",
 				XDP: ServerConfigADKXDP{
@@ -446,6 +1423,81 @@ func DefaultServerConfig() ServerConfig {
 	}
 }
 
+// ServerConfigChanges lists the configuration sections that differ between two configurations. Reloaded are sections
+// that are applied to a running server, while RestartRequired are sections that are only applied on server start.
+type ServerConfigChanges struct {
+	Reloaded        []string `json:"reloaded"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+func (c ServerConfigChanges) Empty() bool {
+	return len(c.Reloaded) == 0 && len(c.RestartRequired) == 0
+}
+
+// reloaded returns whether the section is one of the reloaded sections.
+func (c ServerConfigChanges) reloaded(section string) bool {
+	for _, s := range c.Reloaded {
+		if s == section {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerConfigDiff returns the configuration sections that changed from prev to curr.
+func ServerConfigDiff(prev, curr ServerConfig) ServerConfigChanges {
+	c := ServerConfigChanges{
+		Reloaded:        make([]string, 0),
+		RestartRequired: make([]string, 0),
+	}
+
+	sections := []struct {
+		name       string
+		changed    bool
+		reloadable bool
+	}{
+		{"server.ip", prev.Server.IP != curr.Server.IP, false},
+		{"server.port", prev.Server.Port != curr.Server.Port, false},
+		{"server.requestHandlers", prev.Server.RequestHandlers != curr.Server.RequestHandlers, false},
+		{"server.requestHandlersMax", prev.Server.RequestHandlersMax != curr.Server.RequestHandlersMax, false},
+		{"server.requestQueue", prev.Server.RequestQueue != curr.Server.RequestQueue, false},
+		{"server.http", !reflect.DeepEqual(prev.Server.HTTP, curr.Server.HTTP), false},
+		{"server.control", prev.Server.Control != curr.Server.Control, false},
+		{"server.adk.secret", prev.Server.ADK.Secret != curr.Server.ADK.Secret, true},
+		{"server.adk.xdp", !reflect.DeepEqual(prev.Server.ADK.XDP, curr.Server.ADK.XDP), false},
+		{"server.rateLimit", !reflect.DeepEqual(prev.Server.RateLimit, curr.Server.RateLimit), false},
+		{"firewall", !reflect.DeepEqual(prev.Firewall, curr.Firewall), false},
+		{"authorization", !reflect.DeepEqual(prev.Authorization, curr.Authorization), true},
+		{"targetPolicy", !reflect.DeepEqual(prev.TargetPolicy, curr.TargetPolicy), true},
+		{"crypto", !reflect.DeepEqual(serverConfigCryptoWithoutLookupDir(prev.Crypto),
+			serverConfigCryptoWithoutLookupDir(curr.Crypto)), true},
+		{"crypto.rsa.client.publicKeyLookupDir",
+			prev.Crypto.RSA.Client.PublicKeyLookupDir != curr.Crypto.RSA.Client.PublicKeyLookupDir, false},
+		{"audit", prev.Audit != curr.Audit, false},
+		{"notify", !reflect.DeepEqual(prev.Notify, curr.Notify), false},
+		{"tracing", prev.Tracing != curr.Tracing, false},
+	}
+
+	for _, sec := range sections {
+		if !sec.changed {
+			continue
+		}
+
+		if sec.reloadable {
+			c.Reloaded = append(c.Reloaded, sec.name)
+		} else {
+			c.RestartRequired = append(c.RestartRequired, sec.name)
+		}
+	}
+
+	return c
+}
+
+func serverConfigCryptoWithoutLookupDir(c ServerConfigCrypto) ServerConfigCrypto {
+	c.RSA.Client.PublicKeyLookupDir = ""
+	return c
+}
+
 func serverConfigADKXDPValidMode(m string) error {
 	switch m {
 	// case ServerConfigADKXDPModeSKB, ServerConfigADKXDPModeDriver, ServerConfigADKXDPModeHW:
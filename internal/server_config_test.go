@@ -1,7 +1,10 @@
 package internal
 
 import (
+	"net"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -180,6 +183,199 @@ func TestServerConfigFirewallIPTables(t *testing.T) {
 	assert.NoError(t, ServerConfigFirewallIPTables{
 		Chain: "foo",
 	}.Verify())
+
+	assert.Error(t, ServerConfigFirewallIPTables{Chain: "foo", BatchWindow: "foo"}.Verify())
+	assert.Error(t, ServerConfigFirewallIPTables{Chain: "foo", LockWait: "-1s"}.Verify())
+
+	c := ServerConfigFirewallIPTables{Chain: "foo", BatchWindow: "0s", LockWait: "1m"}
+	assert.NoError(t, c.Verify())
+	assert.Equal(t, IPTablesSettings{Chain: "foo", BatchWindow: 0, LockWait: time.Minute}, c.Settings())
+
+	c = ServerConfigFirewallIPTables{Chain: "foo"}
+	assert.Equal(t, IPTablesBatchWindowDefault, c.Settings().BatchWindow)
+	assert.Equal(t, IPTablesLockWaitDefault, c.Settings().LockWait)
+}
+
+func TestServerConfigFirewallIPTablesManaged(t *testing.T) {
+	managed := ServerConfigFirewallIPTablesManaged{
+		Enable:         true,
+		ProtectedPorts: []ServerConfigFirewallIPTablesPort{{Protocol: "tcp", Port: 22}},
+	}
+	assert.NoError(t, managed.Verify())
+	assert.Equal(t, &IPTablesManagedSettings{
+		Chain:          IPTablesManagedChainDefault,
+		JumpFrom:       []string{"INPUT"},
+		Position:       IPTablesManagedPositionDefault,
+		ProtectedPorts: []IPTablesProtectedPort{{Proto: FirewallProtoTCP, PortStart: 22}},
+	}, managed.Settings())
+
+	assert.NoError(t, ServerConfigFirewallIPTablesManaged{}.Verify())
+	assert.Nil(t, ServerConfigFirewallIPTablesManaged{}.Settings())
+
+	invalid := []ServerConfigFirewallIPTablesManaged{
+		{Enable: true},
+		{Enable: true, ProtectedPorts: []ServerConfigFirewallIPTablesPort{{Protocol: "ICMP", Port: 22}}},
+		{Enable: true, ProtectedPorts: []ServerConfigFirewallIPTablesPort{{Protocol: "TCP"}}},
+		{Enable: true, ProtectedPorts: []ServerConfigFirewallIPTablesPort{{Protocol: "TCP", Port: 22, PortEnd: 21}}},
+		{Enable: true, JumpFrom: []string{"OUTPUT"}, ProtectedPorts: managed.ProtectedPorts},
+		{Enable: true, Position: -1, ProtectedPorts: managed.ProtectedPorts},
+		{Enable: true, Chain: "OPENSPA-0123456789ABCDEFGHIJK", ProtectedPorts: managed.ProtectedPorts},
+	}
+	for _, m := range invalid {
+		assert.Error(t, m.Verify(), "%+v", m)
+	}
+
+	// The managed chain is not the chain of the grants
+	managed.Chain = "foo"
+	assert.Error(t, ServerConfigFirewallIPTables{Chain: "foo", Managed: &managed}.Verify())
+
+	// The server's port by default
+	sc, err := ServerConfigParse([]byte(`
+server:
+  port: 1234
+firewall:
+  backend: iptables
+  iptables:
+    chain: OPENSPA-ALLOW
+    managed:
+      enable: true
+      jumpFrom: [INPUT, FORWARD]
+      position: 3
+      protectedPorts:
+        - protocol: TCP
+          port: 22
+`))
+	assert.NoError(t, err)
+	assert.NoError(t, sc.Firewall.Verify())
+	m := sc.Firewall.IPTables.Settings().Managed
+	if assert.NotNil(t, m) {
+		assert.Equal(t, 1234, m.ServerPort)
+		assert.Equal(t, []string{"INPUT", "FORWARD"}, m.JumpFrom)
+		assert.Equal(t, 3, m.Position)
+	}
+}
+
+func TestServerConfigFirewallNFTables(t *testing.T) {
+	assert.NoError(t, ServerConfigFirewall{Backend: ServerConfigFirewallBackendNFTables}.Verify())
+	assert.NoError(t, ServerConfigFirewall{
+		Backend:  ServerConfigFirewallBackendNFTables,
+		NFTables: &ServerConfigFirewallNFTables{Table: "foo", Hook: NFTablesHookForward, Priority: -10},
+	}.Verify())
+
+	assert.Error(t, ServerConfigFirewall{
+		Backend:  ServerConfigFirewallBackendNFTables,
+		NFTables: &ServerConfigFirewallNFTables{Hook: "output"},
+	}.Verify())
+
+	assert.Error(t, ServerConfigFirewall{
+		Backend:  ServerConfigFirewallBackendNFTables,
+		IPTables: &ServerConfigFirewallIPTables{Chain: "zar"},
+	}.Verify())
+
+	assert.Error(t, ServerConfigFirewall{
+		Backend:  ServerConfigFirewallBackendIPTables,
+		IPTables: &ServerConfigFirewallIPTables{Chain: "zar"},
+		NFTables: &ServerConfigFirewallNFTables{},
+	}.Verify())
+}
+
+func TestServerConfigFirewallIPSet(t *testing.T) {
+	assert.NoError(t, ServerConfigFirewall{Backend: ServerConfigFirewallBackendIPSet}.Verify())
+	assert.NoError(t, ServerConfigFirewall{
+		Backend: ServerConfigFirewallBackendIPSet,
+		IPSet:   &ServerConfigFirewallIPSet{SetIPv4: "FOO", SetIPv6: "FOO6"},
+	}.Verify())
+
+	assert.Error(t, ServerConfigFirewall{
+		Backend: ServerConfigFirewallBackendIPSet,
+		IPSet:   &ServerConfigFirewallIPSet{SetIPv4: "FOO", SetIPv6: "FOO"},
+	}.Verify())
+
+	assert.Error(t, ServerConfigFirewall{
+		Backend: ServerConfigFirewallBackendIPSet,
+		IPSet:   &ServerConfigFirewallIPSet{SetIPv4: "OPENSPA-ALLOW-0123456789ABCDEFGH"},
+	}.Verify())
+
+	assert.Error(t, ServerConfigFirewall{
+		Backend: ServerConfigFirewallBackendIPTables,
+		IPTables: &ServerConfigFirewallIPTables{
+			Chain: "zar",
+		},
+		IPSet: &ServerConfigFirewallIPSet{},
+	}.Verify())
+}
+
+func TestServerConfigFirewallComposite(t *testing.T) {
+	iptables := ServerConfigFirewall{
+		Backend:  ServerConfigFirewallBackendIPTables,
+		IPTables: &ServerConfigFirewallIPTables{Chain: "OPENSPA-ALLOW"},
+	}
+	command := ServerConfigFirewall{
+		Backend: ServerConfigFirewallBackendCommand,
+		Command: &ServerConfigFirewallCommand{RuleAdd: "add", RuleRemove: "remove"},
+	}
+
+	assert.NoError(t, ServerConfigFirewall{
+		Backend:  ServerConfigFirewallBackendComposite,
+		Backends: []ServerConfigFirewall{iptables, command},
+		State:    ServerConfigFirewallState{Path: "/var/lib/openspa/grants"},
+	}.Verify())
+
+	assert.Error(t, ServerConfigFirewall{Backend: ServerConfigFirewallBackendComposite}.Verify())
+
+	// The backends are verified
+	assert.Error(t, ServerConfigFirewall{
+		Backend:  ServerConfigFirewallBackendComposite,
+		Backends: []ServerConfigFirewall{{Backend: ServerConfigFirewallBackendIPTables}},
+	}.Verify())
+
+	// No nesting
+	assert.Error(t, ServerConfigFirewall{
+		Backend: ServerConfigFirewallBackendComposite,
+		Backends: []ServerConfigFirewall{{
+			Backend:  ServerConfigFirewallBackendComposite,
+			Backends: []ServerConfigFirewall{iptables},
+		}},
+	}.Verify())
+
+	// The Firewall Rule Manager settings belong to the composite backend
+	withState := command
+	withState.State = ServerConfigFirewallState{Path: "/var/lib/openspa/grants"}
+	assert.Error(t, ServerConfigFirewall{
+		Backend:  ServerConfigFirewallBackendComposite,
+		Backends: []ServerConfigFirewall{iptables, withState},
+	}.Verify())
+
+	assert.Error(t, ServerConfigFirewall{
+		Backend:  ServerConfigFirewallBackendIPTables,
+		IPTables: iptables.IPTables,
+		Backends: []ServerConfigFirewall{command},
+	}.Verify())
+
+	sc, err := ServerConfigParse([]byte(`
+firewall:
+  backend: composite
+  backends:
+    - backend: iptables
+      iptables:
+        chain: OPENSPA-ALLOW
+    - backend: command
+      command:
+        ruleAdd: /usr/local/bin/edge-rule-add
+        ruleRemove: /usr/local/bin/edge-rule-remove
+`))
+	assert.NoError(t, err)
+	assert.NoError(t, sc.Firewall.Verify())
+	if assert.Len(t, sc.Firewall.Backends, 2) {
+		assert.Equal(t, ServerConfigFirewallBackendIPTables, sc.Firewall.Backends[0].Backend)
+		assert.Equal(t, "/usr/local/bin/edge-rule-add", sc.Firewall.Backends[1].Command.RuleAdd)
+	}
+
+	fw, err := NewFirewallFromServerConfigFirewall(sc.Firewall)
+	assert.NoError(t, err)
+	if c, ok := fw.(*FirewallComposite); assert.True(t, ok) {
+		assert.Len(t, c.backends, 2)
+	}
 }
 
 func TestServerConfigFirewallCommand(t *testing.T) {
@@ -301,3 +497,290 @@ func TestServerConfigAuthorizationSimple(t *testing.T) {
 	assert.Error(t, ServerConfigAuthorizationSimple{Duration: "-1h"}.Verify())
 	assert.Error(t, ServerConfigAuthorizationSimple{Duration: "1ms"}.Verify())
 }
+
+func TestServerConfigDiff(t *testing.T) {
+	prev := DefaultServerConfig()
+	prev.Authorization = ServerConfigAuthorization{
+		Backend: ServerConfigAuthorizationBackendSimple,
+		Simple:  &ServerConfigAuthorizationSimple{Duration: "5s"},
+	}
+
+	assert.True(t, ServerConfigDiff(prev, prev).Empty())
+
+	curr := prev
+	curr.Server.Port = 1000
+	curr.Server.ADK.Secret = "7O4ZIRI"
+	curr.Authorization = ServerConfigAuthorization{
+		Backend: ServerConfigAuthorizationBackendSimple,
+		Simple:  &ServerConfigAuthorizationSimple{Duration: "1h"},
+	}
+	curr.TargetPolicy = ServerConfigTargetPolicy{
+		Allow: []ServerConfigTargetPolicyRule{{Protocols: []string{FirewallProtoTCP}}},
+	}
+
+	c := ServerConfigDiff(prev, curr)
+	assert.False(t, c.Empty())
+	assert.Equal(t, []string{"server.adk.secret", "authorization", "targetPolicy"}, c.Reloaded)
+	assert.Equal(t, []string{"server.port"}, c.RestartRequired)
+}
+
+func TestServerConfigRateLimitLimiter(t *testing.T) {
+	assert.NoError(t, ServerConfigRateLimitLimiter{}.Verify())
+	assert.NoError(t, ServerConfigRateLimitLimiter{Rate: 0.5, Burst: 5, MaxEntries: 1000}.Verify())
+	assert.Error(t, ServerConfigRateLimitLimiter{Rate: -1}.Verify())
+	assert.Error(t, ServerConfigRateLimitLimiter{Rate: 1}.Verify())
+	assert.Error(t, ServerConfigRateLimitLimiter{Rate: 1, Burst: 1, MaxEntries: -1}.Verify())
+
+	assert.False(t, ServerConfigRateLimitLimiter{}.Settings().Enabled())
+	assert.True(t, ServerConfigRateLimitLimiter{Rate: 1, Burst: 1}.Settings().Enabled())
+}
+
+func TestServerConfigRequestQueue(t *testing.T) {
+	assert.NoError(t, ServerConfigRequestQueue{}.Verify())
+	assert.NoError(t, ServerConfigRequestQueue{Size: 100, DropPolicy: "oldest"}.Verify())
+	assert.NoError(t, ServerConfigRequestQueue{Size: 100, DropPolicy: "newest"}.Verify())
+	assert.Error(t, ServerConfigRequestQueue{Size: -1}.Verify())
+	assert.Error(t, ServerConfigRequestQueue{DropPolicy: "random"}.Verify())
+}
+
+func TestServerConfigFirewallState(t *testing.T) {
+	assert.NoError(t, ServerConfigFirewallState{}.Verify())
+	assert.NoError(t, ServerConfigFirewallState{Path: "/var/lib/openspa/grants.journal"}.Verify())
+	assert.NoError(t, ServerConfigFirewallState{Path: "/var/lib/openspa/grants.journal", KeepRules: true}.Verify())
+	assert.Error(t, ServerConfigFirewallState{KeepRules: true}.Verify())
+}
+
+func TestServerConfigFirewallReconcile(t *testing.T) {
+	assert.NoError(t, ServerConfigFirewallReconcile{}.Verify())
+	assert.Nil(t, ServerConfigFirewallReconcile{}.Settings())
+
+	assert.Error(t, ServerConfigFirewallReconcile{Enable: true, Interval: "-1m"}.Verify())
+	assert.Error(t, ServerConfigFirewallReconcile{Enable: true, Orphans: "delete"}.Verify())
+
+	c := ServerConfigFirewallReconcile{Enable: true}
+	assert.NoError(t, c.Verify())
+	assert.Equal(t, &FirewallRuleManagerReconcileOpt{Interval: FirewallReconcileIntervalDefault}, c.Settings())
+
+	c = ServerConfigFirewallReconcile{Enable: true, Interval: "0s", Orphans: ServerConfigFirewallReconcileOrphansRemove}
+	assert.NoError(t, c.Verify())
+	assert.Equal(t, &FirewallRuleManagerReconcileOpt{RemoveOrphans: true}, c.Settings())
+
+	assert.Error(t, ServerConfigFirewall{
+		Backend:   ServerConfigFirewallBackendNFTables,
+		Reconcile: ServerConfigFirewallReconcile{Enable: true, Interval: "foo"},
+	}.Verify())
+}
+
+func TestServerConfigFirewallRemoval(t *testing.T) {
+	assert.NoError(t, ServerConfigFirewallRemoval{}.Verify())
+	assert.Equal(t, FirewallRuleManagerRemovalOpt{}, ServerConfigFirewallRemoval{}.Settings())
+	assert.Error(t, ServerConfigFirewallRemoval{EscalateAfter: -1}.Verify())
+
+	opt := ServerConfigFirewallRemoval{EscalateAfter: 3, EscalateCommand: "/usr/local/bin/escalate"}.Settings()
+	assert.Equal(t, 3, opt.EscalateAfter)
+	e, ok := opt.Escalator.(*FirewallRemovalEscalationCommand)
+	if assert.True(t, ok) {
+		assert.Equal(t, "/usr/local/bin/escalate", e.Cmd)
+	}
+}
+
+func TestServerConfigPlugin(t *testing.T) {
+	assert.Error(t, ServerConfigPlugin{}.Verify())
+	assert.Error(t, ServerConfigPlugin{Command: "plugin", Timeout: "0s"}.Verify())
+	assert.Error(t, ServerConfigPlugin{Command: "plugin", Timeout: "foo"}.Verify())
+	assert.Error(t, ServerConfigPlugin{Command: "plugin", HealthCheckInterval: "-1s"}.Verify())
+
+	p := ServerConfigPlugin{Command: "plugin"}
+	assert.NoError(t, p.Verify())
+	assert.Equal(t, PluginSettingsDefault, p.Settings())
+
+	p = ServerConfigPlugin{Command: "plugin", Timeout: "1s", HealthCheckInterval: "0s"}
+	assert.NoError(t, p.Verify())
+	assert.Equal(t, PluginSettings{Timeout: time.Second}, p.Settings())
+
+	// The plugin replaces the commands
+	assert.NoError(t, ServerConfigFirewallCommand{Plugin: &p}.Verify())
+	assert.Error(t, ServerConfigFirewallCommand{RuleAdd: "add", Plugin: &p}.Verify())
+	assert.Error(t, ServerConfigFirewallCommand{Plugin: &ServerConfigPlugin{}}.Verify())
+	assert.NoError(t, ServerConfigAuthorizationCommand{Plugin: &p}.Verify())
+	assert.Error(t, ServerConfigAuthorizationCommand{AuthorizationCmd: "authz", Plugin: &p}.Verify())
+
+	sc, err := ServerConfigParse([]byte(`
+firewall:
+  backend: command
+  command:
+    plugin:
+      command: /usr/local/bin/firewall-plugin
+      timeout: 2s
+authorization:
+  backend: command
+  command:
+    plugin:
+      command: /usr/local/bin/authorization-plugin
+`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, sc.Firewall.Command.Plugin) {
+		assert.Equal(t, "/usr/local/bin/firewall-plugin", sc.Firewall.Command.Plugin.Command)
+		assert.Equal(t, "2s", sc.Firewall.Command.Plugin.Timeout)
+	}
+	if assert.NotNil(t, sc.Authorization.Command.Plugin) {
+		assert.Equal(t, "/usr/local/bin/authorization-plugin", sc.Authorization.Command.Plugin.Command)
+	}
+}
+
+func TestServerConfigServerControl(t *testing.T) {
+	assert.NoError(t, ServerConfigServerControl{}.Verify())
+	assert.NoError(t, ServerConfigServerControl{Enable: true, Socket: "/run/openspa/control.sock"}.Verify())
+	assert.Error(t, ServerConfigServerControl{Enable: true}.Verify())
+	assert.Error(t, ServerConfigServerControl{Enable: true, Socket: "/run/openspa/control.sock", Mode: "0999"}.Verify())
+
+	m, err := ServerConfigServerControl{}.FileMode()
+	assert.NoError(t, err)
+	assert.Equal(t, ControlSocketModeDefault, m)
+
+	m, err = ServerConfigServerControl{Mode: "0660"}.FileMode()
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), m)
+
+	sc, err := ServerConfigParse([]byte(`
+server:
+  control:
+    enable: true
+    mode: "0660"
+`))
+	assert.NoError(t, err)
+	assert.True(t, sc.Server.Control.Enable)
+	assert.Equal(t, ControlSocketPathDefault, sc.Server.Control.Socket)
+	assert.Equal(t, "0660", sc.Server.Control.Mode)
+}
+
+func TestServerConfigServerHTTPTLS(t *testing.T) {
+	assert.NoError(t, ServerConfigServerHTTPTLS{}.Verify())
+	assert.NoError(t, ServerConfigServerHTTPTLS{Cert: "cert.pem", Key: "key.pem"}.Verify())
+	assert.NoError(t, ServerConfigServerHTTPTLS{Cert: "cert.pem", Key: "key.pem", ClientCA: "ca.pem"}.Verify())
+	assert.Error(t, ServerConfigServerHTTPTLS{Cert: "cert.pem"}.Verify())
+	assert.Error(t, ServerConfigServerHTTPTLS{Key: "key.pem"}.Verify())
+	assert.Error(t, ServerConfigServerHTTPTLS{ClientCA: "ca.pem"}.Verify())
+
+	sc, err := ServerConfigParse([]byte(`
+server:
+  http:
+    enable: true
+    metricsToken: metrics-secret
+    tls:
+      cert: /etc/openspa/tls/cert.pem
+      key: /etc/openspa/tls/key.pem
+      clientCA: /etc/openspa/tls/ca.pem
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "metrics-secret", sc.Server.HTTP.MetricsToken)
+	assert.Equal(t, ServerConfigServerHTTPTLS{
+		Cert:     "/etc/openspa/tls/cert.pem",
+		Key:      "/etc/openspa/tls/key.pem",
+		ClientCA: "/etc/openspa/tls/ca.pem",
+	}, sc.Server.HTTP.TLS)
+
+	sc, err = ServerConfigParse([]byte(`
+server:
+  http:
+    enable: true
+    tls:
+      cert: /etc/openspa/tls/cert.pem
+`))
+	assert.NoError(t, err)
+	assert.Error(t, sc.Server.HTTP.Verify())
+}
+
+func TestServerConfigAudit(t *testing.T) {
+	assert.NoError(t, ServerConfigAudit{}.Verify())
+	assert.NoError(t, ServerConfigAudit{Path: "/var/log/openspa/audit.log", MaxSize: 10, MaxBackups: 3}.Verify())
+	assert.Error(t, ServerConfigAudit{MaxSize: -1}.Verify())
+	assert.Error(t, ServerConfigAudit{MaxBackups: -1}.Verify())
+
+	opt := ServerConfigAudit{MaxSize: 10, MaxBackups: 3}.Opt()
+	assert.Equal(t, AuditLogOpt{MaxSize: 10 * 1024 * 1024, MaxBackups: 3}, opt)
+}
+
+func TestServerConfigNotify(t *testing.T) {
+	assert.NoError(t, ServerConfigNotify{}.Verify())
+	assert.NoError(t, ServerConfigNotifyWebhook{URL: "https://chat.example.com/hook"}.Verify())
+	assert.NoError(t, ServerConfigNotifyWebhook{
+		URL:     "https://chat.example.com/hook",
+		Events:  []string{"grant", "revoke"},
+		Timeout: "2s",
+	}.Verify())
+	assert.Error(t, ServerConfigNotifyWebhook{URL: "chat.example.com/hook"}.Verify())
+	assert.Error(t, ServerConfigNotifyWebhook{URL: "https://chat.example.com/hook", Events: []string{"login"}}.Verify())
+	assert.Error(t, ServerConfigNotifyWebhook{URL: "https://chat.example.com/hook", Timeout: "soon"}.Verify())
+	assert.Error(t, ServerConfigNotify{Webhooks: []ServerConfigNotifyWebhook{{URL: ""}}}.Verify())
+
+	set := ServerConfigNotifyWebhook{
+		URL:     "https://chat.example.com/hook",
+		Secret:  "s3cret",
+		Events:  []string{"grant"},
+		Timeout: "2s",
+		Retries: -1,
+	}.Settings()
+	assert.Equal(t, WebhookSettings{
+		URL:     "https://chat.example.com/hook",
+		Secret:  "s3cret",
+		Events:  []AuditEventType{AuditEventGrant},
+		Timeout: 2 * time.Second,
+		Retries: -1,
+	}, set)
+}
+
+func TestServerConfigTracing(t *testing.T) {
+	assert.NoError(t, ServerConfigTracing{}.Verify())
+	assert.NoError(t, ServerConfigTracing{Enable: true, Endpoint: "localhost:4318", SampleRatio: 0.1}.Verify())
+	assert.Error(t, ServerConfigTracing{SampleRatio: -0.1}.Verify())
+	assert.Error(t, ServerConfigTracing{SampleRatio: 1.5}.Verify())
+
+	assert.Equal(t, TracingSettings{Endpoint: "localhost:4318", Insecure: true, SampleRatio: 1},
+		ServerConfigTracing{Enable: true, Endpoint: "localhost:4318", Insecure: true}.Settings())
+	assert.Equal(t, 0.25, ServerConfigTracing{SampleRatio: 0.25}.Settings().SampleRatio)
+}
+
+func TestServerConfigTargetPolicy(t *testing.T) {
+	sc, err := ServerConfigParse([]byte(`
+targetPolicy:
+  allow:
+    - networks: [10.0.0.0/24, 10.0.1.1]
+      protocols: [tcp]
+      ports:
+        - port: 22
+        - port: 8000
+          portEnd: 8080
+  clients:
+    c1:
+      - protocols: [ICMPv6]
+`))
+	assert.NoError(t, err)
+	assert.NoError(t, sc.TargetPolicy.Verify())
+
+	_, lan, _ := net.ParseCIDR("10.0.0.0/24")
+	assert.Equal(t, &TargetPolicy{
+		Default: []TargetPolicyRule{{
+			Networks: []*net.IPNet{lan, {IP: net.IPv4(10, 0, 1, 1).To4(), Mask: net.CIDRMask(32, 32)}},
+			Protos:   []string{FirewallProtoTCP},
+			Ports:    []TargetPolicyPortRange{{Start: 22}, {Start: 8000, End: 8080}},
+		}},
+		Clients: map[string][]TargetPolicyRule{"c1": {{Protos: []string{FirewallProtoICMPv6}}}},
+	}, sc.TargetPolicy.TargetPolicy())
+
+	assert.NoError(t, ServerConfigTargetPolicy{}.Verify())
+	assert.Nil(t, ServerConfigTargetPolicy{}.TargetPolicy())
+
+	invalid := []ServerConfigTargetPolicy{
+		{Allow: []ServerConfigTargetPolicyRule{{Networks: []string{"10.0.0.0/33"}}}},
+		{Allow: []ServerConfigTargetPolicyRule{{Networks: []string{"foo"}}}},
+		{Allow: []ServerConfigTargetPolicyRule{{Protocols: []string{"SCTP"}}}},
+		{Allow: []ServerConfigTargetPolicyRule{{Ports: []ServerConfigTargetPolicyPorts{{Port: 0}}}}},
+		{Allow: []ServerConfigTargetPolicyRule{{Ports: []ServerConfigTargetPolicyPorts{{Port: 22, PortEnd: 21}}}}},
+		{Clients: map[string][]ServerConfigTargetPolicyRule{"c1": nil}},
+		{Clients: map[string][]ServerConfigTargetPolicyRule{"": {{}}}},
+	}
+	for _, p := range invalid {
+		assert.Error(t, p.Verify(), "%+v", p)
+	}
+}
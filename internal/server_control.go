@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ControlSocketPathDefault             = "/run/openspa/control.sock"
+	ControlSocketModeDefault os.FileMode = 0600
+)
+
+// ControlServer serves the admin API on a Unix socket for local administration. There is no authentication, access is
+// controlled with the socket's file mode (and ownership).
+type ControlServer struct {
+	path string
+	mode os.FileMode
+
+	admin  adminHandler
+	server *http.Server
+}
+
+func NewControlServer(path string, mode os.FileMode) *ControlServer {
+	if mode == 0 {
+		mode = ControlSocketModeDefault
+	}
+
+	c := &ControlServer{
+		path: path,
+		mode: mode,
+	}
+	return c
+}
+
+// Start listens on the control socket and serves requests in a goroutine.
+func (c *ControlServer) Start() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return errors.Wrap(err, "socket directory")
+	}
+
+	if err := c.removeStaleSocket(); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("unix", c.path)
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+
+	if err := os.Chmod(c.path, c.mode); err != nil {
+		_ = l.Close()
+		return errors.Wrap(err, "chmod")
+	}
+
+	mux := http.NewServeMux()
+	c.admin.register(mux, func(next http.Handler) http.Handler {
+		return next
+	})
+	mux.HandleFunc("/", handleStatusNotFound)
+
+	c.server = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	log.Info().Msgf("Starting control socket server on: %s", c.path)
+	go func() {
+		if err := c.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msgf("Control socket server crashed")
+		}
+	}()
+
+	return nil
+}
+
+// removeStaleSocket removes the socket left behind by a previous (crashed) instance, which would cause the listen to
+// fail. A socket that accepts connections belongs to a running instance and is not removed.
+func (c *ControlServer) removeStaleSocket() error {
+	fi, err := os.Lstat(c.path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("unix", c.path, time.Second)
+	if err == nil {
+		_ = conn.Close()
+		return errors.New("socket is in use by another instance")
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return errors.Wrap(err, "dial existing socket")
+	}
+
+	if err := os.Remove(c.path); err != nil {
+		return errors.Wrap(err, "remove stale socket")
+	}
+
+	return nil
+}
+
+func (c *ControlServer) Stop() error {
+	if c.server == nil {
+		return nil
+	}
+
+	log.Debug().Msgf("Stopping control socket server")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The socket file is removed when the listener is closed
+	return c.server.Shutdown(ctx)
+}
+
+// ControlClient is a client of the admin API served on the control socket.
+type ControlClient struct {
+	c *http.Client
+}
+
+func NewControlClient(path string) *ControlClient {
+	c := &ControlClient{
+		c: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					d := net.Dialer{}
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+	return c
+}
+
+func (c *ControlClient) Status() (ServerStatus, error) {
+	st := ServerStatus{}
+	err := c.do(http.MethodGet, "/admin/status", nil, &st)
+	return st, err
+}
+
+func (c *ControlClient) Reload() (ServerConfigChanges, error) {
+	ch := ServerConfigChanges{}
+	err := c.do(http.MethodPost, "/admin/reload", nil, &ch)
+	return ch, err
+}
+
+func (c *ControlClient) Clients() ([]string, error) {
+	cl := AdminClients{}
+	err := c.do(http.MethodGet, "/admin/clients", nil, &cl)
+	return cl.Clients, err
+}
+
+// Grants lists the active grants, if clientUUID is not empty only the grants of the client are returned.
+func (c *ControlClient) Grants(clientUUID string) ([]AdminGrant, error) {
+	g := AdminGrants{}
+	err := c.do(http.MethodGet, adminGrantsPath+c.clientUUIDQuery(clientUUID), nil, &g)
+	return g.Grants, err
+}
+
+func (c *ControlClient) Revoke(id string) error {
+	return c.do(http.MethodDelete, adminGrantsPath+"/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *ControlClient) RevokeClient(clientUUID string) (int, error) {
+	r := AdminRevoked{}
+	err := c.do(http.MethodDelete, adminGrantsPath+c.clientUUIDQuery(clientUUID), nil, &r)
+	return r.Revoked, err
+}
+
+func (c *ControlClient) Extend(id string, d time.Duration) (AdminGrant, error) {
+	g := AdminGrant{}
+	body := struct {
+		Duration string `json:"duration"`
+	}{
+		Duration: d.String(),
+	}
+	err := c.do(http.MethodPost, adminGrantsPath+"/"+url.PathEscape(id)+"/extend", body, &g)
+	return g, err
+}
+
+func (c *ControlClient) clientUUIDQuery(clientUUID string) string {
+	if clientUUID == "" {
+		return ""
+	}
+	return "?clientUUID=" + url.QueryEscape(clientUUID)
+}
+
+func (c *ControlClient) do(method, path string, body, resp interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "json marshal")
+		}
+		r = bytes.NewReader(b)
+	}
+
+	// The host is ignored, since we always dial the control socket
+	req, err := http.NewRequest(method, "http://openspa"+path, r)
+	if err != nil {
+		return errors.Wrap(err, "new request")
+	}
+
+	res, err := c.c.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		e := struct {
+			Error string `json:"error"`
+		}{}
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		return errors.Errorf("server responded with %d: %s", res.StatusCode, e.Error)
+	}
+
+	if resp == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+		return errors.Wrap(err, "json decode")
+	}
+
+	return nil
+}
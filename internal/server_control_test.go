@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type clientListerStub []string
+
+func (c clientListerStub) ClientUUIDs() []string {
+	return c
+}
+
+type statusProviderStub struct{}
+
+func (statusProviderStub) Status() ServerStatus {
+	return ServerStatus{Version: Version(), FirewallBackend: "iptables", Grants: 1}
+}
+
+func TestControlServer(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &FirewallMock{}
+	frm := NewFirewallRuleManager(fw)
+
+	path := filepath.Join(t.TempDir(), "openspa", "control.sock")
+	s := NewControlServer(path, 0660)
+	s.admin.grants = frm
+	s.admin.clients = clientListerStub{"c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43"}
+	s.admin.status = statusProviderStub{}
+	reloader := &configReloaderStub{}
+	s.admin.reloader = reloader
+
+	require.NoError(t, s.Start())
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm())
+
+	c := NewControlClient(path)
+
+	st, err := c.Status()
+	require.NoError(t, err)
+	assert.Equal(t, "iptables", st.FirewallBackend)
+	assert.Equal(t, 1, st.Grants)
+
+	clients, err := c.Clients()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43"}, clients)
+
+	changes, err := c.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"authorization"}, changes.Reloaded)
+	assert.Equal(t, 1, reloader.calls)
+
+	client := "c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43"
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 19),
+		DstPortStart: 22,
+		DstPortEnd:   22,
+	}
+	fw.On("RuleAdd", mock.Anything, mock.Anything).Return(nil).Twice()
+	require.NoError(t, frm.Add(r, FirewallRuleMetadata{ClientUUID: client, Duration: time.Hour}))
+	r.DstPortStart, r.DstPortEnd = 443, 443
+	require.NoError(t, frm.Add(r, FirewallRuleMetadata{ClientUUID: client, Duration: time.Hour}))
+
+	grants, err := c.Grants(client)
+	require.NoError(t, err)
+	require.Len(t, grants, 2)
+
+	grants, err = c.Grants("unknown")
+	require.NoError(t, err)
+	assert.Len(t, grants, 0)
+
+	fw.On("RuleRemove", mock.Anything, mock.Anything).Return(nil).Twice()
+	assert.Error(t, c.Revoke("unknown"))
+	require.NoError(t, c.Revoke(frm.Grants()[0].ID))
+	assert.Equal(t, 1, frm.Count())
+
+	n, err := c.RevokeClient(client)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 0, frm.Count())
+
+	assert.NoError(t, s.Stop())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// A socket left behind should not prevent the server from starting
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, l.Close())
+
+	require.NoError(t, s.Start())
+
+	// The socket of a running instance is not removed
+	s2 := NewControlServer(path, 0660)
+	assert.Error(t, s2.Start())
+	_, err = c.Status()
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Stop())
+
+	fw.AssertExpectations(t)
+}
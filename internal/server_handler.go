@@ -3,6 +3,8 @@ package internal
 import (
 	"context"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/greenstatic/openspa/internal/observability"
 	"github.com/greenstatic/openspa/pkg/openspalib"
@@ -10,116 +12,364 @@ import (
 	"github.com/greenstatic/openspa/pkg/openspalib/tlv"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var _ UDPDatagramRequestHandler = &ServerHandler{}
+var _ DatagramRequestPrioritizer = &ServerHandler{}
 
 type ServerHandler struct {
 	frm *FirewallRuleManager
 	cs  crypto.CipherSuite
 
-	authz AuthorizationStrategy
+	authz        AuthorizationStrategy
+	targetPolicy *TargetPolicy
 
 	adkProver *openspalib.ADKProver
 	metrics   serverHandlerMetrics
+	tracer    trace.Tracer
+
+	// Optional, nil if disabled
+	sourceIPLimiter   *RateLimiter
+	clientUUIDLimiter *RateLimiter
+	audit             AuditLogger
+	auditDenySummary  *auditDenySummary
+
+	// lock guards cs, authz, targetPolicy and adkProver, which can be swapped during a configuration reload
+	lock sync.RWMutex
 }
 
 type ServerHandlerOpt struct {
 	ADKSecret string
+
+	// SourceIPRateLimit limits the requests per source IP (IPv6 per /64) before any cryptographic operation is
+	// performed.
+	SourceIPRateLimit RateLimitSettings
+	// ClientUUIDRateLimit limits the (authenticated) requests per client UUID before authorization.
+	ClientUUIDRateLimit RateLimitSettings
+
+	// TargetPolicy restricts the targets the clients may request before authorization, optional
+	TargetPolicy *TargetPolicy
+
+	// Audit records every authorization decision, optional. The requests denied before they are authenticated are
+	// recorded as a summary per interval.
+	Audit AuditLogger
+
+	// TracerProvider of the request spans, the global (otel) tracer provider is used if nil
+	TracerProvider trace.TracerProvider
+}
+
+// serverHandlerState is a consistent snapshot of the reloadable ServerHandler settings, so that a single request is
+// processed with the same settings from start to finish even if a reload happens mid-request.
+type serverHandlerState struct {
+	cs           crypto.CipherSuite
+	authz        AuthorizationStrategy
+	targetPolicy *TargetPolicy
+	adkProver    *openspalib.ADKProver
 }
 
 type serverHandlerMetrics struct {
-	openspaRequest                    observability.Counter
-	openspaRequestBad                 observability.Counter
-	openspaRequestADKFailed           observability.Counter
-	openspaRequestAuthorizationFailed observability.Counter
-	openspaResponse                   observability.Counter
+	openspaRequest                      observability.Counter
+	openspaRequestADKFailed             observability.Counter
+	openspaRequestAuthorizationFailed   observability.Counter
+	openspaRequestTargetDenied          observability.Counter
+	openspaRequestRateLimitedSourceIP   observability.Counter
+	openspaRequestRateLimitedClientUUID observability.Counter
+	openspaResponse                     observability.Counter
+
+	// requestFailed is labeled with the failure reason (AuditReason* or requestFailureReason*), cipher suite and
+	// IP family of the source
+	requestFailed observability.CounterVec
+
+	requestDuration      observability.Histogram
+	requestStageDuration observability.HistogramVec // labeled with the requestStage*
 }
 
+// Reasons of failed requests that are more specific than the AuditReason* (which are used for the remaining failures),
+// see auditReasonFromRequestFailure.
+const (
+	requestFailureReasonInvalidHeader     = "invalid_header"
+	requestFailureReasonInvalidTLV        = "invalid_tlv"
+	requestFailureReasonCipherSuite       = "unsupported_cipher_suite"
+	requestFailureReasonUnknownClient     = "unknown_client"
+	requestFailureReasonDecryption        = "decryption_failure"
+	requestFailureReasonInvalidSignature  = "invalid_signature"
+	requestFailureReasonInvalidClientUUID = "invalid_client_uuid"
+	requestFailureReasonResponse          = "response_failure"
+)
+
+// Stages of the request processing, measured by serverHandlerMetrics.requestStageDuration and traced as child spans
+// of the datagram span
+const (
+	requestStageADK             = "adk"
+	requestStageDecrypt         = "decrypt"
+	requestStageAuthorization   = "authorization"
+	requestStageFirewall        = "firewall"
+	requestStageResponseMarshal = "response_marshal"
+	requestStageResponseSend    = "response_send"
+)
+
+const requestSpanName = "openspa.datagram"
+
 func NewServerHandler(frm *FirewallRuleManager, cs crypto.CipherSuite, authz AuthorizationStrategy,
 	opt ServerHandlerOpt) *ServerHandler {
 	o := &ServerHandler{
-		cs:      cs,
-		frm:     frm,
-		authz:   authz,
-		metrics: newServerHandlerMetrics(),
+		cs:           cs,
+		frm:          frm,
+		authz:        authz,
+		targetPolicy: opt.TargetPolicy,
+		metrics:      newServerHandlerMetrics(),
+		tracer:       tracerFromProvider(opt.TracerProvider),
+		audit:        opt.Audit,
+	}
+	if opt.Audit != nil {
+		o.auditDenySummary = newAuditDenySummary(opt.Audit)
 	}
 
-	if len(opt.ADKSecret) != 0 {
-		p, err := openspalib.NewADKProver(opt.ADKSecret)
-		if err != nil {
-			panic(err)
-		}
+	p, err := newADKProverFromSecret(opt.ADKSecret)
+	if err != nil {
+		panic(err)
+	}
+	o.adkProver = p
+
+	if opt.SourceIPRateLimit.Enabled() {
+		o.sourceIPLimiter = NewRateLimiter(opt.SourceIPRateLimit)
+	}
 
-		o.adkProver = &p
+	if opt.ClientUUIDRateLimit.Enabled() {
+		o.clientUUIDLimiter = NewRateLimiter(opt.ClientUUIDRateLimit)
 	}
 
 	return o
 }
 
-func (o *ServerHandler) DatagramRequestHandler(_ context.Context, resp UDPResponser, r DatagramRequest) {
+// Reload atomically replaces the cipher suite, authorization strategy, ADK secret and target policy (nil allows every
+// target). Requests that are already being processed finish with the previous settings.
+func (o *ServerHandler) Reload(cs crypto.CipherSuite, authz AuthorizationStrategy, adkSecret string,
+	targetPolicy *TargetPolicy) error {
+	if cs == nil {
+		return errors.New("cipher suite is nil")
+	}
+
+	if authz == nil {
+		return errors.New("authorization strategy is nil")
+	}
+
+	p, err := newADKProverFromSecret(adkSecret)
+	if err != nil {
+		return errors.Wrap(err, "adk prover")
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.cs = cs
+	o.authz = authz
+	o.targetPolicy = targetPolicy
+	o.adkProver = p
+
+	return nil
+}
+
+func (o *ServerHandler) state() serverHandlerState {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return serverHandlerState{
+		cs:           o.cs,
+		authz:        o.authz,
+		targetPolicy: o.targetPolicy,
+		adkProver:    o.adkProver,
+	}
+}
+
+// DatagramRequestPriority returns RequestPriorityHigh for requests with a valid ADK proof. Without ADK all requests are
+// RequestPriorityLow.
+func (o *ServerHandler) DatagramRequestPriority(r DatagramRequest) RequestPriority {
+	p := o.state().adkProver
+	if p == nil {
+		return RequestPriorityLow
+	}
+
+	header, err := openspalib.RequestUnmarshalHeader(r.data)
+	if err != nil || header.ADKProof == 0 {
+		return RequestPriorityLow
+	}
+
+	if err := p.Valid(header.ADKProof); err != nil {
+		return RequestPriorityLow
+	}
+
+	return RequestPriorityHigh
+}
+
+func (o *ServerHandler) DatagramRequestHandler(ctx context.Context, resp UDPResponser, r DatagramRequest) {
 	remote := r.rAddr.String()
 	log.Debug().Msgf("Received UDP datagram from: %s", remote)
 
-	if o.adkProver != nil {
-		header, err := openspalib.RequestUnmarshalHeader(r.data)
-		if err != nil {
-			log.Info().Err(err).Msgf("OpenSPA request unmarshal header failure for: %s", remote)
+	ctx, span := o.tracer.Start(ctx, requestSpanName, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.NetPeerIPKey.String(r.rAddr.IP.String()), semconv.NetPeerPortKey.Int(r.rAddr.Port)))
+	defer span.End()
+
+	st := o.state()
+	start := time.Now()
+	defer observability.ObserveDuration(o.metrics.requestDuration, start)
+
+	ev := AuditEvent{
+		Source:               remote,
+		AuthorizationBackend: authorizationStrategyName(st.authz),
+	}
+	audit := func(t AuditEventType, reason string) {
+		if o.audit == nil {
+			return
+		}
+		ev.Event = t
+		ev.Reason = reason
+		ev.LatencyMilliseconds = float64(time.Since(start).Microseconds()) / 1000
+		o.audit.Audit(ev)
+	}
+
+	ipFamily := "ipv4"
+	if isIPv6(r.rAddr.IP) {
+		ipFamily = "ipv6"
+	}
+	fail := func(reason string) {
+		cs := ev.CipherSuite
+		if cs == "" {
+			cs = "unknown"
+		}
+		o.metrics.requestFailed.Inc(reason, cs, ipFamily)
+		span.SetAttributes(traceAttributeReason.String(reason))
+	}
+	authenticated := false
+	deny := func(reason string) {
+		fail(reason)
+		span.SetAttributes(traceAttributeDecision.String(string(AuditEventDeny)))
+		if !authenticated {
+			if o.auditDenySummary != nil {
+				o.auditDenySummary.deny(auditReasonFromRequestFailure(reason))
+			}
+			return
+		}
+		audit(AuditEventDeny, auditReasonFromRequestFailure(reason))
+	}
+
+	header, headerErr := openspalib.RequestUnmarshalHeader(r.data)
+	if headerErr == nil {
+		ev.CipherSuite, _ = crypto.CipherSuiteIDToString(header.CipherSuiteID)
+		span.SetAttributes(traceAttributeCipherSuite.String(ev.CipherSuite))
+	}
+
+	if st.adkProver != nil {
+		_, end := o.startStage(ctx, requestStageADK)
+		if headerErr != nil {
+			end(nil)
+			log.Info().Err(headerErr).Msgf("OpenSPA request unmarshal header failure for: %s", remote)
+			deny(requestFailureReasonFromError(headerErr))
 			return
 		}
 
 		if header.ADKProof == 0 {
+			end(nil)
 			log.Debug().Msgf("OpenSPA request missing ADK proof for: %s", remote)
 			o.metrics.openspaRequestADKFailed.Inc()
+			deny(AuditReasonADKMissing)
 			return
 		}
 
-		if err := o.adkProver.Valid(header.ADKProof); err != nil {
+		err := st.adkProver.Valid(header.ADKProof)
+		end(nil)
+		if err != nil {
 			log.Debug().Msgf("OpenSPA request ADK proof rejected for: %s", remote)
 			o.metrics.openspaRequestADKFailed.Inc()
+			deny(AuditReasonADKInvalid)
 			return
 		}
 
 		log.Debug().Msgf("OpenSPA request ADK proof accepted for: %s", remote)
 	}
 
-	request, err := openspalib.RequestUnmarshal(r.data, o.cs)
+	if o.sourceIPLimiter != nil && !o.sourceIPLimiter.Allow(rateLimitKeyFromIP(r.rAddr.IP)) {
+		log.Debug().Msgf("OpenSPA request rate limited for source: %s", remote)
+		o.metrics.openspaRequestRateLimitedSourceIP.Inc()
+		deny(AuditReasonRateLimitedSourceIP)
+		return
+	}
+
+	_, end := o.startStage(ctx, requestStageDecrypt)
+	request, err := openspalib.RequestUnmarshal(r.data, st.cs)
+	end(nil)
 	if err != nil {
 		log.Debug().Err(err).Msgf("OpenSPA request unmarshal failure")
-		o.metrics.openspaRequestBad.Inc()
+		deny(requestFailureReasonFromError(err))
 		return
 	}
+	authenticated = true
 
-	// Authentication has been performed as part of CipherSuite
-	dur, err := o.authz.RequestAuthorization(request.Body)
+	clientUUID, err := openspalib.ClientUUIDFromContainer(request.Body)
 	if err != nil {
-		log.Info().Err(err).Msgf("OpenSPA request not authorized")
-		o.metrics.openspaRequestAuthorizationFailed.Inc()
+		log.Info().Err(err).Msgf("Failed to get client uuid from OpenSPA request")
+		deny(requestFailureReasonInvalidClientUUID)
+		return
+	}
+	ev.ClientUUID = clientUUID
+	span.SetAttributes(traceAttributeClientUUID.String(clientUUID))
+
+	if o.clientUUIDLimiter != nil && !o.clientUUIDLimiter.Allow(clientUUID) {
+		log.Info().Msgf("OpenSPA request rate limited for client: %s (source: %s)", clientUUID, remote)
+		o.metrics.openspaRequestRateLimitedClientUUID.Inc()
+		deny(AuditReasonRateLimitedClientUUID)
 		return
 	}
 
 	fwRule, fwReq, err := firewallRuleFromRequestContainer(request.Body)
 	if err != nil {
 		log.Info().Err(err).Msgf("Failed to get firewall rule information from OpenSPA request")
+		deny(AuditReasonInvalidFirewallRequest)
 		return
 	}
+	ev.Requested = auditTargetFromFirewallRule(fwRule)
 
-	clientUUID, err := openspalib.ClientUUIDFromContainer(request.Body)
+	if !st.targetPolicy.Allowed(clientUUID, fwRule) {
+		log.Info().Msgf("OpenSPA request target not allowed for client: %s (target: %s)", clientUUID, fwRule.String())
+		o.metrics.openspaRequestTargetDenied.Inc()
+		deny(AuditReasonTargetNotAllowed)
+		return
+	}
+
+	// Authentication has been performed as part of CipherSuite
+	stageCtx, end := o.startStage(ctx, requestStageAuthorization)
+	dur, err := st.authz.RequestAuthorization(stageCtx, request.Body)
+	end(nil)
 	if err != nil {
-		log.Info().Err(err).Msgf("Failed to get client uuid from OpenSPA request")
+		log.Info().Err(err).Msgf("OpenSPA request not authorized")
+		o.metrics.openspaRequestAuthorizationFailed.Inc()
+		deny(AuditReasonUnauthorized)
 		return
 	}
+	ev.DurationSeconds = int64(dur.Seconds())
 
 	meta := FirewallRuleMetadata{
 		ClientUUID: clientUUID,
 		Duration:   dur,
 	}
 
-	if err := o.frm.Add(fwRule, meta); err != nil {
+	_, end = o.startStage(ctx, requestStageFirewall)
+	grant, err := o.frm.AddGrant(fwRule, meta)
+	end(err)
+	if err != nil {
 		log.Error().Err(err).Msgf("Failed to add firewall rule: %s", fwRule.String())
+		spanError(span, err)
+		deny(AuditReasonFirewallRuleAddFailure)
 		return
 	}
 
+	ev.GrantID = grant.ID
+	ev.Granted = auditTargetFromFirewallRule(grant.Rule)
+	span.SetAttributes(traceAttributeDecision.String(string(AuditEventGrant)), traceAttributeGrantID.String(grant.ID))
+	audit(AuditEventGrant, "")
+
 	o.metrics.openspaRequest.Inc()
 
 	rd := openspalib.ResponseData{
@@ -132,15 +382,22 @@ func (o *ServerHandler) DatagramRequestHandler(_ context.Context, resp UDPRespon
 		ClientUUID:      fwReq.ClientUUID,
 	}
 
-	response, err := openspalib.NewResponse(rd, o.cs)
+	_, end = o.startStage(ctx, requestStageResponseMarshal)
+	response, err := openspalib.NewResponse(rd, st.cs)
 	if err != nil {
+		end(err)
 		log.Warn().Err(err).Msgf("Failed to create OpenSPA response")
+		spanError(span, err)
+		fail(requestFailureReasonResponse)
 		return
 	}
 
 	responseB, err := response.Marshal()
+	end(err)
 	if err != nil {
 		log.Warn().Err(err).Msgf("Failed to marshal OpenSPA response")
+		spanError(span, err)
+		fail(requestFailureReasonResponse)
 		return
 	}
 
@@ -148,14 +405,80 @@ func (o *ServerHandler) DatagramRequestHandler(_ context.Context, resp UDPRespon
 
 	log.Debug().Msgf("Sending response to: %s", r.rAddr.String())
 
+	_, end = o.startStage(ctx, requestStageResponseSend)
 	err = resp.SendUDPResponse(r.rAddr, responseB)
+	end(err)
 	if err != nil {
 		log.Warn().Err(err).Msgf("Failed to send OpenSPA response")
+		spanError(span, err)
+		fail(requestFailureReasonResponse)
+	}
+}
+
+// requestFailureReasonFromError classifies errors of decoding a request, AuditReasonBadRequest if the error is not
+// recognized.
+func requestFailureReasonFromError(err error) string {
+	switch {
+	case errors.Is(err, openspalib.ErrInvalidHeader):
+		return requestFailureReasonInvalidHeader
+	case errors.Is(err, openspalib.ErrInvalidTLV):
+		return requestFailureReasonInvalidTLV
+	case errors.Is(err, crypto.ErrUnsupportedCipherSuite):
+		return requestFailureReasonCipherSuite
+	case errors.Is(err, crypto.ErrPublicKeyResolve):
+		return requestFailureReasonUnknownClient
+	case errors.Is(err, crypto.ErrDecryption):
+		return requestFailureReasonDecryption
+	case errors.Is(err, crypto.ErrInvalidSignature):
+		return requestFailureReasonInvalidSignature
+	default:
+		return AuditReasonBadRequest
+	}
+}
+
+// auditReasonFromRequestFailure returns the audit reason of a denied request. The request decoding failures are all
+// audited as AuditReasonBadRequest.
+func auditReasonFromRequestFailure(reason string) string {
+	switch reason {
+	case requestFailureReasonInvalidHeader, requestFailureReasonInvalidTLV, requestFailureReasonCipherSuite,
+		requestFailureReasonUnknownClient, requestFailureReasonDecryption, requestFailureReasonInvalidSignature,
+		requestFailureReasonInvalidClientUUID:
+		return AuditReasonBadRequest
+	default:
+		return reason
+	}
+}
+
+// startStage starts measuring the duration of a request processing stage along with its span (a child of the span in
+// ctx). The returned function ends both, a non-nil error is recorded on the span.
+func (o *ServerHandler) startStage(ctx context.Context, stage string) (context.Context, func(err error)) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, "openspa."+stage)
+
+	return ctx, func(err error) {
+		observability.ObserveDurationVec(o.metrics.requestStageDuration, start, stage)
+		if err != nil {
+			spanError(span, err)
+		}
+		span.End()
 	}
 }
 
 func (o *ServerHandler) ADKSupport() bool {
-	return o.adkProver != nil
+	return o.state().adkProver != nil
+}
+
+func newADKProverFromSecret(secret string) (*openspalib.ADKProver, error) {
+	if len(secret) == 0 {
+		return nil, nil
+	}
+
+	p, err := openspalib.NewADKProver(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
 }
 
 func newServerHandlerMetrics() serverHandlerMetrics {
@@ -164,10 +487,15 @@ func newServerHandlerMetrics() serverHandlerMetrics {
 	lbl := observability.NewLabels()
 
 	s.openspaRequest = mr.Count("request", lbl)
-	s.openspaRequestBad = mr.Count("request_bad", lbl)
 	s.openspaRequestADKFailed = mr.Count("request_adk_failed", lbl)
 	s.openspaRequestAuthorizationFailed = mr.Count("request_authorization_failed", lbl)
+	s.openspaRequestTargetDenied = mr.Count("request_target_denied", lbl)
+	s.openspaRequestRateLimitedSourceIP = mr.Count("request_rate_limited", lbl.Add("limiter", "source_ip"))
+	s.openspaRequestRateLimitedClientUUID = mr.Count("request_rate_limited", lbl.Add("limiter", "client_uuid"))
 	s.openspaResponse = mr.Count("response", lbl)
+	s.requestFailed = mr.CountVec("request_failed", "reason", "cipher_suite", "ip_family")
+	s.requestDuration = mr.Histogram("request_duration_seconds", lbl, nil)
+	s.requestStageDuration = mr.HistogramVec("request_stage_duration_seconds", nil, "stage")
 	return s
 }
 
@@ -252,7 +580,7 @@ func firewallRuleFromRequestContainer(c tlv.Container) (FirewallRule, firewallRe
 	}
 
 	noPorts := portEnd - portStart + 1
-	if noPorts < 0 {
+	if noPorts <= 0 {
 		return FirewallRule{}, firewallRequest{}, errors.New("invalid target port range")
 	}
 
@@ -3,12 +3,17 @@ package internal
 import (
 	"context"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/greenstatic/openspa/internal/observability"
 	"github.com/greenstatic/openspa/pkg/openspalib"
 	"github.com/greenstatic/openspa/pkg/openspalib/crypto"
+	"github.com/greenstatic/openspa/pkg/openspalib/tlv"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -26,7 +31,7 @@ func TestServerHandler_DatagramRequestHandler(t *testing.T) {
 	sh := NewServerHandler(frm, cs, NewAuthorizationStrategyAllow(time.Hour), ServerHandlerOpt{ADKSecret: adkSecret})
 
 	assert.Equal(t, 0, sh.metrics.openspaRequest.Get())
-	assert.Equal(t, 0, sh.metrics.openspaRequestBad.Get())
+	assert.Equal(t, 0, sh.metrics.requestFailed.(*observability.CounterVecStub).Total())
 	assert.Equal(t, 0, sh.metrics.openspaRequestADKFailed.Get())
 	assert.Equal(t, 0, sh.metrics.openspaRequestAuthorizationFailed.Get())
 	assert.Equal(t, 0, sh.metrics.openspaResponse.Get())
@@ -72,7 +77,7 @@ func TestServerHandler_DatagramRequestHandler(t *testing.T) {
 	fw.AssertExpectations(t)
 
 	assert.Equal(t, 1, sh.metrics.openspaRequest.Get())
-	assert.Equal(t, 0, sh.metrics.openspaRequestBad.Get())
+	assert.Equal(t, 0, sh.metrics.requestFailed.(*observability.CounterVecStub).Total())
 	assert.Equal(t, 0, sh.metrics.openspaRequestADKFailed.Get())
 	assert.Equal(t, 0, sh.metrics.openspaRequestAuthorizationFailed.Get())
 	assert.Equal(t, 1, sh.metrics.openspaResponse.Get())
@@ -90,7 +95,7 @@ func TestServerHandler_DatagramRequestHandler_WithoutADKProof(t *testing.T) {
 	sh := NewServerHandler(frm, cs, NewAuthorizationStrategyAllow(time.Hour), ServerHandlerOpt{ADKSecret: adkSecret})
 
 	assert.Equal(t, 0, sh.metrics.openspaRequest.Get())
-	assert.Equal(t, 0, sh.metrics.openspaRequestBad.Get())
+	assert.Equal(t, 0, sh.metrics.requestFailed.(*observability.CounterVecStub).Total())
 	assert.Equal(t, 0, sh.metrics.openspaRequestADKFailed.Get())
 	assert.Equal(t, 0, sh.metrics.openspaRequestAuthorizationFailed.Get())
 	assert.Equal(t, 0, sh.metrics.openspaResponse.Get())
@@ -136,7 +141,7 @@ func TestServerHandler_DatagramRequestHandler_WithoutADKProof(t *testing.T) {
 	fw.AssertExpectations(t)
 
 	assert.Equal(t, 1, sh.metrics.openspaRequest.Get())
-	assert.Equal(t, 0, sh.metrics.openspaRequestBad.Get())
+	assert.Equal(t, 0, sh.metrics.requestFailed.(*observability.CounterVecStub).Total())
 	assert.Equal(t, 0, sh.metrics.openspaRequestADKFailed.Get())
 	assert.Equal(t, 0, sh.metrics.openspaRequestAuthorizationFailed.Get())
 	assert.Equal(t, 1, sh.metrics.openspaResponse.Get())
@@ -152,7 +157,7 @@ func TestServerHandler_DatagramRequestHandler_InvalidADKProof(t *testing.T) {
 	sh := NewServerHandler(frm, cs, NewAuthorizationStrategyAllow(time.Hour), ServerHandlerOpt{ADKSecret: "7O4ZIRI"})
 
 	assert.Equal(t, 0, sh.metrics.openspaRequest.Get())
-	assert.Equal(t, 0, sh.metrics.openspaRequestBad.Get())
+	assert.Equal(t, 0, sh.metrics.requestFailed.(*observability.CounterVecStub).Total())
 	assert.Equal(t, 0, sh.metrics.openspaRequestADKFailed.Get())
 	assert.Equal(t, 0, sh.metrics.openspaRequestAuthorizationFailed.Get())
 	assert.Equal(t, 0, sh.metrics.openspaResponse.Get())
@@ -187,12 +192,374 @@ func TestServerHandler_DatagramRequestHandler_InvalidADKProof(t *testing.T) {
 	fw.AssertExpectations(t)
 
 	assert.Equal(t, 0, sh.metrics.openspaRequest.Get())
-	assert.Equal(t, 0, sh.metrics.openspaRequestBad.Get())
+	assert.Equal(t, 1, sh.metrics.requestFailed.(*observability.CounterVecStub).Get(AuditReasonADKInvalid,
+		"CipherSuite_NoSecurity", "ipv4"))
 	assert.Equal(t, 1, sh.metrics.openspaRequestADKFailed.Get())
 	assert.Equal(t, 0, sh.metrics.openspaRequestAuthorizationFailed.Get())
 	assert.Equal(t, 0, sh.metrics.openspaResponse.Get())
 }
 
+func TestServerHandler_DatagramRequestPriority(t *testing.T) {
+	cs := crypto.NewCipherSuiteStub()
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	reqData := openspalib.RequestData{
+		TransactionID:   23,
+		ClientUUID:      "09896692-c299-4f90-9906-2e23cfcc417c",
+		ClientIP:        net.IPv4(88, 200, 23, 23),
+		TargetProtocol:  openspalib.ProtocolTCP,
+		TargetIP:        net.IPv4(88, 200, 23, 19),
+		TargetPortStart: 80,
+		TargetPortEnd:   80,
+	}
+
+	marshal := func(adkSecret string) []byte {
+		req, err := openspalib.NewRequest(reqData, cs, openspalib.RequestDataOpt{ADKSecret: adkSecret})
+		require.NoError(t, err)
+		b, err := req.Marshal()
+		require.NoError(t, err)
+		return b
+	}
+
+	sh := NewServerHandler(nil, cs, NewAuthorizationStrategyAllow(time.Hour), ServerHandlerOpt{ADKSecret: "7O4ZIRI"})
+	assert.Equal(t, RequestPriorityHigh, sh.DatagramRequestPriority(DatagramRequest{data: marshal("7O4ZIRI")}))
+	assert.Equal(t, RequestPriorityLow, sh.DatagramRequestPriority(DatagramRequest{data: marshal("3HRZN3Y")}))
+	assert.Equal(t, RequestPriorityLow, sh.DatagramRequestPriority(DatagramRequest{data: marshal("")}))
+	assert.Equal(t, RequestPriorityLow, sh.DatagramRequestPriority(DatagramRequest{data: []byte{0x01}}))
+
+	sh = NewServerHandler(nil, cs, NewAuthorizationStrategyAllow(time.Hour), ServerHandlerOpt{})
+	assert.Equal(t, RequestPriorityLow, sh.DatagramRequestPriority(DatagramRequest{data: marshal("7O4ZIRI")}))
+}
+
+func TestServerHandler_DatagramRequestHandler_RateLimited(t *testing.T) {
+	fw := &FirewallMock{}
+	frm := NewFirewallRuleManager(fw)
+	cs := crypto.NewCipherSuiteStub()
+
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	sh := NewServerHandler(frm, cs, NewAuthorizationStrategyAllow(time.Hour), ServerHandlerOpt{
+		SourceIPRateLimit:   RateLimitSettings{Rate: 0.001, Burst: 2},
+		ClientUUIDRateLimit: RateLimitSettings{Rate: 0.001, Burst: 1},
+	})
+
+	reqData := openspalib.RequestData{
+		TransactionID:   23,
+		ClientUUID:      "09896692-c299-4f90-9906-2e23cfcc417c",
+		ClientIP:        net.IPv4(88, 200, 23, 23),
+		TargetProtocol:  openspalib.ProtocolTCP,
+		TargetIP:        net.IPv4(88, 200, 23, 19),
+		TargetPortStart: 80,
+		TargetPortEnd:   80,
+	}
+
+	req, err := openspalib.NewRequest(reqData, cs, openspalib.RequestDataOpt{})
+	require.NoError(t, err)
+
+	reqB, err := req.Marshal()
+	require.NoError(t, err)
+
+	rAddr := net.UDPAddr{
+		IP:   net.IPv4(88, 200, 23, 12),
+		Port: 40975,
+	}
+
+	resp := &UDPResponseMock{}
+	resp.On("SendUDPResponse", rAddr, mock.Anything).Return(nil).Once()
+	fw.On("RuleAdd", mock.Anything, mock.Anything).Return(nil).Once()
+
+	for i := 0; i < 3; i++ {
+		sh.DatagramRequestHandler(context.TODO(), resp, DatagramRequest{data: reqB, rAddr: rAddr})
+	}
+
+	resp.AssertExpectations(t)
+	fw.AssertExpectations(t)
+
+	assert.Equal(t, 1, sh.metrics.openspaRequest.Get())
+	assert.Equal(t, 1, sh.metrics.openspaRequestRateLimitedClientUUID.Get())
+	assert.Equal(t, 1, sh.metrics.openspaRequestRateLimitedSourceIP.Get())
+}
+
 func TestFirewallRuleFromRequestContainer(t *testing.T) {
 	// TODO
 }
+
+func TestServerHandler_DatagramRequestHandler_Audit(t *testing.T) {
+	fw := &FirewallMock{}
+	frm := NewFirewallRuleManager(fw)
+	cs := crypto.NewCipherSuiteStub()
+	adkSecret := "7O4ZIRI"
+	audit := &AuditLoggerStub{}
+
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	sh := NewServerHandler(frm, cs, NewAuthorizationStrategyAllow(time.Hour), ServerHandlerOpt{
+		ADKSecret: adkSecret,
+		Audit:     audit,
+	})
+
+	reqData := openspalib.RequestData{
+		TransactionID:   23,
+		ClientUUID:      "09896692-c299-4f90-9906-2e23cfcc417c",
+		ClientIP:        net.IPv4(88, 200, 23, 23),
+		TargetProtocol:  openspalib.ProtocolTCP,
+		TargetIP:        net.IPv4(88, 200, 23, 19),
+		TargetPortStart: 80,
+		TargetPortEnd:   80,
+	}
+
+	marshal := func(secret string) []byte {
+		req, err := openspalib.NewRequest(reqData, cs, openspalib.RequestDataOpt{ADKSecret: secret})
+		require.NoError(t, err)
+		b, err := req.Marshal()
+		require.NoError(t, err)
+		return b
+	}
+
+	rAddr := net.UDPAddr{
+		IP:   net.IPv4(88, 200, 23, 12),
+		Port: 40975,
+	}
+
+	resp := &UDPResponseMock{}
+	resp.On("SendUDPResponse", rAddr, mock.Anything).Return(nil).Once()
+	fw.On("RuleAdd", mock.Anything, mock.Anything).Return(nil).Once()
+
+	sh.DatagramRequestHandler(context.TODO(), resp, DatagramRequest{data: marshal(adkSecret), rAddr: rAddr})
+	sh.DatagramRequestHandler(context.TODO(), resp, DatagramRequest{data: marshal(""), rAddr: rAddr})
+	sh.DatagramRequestHandler(context.TODO(), resp, DatagramRequest{data: []byte{0x01}, rAddr: rAddr})
+
+	resp.AssertExpectations(t)
+	fw.AssertExpectations(t)
+
+	// The unauthenticated denied requests are summarized
+	require.Len(t, audit.Events(), 1)
+	sh.auditDenySummary.flush()
+
+	events := audit.Events()
+	require.Len(t, events, 3)
+
+	grant := events[0]
+	assert.Equal(t, AuditEventGrant, grant.Event)
+	assert.Equal(t, "", grant.Reason)
+	assert.Equal(t, "88.200.23.12:40975", grant.Source)
+	assert.Equal(t, "09896692-c299-4f90-9906-2e23cfcc417c", grant.ClientUUID)
+	assert.Equal(t, frm.Grants()[0].ID, grant.GrantID)
+	require.NotNil(t, grant.Requested)
+	assert.Equal(t, "88.200.23.19", grant.Requested.DstIP)
+	assert.Equal(t, 80, grant.Requested.DstPortStart)
+	assert.Equal(t, grant.Requested, grant.Granted)
+	assert.Equal(t, int64(3600), grant.DurationSeconds)
+	assert.Equal(t, ServerConfigAuthorizationBackendSimple, grant.AuthorizationBackend)
+	assert.NotEmpty(t, grant.CipherSuite)
+
+	assert.Equal(t, AuditEventDeny, events[1].Event)
+	assert.Equal(t, AuditReasonADKMissing, events[1].Reason)
+	assert.Equal(t, 1, events[1].Count)
+	assert.Nil(t, events[1].Granted)
+
+	assert.Equal(t, AuditEventDeny, events[2].Event)
+	assert.Equal(t, AuditReasonBadRequest, events[2].Reason)
+	assert.Equal(t, 1, events[2].Count)
+}
+
+type histogramVecRecorder struct {
+	lock         sync.Mutex
+	observations map[string]int
+}
+
+func (h *histogramVecRecorder) Observe(_ float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.observations[strings.Join(labelValues, ",")]++
+}
+
+func TestServerHandler_DatagramRequestHandler_StageDurations(t *testing.T) {
+	fw := &FirewallMock{}
+	frm := NewFirewallRuleManager(fw)
+	cs := crypto.NewCipherSuiteStub()
+	adkSecret := "7O4ZIRI"
+
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	sh := NewServerHandler(frm, cs, NewAuthorizationStrategyAllow(time.Hour), ServerHandlerOpt{ADKSecret: adkSecret})
+	stages := &histogramVecRecorder{observations: make(map[string]int)}
+	sh.metrics.requestStageDuration = stages
+
+	req, err := openspalib.NewRequest(openspalib.RequestData{
+		TransactionID:   23,
+		ClientUUID:      "09896692-c299-4f90-9906-2e23cfcc417c",
+		ClientIP:        net.IPv4(88, 200, 23, 23),
+		TargetProtocol:  openspalib.ProtocolTCP,
+		TargetIP:        net.IPv4(88, 200, 23, 19),
+		TargetPortStart: 80,
+		TargetPortEnd:   80,
+	}, cs, openspalib.RequestDataOpt{ADKSecret: adkSecret})
+	require.NoError(t, err)
+	reqB, err := req.Marshal()
+	require.NoError(t, err)
+
+	resp := &UDPResponseMock{}
+	resp.On("SendUDPResponse", mock.Anything, mock.Anything).Return(nil).Once()
+	fw.On("RuleAdd", mock.Anything, mock.Anything).Return(nil).Once()
+
+	sh.DatagramRequestHandler(context.TODO(), resp, DatagramRequest{
+		data:  reqB,
+		rAddr: net.UDPAddr{IP: net.IPv4(88, 200, 23, 12), Port: 40975},
+	})
+
+	assert.Equal(t, map[string]int{
+		requestStageADK:             1,
+		requestStageDecrypt:         1,
+		requestStageAuthorization:   1,
+		requestStageFirewall:        1,
+		requestStageResponseMarshal: 1,
+		requestStageResponseSend:    1,
+	}, stages.observations)
+}
+
+func TestServerHandler_DatagramRequestHandler_RequestFailed(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &FirewallMock{}
+	cs := crypto.NewCipherSuiteStub()
+	sh := NewServerHandler(NewFirewallRuleManager(fw), cs, NewAuthorizationStrategyAllow(time.Hour), ServerHandlerOpt{})
+	failed := sh.metrics.requestFailed.(*observability.CounterVecStub)
+
+	req, err := openspalib.NewRequest(openspalib.RequestData{
+		TransactionID:   23,
+		ClientUUID:      "09896692-c299-4f90-9906-2e23cfcc417c",
+		ClientIP:        net.IPv4(88, 200, 23, 23),
+		TargetProtocol:  openspalib.ProtocolTCP,
+		TargetIP:        net.IPv4(88, 200, 23, 19),
+		TargetPortStart: 80,
+		TargetPortEnd:   80,
+	}, cs, openspalib.RequestDataOpt{})
+	require.NoError(t, err)
+	reqB, err := req.Marshal()
+	require.NoError(t, err)
+
+	handle := func(b []byte, ip net.IP) {
+		sh.DatagramRequestHandler(context.TODO(), &UDPResponseMock{}, DatagramRequest{
+			data:  b,
+			rAddr: net.UDPAddr{IP: ip, Port: 40975},
+		})
+	}
+
+	handle([]byte{1, 2, 3}, net.IPv4(88, 200, 23, 12))
+	assert.Equal(t, 1, failed.Get(requestFailureReasonInvalidHeader, "unknown", "ipv4"))
+
+	badTLV := append(append([]byte{}, reqB[:openspalib.HeaderLength]...), 1, 200, 3)
+	handle(badTLV, net.ParseIP("2001:db8::1"))
+	assert.Equal(t, 1, failed.Get(requestFailureReasonInvalidTLV, "CipherSuite_NoSecurity", "ipv6"))
+
+	badCipherSuite := append([]byte{}, reqB...)
+	badCipherSuite[2] = byte(crypto.CipherRSA_SHA256_AES256CBC_ID)
+	handle(badCipherSuite, net.IPv4(88, 200, 23, 12))
+	assert.Equal(t, 1, failed.Get(requestFailureReasonCipherSuite, "CipherSuite_RSA_SHA256_AES256CBC", "ipv4"))
+
+	fw.On("RuleAdd", mock.Anything, mock.Anything).Return(errors.New("iptables failure")).Once()
+	handle(reqB, net.IPv4(88, 200, 23, 12))
+	assert.Equal(t, 1, failed.Get(AuditReasonFirewallRuleAddFailure, "CipherSuite_NoSecurity", "ipv4"))
+
+	assert.Equal(t, 4, failed.Total())
+	fw.AssertExpectations(t)
+}
+
+func TestRequestFailureReasonFromError(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason string
+		audit  string
+	}{
+		{errors.Wrap(openspalib.ErrInvalidHeader, "x"), requestFailureReasonInvalidHeader, AuditReasonBadRequest},
+		{errors.Wrap(openspalib.ErrInvalidTLV, "x"), requestFailureReasonInvalidTLV, AuditReasonBadRequest},
+		{errors.Wrap(crypto.ErrUnsupportedCipherSuite, "x"), requestFailureReasonCipherSuite, AuditReasonBadRequest},
+		{errors.Wrap(crypto.ErrPublicKeyResolve, "x"), requestFailureReasonUnknownClient, AuditReasonBadRequest},
+		{errors.Wrap(crypto.ErrDecryption, "x"), requestFailureReasonDecryption, AuditReasonBadRequest},
+		{errors.Wrap(crypto.ErrInvalidSignature, "x"), requestFailureReasonInvalidSignature, AuditReasonBadRequest},
+		{errors.New("x"), AuditReasonBadRequest, AuditReasonBadRequest},
+	}
+
+	for _, test := range tests {
+		reason := requestFailureReasonFromError(errors.Wrap(test.err, "crypto unlock"))
+		assert.Equal(t, test.reason, reason)
+		assert.Equal(t, test.audit, auditReasonFromRequestFailure(reason))
+	}
+
+	assert.Equal(t, AuditReasonUnauthorized, auditReasonFromRequestFailure(AuditReasonUnauthorized))
+}
+
+type authorizationStrategyCounter struct {
+	calls int32
+}
+
+func (a *authorizationStrategyCounter) RequestAuthorization(_ context.Context, _ tlv.Container) (time.Duration,
+	error) {
+	atomic.AddInt32(&a.calls, 1)
+	return time.Hour, nil
+}
+
+func TestServerHandler_DatagramRequestHandler_TargetPolicy(t *testing.T) {
+	fw := &FirewallMock{}
+	frm := NewFirewallRuleManager(fw)
+	cs := crypto.NewCipherSuiteStub()
+	authz := &authorizationStrategyCounter{}
+	audit := &AuditLoggerStub{}
+
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	policy := &TargetPolicy{Default: []TargetPolicyRule{{
+		Protos: []string{FirewallProtoTCP},
+		Ports:  []TargetPolicyPortRange{{Start: 22}},
+	}}}
+	sh := NewServerHandler(frm, cs, authz, ServerHandlerOpt{TargetPolicy: policy, Audit: audit})
+
+	request := func(port int) []byte {
+		req, err := openspalib.NewRequest(openspalib.RequestData{
+			TransactionID:   23,
+			ClientUUID:      "09896692-c299-4f90-9906-2e23cfcc417c",
+			ClientIP:        net.IPv4(88, 200, 23, 23),
+			TargetProtocol:  openspalib.ProtocolTCP,
+			TargetIP:        net.IPv4(88, 200, 23, 19),
+			TargetPortStart: port,
+			TargetPortEnd:   port,
+		}, cs, openspalib.RequestDataOpt{})
+		require.NoError(t, err)
+
+		b, err := req.Marshal()
+		require.NoError(t, err)
+		return b
+	}
+
+	rAddr := net.UDPAddr{IP: net.IPv4(88, 200, 23, 12), Port: 40975}
+	resp := &UDPResponseMock{}
+
+	// Denied before authorization, no response is sent
+	sh.DatagramRequestHandler(context.TODO(), resp, DatagramRequest{data: request(443), rAddr: rAddr})
+	assert.Equal(t, int32(0), atomic.LoadInt32(&authz.calls))
+	assert.Equal(t, 1, sh.metrics.openspaRequestTargetDenied.Get())
+	if events := audit.Events(); assert.Len(t, events, 1) {
+		assert.Equal(t, AuditEventDeny, events[0].Event)
+		assert.Equal(t, AuditReasonTargetNotAllowed, events[0].Reason)
+	}
+
+	resp.On("SendUDPResponse", rAddr, mock.Anything).Return(nil).Once()
+	fw.On("RuleAdd", mock.Anything, mock.Anything).Return(nil).Once()
+
+	sh.DatagramRequestHandler(context.TODO(), resp, DatagramRequest{data: request(22), rAddr: rAddr})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&authz.calls))
+	assert.Equal(t, 1, sh.metrics.openspaRequest.Get())
+
+	// Without a policy (after a reload) every target is allowed
+	require.NoError(t, sh.Reload(cs, authz, "", nil))
+	resp.On("SendUDPResponse", rAddr, mock.Anything).Return(nil).Once()
+	fw.On("RuleAdd", mock.Anything, mock.Anything).Return(nil).Once()
+
+	sh.DatagramRequestHandler(context.TODO(), resp, DatagramRequest{data: request(443), rAddr: rAddr})
+	assert.Equal(t, 2, sh.metrics.openspaRequest.Get())
+	assert.Equal(t, 1, sh.metrics.openspaRequestTargetDenied.Get())
+
+	resp.AssertExpectations(t)
+	fw.AssertExpectations(t)
+}
@@ -2,13 +2,17 @@ package internal
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 
 	"github.com/greenstatic/openspa/internal/observability/metrics"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 )
 
@@ -17,15 +21,45 @@ const ServerHTTPPortDefault = 22212
 type HTTPServer struct {
 	bindIP   net.IP
 	bindPort int
+	opt      HTTPServerOpt
+
+	server   *http.Server
+	prom     *metrics.PrometheusRepository
+	reloader ConfigReloader
+	grants   GrantManager
+	clients  ClientLister
+	status   StatusProvider
+	health   *Health
+}
+
+type HTTPServerOpt struct {
+	// AdminToken is the bearer token required to access the admin endpoints (/admin/...). If empty, the admin endpoints
+	// are not served.
+	AdminToken string
+
+	// MetricsToken is the bearer token required to access the metrics endpoint (/metrics). If empty, the metrics are
+	// served without authentication.
+	MetricsToken string
+
+	// TLSCertFile and TLSKeyFile are the PEM encoded certificate (chain) and private key of the server. If set, the
+	// server is served over HTTPS instead of plaintext HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSClientCAFile are the PEM encoded CA certificates used to verify client certificates (mTLS). If set, clients
+	// have to present a valid certificate on every endpoint. Requires TLS.
+	TLSClientCAFile string
+}
 
-	server *http.Server
-	prom   *metrics.PrometheusRepository
+func (o HTTPServerOpt) tlsEnabled() bool {
+	return o.TLSCertFile != ""
 }
 
-func NewHTTPServer(ip net.IP, port int) *HTTPServer {
+func NewHTTPServer(ip net.IP, port int, opt HTTPServerOpt) *HTTPServer {
 	h := &HTTPServer{
 		bindIP:   ip,
 		bindPort: port,
+		opt:      opt,
 	}
 
 	return h
@@ -41,15 +75,34 @@ func (h *HTTPServer) start() error {
 	mux := http.NewServeMux()
 	h.setHandles(mux)
 
+	tlsConf, err := h.tlsConfig()
+	if err != nil {
+		return errors.Wrap(err, "tls config")
+	}
+
 	h.server = &http.Server{
 		Handler:      mux,
 		Addr:         net.JoinHostPort(h.bindIP.String(), strconv.Itoa(h.bindPort)),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
+		TLSConfig:    tlsConf,
 	}
 
-	log.Info().Msgf("Starting HTTP server on: %s", h.server.Addr)
-	if err := h.server.ListenAndServe(); err != nil {
+	if tlsConf == nil {
+		if !h.bindIP.IsLoopback() && (h.opt.AdminToken != "" || h.opt.MetricsToken != "") {
+			log.Warn().Msgf("HTTP server bearer tokens are sent in plaintext, consider enabling TLS")
+		}
+
+		log.Info().Msgf("Starting HTTP server on: %s", h.server.Addr)
+		err = h.server.ListenAndServe()
+	} else {
+		log.Info().Msgf("Starting HTTPS server on: %s (client certificates required: %t)", h.server.Addr,
+			tlsConf.ClientAuth == tls.RequireAndVerifyClientCert)
+		// The certificate is already loaded in the TLS config
+		err = h.server.ListenAndServeTLS("", "")
+	}
+
+	if err != nil {
 		if err == http.ErrServerClosed {
 			log.Info().Msgf("HTTP server closed")
 		} else {
@@ -79,8 +132,60 @@ func (h *HTTPServer) stop() error {
 func (h *HTTPServer) setHandles(m *http.ServeMux) {
 	m.HandleFunc("/", handleEndpointRoot)
 	if h.prom != nil {
-		m.Handle("/metrics", h.prom.Handler())
+		m.Handle("/metrics", h.metricsHandler(h.prom.Handler()))
+	}
+	if h.health != nil {
+		m.HandleFunc("/healthz", h.handleEndpointHealthz)
+		m.HandleFunc("/readyz", h.handleEndpointReadyz)
+	}
+	if h.opt.AdminToken != "" {
+		h.setAdminHandles(m)
+	}
+}
+
+// tlsConfig returns the TLS config of the server, nil if TLS is disabled.
+func (h *HTTPServer) tlsConfig() (*tls.Config, error) {
+	if !h.opt.tlsEnabled() {
+		if h.opt.TLSClientCAFile != "" {
+			return nil, errors.New("client CA requires TLS")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(h.opt.TLSCertFile, h.opt.TLSKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load certificate")
 	}
+
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if h.opt.TLSClientCAFile != "" {
+		b, err := os.ReadFile(h.opt.TLSClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read client ca")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificates found in client ca file")
+		}
+
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return c, nil
+}
+
+// metricsHandler wraps the metrics endpoint with bearer token authentication, if a metrics token is configured.
+func (h *HTTPServer) metricsHandler(next http.Handler) http.Handler {
+	if h.opt.MetricsToken == "" {
+		return next
+	}
+	return httpBearerTokenAuth(h.opt.MetricsToken, next)
 }
 
 func handleEndpointRoot(w http.ResponseWriter, r *http.Request) {
@@ -100,12 +205,37 @@ func handleEndpointRoot(w http.ResponseWriter, r *http.Request) {
 	}))
 }
 
-func handleStatusNotFound(w http.ResponseWriter, _ *http.Request) {
-	w.WriteHeader(http.StatusNotFound)
+// handleEndpointHealthz responds with 200 as long as no component is failing (liveness).
+func (h *HTTPServer) handleEndpointHealthz(w http.ResponseWriter, _ *http.Request) {
+	report := h.health.Report()
+	writeHealthReport(w, report, report.Live())
+}
+
+// handleEndpointReadyz responds with 200 once every component has started and is not failing (readiness).
+func (h *HTTPServer) handleEndpointReadyz(w http.ResponseWriter, _ *http.Request) {
+	report := h.health.Report()
+	writeHealthReport(w, report, report.Ready())
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport, ok bool) {
+	setHTTPResponseHeaders(w)
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	panicOnErr(json.NewEncoder(w).Encode(report))
+}
+
+func handleStatusNotFound(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, http.StatusNotFound, "not found")
+}
+
+func handleError(w http.ResponseWriter, _ *http.Request, status int, msg string) {
+	setHTTPResponseHeaders(w)
+	w.WriteHeader(status)
 	panicOnErr(json.NewEncoder(w).Encode(struct {
 		Error string `json:"error"`
 	}{
-		Error: "not found",
+		Error: msg,
 	}))
 }
 
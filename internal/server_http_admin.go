@@ -0,0 +1,338 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// GrantManager manages the active grants (see FirewallRuleManager).
+type GrantManager interface {
+	Grants() []FirewallRuleWithExpiration
+	Grant(id string) (FirewallRuleWithExpiration, error)
+	Extend(id string, d time.Duration) (FirewallRuleWithExpiration, error)
+	Revoke(id string) error
+	RevokeClient(clientUUID string) (int, error)
+}
+
+var _ GrantManager = &FirewallRuleManager{}
+
+// ClientLister lists the clients that are able to authenticate (see PublicKeyStore).
+type ClientLister interface {
+	ClientUUIDs() []string
+}
+
+// StatusProvider returns the status of a running server.
+type StatusProvider interface {
+	Status() ServerStatus
+}
+
+const adminGrantsPath = "/admin/grants"
+
+// adminHandler serves the admin API, both on the HTTP server (with bearer token authentication) and on the control
+// socket (access controlled by the socket's file mode). Endpoints whose dependency is nil respond with 501.
+type adminHandler struct {
+	reloader ConfigReloader
+	grants   GrantManager
+	clients  ClientLister
+	status   StatusProvider
+}
+
+// register adds the admin endpoints to m, each wrapped with wrap.
+func (h *adminHandler) register(m *http.ServeMux, wrap func(next http.Handler) http.Handler) {
+	m.Handle("/admin/reload", wrap(http.HandlerFunc(h.handleEndpointAdminReload)))
+	m.Handle("/admin/status", wrap(http.HandlerFunc(h.handleEndpointAdminStatus)))
+	m.Handle("/admin/clients", wrap(http.HandlerFunc(h.handleEndpointAdminClients)))
+	m.Handle(adminGrantsPath, wrap(http.HandlerFunc(h.handleEndpointAdminGrants)))
+	m.Handle(adminGrantsPath+"/", wrap(http.HandlerFunc(h.handleEndpointAdminGrant)))
+}
+
+func (h *HTTPServer) setAdminHandles(m *http.ServeMux) {
+	a := &adminHandler{
+		reloader: h.reloader,
+		grants:   h.grants,
+		clients:  h.clients,
+		status:   h.status,
+	}
+
+	a.register(m, func(next http.Handler) http.Handler {
+		return httpBearerTokenAuth(h.opt.AdminToken, next)
+	})
+}
+
+func (h *adminHandler) handleEndpointAdminStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if h.status == nil {
+		handleError(w, r, http.StatusNotImplemented, "status not supported")
+		return
+	}
+
+	log.Info().Msgf("Admin API: status requested by %s", adminRemote(r))
+
+	setHTTPResponseHeaders(w)
+	panicOnErr(json.NewEncoder(w).Encode(h.status.Status()))
+}
+
+func (h *adminHandler) handleEndpointAdminClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if h.clients == nil {
+		handleError(w, r, http.StatusNotImplemented, "clients not supported")
+		return
+	}
+
+	log.Info().Msgf("Admin API: list clients requested by %s", adminRemote(r))
+
+	setHTTPResponseHeaders(w)
+	panicOnErr(json.NewEncoder(w).Encode(AdminClients{
+		Clients: h.clients.ClientUUIDs(),
+	}))
+}
+
+func (h *adminHandler) handleEndpointAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if h.reloader == nil {
+		handleError(w, r, http.StatusNotImplemented, "reload not supported")
+		return
+	}
+
+	log.Info().Msgf("Admin API: configuration reload requested by %s", adminRemote(r))
+
+	changes, err := h.reloader.Reload()
+	if err != nil {
+		log.Error().Err(err).Msgf("Admin API: configuration reload failed")
+		handleError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	setHTTPResponseHeaders(w)
+	panicOnErr(json.NewEncoder(w).Encode(changes))
+}
+
+type AdminGrants struct {
+	Grants []AdminGrant `json:"grants"`
+}
+
+type AdminGrant struct {
+	ID               string         `json:"id"`
+	ClientUUID       string         `json:"clientUUID"`
+	Rule             AdminGrantRule `json:"rule"`
+	Created          time.Time      `json:"created"`
+	Expiration       time.Time      `json:"expiration"`
+	RemainingSeconds int64          `json:"remainingSeconds"`
+	RemoveFailing    bool           `json:"removeFailing,omitempty"` // expired, but the rule removal is failing
+}
+
+type AdminGrantRule struct {
+	Proto        string `json:"proto"`
+	SrcIP        string `json:"srcIP"`
+	DstIP        string `json:"dstIP"`
+	DstPortStart int    `json:"dstPortStart,omitempty"`
+	DstPortEnd   int    `json:"dstPortEnd,omitempty"`
+}
+
+type AdminRevoked struct {
+	Revoked int `json:"revoked"`
+}
+
+type AdminClients struct {
+	Clients []string `json:"clients"`
+}
+
+func adminGrantFromFirewallRuleWithExpiration(re FirewallRuleWithExpiration) AdminGrant {
+	return AdminGrant{
+		ID:         re.ID,
+		ClientUUID: re.Meta.ClientUUID,
+		Rule: AdminGrantRule{
+			Proto:        re.Rule.Proto,
+			SrcIP:        re.Rule.SrcIP.String(),
+			DstIP:        re.Rule.DstIP.String(),
+			DstPortStart: re.Rule.DstPortStart,
+			DstPortEnd:   re.Rule.DstPortEnd,
+		},
+		Created:          re.Created,
+		Expiration:       re.Expiration(),
+		RemainingSeconds: int64(time.Until(re.Expiration()).Seconds()),
+		RemoveFailing:    re.RemoveFailing,
+	}
+}
+
+// handleEndpointAdminGrants handles:
+//   - GET /admin/grants[?clientUUID=<uuid>]: list active grants (optionally only of a single client), including the
+//     expired grants whose removal is failing
+//   - DELETE /admin/grants?clientUUID=<uuid>: revoke all the grants of a client
+func (h *adminHandler) handleEndpointAdminGrants(w http.ResponseWriter, r *http.Request) {
+	if h.grants == nil {
+		handleError(w, r, http.StatusNotImplemented, "grants not supported")
+		return
+	}
+
+	clientUUID := r.URL.Query().Get("clientUUID")
+
+	switch r.Method {
+	case http.MethodGet:
+		log.Info().Msgf("Admin API: list grants (client: %q) requested by %s", clientUUID, adminRemote(r))
+
+		grants := make([]AdminGrant, 0)
+		for _, re := range h.grants.Grants() {
+			if clientUUID != "" && re.Meta.ClientUUID != clientUUID {
+				continue
+			}
+			grants = append(grants, adminGrantFromFirewallRuleWithExpiration(re))
+		}
+
+		setHTTPResponseHeaders(w)
+		panicOnErr(json.NewEncoder(w).Encode(AdminGrants{
+			Grants: grants,
+		}))
+
+	case http.MethodDelete:
+		if clientUUID == "" {
+			handleError(w, r, http.StatusBadRequest, "missing clientUUID")
+			return
+		}
+
+		log.Info().Msgf("Admin API: revoke grants of client %s requested by %s", clientUUID, adminRemote(r))
+
+		n, err := h.grants.RevokeClient(clientUUID)
+		if err != nil {
+			log.Error().Err(err).Msgf("Admin API: revoke grants of client %s failed (revoked: %d)", clientUUID, n)
+			handleError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		log.Info().Msgf("Admin API: revoked %d grants of client %s", n, clientUUID)
+
+		setHTTPResponseHeaders(w)
+		panicOnErr(json.NewEncoder(w).Encode(AdminRevoked{
+			Revoked: n,
+		}))
+
+	default:
+		handleError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleEndpointAdminGrant handles:
+//   - GET /admin/grants/<id>: get grant
+//   - DELETE /admin/grants/<id>: revoke grant
+//   - POST /admin/grants/<id>/extend with body {"duration": "<go duration>"}: extend grant
+func (h *adminHandler) handleEndpointAdminGrant(w http.ResponseWriter, r *http.Request) {
+	if h.grants == nil {
+		handleError(w, r, http.StatusNotImplemented, "grants not supported")
+		return
+	}
+
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, adminGrantsPath+"/"), "/")
+	id := path[0]
+
+	switch {
+	case len(path) == 1 && r.Method == http.MethodGet:
+		log.Info().Msgf("Admin API: get grant %s requested by %s", id, adminRemote(r))
+
+		re, err := h.grants.Grant(id)
+		if err != nil {
+			handleAdminGrantError(w, r, err)
+			return
+		}
+
+		setHTTPResponseHeaders(w)
+		panicOnErr(json.NewEncoder(w).Encode(adminGrantFromFirewallRuleWithExpiration(re)))
+
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		log.Info().Msgf("Admin API: revoke grant %s requested by %s", id, adminRemote(r))
+
+		if err := h.grants.Revoke(id); err != nil {
+			log.Error().Err(err).Msgf("Admin API: revoke grant %s failed", id)
+			handleAdminGrantError(w, r, err)
+			return
+		}
+
+		log.Info().Msgf("Admin API: revoked grant %s", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(path) == 2 && path[1] == "extend" && r.Method == http.MethodPost:
+		body := struct {
+			Duration string `json:"duration"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			handleError(w, r, http.StatusBadRequest, "invalid body")
+			return
+		}
+
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 {
+			handleError(w, r, http.StatusBadRequest, "invalid duration")
+			return
+		}
+
+		log.Info().Msgf("Admin API: extend grant %s by %s requested by %s", id, d.String(), adminRemote(r))
+
+		re, err := h.grants.Extend(id, d)
+		if err != nil {
+			log.Error().Err(err).Msgf("Admin API: extend grant %s failed", id)
+			handleAdminGrantError(w, r, err)
+			return
+		}
+
+		setHTTPResponseHeaders(w)
+		panicOnErr(json.NewEncoder(w).Encode(adminGrantFromFirewallRuleWithExpiration(re)))
+
+	case len(path) > 2 || (len(path) == 2 && path[1] != "extend"):
+		handleStatusNotFound(w, r)
+
+	default:
+		handleError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func handleAdminGrantError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrGrantNotFound) {
+		handleStatusNotFound(w, r)
+		return
+	}
+
+	handleError(w, r, http.StatusInternalServerError, err.Error())
+}
+
+// adminRemote describes who sent the request, requests on the control socket have no remote address.
+func adminRemote(r *http.Request) string {
+	if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		return "control socket"
+	}
+	return r.RemoteAddr
+}
+
+// httpBearerTokenAuth only passes requests to next that contain the token in the Authorization header.
+func httpBearerTokenAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		auth := r.Header.Get("Authorization")
+
+		if token == "" || !strings.HasPrefix(auth, prefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(token)) != 1 {
+			log.Info().Msgf("HTTP request to %s from %s failed authentication", r.URL.Path, adminRemote(r))
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			handleError(w, r, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,14 +1,30 @@
 package internal
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/greenstatic/openspa/internal/observability/metrics"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestHTTPServer(t *testing.T) {
@@ -16,7 +32,7 @@ func TestHTTPServer(t *testing.T) {
 
 	serverPort := 23881 // sufficiently high port that is probably not taken
 
-	h := NewHTTPServer(localhost, serverPort)
+	h := NewHTTPServer(localhost, serverPort, HTTPServerOpt{})
 	done := make(chan bool)
 	go func() {
 		err := h.Start()
@@ -54,3 +70,318 @@ func TestHTTPServer(t *testing.T) {
 		t.Error("Timeout")
 	}
 }
+
+type configReloaderStub struct {
+	calls int
+}
+
+func (c *configReloaderStub) Reload() (ServerConfigChanges, error) {
+	c.calls++
+	return ServerConfigChanges{Reloaded: []string{"authorization"}, RestartRequired: []string{}}, nil
+}
+
+func TestHTTPServer_AdminReload(t *testing.T) {
+	h := NewHTTPServer(net.IPv4(127, 0, 0, 1), 0, HTTPServerOpt{AdminToken: "secret-token"})
+	reloader := &configReloaderStub{}
+	h.reloader = reloader
+
+	m := http.NewServeMux()
+	h.setHandles(m)
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	url := s.URL + "/admin/reload"
+	c := s.Client()
+
+	resp, err := c.Post(url, "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, 0, reloader.calls)
+
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret-token")
+
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, reloader.calls)
+
+	changes := ServerConfigChanges{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&changes))
+	resp.Body.Close()
+	assert.Equal(t, []string{"authorization"}, changes.Reloaded)
+}
+
+func TestHTTPServer_AdminGrants(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	fw := &FirewallMock{}
+	frm := NewFirewallRuleManager(fw)
+
+	h := NewHTTPServer(net.IPv4(127, 0, 0, 1), 0, HTTPServerOpt{AdminToken: "secret-token"})
+	h.grants = frm
+
+	m := http.NewServeMux()
+	h.setHandles(m)
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret-token")
+		resp, err := s.Client().Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	client := "c3b66a7a-5b5f-4e2c-8ad5-5b4b4d4c8d43"
+	r := FirewallRule{
+		Proto:        FirewallProtoTCP,
+		SrcIP:        net.IPv4(88, 200, 23, 12),
+		DstIP:        net.IPv4(88, 200, 23, 19),
+		DstPortStart: 22,
+		DstPortEnd:   22,
+	}
+	fw.On("RuleAdd", mock.Anything, mock.Anything).Return(nil).Twice()
+	require.NoError(t, frm.Add(r, FirewallRuleMetadata{ClientUUID: client, Duration: time.Hour}))
+	r.DstPortStart, r.DstPortEnd = 443, 443
+	require.NoError(t, frm.Add(r, FirewallRuleMetadata{ClientUUID: client, Duration: time.Hour}))
+
+	// Unauthenticated
+	resp, err := s.Client().Get(s.URL + "/admin/grants")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// List
+	resp = do(http.MethodGet, "/admin/grants?clientUUID="+client, "")
+	list := AdminGrants{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	resp.Body.Close()
+	require.Len(t, list.Grants, 2)
+	assert.Equal(t, client, list.Grants[0].ClientUUID)
+	assert.Equal(t, "88.200.23.12", list.Grants[0].Rule.SrcIP)
+	assert.Equal(t, 22, list.Grants[0].Rule.DstPortStart)
+	assert.InDelta(t, time.Hour.Seconds(), list.Grants[0].RemainingSeconds, 5)
+	id := list.Grants[0].ID
+
+	// Get
+	resp = do(http.MethodGet, "/admin/grants/"+id, "")
+	g := AdminGrant{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&g))
+	resp.Body.Close()
+	assert.Equal(t, id, g.ID)
+
+	resp = do(http.MethodGet, "/admin/grants/unknown", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Extend
+	resp = do(http.MethodPost, "/admin/grants/"+id+"/extend", `{"duration": "1h"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&g))
+	resp.Body.Close()
+	assert.InDelta(t, (2 * time.Hour).Seconds(), g.RemainingSeconds, 5)
+
+	resp = do(http.MethodPost, "/admin/grants/"+id+"/extend", `{"duration": "forever"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Revoke
+	fw.On("RuleRemove", mock.Anything, mock.Anything).Return(nil).Twice()
+	resp = do(http.MethodDelete, "/admin/grants/"+id, "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, 1, frm.Count())
+
+	resp = do(http.MethodDelete, "/admin/grants?clientUUID="+client, "")
+	revoked := AdminRevoked{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&revoked))
+	resp.Body.Close()
+	assert.Equal(t, 1, revoked.Revoked)
+	assert.Equal(t, 0, frm.Count())
+
+	fw.AssertExpectations(t)
+}
+
+func TestHTTPServer_Health(t *testing.T) {
+	h := NewHTTPServer(net.IPv4(127, 0, 0, 1), 0, HTTPServerOpt{})
+	h.health = NewHealth()
+
+	status := HealthStatusStarting
+	h.health.Register("udp", func() HealthComponent { return HealthComponent{Status: status} })
+
+	m := http.NewServeMux()
+	h.setHandles(m)
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	get := func(path string) (int, HealthReport) {
+		resp, err := s.Client().Get(s.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		r := HealthReport{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&r))
+		return resp.StatusCode, r
+	}
+
+	code, r := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthStatusStarting, r.Status)
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	status = HealthStatusOK
+	code, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	code, r = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthStatusOK, r.Components["udp"].Status)
+
+	status = HealthStatusFailing
+	code, r = get("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, HealthStatusFailing, r.Status)
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestHTTPServer_MetricsToken(t *testing.T) {
+	h := NewHTTPServer(net.IPv4(127, 0, 0, 1), 0, HTTPServerOpt{MetricsToken: "metrics-token"})
+	h.prom = metrics.NewPrometheusRepository(false)
+
+	m := http.NewServeMux()
+	h.setHandles(m)
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	get := func(token string) int {
+		req, err := http.NewRequest(http.MethodGet, s.URL+"/metrics", nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := s.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get(""))
+	assert.Equal(t, http.StatusUnauthorized, get("wrong-token"))
+	assert.Equal(t, http.StatusOK, get("metrics-token"))
+
+	// The admin token does not grant access to the metrics
+	h = NewHTTPServer(net.IPv4(127, 0, 0, 1), 0, HTTPServerOpt{AdminToken: "admin-token", MetricsToken: "metrics-token"})
+	h.prom = metrics.NewPrometheusRepository(false)
+	m = http.NewServeMux()
+	h.setHandles(m)
+	s2 := httptest.NewServer(m)
+	defer s2.Close()
+	req, err := http.NewRequest(http.MethodGet, s2.URL+"/metrics", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	resp, err := s2.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestHTTPServer_TLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := testCertificate(t, dir, "ca", nil, nil)
+	testCertificate(t, dir, "server", ca, caKey)
+	client, clientKey := testCertificate(t, dir, "client", ca, caKey)
+
+	opt := HTTPServerOpt{
+		TLSCertFile:     filepath.Join(dir, "server.pem"),
+		TLSKeyFile:      filepath.Join(dir, "server-key.pem"),
+		TLSClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	h := NewHTTPServer(net.IPv4(127, 0, 0, 1), 0, opt)
+	tlsConf, err := h.tlsConfig()
+	require.NoError(t, err)
+	require.NotNil(t, tlsConf)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConf.ClientAuth)
+
+	m := http.NewServeMux()
+	h.setHandles(m)
+	s := httptest.NewUnstartedServer(m)
+	s.TLS = tlsConf
+	s.StartTLS()
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	do := func(certs []tls.Certificate) error {
+		c := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs, MinVersion: tls.VersionTLS12},
+			},
+			Timeout: 5 * time.Second,
+		}
+		resp, err := c.Get(s.URL + "/")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	assert.Error(t, do(nil), "client without certificate should be rejected")
+	assert.NoError(t, do([]tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}}))
+}
+
+func TestHTTPServer_TLSConfig(t *testing.T) {
+	c, err := NewHTTPServer(nil, 0, HTTPServerOpt{}).tlsConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	_, err = NewHTTPServer(nil, 0, HTTPServerOpt{TLSClientCAFile: "ca.pem"}).tlsConfig()
+	assert.Error(t, err)
+
+	_, err = NewHTTPServer(nil, 0, HTTPServerOpt{TLSCertFile: "missing.pem", TLSKeyFile: "missing.pem"}).tlsConfig()
+	assert.Error(t, err)
+}
+
+// testCertificate creates a certificate (and key) in dir as <name>.pem and <name>-key.pem. If parent is nil, the
+// certificate is a self-signed CA.
+func testCertificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (
+	*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	return cert, key
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+type ConfigReloader interface {
+	Reload() (ServerConfigChanges, error)
+}
+
+var _ ConfigReloader = &ServerConfigReloader{}
+
+// ServerConfigReloader re-reads the server configuration file and applies the reloadable sections (ADK secret,
+// authorization, target policy and crypto) to a running Server. Changes to the remaining sections are reported, but
+// are only applied after a restart. The client public keys are re-read as part of every reload.
+type ServerConfigReloader struct {
+	path     string
+	server   *Server
+	keyStore *PublicKeyStore
+
+	// adkProofGen is optional, if set the XDP ADK proofs are generated with the reloaded ADK secret
+	adkProofGen *ADKProofGen
+	// newAuthz creates the authorization strategy of the reloaded configuration, only replaced in tests
+	newAuthz func(ServerConfigAuthorization) (AuthorizationStrategy, error)
+
+	config ServerConfig
+	lock   sync.Mutex
+}
+
+func NewServerConfigReloader(path string, running ServerConfig, s *Server, keyStore *PublicKeyStore,
+	adkProofGen *ADKProofGen) *ServerConfigReloader {
+	r := &ServerConfigReloader{
+		path:        path,
+		server:      s,
+		keyStore:    keyStore,
+		adkProofGen: adkProofGen,
+		newAuthz:    NewAuthorizationStrategyFromServerConfigAuthorization,
+		config:      running,
+	}
+	return r
+}
+
+func (r *ServerConfigReloader) Reload() (ServerConfigChanges, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	log.Info().Msgf("Reloading server configuration: %s", r.path)
+
+	sc, err := ServerConfigFromFile(r.path)
+	if err != nil {
+		return ServerConfigChanges{}, errors.Wrap(err, "config read")
+	}
+
+	if err := sc.Verify(); err != nil {
+		return ServerConfigChanges{}, errors.Wrap(err, "config invalid")
+	}
+
+	if r.adkProofGen != nil && sc.Server.ADK.Secret == "" {
+		return ServerConfigChanges{}, errors.New("adk secret cannot be removed while xdp is enabled")
+	}
+
+	changes := ServerConfigDiff(r.config, sc)
+
+	if err := r.keyStore.Load(); err != nil {
+		return ServerConfigChanges{}, errors.Wrap(err, "public key store load")
+	}
+
+	cs, err := NewServerCipherSuite(sc.Crypto, r.keyStore)
+	if err != nil {
+		return ServerConfigChanges{}, errors.Wrap(err, "cipher suite")
+	}
+
+	// The running authorization backend is kept (e.g. its plugin is not restarted) unless its section changed
+	var authz AuthorizationStrategy
+	if changes.reloaded("authorization") {
+		authz, err = r.newAuthz(sc.Authorization)
+		if err != nil {
+			return ServerConfigChanges{}, errors.Wrap(err, "authorization")
+		}
+	}
+
+	err = r.server.Reload(ServerReloadSettings{
+		CS:           cs,
+		Authz:        authz,
+		ADKSecret:    sc.Server.ADK.Secret,
+		TargetPolicy: sc.TargetPolicy.TargetPolicy(),
+	})
+	if err != nil {
+		if st, ok := authz.(stopper); ok {
+			if err := st.Stop(); err != nil {
+				log.Error().Err(err).Msgf("Failed to stop the authorization backend of the refused configuration")
+			}
+		}
+		return ServerConfigChanges{}, errors.Wrap(err, "server reload")
+	}
+
+	if r.adkProofGen != nil {
+		r.adkProofGen.SetSecret(sc.Server.ADK.Secret)
+	}
+
+	// Only the reloaded sections are running, the rest remain as they were on server start
+	r.config.Server.ADK.Secret = sc.Server.ADK.Secret
+	r.config.Authorization = sc.Authorization
+	r.config.TargetPolicy = sc.TargetPolicy
+	r.config.Crypto = sc.Crypto
+	r.config.Crypto.RSA.Client.PublicKeyLookupDir = r.keyStore.DirPath()
+
+	log.Info().Msgf("Server configuration reloaded (reloaded: %v, restart required: %v)",
+		changes.Reloaded, changes.RestartRequired)
+
+	return changes, nil
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/greenstatic/openspa/pkg/openspalib/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type serverConfigReloaderTestEnv struct {
+	dir        string
+	configPath string
+}
+
+func newServerConfigReloaderTestEnv(t *testing.T) serverConfigReloaderTestEnv {
+	dir := t.TempDir()
+
+	priv, pub, err := crypto.RSAKeypair(2048)
+	require.NoError(t, err)
+
+	privStr, err := crypto.RSAEncodePrivateKey(priv)
+	require.NoError(t, err)
+	pubStr, err := crypto.RSAEncodePublicKey(pub)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "server_private.key"), []byte(privStr), fs.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "server_public.key"), []byte(pubStr), fs.ModePerm))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "authorized"), fs.ModePerm))
+
+	return serverConfigReloaderTestEnv{
+		dir:        dir,
+		configPath: filepath.Join(dir, "config.yaml"),
+	}
+}
+
+func (e serverConfigReloaderTestEnv) writeConfig(t *testing.T, adkSecret, duration string) {
+	content := fmt.Sprintf(`
+server:
+  ip: "127.0.0.1"
+  port: 22211
+  http:
+    enable: false
+  adk:
+    secret: "%s"
+
+firewall:
+  backend: "none"
+
+authorization:
+  backend: "simple"
+  simple:
+    duration: "%s"
+
+crypto:
+  cipherSuitePriority:
+    - "CipherSuite_RSA_SHA256_AES256CBC"
+  rsa:
+    client:
+      publicKeyLookupDir: "%s"
+    server:
+      privateKeyPath: "%s"
+      publicKeyPath: "%s"
+`, adkSecret, duration, filepath.Join(e.dir, "authorized"), filepath.Join(e.dir, "server_private.key"),
+		filepath.Join(e.dir, "server_public.key"))
+
+	require.NoError(t, os.WriteFile(e.configPath, []byte(content), fs.ModePerm))
+}
+
+func (e serverConfigReloaderTestEnv) server(t *testing.T) (*Server, ServerConfig, *PublicKeyStore) {
+	sc, err := ServerConfigFromFile(e.configPath)
+	require.NoError(t, err)
+	require.NoError(t, sc.Verify())
+
+	ks := NewPublicKeyStore(sc.Crypto.RSA.Client.PublicKeyLookupDir)
+	require.NoError(t, ks.Load())
+
+	cs, err := NewServerCipherSuite(sc.Crypto, ks)
+	require.NoError(t, err)
+
+	authz, err := NewAuthorizationStrategyFromServerConfigAuthorization(sc.Authorization)
+	require.NoError(t, err)
+
+	s := NewServer(ServerSettings{
+		UDPServerIP:   net.ParseIP(sc.Server.IP),
+		UDPServerPort: sc.Server.Port,
+		FW:            FirewallStub{},
+		CS:            cs,
+		Authz:         authz,
+		ADKSecret:     sc.Server.ADK.Secret,
+	})
+
+	return s, sc, ks
+}
+
+func TestServerConfigReloader_Reload(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	env := newServerConfigReloaderTestEnv(t)
+	env.writeConfig(t, "7O4ZIRI", "5s")
+
+	s, sc, ks := env.server(t)
+	r := NewServerConfigReloader(env.configPath, sc, s, ks, nil)
+
+	authzBefore := s.serverHandler.state().authz
+
+	changes, err := r.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changes.Empty())
+
+	env.writeConfig(t, "3HRZN3Y", "1h")
+
+	changes, err = r.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"server.adk.secret", "authorization"}, changes.Reloaded)
+	assert.Len(t, changes.RestartRequired, 0)
+
+	st := s.serverHandler.state()
+	assert.NotEqual(t, authzBefore, st.authz)
+	d, err := st.authz.RequestAuthorization(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, d)
+	assert.NotNil(t, st.adkProver)
+}
+
+func TestServerConfigReloader_ReloadInvalidConfigRefused(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	env := newServerConfigReloaderTestEnv(t)
+	env.writeConfig(t, "", "5s")
+
+	s, sc, ks := env.server(t)
+	r := NewServerConfigReloader(env.configPath, sc, s, ks, nil)
+
+	stBefore := s.serverHandler.state()
+
+	env.writeConfig(t, "", "invalid")
+
+	_, err := r.Reload()
+	assert.Error(t, err)
+
+	st := s.serverHandler.state()
+	assert.Equal(t, stBefore.authz, st.authz)
+	assert.Equal(t, stBefore.cs, st.cs)
+	assert.Nil(t, st.adkProver)
+}
+
+func TestServerConfigReloader_ReloadADKSecretRemovalRefusedWithXDP(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	env := newServerConfigReloaderTestEnv(t)
+	env.writeConfig(t, "7O4ZIRI", "5s")
+
+	s, sc, ks := env.server(t)
+	proofGen := NewADKProofGen(sc.Server.ADK.Secret)
+	r := NewServerConfigReloader(env.configPath, sc, s, ks, proofGen)
+
+	env.writeConfig(t, "", "5s")
+	_, err := r.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, "7O4ZIRI", proofGen.getSecret())
+
+	env.writeConfig(t, "3HRZN3Y", "5s")
+	_, err = r.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, "3HRZN3Y", proofGen.getSecret())
+}
+
+// authorizationStrategyStopStub records whether it was stopped.
+type authorizationStrategyStopStub struct {
+	AuthorizationStrategySimple
+	stopped bool
+}
+
+func (a *authorizationStrategyStopStub) Stop() error {
+	a.stopped = true
+	return nil
+}
+
+func TestServerConfigReloader_ReloadKeepsAuthorization(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	env := newServerConfigReloaderTestEnv(t)
+	env.writeConfig(t, "7O4ZIRI", "5s")
+
+	s, sc, ks := env.server(t)
+	r := NewServerConfigReloader(env.configPath, sc, s, ks, nil)
+
+	created := 0
+	r.newAuthz = func(c ServerConfigAuthorization) (AuthorizationStrategy, error) {
+		created++
+		return NewAuthorizationStrategyFromServerConfigAuthorization(c)
+	}
+
+	// The authorization section did not change, the running backend is kept
+	env.writeConfig(t, "3HRZN3Y", "5s")
+	changes, err := r.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"server.adk.secret"}, changes.Reloaded)
+	assert.Equal(t, 0, created)
+
+	env.writeConfig(t, "3HRZN3Y", "1h")
+	_, err = r.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, 1, created)
+}
+
+func TestServerConfigReloader_ReloadFailedStopsAuthorization(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	env := newServerConfigReloaderTestEnv(t)
+	env.writeConfig(t, "7O4ZIRI", "5s")
+
+	s, sc, ks := env.server(t)
+	r := NewServerConfigReloader(env.configPath, sc, s, ks, nil)
+
+	authz := &authorizationStrategyStopStub{}
+	r.newAuthz = func(c ServerConfigAuthorization) (AuthorizationStrategy, error) {
+		return authz, nil
+	}
+
+	stBefore := s.serverHandler.state()
+
+	// The secret is not base32 encoded, the server refuses the configuration
+	env.writeConfig(t, "1111111", "1h")
+	_, err := r.Reload()
+	assert.Error(t, err)
+
+	assert.True(t, authz.stopped)
+	assert.Equal(t, stBefore.authz, s.serverHandler.state().authz)
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"time"
+)
+
+// ServerStatus is a snapshot of a running server's state, served by the admin API.
+type ServerStatus struct {
+	Version         string                   `json:"version"`
+	Started         time.Time                `json:"started"`
+	UptimeSeconds   int64                    `json:"uptimeSeconds"`
+	ADK             ServerStatusADK          `json:"adk"`
+	RequestQueue    ServerStatusRequestQueue `json:"requestQueue"`
+	FirewallBackend string                   `json:"firewallBackend"`
+	Grants          int                      `json:"grants"`
+}
+
+type ServerStatusADK struct {
+	Enabled bool   `json:"enabled"`
+	XDPMode string `json:"xdpMode,omitempty"` // empty if XDP is disabled
+}
+
+type ServerStatusRequestQueue struct {
+	Depth    int `json:"depth"`
+	Handlers int `json:"handlers"`
+}
+
+var _ StatusProvider = &Server{}
+
+func (s *Server) Status() ServerStatus {
+	st := ServerStatus{
+		Version:         Version(),
+		Started:         s.started,
+		UptimeSeconds:   int64(time.Since(s.started).Seconds()),
+		FirewallBackend: s.settings.FirewallBackend,
+		Grants:          s.frm.Count(),
+		ADK: ServerStatusADK{
+			Enabled: s.serverHandler.ADKSupport(),
+			XDPMode: s.settings.XDPMode,
+		},
+		RequestQueue: ServerStatusRequestQueue{
+			Depth:    s.reqCoord.queue.len(),
+			Handlers: s.reqCoord.handlerCount(),
+		},
+	}
+
+	return st
+}
@@ -3,7 +3,11 @@ package internal
 import (
 	"context"
 	"net"
+	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/greenstatic/openspa/internal/observability"
 	"github.com/greenstatic/openspa/pkg/openspalib"
@@ -15,70 +19,192 @@ import (
 const readRequestBufferSize = openspalib.MaxPDUSize
 
 type Server struct {
-	udpServer  *UDPServer
-	httpServer *HTTPServer
-	handler    UDPDatagramRequestHandler
-	reqCoord   *RequestCoordinator
-	frm        *FirewallRuleManager
-	settings   ServerSettings
+	udpServer     *UDPServer
+	httpServer    *HTTPServer
+	controlServer *ControlServer
+	handler       UDPDatagramRequestHandler
+	serverHandler *ServerHandler
+	reqCoord      *RequestCoordinator
+	frm           *FirewallRuleManager
+	settings      ServerSettings
+	started       time.Time
+	health        *Health
+	firewallSetup int32 // 1 once FirewallSetup succeeded, accessed atomically
 }
 
 const NoRequestHandlersDefault = 100
 
 type ServerSettings struct {
-	UDPServerIP       net.IP
-	UDPServerPort     int
-	NoRequestHandlers int
-	FW                Firewall
-	CS                crypto.CipherSuite
-	Authz             AuthorizationStrategy
+	UDPServerIP         net.IP
+	UDPServerPort       int
+	NoRequestHandlers   int // NoRequestHandlersDefault if not positive
+	RequestCoordinator  RequestCoordinatorOpt
+	FirewallRuleManager FirewallRuleManagerOpt
+	FW                  Firewall
+	CS                  crypto.CipherSuite
+	Authz               AuthorizationStrategy
 
 	// HTTP server parameters, if HTTPServerPort is 0, the HTTP server will not be started
 	HTTPServerIP   net.IP
 	HTTPServerPort int
+	HTTPServerOpt  HTTPServerOpt
+
+	// Control socket parameters, if ControlSocketPath is empty, the control socket will not be served
+	ControlSocketPath string
+	ControlSocketMode os.FileMode
 
 	// Optional
-	ADKSecret string
+	HealthChecks        map[string]HealthCheck // additional components reported by /healthz and /readyz
+	Clients             ClientLister
+	FirewallBackend     string // used for status reporting and audit events
+	XDPMode             string // used for status reporting
+	Audit               AuditLogger
+	ADKSecret           string
+	SourceIPRateLimit   RateLimitSettings
+	ClientUUIDRateLimit RateLimitSettings
+	TargetPolicy        *TargetPolicy
 }
 
 func NewServer(set ServerSettings) *Server {
-	frm := NewFirewallRuleManager(set.FW)
+	var audit AuditLogger
+	if set.Audit != nil {
+		audit = auditLoggerWithFirewallBackend{next: set.Audit, backend: set.FirewallBackend}
+	}
 
-	h := NewServerHandler(frm, set.CS, set.Authz, ServerHandlerOpt{ADKSecret: set.ADKSecret})
-	var handler UDPDatagramRequestHandler
-	var rc *RequestCoordinator
-	if set.NoRequestHandlers > 0 {
-		rc = NewRequestCoordinator(h, set.NoRequestHandlers)
-		handler = rc
-	} else {
-		handler = &datagramRequestHandlerUnbound{h}
+	frmOpt := set.FirewallRuleManager
+	frmOpt.Audit = audit
+	frm := NewFirewallRuleManagerWithOpt(set.FW, frmOpt)
+
+	h := NewServerHandler(frm, set.CS, set.Authz, ServerHandlerOpt{
+		ADKSecret:           set.ADKSecret,
+		SourceIPRateLimit:   set.SourceIPRateLimit,
+		ClientUUIDRateLimit: set.ClientUUIDRateLimit,
+		TargetPolicy:        set.TargetPolicy,
+		Audit:               audit,
+	})
+
+	handlers := set.NoRequestHandlers
+	if handlers <= 0 {
+		handlers = NoRequestHandlersDefault
 	}
+	rc := NewRequestCoordinator(h, handlers, set.RequestCoordinator)
 
 	var httpServer *HTTPServer
 	if set.HTTPServerPort != 0 {
-		httpServer = NewHTTPServer(set.HTTPServerIP, set.HTTPServerPort)
+		httpServer = NewHTTPServer(set.HTTPServerIP, set.HTTPServerPort, set.HTTPServerOpt)
+		httpServer.grants = frm
+		httpServer.clients = set.Clients
+	}
+
+	var controlServer *ControlServer
+	if set.ControlSocketPath != "" {
+		controlServer = NewControlServer(set.ControlSocketPath, set.ControlSocketMode)
+		controlServer.admin.grants = frm
+		controlServer.admin.clients = set.Clients
 	}
 
 	s := &Server{
-		udpServer:  NewUDPServer(set.UDPServerIP, set.UDPServerPort, handler),
-		httpServer: httpServer,
-		handler:    handler,
-		reqCoord:   rc,
-		settings:   set,
-		frm:        frm,
+		udpServer:     NewUDPServer(set.UDPServerIP, set.UDPServerPort, rc),
+		httpServer:    httpServer,
+		controlServer: controlServer,
+		handler:       rc,
+		serverHandler: h,
+		reqCoord:      rc,
+		settings:      set,
+		frm:           frm,
+		health:        NewHealth(),
+	}
+
+	s.health.Register("udp", s.udpServer.Health)
+	s.health.Register("ruleManager", frm.Health)
+	s.health.Register("firewall", s.firewallHealth)
+	s.health.Register("authorization", s.authorizationHealth)
+	for name, check := range set.HealthChecks {
+		s.health.Register(name, check)
+	}
+
+	if httpServer != nil {
+		httpServer.status = s
+		httpServer.health = s.health
+	}
+	if controlServer != nil {
+		controlServer.admin.status = s
 	}
+
 	return s
 }
 
+// firewallHealth checks the firewall backend, once it has been set up.
+func (s *Server) firewallHealth() HealthComponent {
+	if atomic.LoadInt32(&s.firewallSetup) == 0 {
+		return HealthComponent{Status: HealthStatusStarting}
+	}
+	return healthComponentFromError(s.frm.fw.Check())
+}
+
+// authorizationHealth checks the authorization backend, if it has a health check (e.g. a plugin).
+func (s *Server) authorizationHealth() HealthComponent {
+	if h, ok := s.serverHandler.state().authz.(healthChecker); ok {
+		return h.Health()
+	}
+	return HealthComponent{Status: HealthStatusOK}
+}
+
+// ServerReloadSettings are the ServerSettings that can be replaced on a running server.
+type ServerReloadSettings struct {
+	CS           crypto.CipherSuite
+	Authz        AuthorizationStrategy // optional, the running authorization strategy is kept if nil
+	ADKSecret    string
+	TargetPolicy *TargetPolicy
+}
+
+// Reload replaces the cipher suite, authorization strategy, ADK secret and target policy of a running server. Active
+// firewall rules are kept.
+func (s *Server) Reload(set ServerReloadSettings) error {
+	prev := s.serverHandler.state().authz
+	if set.Authz == nil {
+		set.Authz = prev
+	}
+
+	if err := s.serverHandler.Reload(set.CS, set.Authz, set.ADKSecret, set.TargetPolicy); err != nil {
+		return errors.Wrap(err, "server handler reload")
+	}
+
+	// The requests in-flight finish with the previous authorization backend
+	if st, ok := prev.(stopper); ok && prev != set.Authz {
+		go func() {
+			if err := st.Stop(); err != nil {
+				log.Error().Err(err).Msgf("Failed to stop the previous authorization backend")
+			}
+		}()
+	}
+
+	return nil
+}
+
+// SetConfigReloader enables the admin reload endpoint of the HTTP server and control socket (if enabled). Needs to be
+// called before Start.
+func (s *Server) SetConfigReloader(r ConfigReloader) {
+	if s.httpServer != nil {
+		s.httpServer.reloader = r
+	}
+	if s.controlServer != nil {
+		s.controlServer.admin.reloader = r
+	}
+}
+
 func (s *Server) Start() error {
 	if err := s.frm.fw.FirewallSetup(); err != nil {
 		log.Fatal().Err(err).Msgf("Failed to setup firewall")
 	}
+	atomic.StoreInt32(&s.firewallSetup, 1)
 
 	if err := s.frm.Start(); err != nil {
 		log.Fatal().Err(err).Msgf("Failed to start firewall rule manager")
 	}
 
+	s.started = time.Now()
+
 	if s.httpServer != nil {
 		go func() {
 			if err := s.httpServer.Start(); err != nil {
@@ -87,18 +213,22 @@ func (s *Server) Start() error {
 		}()
 	}
 
-	bind := net.JoinHostPort(s.settings.UDPServerIP.String(), strconv.Itoa(s.settings.UDPServerPort))
-	rc := s.reqCoord != nil // do we have a request coordinator?
-	log.Info().Msgf("Starting UDP server (ADK support: %t, request coordinator: %t): %s", s.handler.ADKSupport(), rc, bind)
-	if s.reqCoord != nil {
-		s.reqCoord.Start()
+	if s.controlServer != nil {
+		// Local administration is a convenience, the server can operate without it
+		if err := s.controlServer.Start(); err != nil {
+			log.Error().Err(err).Msgf("Failed to start control socket server")
+		}
 	}
 
+	bind := net.JoinHostPort(s.settings.UDPServerIP.String(), strconv.Itoa(s.settings.UDPServerPort))
+	log.Info().Msgf("Starting UDP server (ADK support: %t): %s", s.handler.ADKSupport(), bind)
+	s.reqCoord.Start()
+
 	return s.udpServer.Start()
 }
 
 func (s *Server) Stop() error {
-	// s.reqCoord.Stop() // TODO
+	s.reqCoord.Stop()
 
 	if s.httpServer != nil {
 		if err := s.httpServer.Stop(); err != nil {
@@ -106,6 +236,12 @@ func (s *Server) Stop() error {
 		}
 	}
 
+	if s.controlServer != nil {
+		if err := s.controlServer.Stop(); err != nil {
+			log.Error().Err(err).Msgf("Failed to stop control socket server")
+		}
+	}
+
 	if err := s.udpServer.Stop(); err != nil {
 		return errors.Wrap(err, "udp server stop")
 	}
@@ -114,15 +250,37 @@ func (s *Server) Stop() error {
 		return errors.Wrap(err, "firewall rule manager stop")
 	}
 
+	if st, ok := s.frm.fw.(stopper); ok {
+		if err := st.Stop(); err != nil {
+			return errors.Wrap(err, "firewall stop")
+		}
+	}
+
+	if st, ok := s.serverHandler.state().authz.(stopper); ok {
+		if err := st.Stop(); err != nil {
+			return errors.Wrap(err, "authorization stop")
+		}
+	}
+
 	return nil
 }
 
+// stopper is implemented by the firewall and authorization backends that have to be stopped (e.g. plugins).
+type stopper interface {
+	Stop() error
+}
+
+type healthChecker interface {
+	Health() HealthComponent
+}
+
 type UDPServer struct {
 	IP      net.IP
 	Port    int
 	handler UDPDatagramRequestHandler
 
-	c *net.UDPConn
+	c     *net.UDPConn
+	state int32 // udpServerState*, accessed atomically
 
 	metrics udpServerMetrics
 }
@@ -160,6 +318,8 @@ func (u *UDPServer) start() error {
 	u.c = c
 	responder := NewUDPResponse(c, u.metrics)
 
+	atomic.StoreInt32(&u.state, udpServerStateListening)
+	defer atomic.StoreInt32(&u.state, udpServerStateStopped)
 	defer c.Close()
 
 	b := make([]byte, readRequestBufferSize)
@@ -188,6 +348,23 @@ func (u *UDPServer) start() error {
 	return nil
 }
 
+const (
+	udpServerStateNotStarted int32 = iota
+	udpServerStateListening
+	udpServerStateStopped
+)
+
+func (u *UDPServer) Health() HealthComponent {
+	switch atomic.LoadInt32(&u.state) {
+	case udpServerStateListening:
+		return HealthComponent{Status: HealthStatusOK}
+	case udpServerStateStopped:
+		return HealthComponent{Status: HealthStatusFailing, Message: "not listening"}
+	default:
+		return HealthComponent{Status: HealthStatusStarting}
+	}
+}
+
 func (u *UDPServer) Stop() error {
 	return u.stop()
 }
@@ -224,12 +401,38 @@ type UDPDatagramRequestHandler interface {
 
 var _ UDPDatagramRequestHandler = &RequestCoordinator{}
 
+const requestHandlerIdleTimeoutDefault = 30 * time.Second
+
+// RequestCoordinator queues requests in a bounded priority queue (see requestQueue) and processes them with a pool of
+// handlers. The pool starts with the minimum number of handlers and grows (up to MaxHandlers) when requests are waiting
+// and no handler is idle. Handlers above the minimum exit once they are idle for a while.
 type RequestCoordinator struct {
-	reqHandler UDPDatagramRequestHandler
-	queue      chan QueuedDatagramRequest
+	reqHandler  UDPDatagramRequestHandler
+	prioritizer DatagramRequestPrioritizer // optional
+	queue       *requestQueue
+
+	minHandlers int
+	maxHandlers int
+	idleTimeout time.Duration
+
+	handlers     int
+	idleHandlers int
+	handlersLock sync.Mutex
+
+	stop    chan struct{}
+	started bool
+
+	metrics requestCoordinatorMetrics
+}
 
-	noHandlers int
-	started    bool
+type RequestCoordinatorOpt struct {
+	// QueueSize is the maximum number of queued requests, if 0 RequestQueueSizeDefault is used
+	QueueSize int
+	// DropPolicy decides which request is dropped when the queue is full, if empty RequestQueueDropNewest is used
+	DropPolicy RequestQueueDropPolicy
+	// MaxHandlers is the upper bound of handlers when scaling with load, if lower than the number of handlers the
+	// number of handlers is fixed
+	MaxHandlers int
 }
 
 type QueuedDatagramRequest struct {
@@ -238,52 +441,193 @@ type QueuedDatagramRequest struct {
 	ctx  context.Context
 }
 
-func NewRequestCoordinator(h UDPDatagramRequestHandler, handlers int) *RequestCoordinator {
+type requestCoordinatorMetrics struct {
+	queueDepth      observability.GaugeFunc
+	handlers        observability.GaugeFunc
+	droppedHigh     observability.Counter
+	droppedLow      observability.Counter
+	handlersScaleUp observability.Counter
+}
+
+func NewRequestCoordinator(h UDPDatagramRequestHandler, handlers int, opt RequestCoordinatorOpt) *RequestCoordinator {
 	d := &RequestCoordinator{
-		reqHandler: h,
-		queue:      make(chan QueuedDatagramRequest),
-		noHandlers: handlers,
-		started:    false,
+		reqHandler:  h,
+		queue:       newRequestQueue(opt.QueueSize, opt.DropPolicy),
+		minHandlers: handlers,
+		maxHandlers: opt.MaxHandlers,
+		idleTimeout: requestHandlerIdleTimeoutDefault,
+		stop:        make(chan struct{}),
+		started:     false,
+		metrics:     newRequestCoordinatorMetrics(),
+	}
+
+	if p, ok := h.(DatagramRequestPrioritizer); ok {
+		d.prioritizer = p
+	}
+
+	if d.maxHandlers < d.minHandlers {
+		d.maxHandlers = d.minHandlers
 	}
+
 	return d
 }
 
 func (d *RequestCoordinator) Start() {
+	d.handlersLock.Lock()
+	defer d.handlersLock.Unlock()
+
+	if d.started {
+		return
+	}
+	d.started = true
+
+	d.metrics.queueDepth.GaugeFuncRegister(func() float64 {
+		return float64(d.queue.len())
+	})
+	d.metrics.handlers.GaugeFuncRegister(func() float64 {
+		return float64(d.handlerCount())
+	})
+
+	for i := 0; i < d.minHandlers; i++ {
+		d.spawnHandler()
+	}
+}
+
+// Stop stops all handlers, queued requests are not processed.
+func (d *RequestCoordinator) Stop() {
+	d.handlersLock.Lock()
+	defer d.handlersLock.Unlock()
+
 	if !d.started {
-		d.startHandlers(d.queue, d.noHandlers)
+		return
 	}
+	d.started = false
+
+	close(d.stop)
+	d.metrics.queueDepth.GaugeFuncDeregister()
+	d.metrics.handlers.GaugeFuncDeregister()
 }
 
+// DatagramRequestHandler queues the request, it never blocks. If the queue is full a request is dropped.
 func (d *RequestCoordinator) DatagramRequestHandler(ctx context.Context, resp UDPResponser, r DatagramRequest) {
-	d.queue <- QueuedDatagramRequest{ctx: ctx, DatagramRequest: r, resp: resp}
+	p := RequestPriorityLow
+	if d.prioritizer != nil {
+		p = d.prioritizer.DatagramRequestPriority(r)
+	}
+
+	dropped, droppedPriority := d.queue.push(QueuedDatagramRequest{ctx: ctx, DatagramRequest: r, resp: resp}, p)
+	if dropped {
+		log.Debug().Msgf("Request queue full, dropped %s priority request", droppedPriority.String())
+		if droppedPriority == RequestPriorityHigh {
+			d.metrics.droppedHigh.Inc()
+		} else {
+			d.metrics.droppedLow.Inc()
+		}
+	}
+
+	d.scale()
+}
+
+func (d *RequestCoordinator) handlerCount() int {
+	d.handlersLock.Lock()
+	defer d.handlersLock.Unlock()
+	return d.handlers
 }
 
 func (d *RequestCoordinator) ADKSupport() bool {
 	return d.reqHandler.ADKSupport()
 }
 
-// startHandlers spawns size handler(), each in a goroutine.
-func (d *RequestCoordinator) startHandlers(queue chan QueuedDatagramRequest, size int) {
-	for i := 0; i < size; i++ {
-		go d.handler(queue)
+// scale spawns an additional handler if there are more queued requests than idle handlers and we are below
+// MaxHandlers.
+func (d *RequestCoordinator) scale() {
+	d.handlersLock.Lock()
+	defer d.handlersLock.Unlock()
+
+	if !d.started || d.handlers >= d.maxHandlers || d.queue.len() <= d.idleHandlers {
+		return
 	}
+
+	d.spawnHandler()
+	d.metrics.handlersScaleUp.Inc()
+}
+
+// spawnHandler needs to be called with handlersLock held.
+func (d *RequestCoordinator) spawnHandler() {
+	d.handlers++
+	d.idleHandlers++
+	go d.handler()
 }
 
-func (d *RequestCoordinator) handler(queue chan QueuedDatagramRequest) {
-	for r := range queue {
-		if d.reqHandler != nil {
-			d.reqHandler.DatagramRequestHandler(r.ctx, r.resp, r.DatagramRequest)
+func (d *RequestCoordinator) handler() {
+	for {
+		var idle <-chan time.Time
+		var t *time.Timer
+		if d.maxHandlers > d.minHandlers {
+			t = time.NewTimer(d.idleTimeout)
+			idle = t.C
+		}
+
+		select {
+		case <-d.queue.ready:
+			if t != nil {
+				t.Stop()
+			}
+			d.handle()
+
+		case <-idle:
+			if d.scaleDown() {
+				return
+			}
+
+		case <-d.stop:
+			if t != nil {
+				t.Stop()
+			}
+			return
 		}
 	}
 }
 
-// datagramRequestHandlerUnbound spawns each DatagramRequestHandler in its own goroutine. This is dangerous
-// since we spawn goroutines without any limit.
-type datagramRequestHandlerUnbound struct {
-	UDPDatagramRequestHandler
+func (d *RequestCoordinator) handle() {
+	d.handlersLock.Lock()
+	d.idleHandlers--
+	d.handlersLock.Unlock()
+
+	r, ok := d.queue.pop()
+	if ok && d.reqHandler != nil {
+		d.reqHandler.DatagramRequestHandler(r.ctx, r.resp, r.DatagramRequest)
+	}
+
+	d.handlersLock.Lock()
+	d.idleHandlers++
+	d.handlersLock.Unlock()
+}
+
+// scaleDown returns true if the (idle) handler should exit.
+func (d *RequestCoordinator) scaleDown() bool {
+	d.handlersLock.Lock()
+	defer d.handlersLock.Unlock()
+
+	if d.handlers <= d.minHandlers {
+		return false
+	}
+
+	d.handlers--
+	d.idleHandlers--
+	return true
 }
 
-//nolint:lll
-func (d *datagramRequestHandlerUnbound) DatagramRequestHandler(ctx context.Context, resp UDPResponser, r DatagramRequest) {
-	go d.UDPDatagramRequestHandler.DatagramRequestHandler(ctx, resp, r)
+func newRequestCoordinatorMetrics() requestCoordinatorMetrics {
+	m := requestCoordinatorMetrics{}
+	mr := getMetricsRepository()
+	lbl := observability.NewLabels()
+
+	m.queueDepth = mr.GaugeFunc("request_queue_depth", lbl)
+	m.handlers = mr.GaugeFunc("request_handlers", lbl)
+	m.droppedHigh = mr.Count("request_queue_dropped", lbl.Add("priority", RequestPriorityHigh.String()))
+	m.droppedLow = mr.Count("request_queue_dropped", lbl.Add("priority", RequestPriorityLow.String()))
+	m.handlersScaleUp = mr.Count("request_handlers_scale_up", lbl)
+
+	return m
 }
@@ -7,9 +7,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/greenstatic/openspa/internal/observability"
 	"github.com/greenstatic/openspa/pkg/openspalib/crypto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestUDPServer(t *testing.T) {
@@ -66,34 +68,39 @@ func TestUDPServer(t *testing.T) {
 	assert.Equal(t, 1, s.metrics.datagramRX.Get())
 }
 
-func TestRequestCoordinator_Size0ShouldBlock(t *testing.T) {
-	r := NewRequestCoordinator(nil, 0)
+func TestRequestCoordinator_Size0ShouldNotBlock(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+
+	r := NewRequestCoordinator(nil, 0, RequestCoordinatorOpt{QueueSize: 1})
 	r.Start()
+	defer r.Stop()
 
 	done := make(chan bool)
 	go func() {
-		r.DatagramRequestHandler(context.TODO(), nil, DatagramRequest{
-			data: []byte{0x01},
-			rAddr: net.UDPAddr{
-				IP:   net.IPv4(127, 0, 0, 1),
-				Port: 8998,
-			}})
+		for i := 0; i < 2; i++ {
+			r.DatagramRequestHandler(context.TODO(), nil, DatagramRequest{
+				data: []byte{0x01},
+				rAddr: net.UDPAddr{
+					IP:   net.IPv4(127, 0, 0, 1),
+					Port: 8998,
+				}})
+		}
 		done <- true
 	}()
 
 	tm := time.NewTimer(2 * time.Second)
 	select {
 	case <-done:
-		t.Fatal("Request is not blocking")
 	case <-tm.C:
-		<-r.queue
+		t.Fatal("Request is blocking")
 	}
 
-	<-done
+	assert.Equal(t, 1, r.queue.len())
+	assert.Equal(t, 1, r.metrics.droppedLow.Get())
 }
 
 func TestRequestCoordinator_Size1ShouldNotBlock(t *testing.T) {
-	r := NewRequestCoordinator(nil, 1)
+	r := NewRequestCoordinator(nil, 1, RequestCoordinatorOpt{})
 	r.Start()
 
 	done := make(chan bool)
@@ -119,7 +126,7 @@ func TestRequestCoordinator_ShouldCoordinate(t *testing.T) {
 	h := NewDatagramRequestHandlerMock()
 	h.On("DatagramRequestHandler", mock.Anything, mock.Anything)
 
-	r := NewRequestCoordinator(h, 1)
+	r := NewRequestCoordinator(h, 1, RequestCoordinatorOpt{})
 	r.Start()
 
 	done := make(chan bool)
@@ -157,7 +164,7 @@ func TestRequestCoordinator_WorkAllocation(t *testing.T) {
 		wg.Done()
 	}, false)
 
-	r := NewRequestCoordinator(h, 10)
+	r := NewRequestCoordinator(h, 10, RequestCoordinatorOpt{})
 	r.Start()
 
 	timeStart := time.Now()
@@ -193,6 +200,41 @@ func TestRequestCoordinator_WorkAllocation(t *testing.T) {
 	assert.GreaterOrEqual(t, diff.Seconds(), 2.0)
 }
 
+func TestRequestCoordinator_ScaleHandlers(t *testing.T) {
+	release := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(10)
+
+	h := NewDatagramRequestHandlerStub(func(ctx context.Context, resp UDPResponser, r DatagramRequest) {
+		<-release
+		wg.Done()
+	}, false)
+
+	r := NewRequestCoordinator(h, 1, RequestCoordinatorOpt{MaxHandlers: 5})
+	r.idleTimeout = 100 * time.Millisecond
+	r.Start()
+	defer r.Stop()
+
+	for i := 0; i < 10; i++ {
+		r.DatagramRequestHandler(context.TODO(), nil, DatagramRequest{data: []byte{byte(i)}})
+	}
+
+	assert.Eventually(t, func() bool {
+		r.handlersLock.Lock()
+		defer r.handlersLock.Unlock()
+		return r.handlers == 5
+	}, 2*time.Second, 10*time.Millisecond)
+
+	close(release)
+	wg.Wait()
+
+	assert.Eventually(t, func() bool {
+		r.handlersLock.Lock()
+		defer r.handlersLock.Unlock()
+		return r.handlers == 1
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
 func TestServerShutdown(t *testing.T) {
 	fw := &FirewallMock{}
 	cs := crypto.NewCipherSuiteStub()
@@ -229,12 +271,12 @@ func TestServerShutdown(t *testing.T) {
 		Duration:   time.Hour,
 	}
 
-	fw.On("RuleAdd", rule, meta).Return(nil).Once()
+	fw.On("RuleAdd", rule, firewallRuleManagerMeta(meta)).Return(nil).Once()
 	assert.NoError(t, s.frm.Add(rule, meta))
 
 	time.Sleep(2 * time.Second)
 
-	fw.On("RuleRemove", rule, meta).Return(nil).Once()
+	fw.On("RuleRemove", rule, firewallRuleManagerMeta(meta)).Return(nil).Once()
 	assert.NoError(t, s.Stop())
 
 	<-startDone
@@ -294,7 +336,9 @@ func TestServerCreation_0RequestHandlers(t *testing.T) {
 		Authz:             authz,
 	})
 
-	assert.Nil(t, s.reqCoord)
+	// The request handlers are bounded with the default
+	require.NotNil(t, s.reqCoord)
+	assert.Equal(t, NoRequestHandlersDefault, s.reqCoord.minHandlers)
 
 	startDone := make(chan bool)
 	go func() {
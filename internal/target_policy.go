@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"net"
+)
+
+// TargetPolicy restricts the targets (IP, protocol and ports) the clients may request, regardless of what the
+// authorization backend allows. A request is allowed if one of the rules of the client permits it, the Default rules
+// apply to the clients without rules of their own. Empty Default rules allow every target, as does a nil TargetPolicy.
+type TargetPolicy struct {
+	Default []TargetPolicyRule
+	// Clients (by UUID) replace the Default rules for the listed clients
+	Clients map[string][]TargetPolicyRule
+}
+
+// TargetPolicyRule permits the targets that match all of its (non-empty) fields.
+type TargetPolicyRule struct {
+	Networks []*net.IPNet // any target IP if empty
+	Protos   []string     // any protocol if empty
+	// Ports (if not empty) only permit TCP and UDP targets whose port range lies within one of the ranges
+	Ports []TargetPolicyPortRange
+}
+
+type TargetPolicyPortRange struct {
+	Start int
+	End   int // optional
+}
+
+// Allowed returns whether the client may request the rule's target.
+func (p *TargetPolicy) Allowed(clientUUID string, r FirewallRule) bool {
+	if p == nil {
+		return true
+	}
+
+	rules, ok := p.Clients[clientUUID]
+	if !ok {
+		if len(p.Default) == 0 {
+			return true
+		}
+		rules = p.Default
+	}
+
+	for _, rule := range rules {
+		if rule.permits(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t TargetPolicyRule) permits(r FirewallRule) bool {
+	if len(t.Networks) != 0 && !targetPolicyNetworksContain(t.Networks, r.DstIP) {
+		return false
+	}
+
+	if len(t.Protos) != 0 && !stringsContain(t.Protos, r.Proto) {
+		return false
+	}
+
+	if len(t.Ports) == 0 {
+		return true
+	}
+
+	if r.Proto != FirewallProtoTCP && r.Proto != FirewallProtoUDP {
+		return false
+	}
+
+	start, end := r.DstPortStart, r.DstPortEnd
+	if end == 0 {
+		end = start
+	}
+	// A reversed range would be swapped by some backends (e.g. ipset), opening the ports outside of the range
+	if end < start {
+		return false
+	}
+	for _, pr := range t.Ports {
+		if start >= pr.Start && end <= pr.end() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (pr TargetPolicyPortRange) end() int {
+	if pr.End == 0 {
+		return pr.Start
+	}
+	return pr.End
+}
+
+func targetPolicyNetworksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func stringsContain(s []string, e string) bool {
+	for _, v := range s {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
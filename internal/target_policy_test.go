@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetPolicy_Allowed(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/24")
+	_, lan6, _ := net.ParseCIDR("2001:1470:fffd:66::/64")
+	p := &TargetPolicy{
+		Default: []TargetPolicyRule{
+			{Networks: []*net.IPNet{lan, lan6}, Protos: []string{FirewallProtoTCP},
+				Ports: []TargetPolicyPortRange{{Start: 22}, {Start: 8000, End: 8080}}},
+			{Networks: []*net.IPNet{lan}, Protos: []string{FirewallProtoICMP}},
+		},
+		Clients: map[string][]TargetPolicyRule{
+			"admin":  {{}},
+			"backup": {{Protos: []string{FirewallProtoUDP}, Ports: []TargetPolicyPortRange{{Start: 5000}}}},
+		},
+	}
+
+	tcp := func(ip string, start, end int) FirewallRule {
+		return FirewallRule{Proto: FirewallProtoTCP, SrcIP: net.IPv4(88, 200, 23, 12), DstIP: net.ParseIP(ip),
+			DstPortStart: start, DstPortEnd: end}
+	}
+
+	tests := []struct {
+		name    string
+		client  string
+		r       FirewallRule
+		allowed bool
+	}{
+		{"port", "c1", tcp("10.0.0.5", 22, 22), true},
+		{"port without end", "c1", tcp("10.0.0.5", 22, 0), true},
+		{"ipv6", "c1", tcp("2001:1470:fffd:66::5", 22, 22), true},
+		{"range", "c1", tcp("10.0.0.5", 8000, 8080), true},
+		{"range in range", "c1", tcp("10.0.0.5", 8010, 8020), true},
+		{"range overlapping", "c1", tcp("10.0.0.5", 8070, 8090), false},
+		{"all ports", "c1", tcp("10.0.0.5", 1, 65535), false},
+		{"other port", "c1", tcp("10.0.0.5", 23, 23), false},
+		{"reversed range", "c1", tcp("10.0.0.5", 23, 22), false},
+		{"reversed range in range", "c1", tcp("10.0.0.5", 8080, 8000), false},
+		{"other network", "c1", tcp("10.0.1.5", 22, 22), false},
+		{"other proto", "c1", FirewallRule{Proto: FirewallProtoUDP, DstIP: net.ParseIP("10.0.0.5"), DstPortStart: 22},
+			false},
+		{"icmp", "c1", FirewallRule{Proto: FirewallProtoICMP, DstIP: net.ParseIP("10.0.0.5")}, true},
+		{"icmp other network", "c1", FirewallRule{Proto: FirewallProtoICMP, DstIP: net.ParseIP("10.0.1.5")}, false},
+		{"client without restrictions", "admin", tcp("192.168.1.1", 1, 65535), true},
+		{"client rules replace the default", "backup", tcp("10.0.0.5", 22, 22), false},
+		{"client", "backup", FirewallRule{Proto: FirewallProtoUDP, DstIP: net.ParseIP("192.168.1.1"),
+			DstPortStart: 5000}, true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.allowed, p.Allowed(test.client, test.r), test.name)
+	}
+}
+
+func TestTargetPolicy_AllowedWithoutRules(t *testing.T) {
+	r := FirewallRule{Proto: FirewallProtoTCP, DstIP: net.IPv4(10, 0, 0, 5), DstPortStart: 1, DstPortEnd: 65535}
+
+	var p *TargetPolicy
+	assert.True(t, p.Allowed("c1", r))
+
+	// Only the listed clients are restricted
+	p = &TargetPolicy{Clients: map[string][]TargetPolicyRule{"c2": {{Protos: []string{FirewallProtoUDP}}}}}
+	assert.True(t, p.Allowed("c1", r))
+	assert.False(t, p.Allowed("c2", r))
+
+	// A rule with ports does not permit the protocols without ports
+	p = &TargetPolicy{Default: []TargetPolicyRule{{Ports: []TargetPolicyPortRange{{Start: 22}}}}}
+	assert.False(t, p.Allowed("c1", FirewallRule{Proto: FirewallProtoICMP, DstIP: net.IPv4(10, 0, 0, 5)}))
+}
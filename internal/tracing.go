@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/greenstatic/openspa/internal"
+	TracingServiceName = "openspa-server"
+)
+
+// Span attributes
+const (
+	traceAttributeClientUUID  = attribute.Key("openspa.client_uuid")
+	traceAttributeCipherSuite = attribute.Key("openspa.cipher_suite")
+	traceAttributeDecision    = attribute.Key("openspa.decision") // AuditEventGrant or AuditEventDeny
+	traceAttributeReason      = attribute.Key("openspa.reason")   // reason of a denied request
+	traceAttributeGrantID     = attribute.Key("openspa.grant_id")
+)
+
+type TracingSettings struct {
+	// Endpoint (host:port) of the OTLP/HTTP collector. If empty, the exporter's default (or the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable) is used.
+	Endpoint string
+	// Insecure disables TLS towards the collector
+	Insecure bool
+	// SampleRatio is the fraction of datagrams that are traced, all are traced if 1
+	SampleRatio float64
+}
+
+// NewTracerProvider returns a tracer provider that exports spans with OTLP over HTTP. Until it is installed with
+// otel.SetTracerProvider tracing is a no-op. It has to be shut down to flush the spans that are yet to be exported.
+func NewTracerProvider(s TracingSettings) (*sdktrace.TracerProvider, error) {
+	opts := make([]otlptracehttp.Option, 0)
+	if s.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(s.Endpoint))
+	}
+	if s.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "otlp exporter")
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String(TracingServiceName),
+		semconv.ServiceVersionKey.String(Version()),
+	))
+	if err != nil {
+		return nil, errors.Wrap(err, "resource")
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(s.SampleRatio))),
+	)
+
+	return tp, nil
+}
+
+// tracerFromProvider returns the tracer of tp, or of the global (otel) tracer provider if tp is nil.
+func tracerFromProvider(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// startSpan starts a child span of the span in ctx, with the same tracer provider. If ctx has no span, the span is a
+// no-op.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// spanError records the error on the span and marks the span as failed.
+func spanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/greenstatic/openspa/internal/observability"
+	"github.com/greenstatic/openspa/pkg/openspalib"
+	"github.com/greenstatic/openspa/pkg/openspalib/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestTracerProvider() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exp := tracetest.NewInMemoryExporter()
+	return sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)), exp
+}
+
+func spanStubByName(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, s := range spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func spanStubAttributes(s tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value)
+	for _, a := range s.Attributes {
+		m[a.Key] = a.Value
+	}
+	return m
+}
+
+func TestServerHandler_DatagramRequestHandler_Tracing(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	tp, exp := newTestTracerProvider()
+
+	fw := &FirewallMock{}
+	cs := crypto.NewCipherSuiteStub()
+	adkSecret := "7O4ZIRI"
+
+	authz := NewAuthorizationStrategyCommand("authorize")
+	exec := &CommandExecuteMock{}
+	exec.On("Execute", "authorize", mock.Anything, []string(nil)).Return([]byte(`{"duration": 60}`), nil).Once()
+	authz.exec = exec
+
+	sh := NewServerHandler(NewFirewallRuleManager(fw), cs, authz, ServerHandlerOpt{
+		ADKSecret:      adkSecret,
+		TracerProvider: tp,
+	})
+
+	clientUUID := "09896692-c299-4f90-9906-2e23cfcc417c"
+	req, err := openspalib.NewRequest(openspalib.RequestData{
+		TransactionID:   23,
+		ClientUUID:      clientUUID,
+		ClientIP:        net.IPv4(88, 200, 23, 23),
+		TargetProtocol:  openspalib.ProtocolTCP,
+		TargetIP:        net.IPv4(88, 200, 23, 19),
+		TargetPortStart: 80,
+		TargetPortEnd:   80,
+	}, cs, openspalib.RequestDataOpt{ADKSecret: adkSecret})
+	require.NoError(t, err)
+	reqB, err := req.Marshal()
+	require.NoError(t, err)
+
+	resp := &UDPResponseMock{}
+	resp.On("SendUDPResponse", mock.Anything, mock.Anything).Return(nil).Once()
+	fw.On("RuleAdd", mock.Anything, mock.Anything).Return(nil).Once()
+
+	sh.DatagramRequestHandler(context.Background(), resp, DatagramRequest{
+		data:  reqB,
+		rAddr: net.UDPAddr{IP: net.IPv4(88, 200, 23, 12), Port: 40975},
+	})
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 8)
+
+	root, ok := spanStubByName(spans, requestSpanName)
+	require.True(t, ok)
+	assert.False(t, root.Parent.IsValid())
+	assert.Equal(t, codes.Unset, root.Status.Code)
+
+	attr := spanStubAttributes(root)
+	assert.Equal(t, clientUUID, attr[traceAttributeClientUUID].AsString())
+	assert.Equal(t, string(AuditEventGrant), attr[traceAttributeDecision].AsString())
+	assert.Equal(t, "CipherSuite_NoSecurity", attr[traceAttributeCipherSuite].AsString())
+	assert.NotEmpty(t, attr[traceAttributeGrantID].AsString())
+	assert.Equal(t, "88.200.23.12", attr["net.peer.ip"].AsString())
+
+	for _, stage := range []string{requestStageADK, requestStageDecrypt, requestStageAuthorization, requestStageFirewall,
+		requestStageResponseMarshal, requestStageResponseSend} {
+		s, ok := spanStubByName(spans, "openspa."+stage)
+		require.True(t, ok, stage)
+		assert.Equal(t, root.SpanContext.SpanID(), s.Parent.SpanID(), stage)
+		assert.Equal(t, root.SpanContext.TraceID(), s.SpanContext.TraceID(), stage)
+	}
+
+	authzSpan, _ := spanStubByName(spans, "openspa."+requestStageAuthorization)
+	cmdSpan, ok := spanStubByName(spans, "authorization.command")
+	require.True(t, ok)
+	assert.Equal(t, authzSpan.SpanContext.SpanID(), cmdSpan.Parent.SpanID())
+
+	exec.AssertExpectations(t)
+	fw.AssertExpectations(t)
+	resp.AssertExpectations(t)
+}
+
+func TestServerHandler_DatagramRequestHandler_TracingDeny(t *testing.T) {
+	SetMetricsRepository(observability.MetricsRepositoryStub{})
+	tp, exp := newTestTracerProvider()
+
+	cs := crypto.NewCipherSuiteStub()
+	sh := NewServerHandler(NewFirewallRuleManager(&FirewallMock{}), cs, NewAuthorizationStrategyAllow(time.Hour),
+		ServerHandlerOpt{ADKSecret: "7O4ZIRI", TracerProvider: tp})
+
+	req, err := openspalib.NewRequest(openspalib.RequestData{
+		TransactionID:   23,
+		ClientUUID:      "09896692-c299-4f90-9906-2e23cfcc417c",
+		ClientIP:        net.IPv4(88, 200, 23, 23),
+		TargetProtocol:  openspalib.ProtocolTCP,
+		TargetIP:        net.IPv4(88, 200, 23, 19),
+		TargetPortStart: 80,
+		TargetPortEnd:   80,
+	}, cs, openspalib.RequestDataOpt{})
+	require.NoError(t, err)
+	reqB, err := req.Marshal()
+	require.NoError(t, err)
+
+	sh.DatagramRequestHandler(context.Background(), &UDPResponseMock{}, DatagramRequest{
+		data:  reqB,
+		rAddr: net.UDPAddr{IP: net.IPv4(88, 200, 23, 12), Port: 40975},
+	})
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 2)
+
+	root, ok := spanStubByName(spans, requestSpanName)
+	require.True(t, ok)
+	attr := spanStubAttributes(root)
+	assert.Equal(t, string(AuditEventDeny), attr[traceAttributeDecision].AsString())
+	assert.Equal(t, AuditReasonADKMissing, attr[traceAttributeReason].AsString())
+
+	_, ok = spanStubByName(spans, "openspa."+requestStageADK)
+	assert.True(t, ok)
+}
+
+func TestStartSpan_NoParent(t *testing.T) {
+	_, span := startSpan(context.Background(), "test")
+	defer span.End()
+
+	assert.False(t, span.SpanContext().IsValid())
+	assert.False(t, span.IsRecording())
+}
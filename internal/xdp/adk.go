@@ -3,6 +3,7 @@
 package xdp
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/cilium/ebpf"
@@ -27,6 +28,8 @@ type adk struct {
 	iface netlink.Link
 	flags int
 	objs  bpfObjects
+	// linked is 1 while the XDP program is linked, accessed atomically since Check is called by the health checks
+	linked int32
 }
 
 func NewADK(s ADKSettings, proof ADKProofGenerator) (ADK, error) {
@@ -117,6 +120,7 @@ func (a *adk) link() error {
 		return errors.Wrap(err, "link set xdp")
 	}
 
+	atomic.StoreInt32(&a.linked, 1)
 	return nil
 }
 
@@ -125,6 +129,24 @@ func (a *adk) unlink() error {
 		return errors.Wrap(err, "link uset xdp")
 	}
 
+	atomic.StoreInt32(&a.linked, 0)
+	return nil
+}
+
+func (a *adk) Check() error {
+	if atomic.LoadInt32(&a.linked) == 0 {
+		return ErrNotStarted
+	}
+
+	l, err := netlink.LinkByIndex(a.iface.Attrs().Index)
+	if err != nil {
+		return errors.Wrap(err, "interface lookup")
+	}
+
+	if xdp := l.Attrs().Xdp; xdp == nil || !xdp.Attached {
+		return errors.New("xdp program is not attached")
+	}
+
 	return nil
 }
 
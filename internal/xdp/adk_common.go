@@ -3,13 +3,18 @@ package xdp
 import (
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 )
 
+var ErrNotStarted = errors.New("XDP ADK is not started")
+
 type ADK interface {
 	StatsProvider
 	Start() error
 	Stop() error
+	// Check verifies that the XDP program is attached to the interface, returns ErrNotStarted before Start.
+	Check() error
 }
 
 type StatsProvider interface {
@@ -25,6 +25,10 @@ func (a adk) Stop() error {
 	return ErrNotSupported
 }
 
+func (a adk) Check() error {
+	return ErrNotSupported
+}
+
 func (a adk) Stats() (Stats, error) {
 	return Stats{}, ErrNotSupported
 }
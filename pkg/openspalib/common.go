@@ -14,6 +14,8 @@ var (
 	ErrViolationOfProtocolSpec = errors.New("violation of protocol spec")
 	ErrCipherSuiteRequired     = errors.New("cipher suite required")
 	ErrPDUTooLarge             = errors.New("pdu too large")
+	ErrInvalidHeader           = errors.New("invalid header")
+	ErrInvalidTLV              = errors.New("invalid tlv")
 )
 
 const (
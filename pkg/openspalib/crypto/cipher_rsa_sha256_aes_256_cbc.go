@@ -102,11 +102,11 @@ func (r *CipherSuite_RSA_SHA256_AES256CBC) Unlock(header []byte, ec tlv.Containe
 
 	sessionKey, err := r.dec.Decrypt(sessionKeyEnc)
 	if err != nil {
-		return nil, errors.Wrap(err, "decrypt session key")
+		return nil, errors.Wrapf(ErrDecryption, "decrypt session key: %v", err)
 	}
 
 	if len(sessionKey) != 32+16 {
-		return nil, errors.New("invalid session key length")
+		return nil, errors.Wrap(ErrDecryption, "invalid session key length")
 	}
 
 	iv := sessionKey[:16]
@@ -114,12 +114,13 @@ func (r *CipherSuite_RSA_SHA256_AES256CBC) Unlock(header []byte, ec tlv.Containe
 
 	payload, err := NewAES256CBCDecrypter(iv, key).Decrypt(encryptedPayload)
 	if err != nil {
-		return nil, errors.Wrap(err, "decrypt payload")
+		return nil, errors.Wrapf(ErrDecryption, "decrypt payload: %v", err)
 	}
 
+	// A payload decrypted with the wrong key is garbage, so it is classified as a decryption failure
 	payloadContainer, err := tlv.UnmarshalTLVContainer(payload)
 	if err != nil {
-		return nil, errors.Wrap(err, "unmarshal payload container")
+		return nil, errors.Wrapf(ErrDecryption, "unmarshal payload container: %v", err)
 	}
 
 	if err := r.encryptedPayloadContainerValid(payloadContainer); err != nil {
@@ -143,7 +144,7 @@ func (r *CipherSuite_RSA_SHA256_AES256CBC) Unlock(header []byte, ec tlv.Containe
 
 	sigPubKey, err := r.resolver.PublicKey(packetContainer, packetContainer)
 	if err != nil {
-		return nil, errors.Wrap(err, "resolve sender's public key")
+		return nil, errors.Wrapf(ErrPublicKeyResolve, "resolve sender's public key: %v", err)
 	}
 
 	sigRSAPubKey, ok := sigPubKey.(*rsa.PublicKey)
@@ -158,9 +159,9 @@ func (r *CipherSuite_RSA_SHA256_AES256CBC) Unlock(header []byte, ec tlv.Containe
 	sigValid, err := NewRSA_SHA256SignatureVerifier(sigRSAPubKey).Verify(signatureContent, signature)
 	if !sigValid || err != nil {
 		if err != nil {
-			return nil, errors.Wrap(err, "invalid signature")
+			return nil, errors.Wrapf(ErrInvalidSignature, "verify: %v", err)
 		}
-		return nil, errors.New("invalid signature")
+		return nil, ErrInvalidSignature
 	}
 
 	return packetContainer, nil
@@ -2,6 +2,7 @@ package crypto
 
 import (
 	"crypto/rsa"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -201,3 +202,45 @@ func TestCipherSuite_RSA_SHA256_AES256CBC_EncryptedPayloadContainerValid(t *test
 	c.SetBytes(NonceKey, []byte{32, 42, 00, 21, 99})
 	assert.NoError(t, r.encryptedPayloadContainerValid(c))
 }
+
+func TestCipherSuite_RSA_SHA256_AES256CBC_UnlockErrors(t *testing.T) {
+	clientPriv, clientPub, err := RSAKeypair(2048)
+	require.NoError(t, err)
+	serverPriv, serverPub, err := RSAKeypair(2048)
+	require.NoError(t, err)
+	otherPriv, otherPub, err := RSAKeypair(2048)
+	require.NoError(t, err)
+
+	header := []byte{4, 8, 15, 16, 23, 42}
+	pc := tlv.NewContainer()
+	pc.SetBytes(2, []byte{1, 2, 3, 4, 5})
+
+	resolverClient := NewPublicKeyResolverMock()
+	resolverClient.On("PublicKey", mock.Anything, mock.Anything).Return(serverPub, nil)
+	ec, err := NewCipherSuite_RSA_SHA256_AES256CBC(clientPriv, resolverClient).Secure(header, pc, nil)
+	require.NoError(t, err)
+
+	// Wrong server private key
+	resolverOther := NewPublicKeyResolverMock()
+	resolverOther.On("PublicKey", mock.Anything, mock.Anything).Return(clientPub, nil)
+	_, err = NewCipherSuite_RSA_SHA256_AES256CBC(otherPriv, resolverOther).Unlock(header, ec)
+	assert.ErrorIs(t, err, ErrDecryption)
+
+	// Unknown client
+	resolverUnknown := NewPublicKeyResolverMock()
+	resolverUnknown.On("PublicKey", mock.Anything, mock.Anything).Return((*rsa.PublicKey)(nil), errors.New("no key found"))
+	_, err = NewCipherSuite_RSA_SHA256_AES256CBC(serverPriv, resolverUnknown).Unlock(header, ec)
+	assert.ErrorIs(t, err, ErrPublicKeyResolve)
+
+	// Signed with a different key than the one the client is known by
+	resolverImpostor := NewPublicKeyResolverMock()
+	resolverImpostor.On("PublicKey", mock.Anything, mock.Anything).Return(otherPub, nil)
+	_, err = NewCipherSuite_RSA_SHA256_AES256CBC(serverPriv, resolverImpostor).Unlock(header, ec)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	// Tampered header
+	resolverServer := NewPublicKeyResolverMock()
+	resolverServer.On("PublicKey", mock.Anything, mock.Anything).Return(clientPub, nil)
+	_, err = NewCipherSuite_RSA_SHA256_AES256CBC(serverPriv, resolverServer).Unlock([]byte{4, 8, 15, 16, 23, 43}, ec)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
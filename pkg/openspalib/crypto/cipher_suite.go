@@ -2,10 +2,20 @@ package crypto
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/greenstatic/openspa/pkg/openspalib/tlv"
 )
 
+// Errors returned (wrapped) by the cipher suites, so that failures can be classified with errors.Is
+var (
+	ErrUnsupportedCipherSuite = errors.New("unsupported cipher suite")
+	// ErrPublicKeyResolve is returned when the public key of the other party cannot be resolved (e.g. unknown client)
+	ErrPublicKeyResolve = errors.New("public key resolve failure")
+	ErrDecryption       = errors.New("decryption failure")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
 type CipherSuiteID uint8
 
 //nolint:revive,stylecheck
@@ -71,9 +81,9 @@ func CipherSuiteIDToString(c CipherSuiteID) (string, error) {
 	case CipherRSA_SHA256_AES256CBC_ID:
 		return "CipherSuite_RSA_SHA256_AES256CBC", nil
 	case CipherUnknown:
-		return "", errors.New("unknown cipher suite id")
+		return "", fmt.Errorf("unknown cipher suite id: %w", ErrUnsupportedCipherSuite)
 	default:
-		return "", errors.New("unsupported cipher suite id")
+		return "", fmt.Errorf("cipher suite id %d: %w", c, ErrUnsupportedCipherSuite)
 	}
 }
 
@@ -109,12 +109,16 @@ func RequestUnmarshal(b []byte, cs crypto.CipherSuite) (*Request, error) {
 		return nil, errors.Wrap(err, "unmarshal header")
 	}
 
+	if header.CipherSuiteID != cs.CipherSuiteID() {
+		return nil, errors.Wrapf(crypto.ErrUnsupportedCipherSuite, "request cipher suite id %d", header.CipherSuiteID)
+	}
+
 	headerBytes := b[:HeaderLength]
 	bodyBytes := b[HeaderLength:]
 
 	c, err := tlv.UnmarshalTLVContainer(bodyBytes)
 	if err != nil {
-		return nil, errors.Wrap(err, "unmarshal tlv container")
+		return nil, errors.Wrapf(ErrInvalidTLV, "unmarshal tlv container: %v", err)
 	}
 
 	body, err := cs.Unlock(headerBytes, c)
@@ -133,18 +137,18 @@ func RequestUnmarshal(b []byte, cs crypto.CipherSuite) (*Request, error) {
 
 func RequestUnmarshalHeader(b []byte) (Header, error) {
 	if len(b) < HeaderLength {
-		return Header{}, errors.New("too short to be request")
+		return Header{}, errors.Wrap(ErrInvalidHeader, "too short to be request")
 	}
 
 	if len(b) == HeaderLength {
-		return Header{}, errors.New("body is empty")
+		return Header{}, errors.Wrap(ErrInvalidHeader, "body is empty")
 	}
 
 	headerBytes := b[:HeaderLength]
 
 	h, err := UnmarshalHeader(headerBytes)
 	if err != nil {
-		return Header{}, errors.Wrap(err, "unmarshal header")
+		return Header{}, errors.Wrapf(ErrInvalidHeader, "unmarshal header: %v", err)
 	}
 
 	return h, nil
@@ -9,6 +9,7 @@ import (
 	"github.com/greenstatic/openspa/pkg/openspalib/crypto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewRequest(t *testing.T) {
@@ -337,3 +338,22 @@ func BenchmarkRequestUnmarshal_RSA_SHA256_AES_256_CBC_with2048Keypair_withFakeDa
 		assert.Error(b, err)
 	}
 }
+
+func TestRequestUnmarshal_Errors(t *testing.T) {
+	_, err := RequestUnmarshal([]byte{1, 2, 3}, crypto.NewCipherSuiteStub())
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+
+	r, err := NewRequest(testRequestData(), crypto.NewCipherSuiteStub(), RequestDataOpt{})
+	require.NoError(t, err)
+	b, err := r.Marshal()
+	require.NoError(t, err)
+
+	cs := crypto.NewCipherSuiteMock()
+	cs.On("CipherSuiteID").Return(int(crypto.CipherRSA_SHA256_AES256CBC_ID))
+	_, err = RequestUnmarshal(b, cs)
+	assert.ErrorIs(t, err, crypto.ErrUnsupportedCipherSuite)
+
+	bad := append(append([]byte{}, b[:HeaderLength]...), 1, 200, 3)
+	_, err = RequestUnmarshal(bad, crypto.NewCipherSuiteStub())
+	assert.ErrorIs(t, err, ErrInvalidTLV)
+}
@@ -144,19 +144,23 @@ func (r *Response) metadataCreate(c tlv.Container, d ResponseData) error {
 
 func ResponseUnmarshal(b []byte, cs crypto.CipherSuite) (*Response, error) {
 	if len(b) < HeaderLength {
-		return nil, errors.New("too short to be response")
+		return nil, errors.Wrap(ErrInvalidHeader, "too short to be response")
 	}
 
 	headerB := b[:HeaderLength]
 
 	header, err := UnmarshalHeader(headerB)
 	if err != nil {
-		return nil, errors.Wrap(err, "unmarshal header")
+		return nil, errors.Wrapf(ErrInvalidHeader, "unmarshal header: %v", err)
+	}
+
+	if header.CipherSuiteID != cs.CipherSuiteID() {
+		return nil, errors.Wrapf(crypto.ErrUnsupportedCipherSuite, "response cipher suite id %d", header.CipherSuiteID)
 	}
 
 	c, err := tlv.UnmarshalTLVContainer(b[HeaderLength:])
 	if err != nil {
-		return nil, errors.Wrap(err, "unmarshal tlv container")
+		return nil, errors.Wrapf(ErrInvalidTLV, "unmarshal tlv container: %v", err)
 	}
 
 	body, err := cs.Unlock(headerB, c)